@@ -1,23 +1,71 @@
 package crypt
 
 import (
+	"crypto/rand"
+	"errors"
 	"math/big"
-	"math/rand"
 )
 
+// P, G 默认使用RFC 2409 1024位MODP组，兼容旧的DHExchange和DHSecret
 var P, G *big.Int
 
-// a
+var (
+	one = big.NewInt(1)
+
+	InvalidExchangeErr = errors.New("invalid dh exchange value")
+)
+
+// Group DH参数组，KeyBits为私钥位数
+type Group struct {
+	P       *big.Int
+	G       *big.Int
+	KeyBits int
+}
+
+// RFC 3526 MODP组，MODP1024为RFC 2409 Group 2
+var (
+	MODP1024 *Group
+	MODP2048 *Group
+	MODP3072 *Group
+	MODP4096 *Group
+)
+
+// Randomkey 生成默认组的私钥a
+// 使用crypto/rand生成，长度为MODP1024.KeyBits
 func Randomkey() *big.Int {
 
-	n := new(big.Int)
-	tmp := make([]byte, 8)
-	for i := 0; i < 8; i++ {
+	key, err := MODP1024.RandomKey()
+	if err != nil {
 
-		tmp[i] = byte(rand.Intn(256))
+		panic("crypt: " + err.Error())
 	}
 
-	return n.SetBytes(tmp)
+	return key
+}
+
+// RandomKey 使用crypto/rand生成bits位的随机数，最高位为1
+func RandomKey(bits int) (*big.Int, error) {
+
+	if bits < 2 {
+
+		return nil, errors.New("crypt: key bits too small")
+	}
+
+	b := make([]byte, (bits+7)/8)
+	if _, err := rand.Read(b); err != nil {
+
+		return nil, err
+	}
+
+	// 去掉多余的位并设置最高位，保证私钥长度
+	if extra := len(b)*8 - bits; extra > 0 {
+
+		b[0] &= byte(0xff) >> uint(extra)
+	}
+
+	b[0] |= byte(0x80) >> uint((len(b)*8-bits)%8)
+
+	return new(big.Int).SetBytes(b), nil
 }
 
 // G**a mod p
@@ -36,10 +84,82 @@ func DHSecret(key, exchange *big.Int) *big.Int {
 	return n.Exp(exchange, key, P)
 }
 
+// RandomKey 生成该组的私钥
+func (g *Group) RandomKey() (*big.Int, error) {
+
+	return RandomKey(g.KeyBits)
+}
+
+// Exchange G**a mod p
+func (g *Group) Exchange(key *big.Int) *big.Int {
+
+	return new(big.Int).Exp(g.G, key, g.P)
+}
+
+// Secret exchange**a mod p，拒绝1、p-1等弱公钥
+func (g *Group) Secret(key, exchange *big.Int) (*big.Int, error) {
+
+	if err := g.Check(exchange); err != nil {
+
+		return nil, err
+	}
+
+	return new(big.Int).Exp(exchange, key, g.P), nil
+}
+
+// Check 检查对方公钥在(1, p-1)范围内
+func (g *Group) Check(exchange *big.Int) error {
+
+	pm1 := new(big.Int).Sub(g.P, one)
+	if exchange.Cmp(one) <= 0 || exchange.Cmp(pm1) >= 0 {
+
+		return InvalidExchangeErr
+	}
+
+	return nil
+}
+
+// Bytes 按P的长度补齐的大端字节，用于派生密钥
+func (g *Group) Bytes(n *big.Int) []byte {
+
+	b := make([]byte, (g.P.BitLen()+7)/8)
+
+	return n.FillBytes(b)
+}
+
+func newGroup(p string, keyBits int) *Group {
+
+	n, ok := new(big.Int).SetString(p, 16)
+	if !ok {
+
+		panic("crypt: bad group prime")
+	}
+
+	return &Group{P: n, G: big.NewInt(2), KeyBits: keyBits}
+}
+
 func init() {
 
-	P = new(big.Int)
-	P.SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF", 16)
-	G = new(big.Int)
-	G.SetInt64(2)
+	MODP1024 = newGroup("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF", 256)
+	MODP2048 = newGroup("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05"+
+		"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF", 256)
+	MODP3072 = newGroup("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05"+
+		"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33"+
+		"A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864"+
+		"D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E208E24FA074E5AB3143DB5BFCE0FD108E4B82D120A93AD2CAFFFFFFFFFFFFFFFF", 320)
+	MODP4096 = newGroup("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05"+
+		"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33"+
+		"A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864"+
+		"D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E208E24FA074E5AB3143DB5BFCE0FD108E4B82D120A92108011A723C12A787E6D7"+
+		"88719A10BDBA5B2699C327186AF4E23C1A946834B6150BDA2583E9CA2AD44CE8DBBBC2DB04DE8EF92E8EFC141FBECAA6287C59474E6BC05D99B2964FA090C3A2"+
+		"233BA186515BE7ED1F612970CEE2D7AFB81BDD762170481CD0069127D5B05AA993B4EA988D8FDDC186FFB7DC90A6C08F4DF435C934063199FFFFFFFFFFFFFFFF", 384)
+
+	P = MODP1024.P
+	G = MODP1024.G
 }
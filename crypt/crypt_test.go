@@ -0,0 +1,259 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func unhex(t *testing.T, s string) []byte {
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestGroupPrimes(t *testing.T) {
+
+	for _, g := range []*Group{MODP1024, MODP2048, MODP3072, MODP4096} {
+
+		if !g.P.ProbablyPrime(8) {
+
+			t.Errorf("P(%d) not prime", g.P.BitLen())
+		}
+	}
+
+	if MODP2048.P.BitLen() != 2048 || MODP3072.P.BitLen() != 3072 || MODP4096.P.BitLen() != 4096 {
+
+		t.Error("group bit length error")
+	}
+}
+
+func TestRandomKey(t *testing.T) {
+
+	for _, bits := range []int{64, 255, 256, 320} {
+
+		key, err := RandomKey(bits)
+		if err != nil {
+
+			t.Fatal(err)
+		}
+
+		if key.BitLen() != bits {
+
+			t.Errorf("RandomKey(%d) bitlen = %d", bits, key.BitLen())
+		}
+	}
+
+	if Randomkey().Cmp(Randomkey()) == 0 {
+
+		t.Error("Randomkey repeated")
+	}
+}
+
+func TestDH(t *testing.T) {
+
+	a, b := Randomkey(), Randomkey()
+	if DHSecret(a, DHExchange(b)).Cmp(DHSecret(b, DHExchange(a))) != 0 {
+
+		t.Error("DHSecret mismatch")
+	}
+
+	g := MODP2048
+	ka, _ := g.RandomKey()
+	kb, _ := g.RandomKey()
+
+	sa, err := g.Secret(ka, g.Exchange(kb))
+	if err != nil {
+
+		t.Fatal(err)
+	}
+
+	sb, err := g.Secret(kb, g.Exchange(ka))
+	if err != nil {
+
+		t.Fatal(err)
+	}
+
+	if sa.Cmp(sb) != 0 {
+
+		t.Error("Group.Secret mismatch")
+	}
+
+	if _, err = g.Secret(ka, one); err != InvalidExchangeErr {
+
+		t.Error("Group.Secret accepted weak exchange")
+	}
+}
+
+// RFC 5869 A.1
+func TestHKDF(t *testing.T) {
+
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt := unhex(t, "000102030405060708090a0b0c")
+	info := unhex(t, "f0f1f2f3f4f5f6f7f8f9")
+
+	prk := HKDFExtract(salt, ikm)
+	if hex.EncodeToString(prk) != "077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5" {
+
+		t.Errorf("HKDFExtract = %x", prk)
+	}
+
+	okm, err := HKDF(ikm, salt, info, 42)
+	if err != nil {
+
+		t.Fatal(err)
+	}
+
+	if hex.EncodeToString(okm) != "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865" {
+
+		t.Errorf("HKDF = %x", okm)
+	}
+}
+
+// RFC 7748 6.1
+func TestX25519(t *testing.T) {
+
+	alice := unhex(t, "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	bobPub := unhex(t, "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f")
+
+	secret, err := X25519Secret(alice, bobPub)
+	if err != nil {
+
+		t.Fatal(err)
+	}
+
+	if hex.EncodeToString(secret) != "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742" {
+
+		t.Errorf("X25519Secret = %x", secret)
+	}
+
+	priv1, pub1, _ := X25519GenerateKey()
+	priv2, pub2, _ := X25519GenerateKey()
+	s1, _ := X25519Secret(priv1, pub2)
+	s2, _ := X25519Secret(priv2, pub1)
+	if !bytes.Equal(s1, s2) {
+
+		t.Error("X25519Secret mismatch")
+	}
+}
+
+// RFC 8032 7.1 TEST 1 私钥种子，签名覆盖握手双方公钥
+func TestSignExchange(t *testing.T) {
+
+	priv := ed25519.NewKeyFromSeed(unhex(t, "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60"))
+	pub := priv.Public().(ed25519.PublicKey)
+	if hex.EncodeToString(pub) != "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a" {
+
+		t.Errorf("public key = %x", pub)
+	}
+
+	serverPub, clientPub := []byte("server"), []byte("client")
+	sig := SignExchange(priv, serverPub, clientPub)
+
+	if !VerifyExchange(pub, serverPub, clientPub, sig) {
+
+		t.Error("VerifyExchange failed")
+	}
+
+	if VerifyExchange(pub, clientPub, serverPub, sig) {
+
+		t.Error("VerifyExchange accepted swapped values")
+	}
+}
+
+func TestSession(t *testing.T) {
+
+	secret := []byte("shared secret")
+	salt := []byte("client pub server pub")
+
+	server, err := NewSession(secret, salt, true)
+	if err != nil {
+
+		t.Fatal(err)
+	}
+
+	client, _ := NewSession(secret, salt, false)
+
+	p1 := client.Seal([]byte("first"))
+	p2 := client.Seal([]byte("second"))
+
+	// 乱序到达
+	if b, err := server.Open(p2); err != nil || string(b) != "second" {
+
+		t.Fatal("Open p2", err)
+	}
+
+	if b, err := server.Open(p1); err != nil || string(b) != "first" {
+
+		t.Fatal("Open p1", err)
+	}
+
+	if _, err = server.Open(p1); err != ReplayErr {
+
+		t.Error("replay accepted", err)
+	}
+
+	p3 := server.Seal([]byte("reply"))
+	if _, err = server.Open(p3); err == nil {
+
+		t.Error("own packet accepted")
+	}
+
+	p3[len(p3)-1] ^= 1
+	if _, err = client.Open(p3); err != PacketErr {
+
+		t.Error("tampered packet accepted", err)
+	}
+}
+
+// RFC 4231 Test Case 2
+func TestSign(t *testing.T) {
+
+	sig := Sign([]byte("Jefe"), []byte("what do ya want for nothing?"))
+	if sig != "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+
+		t.Errorf("Sign = %s", sig)
+	}
+
+	params := map[string]string{"order": "1001", "amount": "600", "empty": "", "sign": "x"}
+	psig := SignParams([]byte("key"), params, "sign")
+	if psig != Sign([]byte("key"), []byte("amount=600&order=1001")) {
+
+		t.Error("SignParams order error")
+	}
+
+	if !VerifyParams([]byte("key"), params, psig, "sign") {
+
+		t.Error("VerifyParams failed")
+	}
+}
+
+func TestToken(t *testing.T) {
+
+	key := []byte("gateway key")
+
+	token := MakeToken(key, 10086, time.Now().Add(time.Minute))
+	uid, err := ParseToken(key, token)
+	if err != nil || uid != 10086 {
+
+		t.Fatal("ParseToken", uid, err)
+	}
+
+	if _, err = ParseToken([]byte("other"), token); err != TokenInvalidErr {
+
+		t.Error("token with wrong key", err)
+	}
+
+	expired := MakeToken(key, 10086, time.Now().Add(-time.Minute))
+	if _, err = ParseToken(key, expired); err != TokenExpiredErr {
+
+		t.Error("expired token", err)
+	}
+}
@@ -0,0 +1,53 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// HKDFExtract RFC 5869 extract，使用SHA-256
+func HKDFExtract(salt, secret []byte) []byte {
+
+	if len(salt) == 0 {
+
+		salt = make([]byte, sha256.Size)
+	}
+
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+
+	return mac.Sum(nil)
+}
+
+// HKDFExpand RFC 5869 expand，length最大为255*32
+func HKDFExpand(prk, info []byte, length int) ([]byte, error) {
+
+	if length > 255*sha256.Size {
+
+		return nil, errors.New("crypt: hkdf length too large")
+	}
+
+	mac := hmac.New(sha256.New, prk)
+	okm := make([]byte, 0, length+sha256.Size)
+
+	var t []byte
+	for i := byte(1); len(okm) < length; i++ {
+
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(t[:0])
+
+		okm = append(okm, t...)
+	}
+
+	return okm[:length], nil
+}
+
+// HKDF 由共享密钥派生length字节的密钥，info区分不同用途
+func HKDF(secret, salt, info []byte, length int) ([]byte, error) {
+
+	return HKDFExpand(HKDFExtract(salt, secret), info, length)
+}
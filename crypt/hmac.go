@@ -0,0 +1,141 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	TokenInvalidErr = errors.New("crypt: token invalid")
+	TokenExpiredErr = errors.New("crypt: token expired")
+)
+
+// Sign HMAC-SHA256签名，返回16进制字符串
+func Sign(key, data []byte) string {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify 常量时间比较签名
+func Verify(key, data []byte, sig string) bool {
+
+	return hmac.Equal([]byte(Sign(key, data)), []byte(strings.ToLower(sig)))
+}
+
+// SignParams 支付回调签名，参数按key排序拼接为k1=v1&k2=v2后签名
+// 空值和skip中的key(通常是sign字段)不参与签名
+func SignParams(key []byte, params map[string]string, skip ...string) string {
+
+	return Sign(key, []byte(joinParams(params, skip)))
+}
+
+// VerifyParams 校验支付回调签名
+func VerifyParams(key []byte, params map[string]string, sig string, skip ...string) bool {
+
+	return Verify(key, []byte(joinParams(params, skip)), sig)
+}
+
+func joinParams(params map[string]string, skip []string) string {
+
+	keys := make([]string, 0, len(params))
+	for k, v := range params {
+
+		if len(v) == 0 {
+
+			continue
+		}
+
+		skipped := false
+		for _, s := range skip {
+
+			if k == s {
+
+				skipped = true
+
+				break
+			}
+		}
+
+		if !skipped {
+
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for i, k := range keys {
+
+		if i > 0 {
+
+			sb.WriteByte('&')
+		}
+
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(params[k])
+	}
+
+	return sb.String()
+}
+
+// MakeToken 网关登录token，包含uid和过期时间
+// 格式 base64url(uid(8) expire(8)).base64url(hmac)
+func MakeToken(key []byte, uid uint64, expire time.Time) string {
+
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint64(payload[:8], uid)
+	binary.BigEndian.PutUint64(payload[8:], uint64(expire.Unix()))
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ParseToken 校验token并返回uid
+func ParseToken(key []byte, token string) (uint64, error) {
+
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+
+		return 0, TokenInvalidErr
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil || len(payload) != 16 {
+
+		return 0, TokenInvalidErr
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+
+		return 0, TokenInvalidErr
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+
+		return 0, TokenInvalidErr
+	}
+
+	if time.Now().Unix() > int64(binary.BigEndian.Uint64(payload[8:])) {
+
+		return 0, TokenExpiredErr
+	}
+
+	return binary.BigEndian.Uint64(payload[:8]), nil
+}
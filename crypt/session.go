@@ -0,0 +1,168 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+var (
+	sessionInfo  = []byte("gamelib session keys")
+	replayWindow = uint64(64)
+
+	PacketErr = errors.New("crypt: invalid packet")
+	ReplayErr = errors.New("crypt: packet replayed")
+)
+
+// Session 由共享密钥创建的包加密会话，使用AES-256-GCM
+// 两个方向使用HKDF派生的不同密钥，包格式 seq(8) + 密文，seq作为nonce并参与认证
+// 接收方允许最近64个seq内乱序，拒绝重放
+type Session struct {
+	wmux    sync.Mutex
+	sendSeq uint64
+	send    cipher.AEAD
+
+	rmux    sync.Mutex
+	recvSeq uint64
+	recvWin uint64
+	recv    cipher.AEAD
+}
+
+// NewSession 创建会话，secret为DH或X25519的共享密钥，
+// salt建议使用双方握手公钥，两端isServer相反
+func NewSession(secret, salt []byte, isServer bool) (*Session, error) {
+
+	keys, err := HKDF(secret, salt, sessionInfo, 64)
+	if err != nil {
+
+		return nil, err
+	}
+
+	c2s, err := newGCM(keys[:32])
+	if err != nil {
+
+		return nil, err
+	}
+
+	s2c, err := newGCM(keys[32:])
+	if err != nil {
+
+		return nil, err
+	}
+
+	if isServer {
+
+		return &Session{send: s2c, recv: c2s}, nil
+	}
+
+	return &Session{send: c2s, recv: s2c}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Seal 加密一个包，并发安全
+func (s *Session) Seal(plain []byte) []byte {
+
+	s.wmux.Lock()
+	defer s.wmux.Unlock()
+
+	s.sendSeq++
+
+	packet := make([]byte, 8, 8+len(plain)+s.send.Overhead())
+	binary.BigEndian.PutUint64(packet, s.sendSeq)
+
+	return s.send.Seal(packet, s.nonce(packet[:8]), plain, packet[:8])
+}
+
+// Open 解密并校验一个包
+func (s *Session) Open(packet []byte) ([]byte, error) {
+
+	if len(packet) < 8+s.recv.Overhead() {
+
+		return nil, PacketErr
+	}
+
+	seq := binary.BigEndian.Uint64(packet[:8])
+
+	s.rmux.Lock()
+	defer s.rmux.Unlock()
+
+	if !s.checkSeq(seq) {
+
+		return nil, ReplayErr
+	}
+
+	plain, err := s.recv.Open(nil, s.nonce(packet[:8]), packet[8:], packet[:8])
+	if err != nil {
+
+		return nil, PacketErr
+	}
+
+	s.markSeq(seq)
+
+	return plain, nil
+}
+
+func (s *Session) nonce(seq []byte) []byte {
+
+	nonce := make([]byte, 12)
+	copy(nonce[4:], seq)
+
+	return nonce
+}
+
+// checkSeq 调用者需持有rmux，recvWin第i位表示recvSeq-i已收到
+func (s *Session) checkSeq(seq uint64) bool {
+
+	if seq == 0 {
+
+		return false
+	}
+
+	if seq > s.recvSeq {
+
+		return true
+	}
+
+	diff := s.recvSeq - seq
+	if diff >= replayWindow {
+
+		return false
+	}
+
+	return s.recvWin&(1<<diff) == 0
+}
+
+// markSeq 调用者需持有rmux
+func (s *Session) markSeq(seq uint64) {
+
+	if seq > s.recvSeq {
+
+		shift := seq - s.recvSeq
+		if shift >= replayWindow {
+
+			s.recvWin = 0
+		} else {
+
+			s.recvWin <<= shift
+		}
+
+		s.recvWin |= 1
+		s.recvSeq = seq
+
+		return
+	}
+
+	s.recvWin |= 1 << (s.recvSeq - seq)
+}
@@ -0,0 +1,43 @@
+package crypt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+)
+
+var handshakeContext = []byte("gamelib handshake v1")
+
+// GenerateSignKey 生成服务端签名密钥，公钥内置在客户端中
+func GenerateSignKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+
+	return ed25519.GenerateKey(rand.Reader)
+}
+
+// SignExchange 服务端对双方的握手公钥签名，客户端据此验证服务端身份
+func SignExchange(priv ed25519.PrivateKey, serverPub, clientPub []byte) []byte {
+
+	return ed25519.Sign(priv, exchangeMessage(serverPub, clientPub))
+}
+
+// VerifyExchange 客户端验证服务端握手签名
+func VerifyExchange(pub ed25519.PublicKey, serverPub, clientPub, sig []byte) bool {
+
+	if len(pub) != ed25519.PublicKeySize {
+
+		return false
+	}
+
+	return ed25519.Verify(pub, exchangeMessage(serverPub, clientPub), sig)
+}
+
+func exchangeMessage(serverPub, clientPub []byte) []byte {
+
+	msg := make([]byte, 0, len(handshakeContext)+8+len(serverPub)+len(clientPub))
+	msg = append(msg, handshakeContext...)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(clientPub)))
+	msg = append(msg, clientPub...)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(serverPub)))
+
+	return append(msg, serverPub...)
+}
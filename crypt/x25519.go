@@ -0,0 +1,36 @@
+package crypt
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+)
+
+// X25519GenerateKey 生成X25519密钥对，公钥发送给对方
+func X25519GenerateKey() (priv []byte, pub []byte, err error) {
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+
+		return nil, nil, err
+	}
+
+	return key.Bytes(), key.PublicKey().Bytes(), nil
+}
+
+// X25519Secret 由自己的私钥和对方公钥计算共享密钥，需经过HKDF后再使用
+func X25519Secret(priv []byte, peerPub []byte) ([]byte, error) {
+
+	key, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+
+		return nil, err
+	}
+
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+
+		return nil, err
+	}
+
+	return key.ECDH(pub)
+}
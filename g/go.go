@@ -18,6 +18,7 @@ func init() {
 
 func Go(f func()) {
 
+	waitGroup.Add(1)
 	go run(f)
 }
 
@@ -34,8 +35,6 @@ func Close() {
 
 func run(f func()) {
 
-	waitGroup.Add(1)
-
 	defer func() {
 
 		waitGroup.Done()
@@ -0,0 +1,152 @@
+package multicast
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strings"
+
+	"github.com/laonsx/gamelib/redis"
+)
+
+//BridgeOptions 跨节点组播配置
+type BridgeOptions struct {
+	//Redis 使用的redis配置名，默认multicast，分片时使用第一个分片
+	Redis string
+	//Prefix redis频道名前缀，默认multicast:
+	Prefix string
+	//Decode 其它节点发布的消息解码后再分发，默认直接分发[]byte
+	Decode func(data []byte) (interface{}, error)
+}
+
+//envelope 节点间传递的消息，使用redis配置的编码
+type envelope struct {
+	Node    string
+	Channel string
+	Data    []byte
+}
+
+//bridge 通过redis发布订阅转发组播消息，本节点发布的消息直接分发，不经过redis
+type bridge struct {
+	mc      *MulticastService
+	r       *redis.Redis
+	ps      *redis.PubSub
+	node    string
+	options BridgeOptions
+}
+
+//NewRedisMulticastService 创建跨节点组播，任意节点Publish的消息会分发到所有节点上该频道的订阅者
+//消息使用redis.Encode编码，不是[]byte时需要设置Decode还原
+func NewRedisMulticastService(handle MulticastHandle, options *BridgeOptions) (*MulticastService, error) {
+
+	b := &bridge{}
+	if options != nil {
+
+		b.options = *options
+	}
+
+	if len(b.options.Redis) == 0 {
+
+		b.options.Redis = "multicast"
+	}
+
+	if len(b.options.Prefix) == 0 {
+
+		b.options.Prefix = "multicast:"
+	}
+
+	r, err := redis.UseRedisByName(b.options.Redis)
+	if err != nil {
+
+		return nil, err
+	}
+
+	node := make([]byte, 8)
+	if _, err = rand.Read(node); err != nil {
+
+		return nil, err
+	}
+
+	mc := NewMulticastService(handle)
+	mc.bridge = b
+
+	b.mc = mc
+	b.r = r
+	b.node = hex.EncodeToString(node)
+	b.ps = r.NewPubSub(b.receive)
+
+	return mc, nil
+}
+
+func (b *bridge) subscribe(id string) {
+
+	if err := b.ps.Subscribe(b.options.Prefix + id); err != nil {
+
+		log.Printf("multicast subscribe %s err=%s", id, err.Error())
+	}
+}
+
+func (b *bridge) unSubscribe(id string) {
+
+	if err := b.ps.Unsubscribe(b.options.Prefix + id); err != nil {
+
+		log.Printf("multicast unsubscribe %s err=%s", id, err.Error())
+	}
+}
+
+func (b *bridge) publish(id string, msg interface{}) error {
+
+	data, err := redis.Encode(msg)
+	if err != nil {
+
+		return err
+	}
+
+	v, err := redis.Encode(&envelope{Node: b.node, Channel: id, Data: data})
+	if err != nil {
+
+		return err
+	}
+
+	return b.r.Publish(b.options.Prefix+id, v)
+}
+
+func (b *bridge) receive(channel string, data []byte) {
+
+	var env envelope
+	if err := redis.Decode(data, &env); err != nil {
+
+		log.Printf("multicast decode %s err=%s", channel, err.Error())
+
+		return
+	}
+
+	if env.Node == b.node || strings.TrimPrefix(channel, b.options.Prefix) != env.Channel {
+
+		return
+	}
+
+	sc, err := b.mc.getSuperChannel(env.Channel)
+	if err != nil {
+
+		return
+	}
+
+	var msg interface{} = env.Data
+	if b.options.Decode != nil {
+
+		if msg, err = b.options.Decode(env.Data); err != nil {
+
+			log.Printf("multicast decode %s err=%s", channel, err.Error())
+
+			return
+		}
+	}
+
+	sc.publish(msg)
+}
+
+func (b *bridge) close() error {
+
+	return b.ps.Close()
+}
@@ -19,6 +19,7 @@ type MulticastService struct {
 	id       int
 	handle   MulticastHandle
 	channels map[string]*superChannel
+	bridge   *bridge
 }
 
 //NewChannel 创建一个频道
@@ -49,6 +50,11 @@ func (mc *MulticastService) NewChannel(id string, size int) {
 	mc.Lock()
 	mc.channels[id] = suChan
 	mc.Unlock()
+
+	if mc.bridge != nil {
+
+		mc.bridge.subscribe(id)
+	}
 }
 
 //DelChannel 删除频道
@@ -65,6 +71,11 @@ func (mc *MulticastService) DelChannel(id string) {
 	mc.Lock()
 	delete(mc.channels, id)
 	mc.Unlock()
+
+	if mc.bridge != nil {
+
+		mc.bridge.unSubscribe(id)
+	}
 }
 
 // Subscribe 订阅
@@ -114,16 +125,35 @@ func (mc *MulticastService) UnSubscribeAll(uid uint64, subs map[string]bool) err
 	return nil
 }
 
-// Publish 发布消息
+// Publish 发布消息，跨节点组播时本节点没有该频道也会转发到其它节点
 func (mc *MulticastService) Publish(chanId string, msg interface{}) error {
 
 	sc, err := mc.getSuperChannel(chanId)
-	if err != nil {
+	if err != nil && mc.bridge == nil {
 
 		return err
 	}
 
-	sc.publish(msg)
+	if sc != nil {
+
+		sc.publish(msg)
+	}
+
+	if mc.bridge != nil {
+
+		return mc.bridge.publish(chanId, msg)
+	}
+
+	return nil
+}
+
+//Close 停止跨节点组播的订阅
+func (mc *MulticastService) Close() error {
+
+	if mc.bridge != nil {
+
+		return mc.bridge.close()
+	}
 
 	return nil
 }
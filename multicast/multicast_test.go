@@ -6,6 +6,9 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/laonsx/gamelib/codec"
+	"github.com/laonsx/gamelib/redis"
 )
 
 func TestMulticast(t *testing.T) {
@@ -146,3 +149,69 @@ type UserInfo struct {
 	sync.RWMutex
 	Data map[string]bool
 }
+
+func TestRedisMulticast(t *testing.T) {
+
+	redis.InitRedis(codec.MsgPack, codec.UnMsgPack, redis.NewRedisConf("multicast", "127.0.0.1", "6379", 0))
+
+	r, _ := redis.UseRedisByName("multicast")
+	if err := r.Publish("multicast:ping", []byte("ping")); err != nil {
+
+		t.Skip("redis unavailable:", err)
+	}
+
+	received := make(chan interface{}, 1)
+	node1, err := NewRedisMulticastService(&Handle{}, nil)
+	if err != nil {
+
+		t.Fatal(err)
+	}
+	defer node1.Close()
+
+	node2, err := NewRedisMulticastService(recvHandle(received), nil)
+	if err != nil {
+
+		t.Fatal(err)
+	}
+	defer node2.Close()
+
+	node2.NewChannel("world", 1)
+	node2.Subscribe("world", 1)
+
+	// 等待订阅生效
+	time.Sleep(100 * time.Millisecond)
+
+	if err = node1.Publish("world", []byte("hello")); err != nil {
+
+		t.Fatal("Publish:", err)
+	}
+
+	select {
+
+	case msg := <-received:
+
+		if string(msg.([]byte)) != "hello" {
+
+			t.Error("received:", msg)
+		}
+
+	case <-time.After(time.Second):
+
+		t.Fatal("timeout")
+	}
+}
+
+type recvHandle chan interface{}
+
+func (h recvHandle) Subscribe(chanId string, uid uint64) func(interface{}) {
+
+	return func(i interface{}) {
+
+		h <- i
+	}
+}
+
+func (h recvHandle) UnSubscribe(chanId string, uid uint64) error {
+
+	return nil
+}
@@ -0,0 +1,639 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/laonsx/gamelib/g"
+	"github.com/laonsx/gamelib/redis"
+)
+
+var NotFoundErr = errors.New("cache not found")
+
+//Loader 本地和redis都没有数据时加载，比如从数据库读取，返回nil表示不存在
+type Loader func(ctx context.Context, id string) (interface{}, error)
+
+//Options 缓存配置
+type Options struct {
+	//Redis 使用的redis配置名，默认cache
+	Redis string
+	//Size 本地缓存的最大数量，默认10000
+	Size int
+	//TTL 本地缓存的有效期，默认5分钟
+	TTL time.Duration
+	//RedisTTL 写入redis时设置的过期时间，0不过期
+	RedisTTL time.Duration
+	//FlushInterval 修改写回redis的间隔，默认1秒
+	FlushInterval time.Duration
+	//FlushBatch 每个管道最多写回的数量，默认100
+	FlushBatch int
+}
+
+//Cache 本地LRU加redis的两级缓存，数据以hash保存，按结构体的redis标签映射
+//读取时本地没有则读redis，redis没有则调用Loader并写入redis；修改通过Set标记后批量写回redis
+type Cache struct {
+	name     string
+	options  Options
+	newValue func() interface{}
+	loader   Loader
+	local    *lru
+	flight   flight
+
+	//read和run访问redis，测试时替换
+	read func(ctx context.Context, r *redis.Redis, key string, v interface{}) error
+	run  func(ctx context.Context, r *redis.Redis, pipe *redis.PipeLine) bool
+
+	mux   sync.Mutex
+	dirty map[string]*dirtyEntry
+	//flushing 正在写回的id，写回结束时关闭，同一个id同时只有一个写回
+	flushing map[string]chan struct{}
+	//loading 正在加载的id的修改次数，Set和Delete时增加，加载期间有修改时不写入本地缓存
+	loading map[string]int
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+//dirtyEntry 待写回的数据，all为true时写入全部字段
+type dirtyEntry struct {
+	value  interface{}
+	all    bool
+	fields map[string]bool
+}
+
+//New 创建缓存，key为name:id，newValue返回结构体指针用于从redis读取
+func New(name string, newValue func() interface{}, loader Loader, options *Options) *Cache {
+
+	c := &Cache{
+		name:     name,
+		newValue: newValue,
+		loader:   loader,
+		read:     readRedis,
+		run:      runPipeLine,
+		dirty:    make(map[string]*dirtyEntry),
+		flushing: make(map[string]chan struct{}),
+		loading:  make(map[string]int),
+		quit:     make(chan struct{}),
+	}
+
+	if options != nil {
+
+		c.options = *options
+	}
+
+	if len(c.options.Redis) == 0 {
+
+		c.options.Redis = "cache"
+	}
+
+	if c.options.Size <= 0 {
+
+		c.options.Size = 10000
+	}
+
+	if c.options.TTL <= 0 {
+
+		c.options.TTL = time.Duration(5) * time.Minute
+	}
+
+	if c.options.FlushInterval <= 0 {
+
+		c.options.FlushInterval = time.Duration(1) * time.Second
+	}
+
+	if c.options.FlushBatch <= 0 {
+
+		c.options.FlushBatch = 100
+	}
+
+	c.local = newLRU(c.options.Size, c.options.TTL)
+
+	g.Go(c.flusher)
+
+	return c
+}
+
+func readRedis(ctx context.Context, r *redis.Redis, key string, v interface{}) error {
+
+	return r.HgetStructCtx(ctx, key, v)
+}
+
+func runPipeLine(ctx context.Context, r *redis.Redis, pipe *redis.PipeLine) bool {
+
+	return r.RunPipeLineCtx(ctx, pipe)
+}
+
+func (c *Cache) Key(id string) string {
+
+	return c.name + ":" + id
+}
+
+func (c *Cache) useRedis(id string) (*redis.Redis, error) {
+
+	return redis.UseRedisByKey(c.options.Redis, c.Key(id))
+}
+
+//Get 读取数据，没有数据时返回NotFoundErr，同一个id的并发加载只执行一次
+//返回的值和本地缓存、写回协程共享，写回时会编码该值，不加锁直接修改会产生数据竞争，需要修改时复制一份再Set
+func (c *Cache) Get(ctx context.Context, id string) (interface{}, error) {
+
+	c.mux.Lock()
+	entry, ok := c.dirty[id]
+	c.mux.Unlock()
+
+	if ok {
+
+		return entry.value, nil
+	}
+
+	if v, ok := c.local.get(id); ok {
+
+		return v, nil
+	}
+
+	return c.flight.do(id, func() (interface{}, error) {
+
+		return c.load(ctx, id)
+	})
+}
+
+func (c *Cache) load(ctx context.Context, id string) (interface{}, error) {
+
+	c.mux.Lock()
+	c.loading[id] = 0
+	c.mux.Unlock()
+
+	v, err := c.fetch(ctx, id)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	changed := c.loading[id] > 0
+	delete(c.loading, id)
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	// 加载期间被Set修改过的以修改为准，修改可能已经写回，
+	// 被Delete删除的不再写入本地缓存
+	if entry, ok := c.dirty[id]; ok {
+
+		v = entry.value
+	} else if !changed {
+
+		c.local.add(id, v)
+	} else if lv, ok := c.local.get(id); ok {
+
+		v = lv
+	}
+
+	return v, nil
+}
+
+//fetch 读取redis，redis没有数据时调用Loader
+func (c *Cache) fetch(ctx context.Context, id string) (interface{}, error) {
+
+	r, err := c.useRedis(id)
+	if err != nil {
+
+		return nil, err
+	}
+
+	v := c.newValue()
+	err = c.read(ctx, r, c.Key(id), v)
+	if err == redis.KeyNotExistsErr {
+
+		return c.loadMiss(ctx, r, id)
+	}
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	return v, nil
+}
+
+//loadMiss redis没有数据时调用Loader，加载到的数据写入redis
+func (c *Cache) loadMiss(ctx context.Context, r *redis.Redis, id string) (interface{}, error) {
+
+	if c.loader == nil {
+
+		return nil, NotFoundErr
+	}
+
+	v, err := c.loader(ctx, id)
+	if err != nil {
+
+		return nil, err
+	}
+
+	if v == nil {
+
+		return nil, NotFoundErr
+	}
+
+	pipe := &redis.PipeLine{}
+	if err = c.appendWrite(pipe, id, v, nil); err != nil {
+
+		return nil, err
+	}
+
+	if !c.run(ctx, r, pipe) {
+
+		log.Printf("cache[%s] write %s err=%v", c.name, id, pipe.RunErr)
+	}
+
+	return v, nil
+}
+
+//Set 更新数据并标记修改的字段，fields为空时写回全部字段，修改在FlushInterval内写回redis
+func (c *Cache) Set(id string, v interface{}, fields ...string) {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.local.add(id, v)
+	c.changedLocked(id)
+	c.markLocked(id, &dirtyEntry{value: v, all: len(fields) == 0, fields: toSet(fields)})
+}
+
+func (c *Cache) markLocked(id string, entry *dirtyEntry) {
+
+	old, ok := c.dirty[id]
+	if !ok {
+
+		c.dirty[id] = entry
+
+		return
+	}
+
+	old.value = entry.value
+	old.all = old.all || entry.all
+	for field := range entry.fields {
+
+		old.fields[field] = true
+	}
+}
+
+//changedLocked 记录加载期间的修改，调用时持有c.mux
+func (c *Cache) changedLocked(id string) {
+
+	if _, ok := c.loading[id]; ok {
+
+		c.loading[id]++
+	}
+}
+
+//remark 写回失败的数据重新标记，期间有新的修改时保留新的数据
+func (c *Cache) remark(id string, entry *dirtyEntry) {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	old, ok := c.dirty[id]
+	if !ok {
+
+		c.dirty[id] = entry
+
+		return
+	}
+
+	old.all = old.all || entry.all
+	for field := range entry.fields {
+
+		old.fields[field] = true
+	}
+}
+
+func toSet(fields []string) map[string]bool {
+
+	set := make(map[string]bool, len(fields))
+	for _, field := range fields {
+
+		set[field] = true
+	}
+
+	return set
+}
+
+//Delete 删除本地、待写回和redis中的数据，等待正在进行的写回结束后再删除redis
+func (c *Cache) Delete(ctx context.Context, id string) error {
+
+	c.mux.Lock()
+	if err := c.waitLocked(ctx, id); err != nil {
+
+		c.mux.Unlock()
+
+		return err
+	}
+
+	delete(c.dirty, id)
+	c.local.remove(id)
+	c.changedLocked(id)
+	c.mux.Unlock()
+
+	r, err := c.useRedis(id)
+	if err != nil {
+
+		return err
+	}
+
+	return r.DelCtx(ctx, c.Key(id))
+}
+
+//waitLocked 等待id正在进行的写回结束，调用时和返回时都持有c.mux
+func (c *Cache) waitLocked(ctx context.Context, id string) error {
+
+	for {
+
+		done, ok := c.flushing[id]
+		if !ok {
+
+			return nil
+		}
+
+		c.mux.Unlock()
+
+		select {
+
+		case <-done:
+
+		case <-ctx.Done():
+
+			c.mux.Lock()
+
+			return ctx.Err()
+		}
+
+		c.mux.Lock()
+	}
+}
+
+//Flush 立即写回所有修改，正在写回的id等待上一次写回结束后再写入，保证同一个id的写入顺序
+func (c *Cache) Flush(ctx context.Context) error {
+
+	c.mux.Lock()
+	entries := make(map[string]*dirtyEntry, len(c.dirty))
+	var busy []string
+	for id, entry := range c.dirty {
+
+		if _, ok := c.flushing[id]; ok {
+
+			busy = append(busy, id)
+
+			continue
+		}
+
+		entries[id] = entry
+		c.flushing[id] = make(chan struct{})
+		delete(c.dirty, id)
+	}
+	c.mux.Unlock()
+
+	err := c.write(ctx, entries)
+	for _, id := range busy {
+
+		if e := c.FlushKey(ctx, id); e != nil {
+
+			err = e
+		}
+	}
+
+	return err
+}
+
+//FlushKey 立即写回一个id的修改，正在写回时等待写回结束
+func (c *Cache) FlushKey(ctx context.Context, id string) error {
+
+	c.mux.Lock()
+	if err := c.waitLocked(ctx, id); err != nil {
+
+		c.mux.Unlock()
+
+		return err
+	}
+
+	entry, ok := c.dirty[id]
+	if ok {
+
+		c.flushing[id] = make(chan struct{})
+		delete(c.dirty, id)
+	}
+	c.mux.Unlock()
+
+	if !ok {
+
+		return nil
+	}
+
+	return c.write(ctx, map[string]*dirtyEntry{id: entry})
+}
+
+//Logout 玩家下线时写回修改并删除本地缓存
+func (c *Cache) Logout(ctx context.Context, id string) error {
+
+	if err := c.FlushKey(ctx, id); err != nil {
+
+		return err
+	}
+
+	// 期间又有修改或者正在写回时保留本地数据，避免从redis读到旧数据
+	c.mux.Lock()
+	_, dirty := c.dirty[id]
+	_, flushing := c.flushing[id]
+	if !dirty && !flushing {
+
+		c.local.remove(id)
+	}
+	c.mux.Unlock()
+
+	return nil
+}
+
+//Close 停止定时写回并写回所有修改
+func (c *Cache) Close() error {
+
+	c.closeOnce.Do(func() {
+
+		close(c.quit)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), redis.DefaultTimeout)
+	defer cancel()
+
+	return c.Flush(ctx)
+}
+
+//write 按redis分片分组，每组按FlushBatch分批用管道写回，失败的重新标记等待下次写回
+//entries中的id已经标记为正在写回，结束后清除
+func (c *Cache) write(ctx context.Context, entries map[string]*dirtyEntry) error {
+
+	defer c.done(entries)
+
+	groups := make(map[*redis.Redis][]string)
+	for id := range entries {
+
+		r, err := c.useRedis(id)
+		if err != nil {
+
+			for id, entry := range entries {
+
+				c.remark(id, entry)
+			}
+
+			return err
+		}
+
+		groups[r] = append(groups[r], id)
+	}
+
+	var lastErr error
+	for r, ids := range groups {
+
+		for len(ids) > 0 {
+
+			n := c.options.FlushBatch
+			if n > len(ids) {
+
+				n = len(ids)
+			}
+
+			if err := c.writeBatch(ctx, r, ids[:n], entries); err != nil {
+
+				lastErr = err
+			}
+			ids = ids[n:]
+		}
+	}
+
+	return lastErr
+}
+
+func (c *Cache) writeBatch(ctx context.Context, r *redis.Redis, ids []string, entries map[string]*dirtyEntry) error {
+
+	pipe := &redis.PipeLine{}
+	written := make([]string, 0, len(ids))
+	for _, id := range ids {
+
+		entry := entries[id]
+
+		var fields []string
+		if !entry.all {
+
+			for field := range entry.fields {
+
+				fields = append(fields, field)
+			}
+		}
+
+		// 编码失败的数据无法写回，丢弃
+		if err := c.appendWrite(pipe, id, entry.value, fields); err != nil {
+
+			log.Printf("cache[%s] encode %s err=%s", c.name, id, err.Error())
+
+			continue
+		}
+
+		written = append(written, id)
+	}
+
+	if len(pipe.Commands) == 0 || c.run(ctx, r, pipe) {
+
+		return nil
+	}
+
+	for _, id := range written {
+
+		c.remark(id, entries[id])
+	}
+
+	if pipe.RunErr != nil {
+
+		return pipe.RunErr
+	}
+
+	for _, command := range pipe.Commands {
+
+		if command.Err != nil {
+
+			return command.Err
+		}
+	}
+
+	return nil
+}
+
+//done 清除写回中的标记，唤醒等待的FlushKey
+func (c *Cache) done(entries map[string]*dirtyEntry) {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for id := range entries {
+
+		if done, ok := c.flushing[id]; ok {
+
+			close(done)
+			delete(c.flushing, id)
+		}
+	}
+}
+
+func (c *Cache) appendWrite(pipe *redis.PipeLine, id string, v interface{}, fields []string) error {
+
+	key := c.Key(id)
+	if err := pipe.AppendStruct(key, v, fields...); err != nil {
+
+		return err
+	}
+
+	if c.options.RedisTTL > 0 {
+
+		return pipe.Append("PEXPIRE", key, int64(c.options.RedisTTL/time.Millisecond))
+	}
+
+	return nil
+}
+
+//flusher 定时写回，g.Close时写回剩余的修改
+func (c *Cache) flusher() {
+
+	ticker := time.NewTicker(c.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+
+		case <-c.quit:
+
+			return
+
+		case <-g.Quit():
+
+			ctx, cancel := context.WithTimeout(context.Background(), redis.DefaultTimeout)
+			if err := c.Flush(ctx); err != nil {
+
+				log.Printf("cache[%s] flush err=%s", c.name, err.Error())
+			}
+			cancel()
+
+			return
+
+		case <-ticker.C:
+
+			ctx, cancel := context.WithTimeout(context.Background(), redis.DefaultTimeout)
+			if err := c.Flush(ctx); err != nil {
+
+				log.Printf("cache[%s] flush err=%s", c.name, err.Error())
+			}
+			cancel()
+		}
+	}
+}
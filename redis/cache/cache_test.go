@@ -0,0 +1,519 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/laonsx/gamelib/codec"
+	"github.com/laonsx/gamelib/g"
+	"github.com/laonsx/gamelib/redis"
+)
+
+type player struct {
+	Uid   uint64 `redis:"uid"`
+	Name  string `redis:"name"`
+	Level int    `redis:"level"`
+}
+
+func TestCache(t *testing.T) {
+
+	redis.InitRedis(codec.MsgPack, codec.UnMsgPack, redis.NewRedisConf("cache", "127.0.0.1", "6379", 0))
+
+	r, _ := redis.UseRedisByName("cache")
+	if err := r.Del("player:10001"); err != nil {
+
+		t.Skip("redis unavailable:", err)
+	}
+
+	loads := 0
+	c := New("player", func() interface{} { return new(player) }, func(ctx context.Context, id string) (interface{}, error) {
+
+		loads++
+		if id != "10001" {
+
+			return nil, nil
+		}
+
+		return &player{Uid: 10001, Name: "player", Level: 1}, nil
+	}, nil)
+	defer c.Close()
+
+	ctx := context.Background()
+	v, err := c.Get(ctx, "10001")
+	if err != nil || v.(*player).Level != 1 {
+
+		t.Fatal("Get:", v, err)
+	}
+
+	if _, err = c.Get(ctx, "10002"); err != NotFoundErr {
+
+		t.Error("Get not found:", err)
+	}
+
+	p := v.(*player)
+	p.Level = 2
+	c.Set("10001", p, "level")
+
+	if err = c.Logout(ctx, "10001"); err != nil {
+
+		t.Fatal("Logout:", err)
+	}
+
+	got := new(player)
+	if err = r.HgetStruct("player:10001", got); err != nil || got.Level != 2 {
+
+		t.Error("redis:", got, err)
+	}
+
+	// 下线后从redis读取，不再调用Loader
+	if v, err = c.Get(ctx, "10001"); err != nil || v.(*player).Level != 2 || loads != 2 {
+
+		t.Error("Get after logout:", v, err, loads)
+	}
+}
+
+// memStore 内存中的hash，替换Cache的read和run，不需要redis
+type memStore struct {
+	mux  sync.Mutex
+	data map[string]map[string][]byte
+	// pipes 每次写回的管道
+	pipes []*redis.PipeLine
+	// fail 写回返回失败
+	fail bool
+	// blocked 不为空时第一次写回先关闭blocked，再等待release关闭
+	blocked chan struct{}
+	release chan struct{}
+	// readBlocked 不为空时第一次读取完成后先关闭readBlocked，再等待readRelease关闭
+	readBlocked chan struct{}
+	readRelease chan struct{}
+}
+
+func newMemStore() *memStore {
+
+	return &memStore{data: make(map[string]map[string][]byte)}
+}
+
+func (m *memStore) read(ctx context.Context, r *redis.Redis, key string, v interface{}) error {
+
+	err := m.decode(key, v)
+
+	m.mux.Lock()
+	blocked := m.readBlocked
+	m.readBlocked = nil
+	m.mux.Unlock()
+
+	if blocked != nil {
+
+		close(blocked)
+		<-m.readRelease
+	}
+
+	return err
+}
+
+func (m *memStore) decode(key string, v interface{}) error {
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	h, ok := m.data[key]
+	if !ok {
+
+		return redis.KeyNotExistsErr
+	}
+
+	p := v.(*player)
+	fields := map[string]interface{}{"uid": &p.Uid, "name": &p.Name, "level": &p.Level}
+	for name, value := range h {
+
+		if err := redis.Decode(value, fields[name]); err != nil {
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *memStore) run(ctx context.Context, r *redis.Redis, pipe *redis.PipeLine) bool {
+
+	m.mux.Lock()
+	blocked := m.blocked
+	m.blocked = nil
+	m.mux.Unlock()
+
+	if blocked != nil {
+
+		close(blocked)
+		<-m.release
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.pipes = append(m.pipes, pipe)
+	if m.fail {
+
+		pipe.RunErr = errors.New("write failed")
+
+		return false
+	}
+
+	for _, command := range pipe.Commands {
+
+		if command.Cmd != "HMSET" {
+
+			continue
+		}
+
+		key := command.Args[0].(string)
+		h, ok := m.data[key]
+		if !ok {
+
+			h = make(map[string][]byte)
+			m.data[key] = h
+		}
+
+		for i := 1; i+1 < len(command.Args); i += 2 {
+
+			h[command.Args[i].(string)] = command.Args[i+1].([]byte)
+		}
+	}
+
+	return true
+}
+
+func (m *memStore) hash(key string) map[string]string {
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	h := make(map[string]string)
+	for field, value := range m.data[key] {
+
+		h[field] = string(value)
+	}
+
+	return h
+}
+
+func (m *memStore) writes() int {
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return len(m.pipes)
+}
+
+// newTestCache 使用memStore的缓存，不定时写回
+func newTestCache(store *memStore, loader Loader, options *Options) *Cache {
+
+	redis.InitRedis(codec.MsgPack, codec.UnMsgPack, redis.NewRedisConf("cache", "127.0.0.1", "6379", 0))
+
+	if options == nil {
+
+		options = &Options{}
+	}
+
+	if options.FlushInterval <= 0 {
+
+		options.FlushInterval = time.Hour
+	}
+
+	c := New("player", func() interface{} { return new(player) }, loader, options)
+	c.read = store.read
+	c.run = store.run
+
+	return c
+}
+
+func TestCache_WriteBehind(t *testing.T) {
+
+	store := newMemStore()
+	c := newTestCache(store, nil, &Options{FlushBatch: 2})
+	ctx := context.Background()
+
+	// 同一个id多次修改合并为一次写入，只写修改过的字段
+	c.Set("1", &player{Uid: 1, Name: "a", Level: 1}, "level")
+	c.Set("1", &player{Uid: 1, Name: "b", Level: 2}, "name")
+	c.Set("2", &player{Uid: 2, Level: 1})
+	c.Set("3", &player{Uid: 3, Level: 1})
+
+	if v, err := c.Get(ctx, "1"); err != nil || v.(*player).Name != "b" {
+
+		t.Fatal("Get dirty:", v, err)
+	}
+
+	if store.writes() != 0 {
+
+		t.Fatal("written before flush")
+	}
+
+	if err := c.Flush(ctx); err != nil {
+
+		t.Fatal("Flush:", err)
+	}
+
+	// 3个id按FlushBatch分成2个管道
+	if n := store.writes(); n != 2 {
+
+		t.Fatal("pipelines:", n)
+	}
+
+	if h := store.hash("player:1"); len(h) != 2 || h["level"] != "2" || h["name"] != "b" {
+
+		t.Error("merged fields:", h)
+	}
+
+	if h := store.hash("player:2"); len(h) != 3 || h["uid"] != "2" {
+
+		t.Error("all fields:", h)
+	}
+
+	// 没有修改时不写回
+	if err := c.Flush(ctx); err != nil || store.writes() != 2 {
+
+		t.Error("empty flush:", store.writes(), err)
+	}
+}
+
+func TestCache_Remark(t *testing.T) {
+
+	store := newMemStore()
+	c := newTestCache(store, nil, nil)
+	ctx := context.Background()
+
+	store.fail = true
+	c.Set("1", &player{Uid: 1, Level: 1}, "level")
+	if err := c.Flush(ctx); err == nil {
+
+		t.Fatal("Flush failed write")
+	}
+
+	// 失败后重新标记，和期间新的修改合并
+	c.Set("1", &player{Uid: 1, Name: "a", Level: 2}, "name")
+
+	store.mux.Lock()
+	store.fail = false
+	store.mux.Unlock()
+
+	if err := c.FlushKey(ctx, "1"); err != nil {
+
+		t.Fatal("FlushKey:", err)
+	}
+
+	if h := store.hash("player:1"); len(h) != 2 || h["level"] != "2" || h["name"] != "a" {
+
+		t.Error("remark:", h)
+	}
+}
+
+func TestCache_Singleflight(t *testing.T) {
+
+	store := newMemStore()
+	release := make(chan struct{})
+
+	var mux sync.Mutex
+	loads := 0
+	c := newTestCache(store, func(ctx context.Context, id string) (interface{}, error) {
+
+		mux.Lock()
+		loads++
+		mux.Unlock()
+
+		<-release
+
+		return &player{Uid: 1, Level: 1}, nil
+	}, nil)
+
+	var wg sync.WaitGroup
+	values := make([]interface{}, 10)
+	for i := range values {
+
+		wg.Add(1)
+		go func(i int) {
+
+			defer wg.Done()
+
+			values[i], _ = c.Get(context.Background(), "1")
+		}(i)
+	}
+
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+
+		t.Fatal("loads:", loads)
+	}
+
+	for _, v := range values {
+
+		if v == nil || v != values[0] {
+
+			t.Fatal("shared value:", values)
+		}
+	}
+
+	// Loader加载的数据写入redis
+	if h := store.hash("player:1"); h["level"] != "1" {
+
+		t.Error("load write:", h)
+	}
+}
+
+func TestCache_FlushOrder(t *testing.T) {
+
+	blocked, release := make(chan struct{}), make(chan struct{})
+	store := newMemStore()
+	store.blocked, store.release = blocked, release
+
+	c := newTestCache(store, nil, nil)
+	ctx := context.Background()
+
+	// 定时写回旧数据的管道还没完成
+	c.Set("1", &player{Uid: 1, Level: 1}, "level")
+	flushed := make(chan error, 1)
+	go func() {
+
+		flushed <- c.Flush(ctx)
+	}()
+	<-blocked
+
+	// 下线写回的新数据必须在旧数据之后写入
+	c.Set("1", &player{Uid: 1, Level: 2}, "level")
+	logout := make(chan error, 1)
+	go func() {
+
+		logout <- c.Logout(ctx, "1")
+	}()
+
+	select {
+
+	case err := <-logout:
+
+		t.Fatal("Logout before previous write:", err)
+
+	case <-time.After(time.Duration(50) * time.Millisecond):
+
+	}
+
+	close(release)
+	if err := <-flushed; err != nil {
+
+		t.Fatal("Flush:", err)
+	}
+
+	if err := <-logout; err != nil {
+
+		t.Fatal("Logout:", err)
+	}
+
+	if h := store.hash("player:1"); h["level"] != "2" {
+
+		t.Fatal("stale write:", h)
+	}
+
+	if v, err := c.Get(ctx, "1"); err != nil || v.(*player).Level != 2 {
+
+		t.Fatal("Get after logout:", v, err)
+	}
+}
+
+func TestCache_LoadRace(t *testing.T) {
+
+	store := newMemStore()
+	c := newTestCache(store, nil, nil)
+	ctx := context.Background()
+
+	c.Set("1", &player{Uid: 1, Level: 1})
+	if err := c.Logout(ctx, "1"); err != nil {
+
+		t.Fatal("Logout:", err)
+	}
+
+	// 加载读到旧数据后，Set的新数据已经写回，加载结果不能覆盖本地缓存
+	load := func() chan interface{} {
+
+		blocked, release := make(chan struct{}), make(chan struct{})
+		store.mux.Lock()
+		store.readBlocked, store.readRelease = blocked, release
+		store.mux.Unlock()
+
+		loaded := make(chan interface{}, 1)
+		go func() {
+
+			v, _ := c.Get(ctx, "1")
+			loaded <- v
+		}()
+		<-blocked
+
+		go func() {
+
+			time.Sleep(time.Duration(20) * time.Millisecond)
+			close(release)
+		}()
+
+		return loaded
+	}
+
+	loaded := load()
+	c.Set("1", &player{Uid: 1, Level: 2})
+	if err := c.FlushKey(ctx, "1"); err != nil {
+
+		t.Fatal("FlushKey:", err)
+	}
+
+	if v := <-loaded; v == nil || v.(*player).Level != 2 {
+
+		t.Fatal("load after Set:", v)
+	}
+
+	if v, err := c.Get(ctx, "1"); err != nil || v.(*player).Level != 2 {
+
+		t.Fatal("Get after load:", v, err)
+	}
+
+	// 加载期间Delete，加载结果不能写回本地缓存
+	c.local.remove("1")
+	loaded = load()
+	_ = c.Delete(ctx, "1")
+	<-loaded
+
+	if v, ok := c.local.get("1"); ok {
+
+		t.Fatal("deleted value cached:", v)
+	}
+}
+
+// TestCache_CloseFlush g.Close之后所有缓存停止定时写回，需要放在最后
+func TestCache_CloseFlush(t *testing.T) {
+
+	select {
+
+	case <-g.Quit():
+
+		t.Skip("g closed")
+
+	default:
+
+	}
+
+	store := newMemStore()
+	c := newTestCache(store, nil, nil)
+
+	c.Set("1", &player{Uid: 1, Level: 3}, "level")
+
+	// g.Go启动前已经退出时不会运行写回协程
+	time.Sleep(time.Duration(10) * time.Millisecond)
+	g.Close()
+
+	if h := store.hash("player:1"); h["level"] != "3" {
+
+		t.Fatal("flush on close:", h)
+	}
+}
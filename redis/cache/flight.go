@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"sync"
+)
+
+type flightCall struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+//flight 同一个id同时只有一个加载，其它调用等待并共享结果
+type flight struct {
+	mux   sync.Mutex
+	calls map[string]*flightCall
+}
+
+func (f *flight) do(id string, fn func() (interface{}, error)) (interface{}, error) {
+
+	f.mux.Lock()
+
+	if f.calls == nil {
+
+		f.calls = make(map[string]*flightCall)
+	}
+
+	if c, ok := f.calls[id]; ok {
+
+		f.mux.Unlock()
+		c.wg.Wait()
+
+		return c.value, c.err
+	}
+
+	c := new(flightCall)
+	c.wg.Add(1)
+	f.calls[id] = c
+
+	f.mux.Unlock()
+
+	defer func() {
+
+		c.wg.Done()
+
+		f.mux.Lock()
+		delete(f.calls, id)
+		f.mux.Unlock()
+	}()
+
+	c.value, c.err = fn()
+
+	return c.value, c.err
+}
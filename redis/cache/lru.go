@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type lruEntry struct {
+	id     string
+	value  interface{}
+	expire time.Time
+}
+
+//lru 本地缓存，超过容量时淘汰最久未使用的，过期的在读取时删除
+type lru struct {
+	mux   sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newLRU(size int, ttl time.Duration) *lru {
+
+	return &lru{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *lru) get(id string) (interface{}, bool) {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	e, ok := c.items[id]
+	if !ok {
+
+		return nil, false
+	}
+
+	entry := e.Value.(*lruEntry)
+	if c.ttl > 0 && time.Now().After(entry.expire) {
+
+		c.ll.Remove(e)
+		delete(c.items, id)
+
+		return nil, false
+	}
+
+	c.ll.MoveToFront(e)
+
+	return entry.value, true
+}
+
+func (c *lru) add(id string, value interface{}) {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	expire := time.Now().Add(c.ttl)
+	if e, ok := c.items[id]; ok {
+
+		entry := e.Value.(*lruEntry)
+		entry.value, entry.expire = value, expire
+		c.ll.MoveToFront(e)
+
+		return
+	}
+
+	c.items[id] = c.ll.PushFront(&lruEntry{id: id, value: value, expire: expire})
+
+	for c.size > 0 && c.ll.Len() > c.size {
+
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*lruEntry).id)
+	}
+}
+
+func (c *lru) remove(id string) {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if e, ok := c.items[id]; ok {
+
+		c.ll.Remove(e)
+		delete(c.items, id)
+	}
+}
+
+func (c *lru) len() int {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.ll.Len()
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+
+	c := newLRU(2, time.Duration(50)*time.Millisecond)
+	c.add("1", 1)
+	c.add("2", 2)
+
+	if v, ok := c.get("1"); !ok || v != 1 {
+
+		t.Fatal("get:", v, ok)
+	}
+
+	// 淘汰最久未使用的2
+	c.add("3", 3)
+	if _, ok := c.get("2"); ok {
+
+		t.Error("2 not evicted")
+	}
+
+	if c.len() != 2 {
+
+		t.Error("len:", c.len())
+	}
+
+	time.Sleep(time.Duration(60) * time.Millisecond)
+
+	if _, ok := c.get("1"); ok {
+
+		t.Error("1 not expired")
+	}
+
+	c.remove("3")
+	if c.len() != 0 {
+
+		t.Error("len after remove:", c.len())
+	}
+}
+
+func TestFlight(t *testing.T) {
+
+	var f flight
+	var calls int32
+	var wg sync.WaitGroup
+
+	start := make(chan struct{})
+	for i := 0; i < 10; i++ {
+
+		wg.Add(1)
+		go func() {
+
+			defer wg.Done()
+
+			<-start
+			v, err := f.do("id", func() (interface{}, error) {
+
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(time.Duration(50) * time.Millisecond)
+
+				return "value", errors.New("err")
+			})
+
+			if v != "value" || err == nil {
+
+				t.Error("do:", v, err)
+			}
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+
+	if calls != 1 {
+
+		t.Error("calls:", calls)
+	}
+}
@@ -0,0 +1,751 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	clusterSlots     = 16384
+	clusterRedirects = 5
+)
+
+var (
+	ClusterDownErr     = errors.New("redis cluster no node")
+	ClusterNoReplyErr  = errors.New("redis cluster no pending reply")
+	ClusterRedirectErr = errors.New("redis cluster too many redirects")
+)
+
+//cluster 集群模式，按key的slot选择节点，处理MOVED和ASK重定向
+type cluster struct {
+	conf    *RedisConf
+	options []redis.DialOption
+
+	mux        sync.RWMutex
+	seeds      []string
+	slots      [clusterSlots]string
+	pools      map[string]*redis.Pool
+	refreshing int32
+}
+
+func newCluster(conf *RedisConf) *cluster {
+
+	// 集群不支持SELECT
+	cconf := *conf
+	cconf.DB = 0
+
+	c := &cluster{
+		conf:    &cconf,
+		options: dialOptions(&cconf),
+		seeds:   append([]string(nil), conf.Cluster...),
+		pools:   make(map[string]*redis.Pool),
+	}
+
+	if err := c.refresh(); err != nil {
+
+		log.Printf("[error] redis cluster(%s) refresh slots err:%v", conf.Name, err)
+	}
+
+	return c
+}
+
+func (c *cluster) get() redis.Conn {
+
+	return &clusterConn{cluster: c}
+}
+
+func (c *cluster) pool(addr string) *redis.Pool {
+
+	c.mux.RLock()
+	rp, ok := c.pools[addr]
+	c.mux.RUnlock()
+
+	if ok {
+
+		return rp
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if rp, ok = c.pools[addr]; ok {
+
+		return rp
+	}
+
+	options := c.options
+	rp = newPool(c.conf, func() (redis.Conn, error) {
+
+		return redis.Dial("tcp", addr, options...)
+	})
+	c.pools[addr] = rp
+
+	return rp
+}
+
+//node slot所在节点，slot未知时返回任意一个节点
+func (c *cluster) node(slot int) string {
+
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	if slot >= 0 && len(c.slots[slot]) > 0 {
+
+		return c.slots[slot]
+	}
+
+	for addr := range c.pools {
+
+		return addr
+	}
+
+	if len(c.seeds) > 0 {
+
+		return c.seeds[0]
+	}
+
+	return ""
+}
+
+//refresh 用CLUSTER SLOTS更新slot和节点的对应关系
+func (c *cluster) refresh() error {
+
+	c.mux.RLock()
+	addrs := append([]string(nil), c.seeds...)
+	for addr := range c.pools {
+
+		addrs = append(addrs, addr)
+	}
+	c.mux.RUnlock()
+
+	err := ClusterDownErr
+	for _, addr := range addrs {
+
+		conn := c.pool(addr).Get()
+		var reply []interface{}
+		reply, err = redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+
+		if err != nil {
+
+			continue
+		}
+
+		var slots [clusterSlots]string
+		for _, v := range reply {
+
+			var r []interface{}
+			r, err = redis.Values(v, nil)
+			if err != nil || len(r) < 3 {
+
+				return fmt.Errorf("redis cluster slots reply error %v", err)
+			}
+
+			start, _ := redis.Int(r[0], nil)
+			end, _ := redis.Int(r[1], nil)
+			master, _ := redis.Values(r[2], nil)
+			if len(master) < 2 || start < 0 || end >= clusterSlots || start > end {
+
+				return errors.New("redis cluster slots reply error")
+			}
+
+			host, _ := redis.String(master[0], nil)
+			port, _ := redis.Int(master[1], nil)
+			if len(host) == 0 {
+
+				host, _, _ = net.SplitHostPort(addr)
+			}
+
+			node := net.JoinHostPort(host, strconv.Itoa(port))
+			for i := start; i <= end; i++ {
+
+				slots[i] = node
+			}
+		}
+
+		c.mux.Lock()
+		c.slots = slots
+		c.mux.Unlock()
+
+		return nil
+	}
+
+	return err
+}
+
+//asyncRefresh MOVED后在后台刷新，同一时间只有一个在刷新
+func (c *cluster) asyncRefresh() {
+
+	if !atomic.CompareAndSwapInt32(&c.refreshing, 0, 1) {
+
+		return
+	}
+
+	go func() {
+
+		defer atomic.StoreInt32(&c.refreshing, 0)
+
+		if err := c.refresh(); err != nil {
+
+			log.Printf("[error] redis cluster(%s) refresh slots err:%v", c.conf.Name, err)
+		}
+	}()
+}
+
+func (c *cluster) moved(slot int, addr string) {
+
+	c.mux.Lock()
+	if slot >= 0 && slot < clusterSlots {
+
+		c.slots[slot] = addr
+	}
+	c.mux.Unlock()
+
+	c.asyncRefresh()
+}
+
+func (c *cluster) stats() redis.PoolStats {
+
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	var st redis.PoolStats
+	for _, rp := range c.pools {
+
+		s := rp.Stats()
+		st.ActiveCount += s.ActiveCount
+		st.IdleCount += s.IdleCount
+	}
+
+	return st
+}
+
+func (c *cluster) close() error {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for _, rp := range c.pools {
+
+		_ = rp.Close()
+	}
+
+	return nil
+}
+
+type clusterCommand struct {
+	cmd  string
+	args []interface{}
+}
+
+//clusterConn 集群连接，每个命令按key路由到节点
+//MULTI、WATCH和订阅命令会把连接固定到一个节点，事务中的key需要使用相同的{tag}
+type clusterConn struct {
+	cluster *cluster
+	conn    redis.Conn
+	pinned  bool
+	multi   bool
+	pending []clusterCommand
+	replies []interface{}
+	err     error
+}
+
+func (cc *clusterConn) Close() error {
+
+	if cc.conn != nil {
+
+		return cc.conn.Close()
+	}
+
+	return nil
+}
+
+func (cc *clusterConn) Err() error {
+
+	if cc.conn != nil {
+
+		return cc.conn.Err()
+	}
+
+	return cc.err
+}
+
+func (cc *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+
+	return cc.do(-1, cmd, args...)
+}
+
+func (cc *clusterConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+
+	return cc.do(timeout, cmd, args...)
+}
+
+func (cc *clusterConn) Send(cmd string, args ...interface{}) error {
+
+	if cc.pinned {
+
+		return cc.conn.Send(cmd, args...)
+	}
+
+	cc.pending = append(cc.pending, clusterCommand{cmd: cmd, args: args})
+
+	return nil
+}
+
+//Flush 管道中有事务或订阅命令时固定到第一个key所在的节点，否则按节点分组执行
+func (cc *clusterConn) Flush() error {
+
+	if !cc.pinned && len(cc.pending) > 0 {
+
+		for _, c := range cc.pending {
+
+			if pinCommand(c.cmd) {
+
+				cc.pin(firstKeySlot(cc.pending))
+
+				break
+			}
+		}
+	}
+
+	if cc.pinned {
+
+		for _, c := range cc.pending {
+
+			if err := cc.conn.Send(c.cmd, c.args...); err != nil {
+
+				return err
+			}
+		}
+		cc.pending = nil
+
+		return cc.conn.Flush()
+	}
+
+	replies := cc.exec(cc.pending)
+	cc.pending = nil
+	cc.replies = append(cc.replies, replies...)
+
+	return nil
+}
+
+func (cc *clusterConn) Receive() (interface{}, error) {
+
+	return cc.receive(-1)
+}
+
+func (cc *clusterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+
+	return cc.receive(timeout)
+}
+
+func (cc *clusterConn) receive(timeout time.Duration) (interface{}, error) {
+
+	if cc.pinned {
+
+		if timeout < 0 {
+
+			return cc.conn.Receive()
+		}
+
+		return redis.ReceiveWithTimeout(cc.conn, timeout)
+	}
+
+	if len(cc.pending) > 0 {
+
+		if err := cc.Flush(); err != nil {
+
+			return nil, err
+		}
+	}
+
+	if len(cc.replies) == 0 {
+
+		return nil, ClusterNoReplyErr
+	}
+
+	reply := cc.replies[0]
+	cc.replies = cc.replies[1:]
+
+	if err, ok := reply.(redis.Error); ok {
+
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+func (cc *clusterConn) do(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+
+	if cc.pinned {
+
+		return doWithTimeout(cc.conn, timeout, cmd, args...)
+	}
+
+	if cmd == "" || len(cc.pending) > 0 {
+
+		if cmd != "" {
+
+			_ = cc.Send(cmd, args...)
+		}
+
+		if err := cc.Flush(); err != nil {
+
+			return nil, err
+		}
+
+		var replies []interface{}
+		if cc.pinned {
+
+			rs, err := redis.Values(doWithTimeout(cc.conn, timeout, ""))
+			if err != nil {
+
+				return nil, err
+			}
+
+			replies = rs
+		} else {
+
+			replies = cc.replies
+			cc.replies = nil
+		}
+
+		if cmd == "" {
+
+			return replies, nil
+		}
+
+		return lastReply(replies)
+	}
+
+	switch strings.ToUpper(cmd) {
+
+	case "MULTI":
+
+		// 等待第一个带key的命令确定节点
+		cc.multi = true
+
+		return "OK", nil
+
+	case "EXEC":
+
+		if cc.multi {
+
+			cc.multi = false
+
+			return []interface{}{}, nil
+		}
+
+	case "DISCARD":
+
+		if cc.multi {
+
+			cc.multi = false
+
+			return "OK", nil
+		}
+	}
+
+	slot := commandSlot(cmd, args)
+	if cc.multi || pinCommand(cmd) {
+
+		cc.pin(slot)
+
+		if cc.multi {
+
+			cc.multi = false
+
+			if _, err := cc.conn.Do("MULTI"); err != nil {
+
+				return nil, err
+			}
+		}
+
+		return doWithTimeout(cc.conn, timeout, cmd, args...)
+	}
+
+	return cc.route(timeout, slot, cmd, args)
+}
+
+//pin 固定到slot所在节点
+func (cc *clusterConn) pin(slot int) {
+
+	cc.pinned = true
+	cc.conn = cc.cluster.pool(cc.cluster.node(slot)).Get()
+}
+
+//route 在slot所在节点执行，处理MOVED和ASK
+func (cc *clusterConn) route(timeout time.Duration, slot int, cmd string, args []interface{}) (interface{}, error) {
+
+	addr := cc.cluster.node(slot)
+	if len(addr) == 0 {
+
+		return nil, ClusterDownErr
+	}
+
+	asking := false
+	for i := 0; i < clusterRedirects; i++ {
+
+		conn := cc.cluster.pool(addr).Get()
+		if asking {
+
+			_, _ = conn.Do("ASKING")
+		}
+
+		reply, err := doWithTimeout(conn, timeout, cmd, args...)
+		conn.Close()
+
+		kind, target, ok := redirect(err)
+		if !ok {
+
+			cc.err = err
+
+			return reply, err
+		}
+
+		addr = target
+		asking = kind == "ASK"
+		if !asking {
+
+			cc.cluster.moved(slot, target)
+		}
+	}
+
+	return nil, ClusterRedirectErr
+}
+
+//exec 管道命令按节点分组执行，返回结果保持原来的顺序，错误以redis.Error返回
+func (cc *clusterConn) exec(cmds []clusterCommand) []interface{} {
+
+	replies := make([]interface{}, len(cmds))
+	groups := make(map[string][]int)
+	for i, c := range cmds {
+
+		addr := cc.cluster.node(commandSlot(c.cmd, c.args))
+		groups[addr] = append(groups[addr], i)
+	}
+
+	for addr, indexes := range groups {
+
+		conn := cc.cluster.pool(addr).Get()
+		for _, i := range indexes {
+
+			_ = conn.Send(cmds[i].cmd, cmds[i].args...)
+		}
+
+		rs, err := redis.Values(conn.Do(""))
+		conn.Close()
+
+		for n, i := range indexes {
+
+			var reply interface{}
+			if err != nil {
+
+				reply = redis.Error(err.Error())
+			} else if n < len(rs) {
+
+				reply = rs[n]
+			}
+
+			// 重定向的命令单独重试
+			if e, ok := reply.(redis.Error); ok {
+
+				if _, _, ok := redirect(e); ok {
+
+					r, err := cc.route(-1, commandSlot(cmds[i].cmd, cmds[i].args), cmds[i].cmd, cmds[i].args)
+					if err != nil {
+
+						reply = redis.Error(err.Error())
+					} else {
+
+						reply = r
+					}
+				}
+			}
+
+			replies[i] = reply
+		}
+	}
+
+	return replies
+}
+
+//lastReply 与redigo一致，返回最后一个命令的结果和第一个错误
+func lastReply(replies []interface{}) (reply interface{}, err error) {
+
+	for _, r := range replies {
+
+		if e, ok := r.(redis.Error); ok && err == nil {
+
+			err = e
+		}
+
+		reply = r
+	}
+
+	return
+}
+
+func doWithTimeout(conn redis.Conn, timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+
+	if timeout < 0 {
+
+		return conn.Do(cmd, args...)
+	}
+
+	return redis.DoWithTimeout(conn, timeout, cmd, args...)
+}
+
+//redirect 解析MOVED和ASK错误 "MOVED 3999 127.0.0.1:6381"
+func redirect(err error) (kind string, addr string, ok bool) {
+
+	e, ok := err.(redis.Error)
+	if !ok {
+
+		return "", "", false
+	}
+
+	fields := strings.Fields(string(e))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+
+		return "", "", false
+	}
+
+	return fields[0], fields[2], true
+}
+
+//pinCommand 需要固定节点的命令
+func pinCommand(cmd string) bool {
+
+	switch strings.ToUpper(cmd) {
+
+	case "MULTI", "WATCH", "SUBSCRIBE", "PSUBSCRIBE":
+
+		return true
+	}
+
+	return false
+}
+
+func firstKeySlot(cmds []clusterCommand) int {
+
+	for _, c := range cmds {
+
+		if slot := commandSlot(c.cmd, c.args); slot >= 0 {
+
+			return slot
+		}
+	}
+
+	return -1
+}
+
+//commandSlot 命令第一个key的slot，没有key返回-1
+func commandSlot(cmd string, args []interface{}) int {
+
+	key, ok := commandKey(cmd, args)
+	if !ok {
+
+		return -1
+	}
+
+	return Slot(key)
+}
+
+func commandKey(cmd string, args []interface{}) (string, bool) {
+
+	switch strings.ToUpper(cmd) {
+
+	case "PING", "AUTH", "SELECT", "ECHO", "INFO", "TIME", "DBSIZE", "FLUSHDB", "FLUSHALL",
+		"MULTI", "EXEC", "DISCARD", "UNWATCH", "SCRIPT", "SCAN", "CLUSTER", "ASKING", "ROLE",
+		"PUBLISH", "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+
+		return "", false
+
+	case "EVAL", "EVALSHA":
+
+		if len(args) < 3 {
+
+			return "", false
+		}
+
+		if n, err := strconv.Atoi(argString(args[1])); err != nil || n <= 0 {
+
+			return "", false
+		}
+
+		return argString(args[2]), true
+
+	case "XREAD", "XREADGROUP":
+
+		for i, v := range args {
+
+			if strings.ToUpper(argString(v)) == "STREAMS" && i+1 < len(args) {
+
+				return argString(args[i+1]), true
+			}
+		}
+
+		return "", false
+	}
+
+	if len(args) == 0 {
+
+		return "", false
+	}
+
+	return argString(args[0]), true
+}
+
+func argString(v interface{}) string {
+
+	switch v := v.(type) {
+
+	case string:
+
+		return v
+
+	case []byte:
+
+		return string(v)
+	}
+
+	return fmt.Sprint(v)
+}
+
+//Slot key所在的集群slot，支持{tag}
+func Slot(key string) int {
+
+	return int(crc16([]byte(hashTag(key))) % clusterSlots)
+}
+
+//crc16 CRC16/XMODEM
+func crc16(b []byte) uint16 {
+
+	var crc uint16
+	for _, v := range b {
+
+		crc ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+
+			if crc&0x8000 != 0 {
+
+				crc = crc<<1 ^ 0x1021
+			} else {
+
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
@@ -0,0 +1,246 @@
+package redis
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeCluster 两个节点，a负责0-8191，b负责8192-16383，owner可以覆盖单个slot
+type fakeCluster struct {
+	mux   sync.Mutex
+	a, b  *fakeServer
+	owner map[int]*fakeServer
+	ask   map[int]*fakeServer
+}
+
+func newFakeCluster(t *testing.T) *fakeCluster {
+
+	fc := &fakeCluster{
+		a:     newFakeServer(t),
+		b:     newFakeServer(t),
+		owner: make(map[int]*fakeServer),
+		ask:   make(map[int]*fakeServer),
+	}
+
+	for _, v := range []struct {
+		s          *fakeServer
+		start, end int
+	}{{fc.a, 0, 8191}, {fc.b, 8192, 16383}} {
+
+		host, port, _ := net.SplitHostPort(v.s.addr)
+		p, _ := strconv.Atoi(port)
+		v.s.slots = [][]interface{}{{v.start, v.end, host, p}}
+
+		s := v.s
+		s.redirect = func(slot int, asking bool) string {
+
+			fc.mux.Lock()
+			defer fc.mux.Unlock()
+
+			if to, ok := fc.ask[slot]; ok {
+
+				if to == s && asking {
+
+					return ""
+				}
+
+				if to != s {
+
+					return "ASK " + strconv.Itoa(slot) + " " + to.addr
+				}
+			}
+
+			if owner := fc.slotOwner(slot); owner != s {
+
+				return "MOVED " + strconv.Itoa(slot) + " " + owner.addr
+			}
+
+			return ""
+		}
+	}
+
+	return fc
+}
+
+func (fc *fakeCluster) slotOwner(slot int) *fakeServer {
+
+	if s, ok := fc.owner[slot]; ok {
+
+		return s
+	}
+
+	if slot < 8192 {
+
+		return fc.a
+	}
+
+	return fc.b
+}
+
+func (fc *fakeCluster) close() {
+
+	fc.a.close()
+	fc.b.close()
+}
+
+func TestSlot(t *testing.T) {
+
+	// redis cluster文档中的示例
+	if Slot("123456789") != 0x31C3%16384 {
+
+		t.Error("Slot:", Slot("123456789"))
+	}
+
+	if Slot("{user1000}.following") != Slot("{user1000}.followers") {
+
+		t.Error("Slot hash tag")
+	}
+}
+
+func TestCluster_Route(t *testing.T) {
+
+	fc := newFakeCluster(t)
+	defer fc.close()
+
+	r := newRedis(&RedisConf{Name: "cluster", Cluster: []string{fc.a.addr}})
+	defer r.Close()
+
+	for i := 0; i < 100; i++ {
+
+		key := "user:" + strconv.Itoa(i)
+		if err := r.Set(key, i); err != nil {
+
+			t.Fatal("Set:", key, err)
+		}
+
+		if fc.slotOwner(Slot(key)).get(key) == nil {
+
+			t.Fatal("Set on wrong node:", key)
+		}
+
+		var v int
+		if err := r.Get(key, &v); err != nil || v != i {
+
+			t.Fatal("Get:", key, v, err)
+		}
+	}
+
+	if err := r.Hset("h", "f", "v"); err != nil {
+
+		t.Fatal("Hset:", err)
+	}
+
+	var v string
+	if err := r.Hget("h", "f", &v); err != nil || v != "v" {
+
+		t.Error("Hget:", v, err)
+	}
+}
+
+func TestCluster_Redirect(t *testing.T) {
+
+	fc := newFakeCluster(t)
+	defer fc.close()
+
+	r := newRedis(&RedisConf{Name: "cluster", Cluster: []string{fc.a.addr}})
+	defer r.Close()
+
+	key := "moved"
+	slot := Slot(key)
+	from := fc.slotOwner(slot)
+	to := fc.a
+	if from == fc.a {
+
+		to = fc.b
+	}
+
+	// slot迁移完成，客户端收到MOVED
+	fc.mux.Lock()
+	fc.owner[slot] = to
+	fc.mux.Unlock()
+
+	if err := r.Set(key, 1); err != nil {
+
+		t.Fatal("Set MOVED:", err)
+	}
+
+	if to.get(key) == nil {
+
+		t.Fatal("Set MOVED wrong node")
+	}
+
+	// slot迁移中，客户端收到ASK
+	key = "asking"
+	slot = Slot(key)
+	from = fc.slotOwner(slot)
+	to = fc.a
+	if from == fc.a {
+
+		to = fc.b
+	}
+
+	fc.mux.Lock()
+	fc.ask[slot] = to
+	fc.mux.Unlock()
+
+	if err := r.Set(key, 1); err != nil {
+
+		t.Fatal("Set ASK:", err)
+	}
+
+	if to.get(key) == nil || from.get(key) != nil {
+
+		t.Fatal("Set ASK wrong node")
+	}
+}
+
+func TestCluster_PipeLine(t *testing.T) {
+
+	fc := newFakeCluster(t)
+	defer fc.close()
+
+	r := newRedis(&RedisConf{Name: "cluster", Cluster: []string{fc.b.addr}})
+	defer r.Close()
+
+	pipe := new(PipeLine)
+	for i := 0; i < 20; i++ {
+
+		_ = pipe.Append("SET", "pipe:"+strconv.Itoa(i), i)
+	}
+	_ = pipe.Append("GET", "pipe:7")
+
+	if !r.RunPipeLine(pipe) {
+
+		t.Fatal("RunPipeLine:", pipe.RunErr)
+	}
+
+	if v, _ := ToString(pipe.Commands[20].Result, nil); v != "7" {
+
+		t.Error("RunPipeLine result:", v)
+	}
+
+	// 事务固定到{tag}所在节点
+	conn := r.get()
+	defer conn.Close()
+
+	_, _ = conn.Do("MULTI")
+	_, _ = conn.Do("SET", "{tx}a", 1)
+	_, _ = conn.Do("SET", "{tx}b", 2)
+	reply, err := conn.Do("EXEC")
+	if err != nil {
+
+		t.Fatal("EXEC:", err)
+	}
+
+	if rs, _ := reply.([]interface{}); len(rs) != 2 {
+
+		t.Error("EXEC reply:", reply)
+	}
+
+	if fc.slotOwner(Slot("{tx}")).get("{tx}b") == nil {
+
+		t.Error("EXEC wrong node")
+	}
+}
@@ -0,0 +1,152 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//DefaultTimeout 不带context的方法使用的超时时间
+//Ctx结尾的方法在获取连接和发送命令前检查ctx，命令发送后只有ctx的截止时间生效，
+//没有截止时间的ctx被取消时不会中断已经发送的命令，要等到命令返回或连接的ReadTimeout，
+//需要及时中断时使用带截止时间的ctx
+var DefaultTimeout = time.Duration(3) * time.Second
+
+func withTimeout() (context.Context, context.CancelFunc) {
+
+	return context.WithTimeout(context.Background(), DefaultTimeout)
+}
+
+//getContext 获取连接，连接池设置了Wait时等待空闲连接可以被ctx取消
+func (r *Redis) getContext(ctx context.Context) (redis.Conn, error) {
+
+	if err := ctx.Err(); err != nil {
+
+		return nil, err
+	}
+
+	switch {
+
+	case r.cluster != nil:
+
+		return r.cluster.get(), nil
+
+	case r.sentinel != nil:
+
+		return r.sentinel.pool().GetContext(ctx)
+	}
+
+	return r.rp.GetContext(ctx)
+}
+
+//do 执行一条命令
+func (r *Redis) do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+
+	conn, err := r.getContext(ctx)
+	if err != nil {
+
+		return nil, err
+	}
+	defer conn.Close()
+
+	return doContext(ctx, conn, cmd, args...)
+}
+
+//doRetry 执行一条命令，失败后间隔10毫秒重试一次
+func (r *Redis) doRetry(ctx context.Context, cmd string, args ...interface{}) (reply interface{}, err error) {
+
+	for i := 0; i < 2; i++ {
+
+		reply, err = r.do(ctx, cmd, args...)
+		if err == nil || ctx.Err() != nil {
+
+			return
+		}
+
+		if i == 0 {
+
+			select {
+
+			case <-ctx.Done():
+
+				return nil, ctx.Err()
+
+			case <-time.After(time.Duration(10) * time.Millisecond):
+
+			}
+		}
+	}
+
+	return
+}
+
+//doContext ctx有截止时间时作为这次命令的读超时，超时返回ctx的错误
+//redigo的连接池不能从外部中断正在读取的连接，命令发送后的取消只能通过截止时间生效
+func doContext(ctx context.Context, conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+
+	timeout, err := ctxTimeout(ctx)
+	if err != nil {
+
+		return nil, err
+	}
+
+	if timeout < 0 {
+
+		return conn.Do(cmd, args...)
+	}
+
+	reply, err := redis.DoWithTimeout(conn, timeout, cmd, args...)
+	if err != nil && ctx.Err() != nil {
+
+		return nil, ctx.Err()
+	}
+
+	return reply, err
+}
+
+func receiveContext(ctx context.Context, conn redis.Conn) (interface{}, error) {
+
+	timeout, err := ctxTimeout(ctx)
+	if err != nil {
+
+		return nil, err
+	}
+
+	if timeout < 0 {
+
+		return conn.Receive()
+	}
+
+	reply, err := redis.ReceiveWithTimeout(conn, timeout)
+	if err != nil && ctx.Err() != nil {
+
+		return nil, ctx.Err()
+	}
+
+	return reply, err
+}
+
+//ctxTimeout ctx剩余时间，没有截止时间返回-1
+func ctxTimeout(ctx context.Context) (time.Duration, error) {
+
+	if err := ctx.Err(); err != nil {
+
+		return 0, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+
+		return -1, nil
+	}
+
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+
+		return 0, context.DeadlineExceeded
+	}
+
+	return timeout, nil
+}
+
@@ -0,0 +1,179 @@
+package redis
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// stuckServer 接受连接但不回复
+func stuckServer(t *testing.T) (net.Listener, *RedisConf) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+
+		t.Fatal(err)
+	}
+
+	go func() {
+
+		for {
+
+			c, err := ln.Accept()
+			if err != nil {
+
+				return
+			}
+
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	return ln, &RedisConf{Name: "stuck", Host: host, Port: port, ReadTimeout: 10000}
+}
+
+func TestRedis_Ctx(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	r := newRedis(s.conf("ctx"))
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := r.HmsetCtx(ctx, "h", map[string]interface{}{"a": 1, "b": "x"}); err != nil {
+
+		t.Fatal("HmsetCtx:", err)
+	}
+
+	var a int
+	var b string
+	if err := r.HmgetCtx(ctx, "h", []interface{}{"a", "b"}, &a, &b); err != nil || a != 1 || b != "x" {
+
+		t.Fatal("HmgetCtx:", a, b, err)
+	}
+
+	pipe := new(PipeLine)
+	_ = pipe.Append("HINCRBY", "h2", "n", 2)
+	_ = pipe.Append("HINCRBY", "h2", "n", 3)
+	if !r.RunPipeLineCtx(ctx, pipe) {
+
+		t.Fatal("RunPipeLineCtx:", pipe.RunErr)
+	}
+
+	if n, _ := pipe.Commands[1].ResultInt(); n != 5 {
+
+		t.Error("RunPipeLineCtx result:", n)
+	}
+
+	canceled, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+
+	if err := r.SetCtx(canceled, "k", 1); err != context.Canceled {
+
+		t.Error("SetCtx canceled:", err)
+	}
+}
+
+func TestRedis_CtxTimeout(t *testing.T) {
+
+	ln, conf := stuckServer(t)
+	defer ln.Close()
+
+	r := newRedis(conf)
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(100)*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	var v int
+	if err := r.GetCtx(ctx, "k", &v); err != context.DeadlineExceeded {
+
+		t.Error("GetCtx:", err)
+	}
+
+	if time.Since(start) > time.Second {
+
+		t.Error("GetCtx not canceled in time:", time.Since(start))
+	}
+
+	old := DefaultTimeout
+	DefaultTimeout = time.Duration(100) * time.Millisecond
+	defer func() { DefaultTimeout = old }()
+
+	start = time.Now()
+	if err := r.Set("k", 1); err == nil || time.Since(start) > time.Second {
+
+		t.Error("Set default timeout:", err, time.Since(start))
+	}
+}
+
+func TestRedis_SubscribeCtx(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	r := newRedis(s.conf("ctx"))
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	got := make(chan []byte, 1)
+	done := make(chan error, 1)
+	go func() {
+
+		done <- r.SubscribeCtx(ctx, []string{"ch"}, func(b []byte) { got <- b })
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+
+		s.publish("ch", "hello")
+
+		select {
+
+		case b := <-got:
+
+			if string(b) != "hello" {
+
+				t.Fatal("SubscribeCtx:", string(b))
+			}
+
+		case <-time.After(time.Duration(20) * time.Millisecond):
+
+			if time.Now().Before(deadline) {
+
+				continue
+			}
+
+			t.Fatal("SubscribeCtx no message")
+		}
+
+		break
+	}
+
+	cancel()
+
+	select {
+
+	case err := <-done:
+
+		if err != context.Canceled {
+
+			t.Error("SubscribeCtx:", err)
+		}
+
+	case <-time.After(2 * time.Second):
+
+		t.Fatal("SubscribeCtx not canceled")
+	}
+}
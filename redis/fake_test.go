@@ -0,0 +1,1820 @@
+package redis
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer 测试用的内存redis，实现RESP协议和常用命令，不支持lua
+type fakeServer struct {
+	t    *testing.T
+	ln   net.Listener
+	addr string
+
+	mux     sync.Mutex
+	data    map[string]interface{}
+	expires map[string]time.Time
+	conns   map[*fakeConn]bool
+
+	// role ROLE返回的角色
+	role string
+	// masters SENTINEL get-master-addr-by-name
+	masters map[string]string
+	// slots CLUSTER SLOTS返回的 [start, end, host, port]
+	slots [][]interface{}
+	// redirect 集群模式下返回MOVED或ASK错误，返回空不重定向
+	redirect func(slot int, asking bool) string
+
+	// versions key的修改次数，用于WATCH
+	versions map[string]int
+	// loaded SCRIPT LOAD或EVAL过的脚本
+	loaded map[string]bool
+	// delay 命令执行后延迟回复，模拟回复超时
+	delay time.Duration
+}
+
+// fakeScripts 用go实现的lua脚本，按脚本sha1查找，调用时持有fakeServer的锁
+var fakeScripts = make(map[string]func(s *fakeServer, keys []string, args []string) interface{})
+
+func fakeScript(script *Script, fn func(s *fakeServer, keys []string, args []string) interface{}) {
+
+	fakeScripts[script.Hash()] = fn
+}
+
+// fakeWrites 修改key的命令，WATCH检测冲突使用
+var fakeWrites = map[string]bool{
+	"SET": true, "SETEX": true, "DEL": true, "INCRBY": true, "INCR": true, "EXPIRE": true, "PEXPIRE": true,
+	"HSET": true, "HMSET": true, "HDEL": true, "HINCRBY": true, "LPUSH": true, "RPUSH": true, "LPOP": true,
+	"RPOP": true, "ZADD": true, "ZINCRBY": true, "ZREM": true, "RESTORE": true, "XADD": true, "XDEL": true,
+	"UNLINK": true, "MSET": true, "SADD": true, "RENAME": true,
+}
+
+type fakeConn struct {
+	net.Conn
+	wmux   sync.Mutex
+	w      *bufio.Writer
+	subs   map[string]bool
+	multi  [][]string
+	inMult bool
+	asking bool
+	watch  map[string]int
+}
+
+type fakeDump struct {
+	Str  []byte
+	Hash map[string][]byte
+	List [][]byte
+	Zset map[string]float64
+	Set  map[string]bool
+}
+
+type fakeError string
+
+type fakeStatus string
+
+func newFakeServer(t *testing.T) *fakeServer {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+
+		t.Fatal(err)
+	}
+
+	s := &fakeServer{
+		t:        t,
+		ln:       ln,
+		addr:     ln.Addr().String(),
+		data:     make(map[string]interface{}),
+		expires:  make(map[string]time.Time),
+		conns:    make(map[*fakeConn]bool),
+		role:     "master",
+		masters:  make(map[string]string),
+		versions: make(map[string]int),
+		loaded:   make(map[string]bool),
+	}
+
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeServer) conf(name string) *RedisConf {
+
+	host, port, _ := net.SplitHostPort(s.addr)
+
+	return &RedisConf{Name: name, Host: host, Port: port}
+}
+
+func (s *fakeServer) close() {
+
+	_ = s.ln.Close()
+
+	s.mux.Lock()
+	for c := range s.conns {
+
+		_ = c.Close()
+	}
+	s.mux.Unlock()
+}
+
+// drop 断开所有客户端连接，模拟网络中断
+func (s *fakeServer) drop() {
+
+	s.mux.Lock()
+	for c := range s.conns {
+
+		_ = c.Close()
+		delete(s.conns, c)
+	}
+	s.mux.Unlock()
+}
+
+func (s *fakeServer) serve() {
+
+	for {
+
+		c, err := s.ln.Accept()
+		if err != nil {
+
+			return
+		}
+
+		fc := &fakeConn{Conn: c, w: bufio.NewWriter(c), subs: make(map[string]bool)}
+
+		s.mux.Lock()
+		s.conns[fc] = true
+		s.mux.Unlock()
+
+		go s.handle(fc)
+	}
+}
+
+func (s *fakeServer) handle(fc *fakeConn) {
+
+	defer func() {
+
+		s.mux.Lock()
+		delete(s.conns, fc)
+		s.mux.Unlock()
+
+		_ = fc.Close()
+	}()
+
+	r := bufio.NewReader(fc)
+	for {
+
+		args, err := readCommand(r)
+		if err != nil {
+
+			return
+		}
+
+		if len(args) == 0 {
+
+			continue
+		}
+
+		s.mux.Lock()
+		reply := s.exec(fc, args)
+		delay := s.delay
+		s.mux.Unlock()
+
+		if delay > 0 {
+
+			time.Sleep(delay)
+		}
+
+		fc.write(reply)
+	}
+}
+
+func (fc *fakeConn) write(replies ...interface{}) {
+
+	fc.wmux.Lock()
+	defer fc.wmux.Unlock()
+
+	for _, reply := range replies {
+
+		writeReply(fc.w, reply)
+	}
+
+	_ = fc.w.Flush()
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+
+		return nil, err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 || line[0] != '*' {
+
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+
+		line, err = r.ReadString('\n')
+		if err != nil {
+
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimRight(line, "\r\n")[1:])
+		if err != nil {
+
+			return nil, err
+		}
+
+		b := make([]byte, size+2)
+		if _, err = io.ReadFull(r, b); err != nil {
+
+			return nil, err
+		}
+
+		args[i] = string(b[:size])
+	}
+
+	return args, nil
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+
+	switch v := reply.(type) {
+
+	case nil:
+
+		w.WriteString("$-1\r\n")
+
+	case fakeStatus:
+
+		w.WriteString("+" + string(v) + "\r\n")
+
+	case fakeError:
+
+		w.WriteString("-" + string(v) + "\r\n")
+
+	case int:
+
+		w.WriteString(":" + strconv.Itoa(v) + "\r\n")
+
+	case int64:
+
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+
+	case string:
+
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+
+	case []byte:
+
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n")
+		w.Write(v)
+		w.WriteString("\r\n")
+
+	case []string:
+
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, s := range v {
+
+			writeReply(w, s)
+		}
+
+	case []interface{}:
+
+		if v == nil {
+
+			w.WriteString("*-1\r\n")
+
+			return
+		}
+
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, r := range v {
+
+			writeReply(w, r)
+		}
+
+	default:
+
+		panic(fmt.Sprintf("fake redis reply type %T", reply))
+	}
+}
+
+var fakeOK = fakeStatus("OK")
+
+// exec 执行命令，调用者持有锁
+func (s *fakeServer) exec(fc *fakeConn, args []string) interface{} {
+
+	cmd := strings.ToUpper(args[0])
+	args = args[1:]
+
+	if fc.inMult {
+
+		switch cmd {
+
+		case "EXEC":
+
+			fc.inMult = false
+			watch := fc.watch
+			fc.watch = nil
+
+			for key, v := range watch {
+
+				if s.versions[key] != v {
+
+					fc.multi = nil
+
+					return []interface{}(nil)
+				}
+			}
+
+			replies := make([]interface{}, 0, len(fc.multi))
+			for _, c := range fc.multi {
+
+				replies = append(replies, s.exec(fc, c))
+			}
+			fc.multi = nil
+
+			return replies
+
+		case "DISCARD":
+
+			fc.inMult = false
+			fc.multi = nil
+
+			return fakeOK
+
+		default:
+
+			fc.multi = append(fc.multi, append([]string{cmd}, args...))
+
+			return fakeStatus("QUEUED")
+		}
+	}
+
+	if s.redirect != nil {
+
+		if key, ok := commandKey(cmd, toInterfaces(args)); ok {
+
+			asking := fc.asking
+			fc.asking = false
+
+			if e := s.redirect(Slot(key), asking); len(e) > 0 {
+
+				return fakeError(e)
+			}
+		}
+	}
+
+	if fakeWrites[cmd] && len(args) > 0 {
+
+		s.versions[args[0]]++
+		switch cmd {
+
+		case "DEL", "UNLINK":
+
+			for _, key := range args[1:] {
+
+				s.versions[key]++
+			}
+
+		case "MSET":
+
+			for i := 2; i < len(args); i += 2 {
+
+				s.versions[args[i]]++
+			}
+		}
+	}
+
+	switch cmd {
+
+	case "PING":
+
+		if len(fc.subs) > 0 {
+
+			return []interface{}{"pong", ""}
+		}
+
+		return fakeStatus("PONG")
+
+	case "AUTH", "SELECT":
+
+		return fakeOK
+
+	case "ASKING":
+
+		fc.asking = true
+
+		return fakeOK
+
+	case "ROLE":
+
+		return []interface{}{s.role}
+
+	case "SENTINEL":
+
+		addr, ok := s.masters[args[1]]
+		if !ok {
+
+			return []interface{}(nil)
+		}
+
+		host, port, _ := net.SplitHostPort(addr)
+
+		return []string{host, port}
+
+	case "CLUSTER":
+
+		replies := make([]interface{}, 0, len(s.slots))
+		for _, v := range s.slots {
+
+			replies = append(replies, []interface{}{v[0], v[1], []interface{}{v[2], v[3]}})
+		}
+
+		return replies
+
+	case "MULTI":
+
+		fc.inMult = true
+
+		return fakeOK
+
+	case "WATCH":
+
+		if fc.watch == nil {
+
+			fc.watch = make(map[string]int)
+		}
+
+		for _, key := range args {
+
+			fc.watch[key] = s.versions[key]
+		}
+
+		return fakeOK
+
+	case "UNWATCH":
+
+		fc.watch = nil
+
+		return fakeOK
+
+	case "SCRIPT":
+
+		h := sha1.Sum([]byte(args[1]))
+		sha := hex.EncodeToString(h[:])
+		s.loaded[sha] = true
+
+		return sha
+
+	case "EVAL", "EVALSHA":
+
+		sha := args[0]
+		if cmd == "EVAL" {
+
+			h := sha1.Sum([]byte(args[0]))
+			sha = hex.EncodeToString(h[:])
+			s.loaded[sha] = true
+		}
+
+		if !s.loaded[sha] {
+
+			return fakeError("NOSCRIPT No matching script. Please use EVAL.")
+		}
+
+		fn, ok := fakeScripts[sha]
+		if !ok {
+
+			return fakeError("ERR fake redis script not implemented")
+		}
+
+		n, _ := strconv.Atoi(args[1])
+
+		return fn(s, args[2:2+n], args[2+n:])
+
+	case "SUBSCRIBE":
+
+		replies := make([]interface{}, 0, len(args))
+		for _, ch := range args {
+
+			fc.subs[ch] = true
+			replies = append(replies, []interface{}{"subscribe", ch, len(fc.subs)})
+		}
+
+		// 多个频道时逐个回复
+		for _, r := range replies[:len(replies)-1] {
+
+			fc.write(r)
+		}
+
+		return replies[len(replies)-1]
+
+	case "UNSUBSCRIBE":
+
+		if len(args) == 0 {
+
+			for ch := range fc.subs {
+
+				args = append(args, ch)
+			}
+			sort.Strings(args)
+		}
+
+		if len(args) == 0 {
+
+			return []interface{}{"unsubscribe", nil, 0}
+		}
+
+		replies := make([]interface{}, 0, len(args))
+		for _, ch := range args {
+
+			delete(fc.subs, ch)
+			replies = append(replies, []interface{}{"unsubscribe", ch, len(fc.subs)})
+		}
+
+		for _, r := range replies[:len(replies)-1] {
+
+			fc.write(r)
+		}
+
+		return replies[len(replies)-1]
+
+	case "PUBLISH":
+
+		n := 0
+		for c := range s.conns {
+
+			if c.subs[args[0]] {
+
+				n++
+				go c.write([]interface{}{"message", args[0], args[1]})
+			}
+		}
+
+		return n
+
+	case "GET":
+
+		v, _ := s.lookup(args[0]).([]byte)
+		if v == nil {
+
+			return nil
+		}
+
+		return v
+
+	case "SET":
+
+		return s.set(args)
+
+	case "SETEX":
+
+		return s.set([]string{args[0], args[2], "EX", args[1]})
+
+	case "DEL", "UNLINK":
+
+		n := 0
+		for _, key := range args {
+
+			if s.lookup(key) != nil {
+
+				n++
+				s.del(key)
+			}
+		}
+
+		return n
+
+	case "RENAME":
+
+		v := s.lookup(args[0])
+		if v == nil {
+
+			return fakeError("ERR no such key")
+		}
+
+		s.del(args[1])
+		s.data[args[1]] = v
+		if at, ok := s.expires[args[0]]; ok {
+
+			s.expires[args[1]] = at
+		}
+		s.del(args[0])
+
+		return "OK"
+
+	case "EXISTS":
+
+		n := 0
+		for _, key := range args {
+
+			if s.lookup(key) != nil {
+
+				n++
+			}
+		}
+
+		return n
+
+	case "INCRBY", "INCR":
+
+		by := int64(1)
+		if cmd == "INCRBY" {
+
+			by, _ = strconv.ParseInt(args[1], 10, 64)
+		}
+
+		v, _ := s.lookup(args[0]).([]byte)
+		n, _ := strconv.ParseInt(string(v), 10, 64)
+		n += by
+		s.data[args[0]] = []byte(strconv.FormatInt(n, 10))
+
+		return n
+
+	case "EXPIRE", "PEXPIRE":
+
+		if s.lookup(args[0]) == nil {
+
+			return 0
+		}
+
+		n, _ := strconv.ParseInt(args[1], 10, 64)
+		d := time.Duration(n) * time.Second
+		if cmd == "PEXPIRE" {
+
+			d = time.Duration(n) * time.Millisecond
+		}
+
+		s.expires[args[0]] = time.Now().Add(d)
+
+		return 1
+
+	case "TTL", "PTTL":
+
+		if s.lookup(args[0]) == nil {
+
+			return -2
+		}
+
+		at, ok := s.expires[args[0]]
+		if !ok {
+
+			return -1
+		}
+
+		if cmd == "TTL" {
+
+			return int64(time.Until(at) / time.Second)
+		}
+
+		return int64(time.Until(at) / time.Millisecond)
+
+	case "HSET", "HMSET":
+
+		h := s.hash(args[0], true)
+		n := 0
+		for i := 1; i+1 < len(args); i += 2 {
+
+			if _, ok := h[args[i]]; !ok {
+
+				n++
+			}
+
+			h[args[i]] = []byte(args[i+1])
+		}
+
+		if cmd == "HMSET" {
+
+			return fakeOK
+		}
+
+		return n
+
+	case "HGET":
+
+		v, ok := s.hash(args[0], false)[args[1]]
+		if !ok {
+
+			return nil
+		}
+
+		return v
+
+	case "HMGET":
+
+		h := s.hash(args[0], false)
+		replies := make([]interface{}, 0, len(args)-1)
+		for _, f := range args[1:] {
+
+			if v, ok := h[f]; ok {
+
+				replies = append(replies, v)
+			} else {
+
+				replies = append(replies, nil)
+			}
+		}
+
+		return replies
+
+	case "HGETALL":
+
+		h := s.hash(args[0], false)
+		fields := make([]string, 0, len(h))
+		for f := range h {
+
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+
+		replies := make([]interface{}, 0, 2*len(h))
+		for _, f := range fields {
+
+			replies = append(replies, f, h[f])
+		}
+
+		return replies
+
+	case "HDEL":
+
+		h := s.hash(args[0], false)
+		n := 0
+		for _, f := range args[1:] {
+
+			if _, ok := h[f]; ok {
+
+				n++
+				delete(h, f)
+			}
+		}
+
+		if len(h) == 0 {
+
+			s.del(args[0])
+		}
+
+		return n
+
+	case "HINCRBY":
+
+		h := s.hash(args[0], true)
+		n, _ := strconv.ParseInt(string(h[args[1]]), 10, 64)
+		by, _ := strconv.ParseInt(args[2], 10, 64)
+		n += by
+		h[args[1]] = []byte(strconv.FormatInt(n, 10))
+
+		return n
+
+	case "LPUSH", "RPUSH":
+
+		l, _ := s.lookup(args[0]).([][]byte)
+		for _, v := range args[1:] {
+
+			if cmd == "LPUSH" {
+
+				l = append([][]byte{[]byte(v)}, l...)
+			} else {
+
+				l = append(l, []byte(v))
+			}
+		}
+		s.data[args[0]] = l
+
+		return len(l)
+
+	case "BLPOP":
+
+		// 不等待，按顺序弹出第一个非空list
+		for _, key := range args[:len(args)-1] {
+
+			if v := s.exec(fc, []string{"LPOP", key}); v != nil {
+
+				s.versions[key]++
+
+				return []interface{}{key, v}
+			}
+		}
+
+		return []interface{}(nil)
+
+	case "LPOP", "RPOP":
+
+		l, _ := s.lookup(args[0]).([][]byte)
+		if len(args) > 1 {
+
+			n, _ := strconv.Atoi(args[1])
+			if len(l) == 0 {
+
+				return []interface{}(nil)
+			}
+
+			if n > len(l) {
+
+				n = len(l)
+			}
+
+			replies := make([]interface{}, 0, n)
+			for i := 0; i < n; i++ {
+
+				replies = append(replies, s.exec(fc, []string{cmd, args[0]}))
+			}
+
+			return replies
+		}
+
+		if len(l) == 0 {
+
+			return nil
+		}
+
+		var v []byte
+		if cmd == "LPOP" {
+
+			v, l = l[0], l[1:]
+		} else {
+
+			v, l = l[len(l)-1], l[:len(l)-1]
+		}
+
+		if len(l) == 0 {
+
+			s.del(args[0])
+		} else {
+
+			s.data[args[0]] = l
+		}
+
+		return v
+
+	case "LLEN":
+
+		l, _ := s.lookup(args[0]).([][]byte)
+
+		return len(l)
+
+	case "LRANGE":
+
+		l, _ := s.lookup(args[0]).([][]byte)
+		start, end := fakeRange(args[1], args[2], len(l))
+		replies := make([]interface{}, 0)
+		for i := start; i <= end; i++ {
+
+			replies = append(replies, l[i])
+		}
+
+		return replies
+
+	case "ZADD":
+
+		z := s.zset(args[0], true)
+		n := 0
+		for i := 1; i+1 < len(args); i += 2 {
+
+			score, _ := strconv.ParseFloat(args[i], 64)
+			if _, ok := z[args[i+1]]; !ok {
+
+				n++
+			}
+
+			z[args[i+1]] = score
+		}
+
+		return n
+
+	case "ZINCRBY":
+
+		z := s.zset(args[0], true)
+		by, _ := strconv.ParseFloat(args[1], 64)
+		z[args[2]] += by
+
+		return formatScore(z[args[2]])
+
+	case "ZSCORE":
+
+		score, ok := s.zset(args[0], false)[args[1]]
+		if !ok {
+
+			return nil
+		}
+
+		return formatScore(score)
+
+	case "ZREM":
+
+		z := s.zset(args[0], false)
+		n := 0
+		for _, m := range args[1:] {
+
+			if _, ok := z[m]; ok {
+
+				n++
+				delete(z, m)
+			}
+		}
+
+		return n
+
+	case "ZCARD":
+
+		return len(s.zset(args[0], false))
+
+	case "ZRANGE", "ZREVRANGE":
+
+		members := s.sortedMembers(args[0], cmd == "ZREVRANGE")
+		start, end := fakeRange(args[1], args[2], len(members))
+		withScores := len(args) > 3 && strings.ToUpper(args[3]) == "WITHSCORES"
+		z := s.zset(args[0], false)
+
+		replies := make([]interface{}, 0)
+		for i := start; i <= end; i++ {
+
+			replies = append(replies, members[i])
+			if withScores {
+
+				replies = append(replies, formatScore(z[members[i]]))
+			}
+		}
+
+		return replies
+
+	case "ZRANK", "ZREVRANK":
+
+		for i, m := range s.sortedMembers(args[0], cmd == "ZREVRANK") {
+
+			if m == args[1] {
+
+				return i
+			}
+		}
+
+		return nil
+
+	case "SCAN":
+
+		keys := make([]string, 0, len(s.data))
+		for key := range s.data {
+
+			if s.lookup(key) != nil {
+
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		cursor, page := fakeScanPage(keys, args)
+
+		return []interface{}{cursor, page}
+
+	case "HSCAN":
+
+		h := s.hash(args[0], false)
+		fields := make([]string, 0, len(h))
+		for field := range h {
+
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		cursor, page := fakeScanPage(fields, args[1:])
+		reply := make([]interface{}, 0, 2*len(page))
+		for _, field := range page {
+
+			reply = append(reply, field, h[field])
+		}
+
+		return []interface{}{cursor, reply}
+
+	case "SSCAN":
+
+		set, _ := s.lookup(args[0]).(map[string]bool)
+		members := make([]string, 0, len(set))
+		for m := range set {
+
+			members = append(members, m)
+		}
+		sort.Strings(members)
+
+		cursor, page := fakeScanPage(members, args[1:])
+
+		return []interface{}{cursor, page}
+
+	case "ZSCAN":
+
+		z := s.zset(args[0], false)
+		cursor, page := fakeScanPage(s.sortedMembers(args[0], false), args[1:])
+		reply := make([]interface{}, 0, 2*len(page))
+		for _, m := range page {
+
+			reply = append(reply, m, formatScore(z[m]))
+		}
+
+		return []interface{}{cursor, reply}
+
+	case "SADD":
+
+		set, _ := s.lookup(args[0]).(map[string]bool)
+		if set == nil {
+
+			set = make(map[string]bool)
+			s.data[args[0]] = set
+		}
+
+		n := 0
+		for _, m := range args[1:] {
+
+			if !set[m] {
+
+				n++
+				set[m] = true
+			}
+		}
+
+		return n
+
+	case "MGET":
+
+		replies := make([]interface{}, len(args))
+		for i, key := range args {
+
+			if v, ok := s.lookup(key).([]byte); ok {
+
+				replies[i] = v
+			}
+		}
+
+		return replies
+
+	case "MSET":
+
+		for i := 0; i+1 < len(args); i += 2 {
+
+			s.set(args[i : i+2])
+		}
+
+		return "OK"
+
+	case "DUMP":
+
+		v := s.lookup(args[0])
+		if v == nil {
+
+			return nil
+		}
+
+		var d fakeDump
+		switch v := v.(type) {
+
+		case []byte:
+
+			d.Str = v
+
+		case map[string][]byte:
+
+			d.Hash = v
+
+		case [][]byte:
+
+			d.List = v
+
+		case map[string]float64:
+
+			d.Zset = v
+
+		case map[string]bool:
+
+			d.Set = v
+		}
+
+		b, _ := json.Marshal(&d)
+
+		return b
+
+	case "RESTORE":
+
+		var d fakeDump
+		if err := json.Unmarshal([]byte(args[2]), &d); err != nil {
+
+			return fakeError("ERR DUMP payload version or checksum are wrong")
+		}
+
+		s.del(args[0])
+		switch {
+
+		case d.Str != nil:
+
+			s.data[args[0]] = d.Str
+
+		case d.Hash != nil:
+
+			s.data[args[0]] = d.Hash
+
+		case d.List != nil:
+
+			s.data[args[0]] = d.List
+
+		case d.Zset != nil:
+
+			s.data[args[0]] = d.Zset
+
+		case d.Set != nil:
+
+			s.data[args[0]] = d.Set
+		}
+
+		if ttl, _ := strconv.ParseInt(args[1], 10, 64); ttl > 0 {
+
+			s.expires[args[0]] = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+
+		return fakeOK
+
+	case "XADD", "XGROUP", "XREADGROUP", "XACK", "XPENDING", "XCLAIM", "XDEL", "XLEN", "XRANGE":
+
+		return s.stream(cmd, args)
+	}
+
+	return fakeError("ERR unknown command '" + cmd + "'")
+}
+
+func (s *fakeServer) set(args []string) interface{} {
+
+	key := args[0]
+	var expire time.Duration
+	nx, xx := false, false
+	for i := 2; i < len(args); i++ {
+
+		switch strings.ToUpper(args[i]) {
+
+		case "EX", "PX":
+
+			n, _ := strconv.ParseInt(args[i+1], 10, 64)
+			if strings.ToUpper(args[i]) == "EX" {
+
+				expire = time.Duration(n) * time.Second
+			} else {
+
+				expire = time.Duration(n) * time.Millisecond
+			}
+			i++
+
+		case "NX":
+
+			nx = true
+
+		case "XX":
+
+			xx = true
+		}
+	}
+
+	exists := s.lookup(key) != nil
+	if (nx && exists) || (xx && !exists) {
+
+		return nil
+	}
+
+	s.del(key)
+	s.data[key] = []byte(args[1])
+	if expire > 0 {
+
+		s.expires[key] = time.Now().Add(expire)
+	}
+
+	return fakeOK
+}
+
+// lookup 读取key，过期的key被删除
+func (s *fakeServer) lookup(key string) interface{} {
+
+	if at, ok := s.expires[key]; ok && !time.Now().Before(at) {
+
+		s.del(key)
+	}
+
+	return s.data[key]
+}
+
+func (s *fakeServer) del(key string) {
+
+	delete(s.data, key)
+	delete(s.expires, key)
+}
+
+func (s *fakeServer) hash(key string, create bool) map[string][]byte {
+
+	h, _ := s.lookup(key).(map[string][]byte)
+	if h == nil && create {
+
+		h = make(map[string][]byte)
+		s.data[key] = h
+	}
+
+	return h
+}
+
+func (s *fakeServer) zset(key string, create bool) map[string]float64 {
+
+	z, _ := s.lookup(key).(map[string]float64)
+	if z == nil && create {
+
+		z = make(map[string]float64)
+		s.data[key] = z
+	}
+
+	return z
+}
+
+func (s *fakeServer) sortedMembers(key string, rev bool) []string {
+
+	z := s.zset(key, false)
+	members := make([]string, 0, len(z))
+	for m := range z {
+
+		members = append(members, m)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+
+		a, b := members[i], members[j]
+		if rev {
+
+			a, b = b, a
+		}
+
+		if z[a] != z[b] {
+
+			return z[a] < z[b]
+		}
+
+		return a < b
+	})
+
+	return members
+}
+
+// get 直接读取数据，测试检查写入的分片
+func (s *fakeServer) get(key string) interface{} {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.lookup(key)
+}
+
+// publish 向订阅者推送消息
+func (s *fakeServer) publish(channel string, msg string) {
+
+	s.mux.Lock()
+	s.exec(&fakeConn{}, []string{"PUBLISH", channel, msg})
+	s.mux.Unlock()
+}
+
+func fakeRange(start, end string, n int) (int, int) {
+
+	s, _ := strconv.Atoi(start)
+	e, _ := strconv.Atoi(end)
+	if s < 0 {
+
+		s += n
+	}
+
+	if e < 0 {
+
+		e += n
+	}
+
+	if s < 0 {
+
+		s = 0
+	}
+
+	if e >= n {
+
+		e = n - 1
+	}
+
+	return s, e
+}
+
+// fakeScanPage 按cursor和COUNT分页，cursor为下一页的起始下标
+func fakeScanPage(items []string, args []string) (string, []string) {
+
+	start, _ := strconv.Atoi(args[0])
+	count, match := 10, ""
+	for i := 1; i+1 < len(args); i += 2 {
+
+		switch strings.ToUpper(args[i]) {
+
+		case "COUNT":
+
+			count, _ = strconv.Atoi(args[i+1])
+
+		case "MATCH":
+
+			match = args[i+1]
+		}
+	}
+
+	if start >= len(items) {
+
+		return "0", nil
+	}
+
+	end := start + count
+	if end >= len(items) {
+
+		end = len(items)
+	}
+
+	page := make([]string, 0, count)
+	for _, item := range items[start:end] {
+
+		if len(match) > 0 {
+
+			if ok, _ := fakeMatch(match, item); !ok {
+
+				continue
+			}
+		}
+
+		page = append(page, item)
+	}
+
+	if end == len(items) {
+
+		return "0", page
+	}
+
+	return strconv.Itoa(end), page
+}
+
+func fakeMatch(pattern, key string) (bool, error) {
+
+	// 只支持*通配
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+
+		return pattern == key, nil
+	}
+
+	if !strings.HasPrefix(key, parts[0]) {
+
+		return false, nil
+	}
+
+	key = key[len(parts[0]):]
+	for _, p := range parts[1 : len(parts)-1] {
+
+		i := strings.Index(key, p)
+		if i < 0 {
+
+			return false, nil
+		}
+
+		key = key[i+len(p):]
+	}
+
+	return strings.HasSuffix(key, parts[len(parts)-1]), nil
+}
+
+func formatScore(f float64) string {
+
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func toInterfaces(args []string) []interface{} {
+
+	r := make([]interface{}, len(args))
+	for i, v := range args {
+
+		r[i] = v
+	}
+
+	return r
+}
+
+// call 脚本中执行命令，相当于redis.call
+func (s *fakeServer) call(args ...string) interface{} {
+
+	return s.exec(&fakeConn{subs: make(map[string]bool)}, args)
+}
+
+func init() {
+
+	fakeScript(unlockLuaScript, func(s *fakeServer, keys []string, args []string) interface{} {
+
+		if v, _ := s.lookup(keys[0]).([]byte); string(v) == keys[1] {
+
+			s.call("DEL", keys[0])
+
+			return 1
+		}
+
+		return nil
+	})
+}
+
+type fakeID struct {
+	ms, seq int64
+}
+
+type fakeEntry struct {
+	id     fakeID
+	fields []string
+}
+
+type fakePending struct {
+	consumer  string
+	delivered time.Time
+	count     int64
+}
+
+type fakeGroup struct {
+	last    fakeID
+	pending map[fakeID]*fakePending
+}
+
+// fakeStream XREADGROUP的BLOCK不等待，没有消息立即返回nil
+type fakeStream struct {
+	entries []fakeEntry
+	last    fakeID
+	groups  map[string]*fakeGroup
+}
+
+func (id fakeID) String() string {
+
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id fakeID) less(o fakeID) bool {
+
+	return id.ms < o.ms || (id.ms == o.ms && id.seq < o.seq)
+}
+
+func parseFakeID(s string) fakeID {
+
+	switch s {
+
+	case "-", "0":
+
+		return fakeID{}
+
+	case "+":
+
+		return fakeID{ms: 1<<63 - 1, seq: 1<<63 - 1}
+	}
+
+	var id fakeID
+	parts := strings.SplitN(s, "-", 2)
+	id.ms, _ = strconv.ParseInt(parts[0], 10, 64)
+	if len(parts) == 2 {
+
+		id.seq, _ = strconv.ParseInt(parts[1], 10, 64)
+	}
+
+	return id
+}
+
+func (e fakeEntry) reply() interface{} {
+
+	fields := make([]interface{}, len(e.fields))
+	for i, f := range e.fields {
+
+		fields[i] = []byte(f)
+	}
+
+	return []interface{}{e.id.String(), fields}
+}
+
+func (st *fakeStream) find(id fakeID) (fakeEntry, bool) {
+
+	for _, e := range st.entries {
+
+		if e.id == id {
+
+			return e, true
+		}
+	}
+
+	return fakeEntry{}, false
+}
+
+func (s *fakeServer) stream(cmd string, args []string) interface{} {
+
+	st, _ := s.lookup(args[0]).(*fakeStream)
+	if cmd == "XGROUP" {
+
+		st, _ = s.lookup(args[1]).(*fakeStream)
+	}
+
+	if cmd == "XREADGROUP" {
+
+		st = nil
+		for i := 3; i < len(args); i++ {
+
+			if strings.ToUpper(args[i]) == "STREAMS" {
+
+				st, _ = s.lookup(args[i+1]).(*fakeStream)
+			}
+		}
+	}
+
+	if st == nil {
+
+		switch cmd {
+
+		case "XADD":
+
+			st = &fakeStream{groups: make(map[string]*fakeGroup)}
+			s.data[args[0]] = st
+
+		case "XGROUP":
+
+			if len(args) < 5 || strings.ToUpper(args[4]) != "MKSTREAM" {
+
+				return fakeError("ERR The XGROUP subcommand requires the key to exist")
+			}
+
+			st = &fakeStream{groups: make(map[string]*fakeGroup)}
+			s.data[args[1]] = st
+
+		case "XLEN", "XACK", "XDEL":
+
+			return 0
+
+		case "XRANGE", "XCLAIM", "XPENDING":
+
+			return []interface{}{}
+
+		default:
+
+			return fakeError("NOGROUP No such key or consumer group")
+		}
+	}
+
+	switch cmd {
+
+	case "XADD":
+
+		i := 1
+		maxLen := 0
+		if strings.ToUpper(args[i]) == "MAXLEN" {
+
+			i++
+			if args[i] == "~" || args[i] == "=" {
+
+				i++
+			}
+			maxLen, _ = strconv.Atoi(args[i])
+			i++
+		}
+
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		id := fakeID{ms: now}
+		if !st.last.less(id) {
+
+			id = fakeID{ms: st.last.ms, seq: st.last.seq + 1}
+		}
+		st.last = id
+		st.entries = append(st.entries, fakeEntry{id: id, fields: append([]string(nil), args[i+1:]...)})
+
+		if maxLen > 0 && len(st.entries) > maxLen {
+
+			st.entries = st.entries[len(st.entries)-maxLen:]
+		}
+
+		return id.String()
+
+	case "XGROUP":
+
+		if _, ok := st.groups[args[2]]; ok {
+
+			return fakeError("BUSYGROUP Consumer Group name already exists")
+		}
+
+		last := st.last
+		if args[3] != "$" {
+
+			last = parseFakeID(args[3])
+		}
+		st.groups[args[2]] = &fakeGroup{last: last, pending: make(map[fakeID]*fakePending)}
+
+		return fakeOK
+
+	case "XREADGROUP":
+
+		group, ok := st.groups[args[1]]
+		if !ok {
+
+			return fakeError("NOGROUP No such key or consumer group")
+		}
+
+		consumer := args[2]
+		count := 0
+		for i := 3; i < len(args); i++ {
+
+			if strings.ToUpper(args[i]) == "COUNT" {
+
+				count, _ = strconv.Atoi(args[i+1])
+			}
+		}
+
+		var replies []interface{}
+		for _, e := range st.entries {
+
+			if !group.last.less(e.id) {
+
+				continue
+			}
+
+			if count > 0 && len(replies) >= count {
+
+				break
+			}
+
+			group.last = e.id
+			group.pending[e.id] = &fakePending{consumer: consumer, delivered: time.Now(), count: 1}
+			replies = append(replies, e.reply())
+		}
+
+		if len(replies) == 0 {
+
+			return []interface{}(nil)
+		}
+
+		return []interface{}{[]interface{}{args[len(args)-2], replies}}
+
+	case "XACK":
+
+		group, ok := st.groups[args[1]]
+		if !ok {
+
+			return 0
+		}
+
+		n := 0
+		for _, v := range args[2:] {
+
+			id := parseFakeID(v)
+			if _, ok := group.pending[id]; ok {
+
+				delete(group.pending, id)
+				n++
+			}
+		}
+
+		return n
+
+	case "XPENDING":
+
+		group, ok := st.groups[args[1]]
+		if !ok {
+
+			return fakeError("NOGROUP No such key or consumer group")
+		}
+
+		var idle time.Duration
+		i := 2
+		if strings.ToUpper(args[i]) == "IDLE" {
+
+			ms, _ := strconv.ParseInt(args[i+1], 10, 64)
+			idle = time.Duration(ms) * time.Millisecond
+			i += 2
+		}
+		count, _ := strconv.Atoi(args[i+2])
+
+		ids := make([]fakeID, 0, len(group.pending))
+		for id := range group.pending {
+
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(a, b int) bool { return ids[a].less(ids[b]) })
+
+		replies := []interface{}{}
+		for _, id := range ids {
+
+			p := group.pending[id]
+			d := time.Since(p.delivered)
+			if d < idle || len(replies) >= count {
+
+				continue
+			}
+
+			replies = append(replies, []interface{}{id.String(), p.consumer, int64(d / time.Millisecond), p.count})
+		}
+
+		return replies
+
+	case "XCLAIM":
+
+		group, ok := st.groups[args[1]]
+		if !ok {
+
+			return fakeError("NOGROUP No such key or consumer group")
+		}
+
+		ms, _ := strconv.ParseInt(args[3], 10, 64)
+		minIdle := time.Duration(ms) * time.Millisecond
+
+		replies := []interface{}{}
+		for _, v := range args[4:] {
+
+			id := parseFakeID(v)
+			p, ok := group.pending[id]
+			if !ok || time.Since(p.delivered) < minIdle {
+
+				continue
+			}
+
+			e, ok := st.find(id)
+			if !ok {
+
+				delete(group.pending, id)
+
+				continue
+			}
+
+			p.consumer, p.delivered = args[2], time.Now()
+			p.count++
+			replies = append(replies, e.reply())
+		}
+
+		return replies
+
+	case "XDEL":
+
+		n := 0
+		for _, v := range args[1:] {
+
+			id := parseFakeID(v)
+			for i, e := range st.entries {
+
+				if e.id == id {
+
+					st.entries = append(st.entries[:i], st.entries[i+1:]...)
+					n++
+
+					break
+				}
+			}
+		}
+
+		return n
+
+	case "XLEN":
+
+		return len(st.entries)
+
+	case "XRANGE":
+
+		start, end := parseFakeID(args[1]), parseFakeID(args[2])
+		count := 0
+		if len(args) > 4 {
+
+			count, _ = strconv.Atoi(args[4])
+		}
+
+		replies := []interface{}{}
+		for _, e := range st.entries {
+
+			if e.id.less(start) || end.less(e.id) {
+
+				continue
+			}
+
+			if count > 0 && len(replies) >= count {
+
+				break
+			}
+
+			replies = append(replies, e.reply())
+		}
+
+		return replies
+	}
+
+	return fakeError("ERR unknown command '" + cmd + "'")
+}
@@ -0,0 +1,502 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	defaultMutexExpiry   = time.Duration(8) * time.Second
+	defaultMutexRetry    = time.Duration(50) * time.Millisecond
+	defaultMutexMaxRetry = time.Duration(1) * time.Second
+
+	//mutexDrift 时钟漂移，Redlock的有效时间需要减去
+	mutexDrift = time.Duration(2) * time.Millisecond
+
+	MutexNotHeldErr = errors.New("redis mutex not held")
+	MutexHeldErr    = errors.New("redis mutex already held")
+	MutexFailedErr  = errors.New("redis mutex acquire failed")
+)
+
+// KEYS[1] 锁 KEYS[2] fencing计数器 ARGV[1] 锁的值 ARGV[2] 过期毫秒
+// 加锁成功返回递增的fencing token，失败返回0
+var mutexLockScript = RegisterScript("mutex_lock", 2, `
+if redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2], "NX") then
+	return redis.call("INCR", KEYS[2])
+end
+return 0
+`)
+
+var mutexExtendScript = RegisterScript("mutex_extend", 1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var mutexUnlockScript = RegisterScript("mutex_unlock", 1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Redlock模式下把计数器提高到token，保证之后的token更大
+var mutexFenceScript = RegisterScript("mutex_fence", 1, `
+local n = tonumber(redis.call("GET", KEYS[1]) or "0")
+if n < tonumber(ARGV[1]) then
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+//MutexOptions 分布式锁配置
+type MutexOptions struct {
+	//Expiry 锁的过期时间，默认8秒
+	Expiry time.Duration
+	//Retry 加锁失败后的首次重试间隔，之后指数退避到MaxRetry，默认50毫秒和1秒
+	Retry    time.Duration
+	MaxRetry time.Duration
+	//Tries 最多尝试次数，0时一直重试直到ctx结束
+	Tries int
+	//Renew 看门狗续期间隔，默认Expiry/3，小于0不续期
+	Renew time.Duration
+}
+
+//Mutex 基于redis的分布式锁，持有期间看门狗自动续期
+//每次加锁得到递增的fencing token，写存储时带上token可以拒绝过期持有者的写入
+type Mutex struct {
+	key     string
+	fence   string
+	shards  []*Redis
+	quorum  int
+	options MutexOptions
+
+	mux     sync.Mutex
+	locking bool
+	value   string
+	token   int64
+	stop    chan struct{}
+	lost    chan struct{}
+	done    chan struct{}
+}
+
+//NewMutex 在r上创建分布式锁
+func (r *Redis) NewMutex(key string, options *MutexOptions) *Mutex {
+
+	return newMutex(key, []*Redis{r}, options)
+}
+
+//NewRedlock 在多个redis配置上创建锁，超过半数加锁成功才算持有
+func NewRedlock(names []string, key string, options *MutexOptions) (*Mutex, error) {
+
+	shards := make([]*Redis, 0, len(names))
+	for _, name := range names {
+
+		r, err := UseRedisByKey(name, key)
+		if err != nil {
+
+			return nil, err
+		}
+
+		shards = append(shards, r)
+	}
+
+	return newMutex(key, shards, options), nil
+}
+
+func newMutex(key string, shards []*Redis, options *MutexOptions) *Mutex {
+
+	m := &Mutex{
+		key:    key,
+		fence:  fenceKey(key),
+		shards: shards,
+		quorum: len(shards)/2 + 1,
+	}
+
+	if options != nil {
+
+		m.options = *options
+	}
+
+	if m.options.Expiry <= 0 {
+
+		m.options.Expiry = defaultMutexExpiry
+	}
+
+	if m.options.Retry <= 0 {
+
+		m.options.Retry = defaultMutexRetry
+	}
+
+	if m.options.MaxRetry < m.options.Retry {
+
+		m.options.MaxRetry = defaultMutexMaxRetry
+		if m.options.MaxRetry < m.options.Retry {
+
+			m.options.MaxRetry = m.options.Retry
+		}
+	}
+
+	if m.options.Renew == 0 {
+
+		m.options.Renew = m.options.Expiry / 3
+	}
+
+	return m
+}
+
+//fenceKey fencing计数器和锁在集群的同一个slot
+func fenceKey(key string) string {
+
+	return tagKey(key, "fence")
+}
+
+func (m *Mutex) Key() string {
+
+	return m.key
+}
+
+//Token 当前持有的fencing token
+func (m *Mutex) Token() int64 {
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return m.token
+}
+
+//Lost 看门狗续期失败，锁可能已被其它持有者获得时关闭
+func (m *Mutex) Lost() <-chan struct{} {
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return m.lost
+}
+
+//Lock 阻塞加锁，失败后退避重试，直到成功、ctx结束或超过Tries
+func (m *Mutex) Lock(ctx context.Context) error {
+
+	delay := m.options.Retry
+	for i := 0; m.options.Tries <= 0 || i < m.options.Tries; i++ {
+
+		ok, err := m.TryLock(ctx)
+		if ok || err == MutexHeldErr {
+
+			return err
+		}
+
+		if ctx.Err() != nil {
+
+			return ctx.Err()
+		}
+
+		// 退避加随机抖动，避免多个等待者同时重试
+		wait := delay/2 + time.Duration(mrand.Int63n(int64(delay)))
+		select {
+
+		case <-ctx.Done():
+
+			return ctx.Err()
+
+		case <-time.After(wait):
+
+		}
+
+		delay *= 2
+		if delay > m.options.MaxRetry {
+
+			delay = m.options.MaxRetry
+		}
+	}
+
+	return MutexFailedErr
+}
+
+//TryLock 尝试加锁一次，网络请求期间不持有m.mux，同时的另一次TryLock返回MutexHeldErr
+func (m *Mutex) TryLock(ctx context.Context) (bool, error) {
+
+	m.mux.Lock()
+
+	if m.stop != nil || m.locking {
+
+		m.mux.Unlock()
+
+		return false, MutexHeldErr
+	}
+
+	m.locking = true
+	m.mux.Unlock()
+
+	value, token, err := m.acquire(ctx)
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.locking = false
+	if len(value) == 0 {
+
+		return false, err
+	}
+
+	m.value = value
+	m.token = token
+	m.stop = make(chan struct{})
+	m.lost = make(chan struct{})
+	m.done = make(chan struct{})
+
+	if m.options.Renew > 0 {
+
+		go m.watchdog(m.stop, m.lost, m.done, value)
+	} else {
+
+		close(m.done)
+	}
+
+	return true, nil
+}
+
+//acquire 在所有分片上加锁，失败时返回空的value
+func (m *Mutex) acquire(ctx context.Context) (string, int64, error) {
+
+	value, err := randomValue()
+	if err != nil {
+
+		return "", 0, err
+	}
+
+	start := time.Now()
+	expiry := m.options.Expiry.Nanoseconds() / int64(time.Millisecond)
+
+	var acquired []*Redis
+	var token int64
+	var lastErr error
+	for _, r := range m.shards {
+
+		n, err := redis.Int64(mutexLockScript.DoCtx(ctx, r, m.key, m.fence, value, expiry))
+		if err != nil {
+
+			lastErr = err
+
+			continue
+		}
+
+		if n > 0 {
+
+			acquired = append(acquired, r)
+			if n > token {
+
+				token = n
+			}
+		}
+	}
+
+	// Redlock需要超过半数成功，并且在有效期内完成
+	// 回复超时的分片可能已经加锁成功，失败时在所有分片上释放
+	valid := m.options.Expiry - time.Since(start) - mutexDrift
+	if len(acquired) < m.quorum || valid <= 0 {
+
+		m.release(m.shards, value)
+
+		return "", 0, lastErr
+	}
+
+	// 超过半数的计数器提高到token，之后任意半数分片上加锁得到的token都更大
+	if len(m.shards) > 1 {
+
+		fenced := 0
+		for _, r := range acquired {
+
+			if _, err = mutexFenceScript.DoCtx(ctx, r, m.fence, token); err != nil {
+
+				lastErr = err
+
+				continue
+			}
+
+			fenced++
+		}
+
+		if fenced < m.quorum {
+
+			m.release(m.shards, value)
+
+			return "", 0, lastErr
+		}
+	}
+
+	return value, token, nil
+}
+
+//Extend 延长锁的过期时间，锁已不属于自己时返回MutexNotHeldErr
+func (m *Mutex) Extend(ctx context.Context) error {
+
+	m.mux.Lock()
+	value := m.value
+	m.mux.Unlock()
+
+	if len(value) == 0 {
+
+		return MutexNotHeldErr
+	}
+
+	return m.extend(ctx, value)
+}
+
+func (m *Mutex) extend(ctx context.Context, value string) error {
+
+	expiry := m.options.Expiry.Nanoseconds() / int64(time.Millisecond)
+
+	n := 0
+	var lastErr error
+	for _, r := range m.shards {
+
+		ok, err := redis.Int64(mutexExtendScript.DoCtx(ctx, r, m.key, value, expiry))
+		if err != nil {
+
+			lastErr = err
+
+			continue
+		}
+
+		if ok > 0 {
+
+			n++
+		}
+	}
+
+	if n >= m.quorum {
+
+		return nil
+	}
+
+	if lastErr != nil {
+
+		return lastErr
+	}
+
+	return MutexNotHeldErr
+}
+
+//watchdog 定时续期，确认锁已丢失或者超过有效期都没有续期成功时关闭lost
+func (m *Mutex) watchdog(stop, lost, done chan struct{}, value string) {
+
+	defer close(done)
+
+	ticker := time.NewTicker(m.options.Renew)
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(m.options.Expiry)
+	for {
+
+		select {
+
+		case <-stop:
+
+			return
+
+		case <-ticker.C:
+
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), m.options.Renew)
+		err := m.extend(ctx, value)
+		cancel()
+
+		if err == nil {
+
+			deadline = time.Now().Add(m.options.Expiry)
+
+			continue
+		}
+
+		if err == MutexNotHeldErr || time.Now().After(deadline) {
+
+			close(lost)
+
+			return
+		}
+	}
+}
+
+//Unlock 释放锁并停止看门狗，锁已过期或被其它持有者获得时返回MutexNotHeldErr
+func (m *Mutex) Unlock(ctx context.Context) error {
+
+	m.mux.Lock()
+
+	if m.stop == nil {
+
+		m.mux.Unlock()
+
+		return MutexNotHeldErr
+	}
+
+	value, stop, done := m.value, m.stop, m.done
+	m.value = ""
+	m.stop = nil
+
+	m.mux.Unlock()
+
+	close(stop)
+	<-done
+
+	n := 0
+	var lastErr error
+	for _, r := range m.shards {
+
+		ok, err := redis.Int64(mutexUnlockScript.DoCtx(ctx, r, m.key, value))
+		if err != nil {
+
+			lastErr = err
+
+			continue
+		}
+
+		if ok > 0 {
+
+			n++
+		}
+	}
+
+	if n >= m.quorum {
+
+		return nil
+	}
+
+	if lastErr != nil {
+
+		return lastErr
+	}
+
+	return MutexNotHeldErr
+}
+
+func (m *Mutex) release(shards []*Redis, value string) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	for _, r := range shards {
+
+		_, _ = mutexUnlockScript.DoCtx(ctx, r, m.key, value)
+	}
+}
+
+func randomValue() (string, error) {
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,250 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func init() {
+
+	fakeScript(mutexLockScript, func(s *fakeServer, keys []string, args []string) interface{} {
+
+		if s.call("SET", keys[0], args[0], "PX", args[1], "NX") == nil {
+
+			return 0
+		}
+
+		return s.call("INCR", keys[1])
+	})
+
+	fakeScript(mutexExtendScript, func(s *fakeServer, keys []string, args []string) interface{} {
+
+		if v, _ := s.lookup(keys[0]).([]byte); string(v) == args[0] {
+
+			return s.call("PEXPIRE", keys[0], args[1])
+		}
+
+		return 0
+	})
+
+	fakeScript(mutexUnlockScript, func(s *fakeServer, keys []string, args []string) interface{} {
+
+		if v, _ := s.lookup(keys[0]).([]byte); string(v) == args[0] {
+
+			return s.call("DEL", keys[0])
+		}
+
+		return 0
+	})
+
+	fakeScript(mutexFenceScript, func(s *fakeServer, keys []string, args []string) interface{} {
+
+		v, _ := s.lookup(keys[0]).([]byte)
+		n, _ := strconv.ParseInt(string(v), 10, 64)
+		if m, _ := strconv.ParseInt(args[0], 10, 64); n < m {
+
+			s.call("SET", keys[0], args[0])
+		}
+
+		return 1
+	})
+}
+
+func TestMutex(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	r := newRedis(s.conf("mutex"))
+	defer r.Close()
+
+	options := &MutexOptions{Expiry: time.Duration(300) * time.Millisecond, Retry: time.Duration(10) * time.Millisecond}
+	m1 := r.NewMutex("lock", options)
+	m2 := r.NewMutex("lock", options)
+
+	ctx := context.Background()
+	if err := m1.Lock(ctx); err != nil {
+
+		t.Fatal("Lock:", err)
+	}
+
+	token := m1.Token()
+
+	// 看门狗续期，超过Expiry后锁仍然有效
+	time.Sleep(time.Duration(700) * time.Millisecond)
+
+	if ok, err := m2.TryLock(ctx); ok || err != nil {
+
+		t.Fatal("TryLock while held:", ok, err)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, time.Duration(100)*time.Millisecond)
+	defer cancel()
+
+	if err := m2.Lock(tctx); err != context.DeadlineExceeded {
+
+		t.Fatal("Lock timeout:", err)
+	}
+
+	if err := m1.Unlock(ctx); err != nil {
+
+		t.Fatal("Unlock:", err)
+	}
+
+	if err := m1.Unlock(ctx); err != MutexNotHeldErr {
+
+		t.Error("Unlock twice:", err)
+	}
+
+	if err := m2.Lock(ctx); err != nil {
+
+		t.Fatal("Lock after unlock:", err)
+	}
+
+	if m2.Token() <= token {
+
+		t.Error("fencing token not increasing:", token, m2.Token())
+	}
+
+	// 锁被删除后看门狗通知丢失
+	s.mux.Lock()
+	s.del("lock")
+	s.mux.Unlock()
+
+	select {
+
+	case <-m2.Lost():
+
+	case <-time.After(time.Second):
+
+		t.Fatal("Lost not closed")
+	}
+
+	if err := m2.Unlock(ctx); err != MutexNotHeldErr {
+
+		t.Error("Unlock lost:", err)
+	}
+}
+
+func TestRedlock(t *testing.T) {
+
+	servers := []*fakeServer{newFakeServer(t), newFakeServer(t), newFakeServer(t)}
+	for _, s := range servers {
+
+		defer s.close()
+	}
+
+	names := []string{"redlock1", "redlock2", "redlock3"}
+	for i, s := range servers {
+
+		useFakeRedis(names[i], s)
+	}
+
+	// 关闭一个节点，超过半数仍然可以加锁
+	servers[2].close()
+
+	options := &MutexOptions{Expiry: time.Second, Tries: 3, Retry: time.Duration(10) * time.Millisecond}
+	m, err := NewRedlock(names, "redlock", options)
+	if err != nil {
+
+		t.Fatal("NewRedlock:", err)
+	}
+
+	ctx := context.Background()
+	if err = m.Lock(ctx); err != nil {
+
+		t.Fatal("Lock:", err)
+	}
+
+	token := m.Token()
+	if err = m.Unlock(ctx); err != nil {
+
+		t.Fatal("Unlock:", err)
+	}
+
+	// 计数器只在一个节点上增加，token仍然递增
+	servers[1].mux.Lock()
+	servers[1].data["{redlock}:fence"] = []byte("100")
+	servers[1].mux.Unlock()
+
+	if err = m.Lock(ctx); err != nil {
+
+		t.Fatal("Lock again:", err)
+	}
+
+	if m.Token() != 101 {
+
+		t.Error("Token:", token, m.Token())
+	}
+
+	_ = m.Unlock(ctx)
+
+	servers[0].mux.Lock()
+	servers[0].data["redlock"] = []byte("other")
+	servers[0].mux.Unlock()
+
+	if err = m.Lock(ctx); err != MutexFailedErr {
+
+		t.Error("Lock without quorum:", err)
+	}
+}
+
+func TestRedlock_Release(t *testing.T) {
+
+	servers := []*fakeServer{newFakeServer(t), newFakeServer(t), newFakeServer(t)}
+	for _, s := range servers {
+
+		defer s.close()
+	}
+
+	names := []string{"release1", "release2", "release3"}
+	for i, s := range servers {
+
+		useFakeRedis(names[i], s)
+	}
+
+	m, err := NewRedlock(names, "release", &MutexOptions{Expiry: time.Second})
+	if err != nil {
+
+		t.Fatal("NewRedlock:", err)
+	}
+
+	// 第一个节点加锁成功但回复超时，第二个节点被其它持有者占用
+	servers[0].mux.Lock()
+	servers[0].delay = time.Duration(100) * time.Millisecond
+	servers[0].loaded[mutexLockScript.Hash()] = true
+	servers[0].mux.Unlock()
+
+	servers[1].mux.Lock()
+	servers[1].data["release"] = []byte("other")
+	servers[1].mux.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(50)*time.Millisecond)
+	defer cancel()
+
+	if ok, err := m.TryLock(ctx); ok || err == nil {
+
+		t.Fatal("TryLock:", ok, err)
+	}
+
+	// 加锁失败后在所有节点上释放，包括回复超时的节点
+	for i, s := range servers {
+
+		s.mux.Lock()
+		v, _ := s.data["release"].([]byte)
+		s.mux.Unlock()
+
+		want := ""
+		if i == 1 {
+
+			want = "other"
+		}
+
+		if string(v) != want {
+
+			t.Fatal("released:", i, string(v))
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package redis
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	//PubSubPing 订阅连接的心跳间隔，两个间隔内没有收到数据认为连接断开
+	PubSubPing = time.Duration(30) * time.Second
+	//PubSubRetry 订阅连接断开后的重连间隔
+	PubSubRetry = time.Duration(1) * time.Second
+
+	PubSubClosedErr = errors.New("redis pubsub closed")
+)
+
+//PubSub 常驻的订阅连接，可以随时增加和退订频道，断线后自动重连并重新订阅
+type PubSub struct {
+	r       *Redis
+	handler func(channel string, data []byte)
+
+	mux      sync.Mutex
+	channels map[string]bool
+	psc      *redis.PubSubConn
+	closed   bool
+	wake     chan struct{}
+	done     chan struct{}
+}
+
+//NewPubSub 创建订阅，收到的消息在同一个协程中按顺序回调handler
+func (r *Redis) NewPubSub(handler func(channel string, data []byte)) *PubSub {
+
+	ps := &PubSub{
+		r:        r,
+		handler:  handler,
+		channels: make(map[string]bool),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	go ps.run()
+
+	return ps
+}
+
+//Subscribe 增加订阅的频道
+func (ps *PubSub) Subscribe(channels ...string) error {
+
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+
+	if ps.closed {
+
+		return PubSubClosedErr
+	}
+
+	args := make([]interface{}, 0, len(channels))
+	for _, channel := range channels {
+
+		if !ps.channels[channel] {
+
+			ps.channels[channel] = true
+			args = append(args, channel)
+		}
+	}
+
+	if len(args) == 0 {
+
+		return nil
+	}
+
+	if ps.psc == nil {
+
+		ps.notify()
+
+		return nil
+	}
+
+	// 发送失败时连接会在读取时出错，重连后重新订阅
+	_ = ps.psc.Subscribe(args...)
+
+	return nil
+}
+
+//Unsubscribe 退订频道
+func (ps *PubSub) Unsubscribe(channels ...string) error {
+
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+
+	if ps.closed {
+
+		return PubSubClosedErr
+	}
+
+	args := make([]interface{}, 0, len(channels))
+	for _, channel := range channels {
+
+		if ps.channels[channel] {
+
+			delete(ps.channels, channel)
+			args = append(args, channel)
+		}
+	}
+
+	if len(args) > 0 && ps.psc != nil {
+
+		_ = ps.psc.Unsubscribe(args...)
+	}
+
+	return nil
+}
+
+//Channels 当前订阅的频道
+func (ps *PubSub) Channels() []string {
+
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+
+	channels := make([]string, 0, len(ps.channels))
+	for channel := range ps.channels {
+
+		channels = append(channels, channel)
+	}
+
+	return channels
+}
+
+//Close 退订全部频道并等待接收协程退出
+func (ps *PubSub) Close() error {
+
+	ps.mux.Lock()
+
+	if ps.closed {
+
+		ps.mux.Unlock()
+
+		return nil
+	}
+
+	ps.closed = true
+	if ps.psc != nil {
+
+		_ = ps.psc.Unsubscribe()
+	}
+	ps.notify()
+
+	ps.mux.Unlock()
+
+	<-ps.done
+
+	return nil
+}
+
+func (ps *PubSub) notify() {
+
+	select {
+
+	case ps.wake <- struct{}{}:
+
+	default:
+
+	}
+}
+
+func (ps *PubSub) run() {
+
+	defer close(ps.done)
+
+	for {
+
+		if !ps.wait() {
+
+			return
+		}
+
+		err := ps.receive()
+		if err == nil {
+
+			continue
+		}
+
+		log.Printf("[error] pubsub err=%s", err.Error())
+
+		select {
+
+		case <-ps.wake:
+
+			// 重连前检查是否已关闭
+			ps.notify()
+
+		case <-time.After(PubSubRetry):
+
+		}
+	}
+}
+
+//wait 等待有频道需要订阅，关闭时返回false
+func (ps *PubSub) wait() bool {
+
+	for {
+
+		ps.mux.Lock()
+		closed, n := ps.closed, len(ps.channels)
+		ps.mux.Unlock()
+
+		if closed {
+
+			return false
+		}
+
+		if n > 0 {
+
+			return true
+		}
+
+		<-ps.wake
+	}
+}
+
+//receive 建立连接并订阅全部频道，频道全部退订时返回nil
+func (ps *PubSub) receive() error {
+
+	ctx, cancel := withTimeout()
+	conn, err := ps.r.getContext(ctx)
+	cancel()
+
+	if err != nil {
+
+		return err
+	}
+
+	psc := &redis.PubSubConn{Conn: conn}
+
+	ps.mux.Lock()
+
+	if ps.closed {
+
+		ps.mux.Unlock()
+		_ = conn.Close()
+
+		return nil
+	}
+
+	args := make([]interface{}, 0, len(ps.channels))
+	for channel := range ps.channels {
+
+		args = append(args, channel)
+	}
+
+	if err = psc.Subscribe(args...); err != nil {
+
+		ps.mux.Unlock()
+		_ = conn.Close()
+
+		return err
+	}
+	ps.psc = psc
+
+	ps.mux.Unlock()
+
+	stop := make(chan struct{})
+	go ps.ping(psc, stop)
+
+	defer func() {
+
+		close(stop)
+
+		ps.mux.Lock()
+		ps.psc = nil
+		ps.mux.Unlock()
+
+		_ = conn.Close()
+	}()
+
+	for {
+
+		switch v := psc.ReceiveWithTimeout(2 * PubSubPing).(type) {
+
+		case redis.Message:
+
+			ps.handler(v.Channel, v.Data)
+
+		case redis.Subscription:
+
+			if v.Count > 0 {
+
+				continue
+			}
+
+			// 全部退订后释放连接，之后又有订阅时重新连接
+			ps.mux.Lock()
+			idle := ps.closed || len(ps.channels) == 0
+			ps.mux.Unlock()
+
+			if idle {
+
+				return nil
+			}
+
+		case error:
+
+			return v
+		}
+	}
+}
+
+func (ps *PubSub) ping(psc *redis.PubSubConn, stop chan struct{}) {
+
+	ticker := time.NewTicker(PubSubPing)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+
+		case <-stop:
+
+			return
+
+		case <-ticker.C:
+
+			ps.mux.Lock()
+			_ = psc.Ping("")
+			ps.mux.Unlock()
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package redis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPubSub(t *testing.T) {
+
+	retry := PubSubRetry
+	PubSubRetry = time.Duration(50) * time.Millisecond
+	defer func() { PubSubRetry = retry }()
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	r := newRedis(s.conf("pubsub"))
+	defer r.Close()
+
+	received := make(chan string, 10)
+	ps := r.NewPubSub(func(channel string, data []byte) {
+
+		received <- channel + ":" + string(data)
+	})
+
+	expect := func(want string) {
+
+		t.Helper()
+
+		select {
+
+		case got := <-received:
+
+			if got != want {
+
+				t.Fatal("received:", got, "want", want)
+			}
+
+		case <-time.After(time.Second):
+
+			t.Fatal("timeout waiting", want)
+		}
+	}
+
+	// 等待订阅生效后发布
+	publish := func(channel string, msg string) {
+
+		t.Helper()
+
+		for i := 0; i < 100; i++ {
+
+			s.mux.Lock()
+			n := 0
+			for c := range s.conns {
+
+				if c.subs[channel] {
+
+					n++
+				}
+			}
+			s.mux.Unlock()
+
+			if n > 0 {
+
+				s.publish(channel, msg)
+
+				return
+			}
+
+			time.Sleep(time.Duration(10) * time.Millisecond)
+		}
+
+		t.Fatal("not subscribed", channel)
+	}
+
+	if err := ps.Subscribe("a", "b"); err != nil {
+
+		t.Fatal("Subscribe:", err)
+	}
+
+	publish("a", "1")
+	expect("a:1")
+
+	publish("b", "2")
+	expect("b:2")
+
+	_ = ps.Unsubscribe("b")
+	_ = ps.Subscribe("c")
+
+	publish("c", "3")
+	expect("c:3")
+
+	// 断线后重新订阅
+	s.drop()
+
+	publish("a", "4")
+	expect("a:4")
+
+	if len(ps.Channels()) != 2 {
+
+		t.Error("Channels:", ps.Channels())
+	}
+
+	if err := ps.Close(); err != nil {
+
+		t.Error("Close:", err)
+	}
+
+	if err := ps.Subscribe("d"); err != PubSubClosedErr {
+
+		t.Error("Subscribe after close:", err)
+	}
+}
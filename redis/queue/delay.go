@@ -0,0 +1,180 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/laonsx/gamelib/g"
+	"github.com/laonsx/gamelib/redis"
+)
+
+//DelayBatch 每次最多转移的到期任务数
+var DelayBatch = 100
+
+// KEYS[1] 延迟zset KEYS[2] 任务数据hash KEYS[3] stream
+// ARGV[1] 当前毫秒 ARGV[2] 最多转移数量 ARGV[3] stream最大长度
+var moveScript = redis.RegisterScript("queue_delay_move", 3, `
+local jobs = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+for _, job in ipairs(jobs) do
+	local data = redis.call("HGET", KEYS[2], job)
+	if data then
+		if tonumber(ARGV[3]) > 0 then
+			redis.call("XADD", KEYS[3], "MAXLEN", "~", ARGV[3], "*", "data", data, "job", job)
+		else
+			redis.call("XADD", KEYS[3], "*", "data", data, "job", job)
+		end
+	end
+	redis.call("ZREM", KEYS[1], job)
+	redis.call("HDEL", KEYS[2], job)
+end
+return #jobs
+`)
+
+var delayScript = redis.RegisterScript("queue_delay_push", 2, `
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[3])
+return redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+`)
+
+var cancelScript = redis.RegisterScript("queue_delay_cancel", 2, `
+redis.call("HDEL", KEYS[2], ARGV[1])
+return redis.call("ZREM", KEYS[1], ARGV[1])
+`)
+
+// 任务不存在或已转移到stream时返回0
+var rescheduleScript = redis.RegisterScript("queue_delay_reschedule", 1, `
+if redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+//delayKey 按到期毫秒排序的任务id
+func delayKey(id string) string {
+
+	return "queue:{" + id + "}:delay"
+}
+
+//jobKey 任务id到数据
+func jobKey(id string) string {
+
+	return "queue:{" + id + "}:jobs"
+}
+
+func millis(t time.Time) int64 {
+
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+//QPushDelay 添加延迟任务，at之后进入队列，返回任务id
+func QPushDelay(id string, v []byte, at time.Time) (string, error) {
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+
+		return "", err
+	}
+
+	jobID := hex.EncodeToString(b)
+
+	return jobID, QPushDelayJob(id, jobID, v, at)
+}
+
+//QPushDelayJob 使用指定的任务id添加延迟任务，id已存在时覆盖数据和时间
+//业务可以用"building:10001"这样的id，不需要保存返回值就能取消
+func QPushDelayJob(id string, jobID string, v []byte, at time.Time) error {
+
+	r, err := useRedis(id, getOptions(id))
+	if err != nil {
+
+		return err
+	}
+
+	_, err = delayScript.Do(r, delayKey(id), jobKey(id), jobID, millis(at), v)
+
+	return err
+}
+
+//QCancel 取消未到期的任务，任务不存在或已进入队列返回false
+func QCancel(id string, jobID string) (bool, error) {
+
+	r, err := useRedis(id, getOptions(id))
+	if err != nil {
+
+		return false, err
+	}
+
+	n, err := redis.ToInt64(cancelScript.Do(r, delayKey(id), jobKey(id), jobID))
+
+	return n > 0, err
+}
+
+//QReschedule 修改未到期任务的时间，任务不存在或已进入队列返回false
+func QReschedule(id string, jobID string, at time.Time) (bool, error) {
+
+	r, err := useRedis(id, getOptions(id))
+	if err != nil {
+
+		return false, err
+	}
+
+	n, err := redis.ToInt64(rescheduleScript.Do(r, delayKey(id), jobID, millis(at)))
+
+	return n > 0, err
+}
+
+//QDelayAt 任务的到期时间
+func QDelayAt(id string, jobID string) (time.Time, bool, error) {
+
+	r, err := useRedis(id, getOptions(id))
+	if err != nil {
+
+		return time.Time{}, false, err
+	}
+
+	ms, err := r.Zscore(delayKey(id), jobID)
+	if err != nil || ms == 0 {
+
+		return time.Time{}, false, err
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond)), true, nil
+}
+
+//move 定时把到期的任务转移到stream，多个进程同时执行也只会转移一次
+func (c *consumer) move() {
+
+	ticker := time.NewTicker(c.options.DelayInterval)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+
+		case <-g.Quit():
+
+			return
+
+		case <-ticker.C:
+
+		}
+
+		for {
+
+			n, err := redis.ToInt64(moveScript.Do(c.conn(), delayKey(c.id), jobKey(c.id), c.key, millis(time.Now()), DelayBatch, c.options.MaxLen))
+			if err != nil {
+
+				log.Printf("queue[%s] move delayed err=%s", c.id, err.Error())
+
+				break
+			}
+
+			if n < int64(DelayBatch) {
+
+				break
+			}
+		}
+	}
+}
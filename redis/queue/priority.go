@@ -0,0 +1,334 @@
+package queue
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/laonsx/gamelib/g"
+	"github.com/laonsx/gamelib/redis"
+)
+
+// KEYS[1] 原优先级list KEYS[2] 失败次数hash KEYS[3] 死信list
+// ARGV[1] 数据摘要 ARGV[2] 数据 ARGV[3] 最多投递次数
+// 失败次数达到上限时移到死信返回1，否则放回队首返回0
+var priorityFailScript = redis.RegisterScript("queue_priority_fail", 3, `
+local n = redis.call("HINCRBY", KEYS[2], ARGV[1], 1)
+if n >= tonumber(ARGV[3]) then
+	redis.call("HDEL", KEYS[2], ARGV[1])
+	redis.call("RPUSH", KEYS[3], ARGV[2])
+	return 1
+end
+redis.call("LPUSH", KEYS[1], ARGV[2])
+return 0
+`)
+
+var priorityAckScript = redis.RegisterScript("queue_priority_ack", 1, `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HDEL", KEYS[1], unpack(ARGV))
+end
+return 0
+`)
+
+//priorityKey 每个优先级一个list，level越小越先处理
+func priorityKey(id string, level int) string {
+
+	return "queue:{" + id + "}:p" + strconv.Itoa(level)
+}
+
+//priorityRetryKey 处理失败的次数，field为数据的sha1
+func priorityRetryKey(id string) string {
+
+	return "queue:{" + id + "}:pretry"
+}
+
+//priorityDeadKey 优先级队列的死信list
+func priorityDeadKey(id string) string {
+
+	return "queue:{" + id + "}:pdead"
+}
+
+func digest(v []byte) string {
+
+	h := sha1.Sum(v)
+
+	return hex.EncodeToString(h[:])
+}
+
+//QPushPriority 按优先级添加数据，level范围[0, Levels)，超出范围时取边界
+func QPushPriority(id string, level int, v []byte) error {
+
+	options := getOptions(id)
+	r, err := useRedis(id, options)
+	if err != nil {
+
+		return err
+	}
+
+	return r.Rpush(priorityKey(id, clampLevel(level, options.Levels)), v)
+}
+
+func clampLevel(level int, levels int) int {
+
+	if level < 0 {
+
+		return 0
+	}
+
+	if level >= levels {
+
+		return levels - 1
+	}
+
+	return level
+}
+
+//PriorityDeadLetters 读取优先级队列的死信，最多count条
+func PriorityDeadLetters(id string, count int) ([][]byte, error) {
+
+	r, err := useRedis(id, getOptions(id))
+	if err != nil {
+
+		return nil, err
+	}
+
+	values, err := r.Lrange(priorityDeadKey(id), 0, count-1)
+	if err != nil {
+
+		return nil, err
+	}
+
+	data := make([][]byte, 0, len(values))
+	for _, v := range values {
+
+		b, _ := v.([]byte)
+		data = append(data, b)
+	}
+
+	return data, nil
+}
+
+//RegisterPriorityHandler 注册优先级队列的批量处理方法，高优先级为空时才处理低优先级
+//使用BLPOP阻塞等待，处理失败的数据放回原优先级的队首，进程崩溃时正在处理的数据会丢失
+//批量处理失败后逐条重试，单条处理失败才计入失败次数
+//同样内容的数据失败次数达到MaxDeliveries后移到死信list，不再阻塞该优先级
+func RegisterPriorityHandler(id string, handler BatchHandler) {
+
+	options := getOptions(id)
+	r, err := useRedis(id, options)
+	if err != nil {
+
+		log.Panicf("redis [%s] err=%s", options.Redis, err.Error())
+	}
+
+	p := &priorityConsumer{
+		id:      id,
+		options: options,
+		handler: handler,
+		keys:    make([]string, options.Levels),
+		r:       r,
+	}
+
+	for i := range p.keys {
+
+		p.keys[i] = priorityKey(id, i)
+	}
+
+	log.Printf("queue[%s] priority starting", id)
+
+	for i := 0; i < options.Concurrency; i++ {
+
+		g.Go(p.work)
+	}
+}
+
+type priorityConsumer struct {
+	id      string
+	options *Options
+	handler BatchHandler
+	keys    []string
+	r       *redis.Redis
+}
+
+func (p *priorityConsumer) work() {
+
+	for {
+
+		select {
+
+		case <-g.Quit():
+
+			return
+
+		default:
+
+		}
+
+		key, v, err := p.r.Blpop(p.options.Block, p.keys...)
+		if err != nil {
+
+			log.Printf("queue[%s] blpop err=%s", p.id, err.Error())
+
+			select {
+
+			case <-g.Quit():
+
+				return
+
+			case <-time.After(time.Duration(1) * time.Second):
+
+			}
+
+			continue
+		}
+
+		if len(key) == 0 {
+
+			continue
+		}
+
+		keys, data := p.fill([]string{key}, [][]byte{v})
+		if err = call(p.handler, data); err == nil {
+
+			p.ack(data)
+
+			continue
+		}
+
+		log.Printf("queue[%s] priority err=%s", p.id, err.Error())
+
+		if len(data) > 1 {
+
+			keys, data = p.retry(keys, data)
+			if len(data) == 0 {
+
+				continue
+			}
+		}
+
+		p.requeue(keys, data)
+
+		select {
+
+		case <-g.Quit():
+
+			return
+
+		case <-time.After(time.Duration(1) * time.Second):
+
+		}
+	}
+}
+
+//retry 批量处理失败后逐条重试，返回单独处理仍然失败的数据
+//只有单条失败才计入失败次数，一条坏数据不会让同批的数据进入死信
+func (p *priorityConsumer) retry(keys []string, data [][]byte) ([]string, [][]byte) {
+
+	var okData, failData [][]byte
+	var failKeys []string
+	for i, v := range data {
+
+		if err := call(p.handler, [][]byte{v}); err != nil {
+
+			log.Printf("queue[%s] priority retry err=%s", p.id, err.Error())
+
+			failKeys = append(failKeys, keys[i])
+			failData = append(failData, v)
+
+			continue
+		}
+
+		okData = append(okData, v)
+	}
+
+	if len(okData) > 0 {
+
+		p.ack(okData)
+	}
+
+	return failKeys, failData
+}
+
+//fill 按优先级从高到低补满一批
+func (p *priorityConsumer) fill(keys []string, data [][]byte) ([]string, [][]byte) {
+
+	for _, key := range p.keys {
+
+		n := p.options.Batch - len(data)
+		if n <= 0 {
+
+			break
+		}
+
+		values, err := p.r.LpopCount(key, n)
+		if err != nil {
+
+			log.Printf("queue[%s] lpop err=%s", p.id, err.Error())
+
+			break
+		}
+
+		for _, v := range values {
+
+			keys = append(keys, key)
+			data = append(data, v)
+		}
+	}
+
+	return keys, data
+}
+
+//requeue 倒序放回队首，保持原来的顺序，失败次数达到上限的移到死信
+func (p *priorityConsumer) requeue(keys []string, data [][]byte) {
+
+	retry, dead := priorityRetryKey(p.id), priorityDeadKey(p.id)
+	for i := len(data) - 1; i >= 0; i-- {
+
+		for {
+
+			buried, err := redis.ToInt64(priorityFailScript.Do(p.r, keys[i], retry, dead, digest(data[i]), data[i], p.options.MaxDeliveries))
+			if err == nil {
+
+				if buried > 0 {
+
+					log.Printf("queue[%s] priority message moved to dead letter after %d deliveries", p.id, p.options.MaxDeliveries)
+				}
+
+				break
+			}
+
+			log.Printf("queue[%s] requeue err=%s", p.id, err.Error())
+
+			// 已经LPOP出来的数据只在内存中，放回成功之前一直重试
+			select {
+
+			case <-g.Quit():
+
+				log.Printf("queue[%s] requeue abandoned %d messages", p.id, i+1)
+
+				return
+
+			case <-time.After(time.Duration(1) * time.Second):
+
+			}
+		}
+	}
+}
+
+//ack 处理成功后清除失败次数
+func (p *priorityConsumer) ack(data [][]byte) {
+
+	args := make([]interface{}, 0, len(data)+1)
+	args = append(args, priorityRetryKey(p.id))
+	for _, v := range data {
+
+		args = append(args, digest(v))
+	}
+
+	if _, err := priorityAckScript.Do(p.r, args...); err != nil {
+
+		log.Printf("queue[%s] priority ack err=%s", p.id, err.Error())
+	}
+}
@@ -1,82 +1,548 @@
 package queue
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"log"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/laonsx/gamelib/g"
 	"github.com/laonsx/gamelib/redis"
 )
 
-//RegisterQueueHandler 注册一个队列处理方法
+const group = "queue"
+
+var (
+	mux      sync.RWMutex
+	settings = make(map[string]*Options)
+
+	consumerName = newConsumerName()
+)
+
+//Handler 队列处理方法，返回错误或panic时消息不确认，ClaimIdle后重新投递
+type Handler func(data []byte) error
+
+//BatchHandler 批量处理方法，每次最多Options.Batch条，返回错误时整批重新投递
+type BatchHandler func(data [][]byte) error
+
+//Options 队列配置
+type Options struct {
+	//Redis 使用的redis配置名，默认queue
+	Redis string
+	//Concurrency 每个处理方法的并发数，默认1
+	Concurrency int
+	//MaxDeliveries 投递次数达到后移到死信stream，优先级队列移到死信list，默认5
+	MaxDeliveries int64
+	//Block 阻塞读的等待时间，也是退出时的最长等待，默认2秒
+	Block time.Duration
+	//ClaimIdle 未确认超过该时间的消息被重新投递，包括崩溃的消费者持有的消息，默认30秒
+	//重新投递使用XPENDING IDLE，需要redis 6.2
+	ClaimIdle time.Duration
+	//MaxLen stream近似最大长度，0不限制
+	MaxLen int64
+	//DelayInterval 检查延迟任务到期的间隔，默认1秒
+	DelayInterval time.Duration
+	//Batch 批量处理方法每次最多处理的数量，默认1
+	Batch int
+	//Levels 优先级队列的级数，默认3
+	Levels int
+}
+
+func (o *Options) withDefault() *Options {
+
+	options := *o
+	if len(options.Redis) == 0 {
+
+		options.Redis = "queue"
+	}
+
+	if options.Concurrency <= 0 {
+
+		options.Concurrency = 1
+	}
+
+	if options.MaxDeliveries <= 0 {
+
+		options.MaxDeliveries = 5
+	}
+
+	if options.Block <= 0 {
+
+		options.Block = time.Duration(2) * time.Second
+	}
+
+	if options.ClaimIdle <= 0 {
+
+		options.ClaimIdle = time.Duration(30) * time.Second
+	}
+
+	if options.DelayInterval <= 0 {
+
+		options.DelayInterval = time.Duration(1) * time.Second
+	}
+
+	if options.Batch <= 0 {
+
+		options.Batch = 1
+	}
+
+	if options.Levels <= 0 {
+
+		options.Levels = 3
+	}
+
+	return &options
+}
+
+//Configure 设置队列配置，需要在QPush和RegisterQueueHandler之前调用
+func Configure(id string, options *Options) {
+
+	mux.Lock()
+	defer mux.Unlock()
+
+	settings[id] = options.withDefault()
+}
+
+func getOptions(id string) *Options {
+
+	mux.RLock()
+	options, ok := settings[id]
+	mux.RUnlock()
+
+	if !ok {
+
+		options = new(Options).withDefault()
+	}
+
+	return options
+}
+
+//streamKey 同一个队列的key使用相同的hash tag，集群模式下在同一个slot
+func streamKey(id string) string {
+
+	return "queue:{" + id + "}"
+}
+
+//deadKey 死信stream
+func deadKey(id string) string {
+
+	return "queue:{" + id + "}:dead"
+}
+
+func useRedis(id string, options *Options) (*redis.Redis, error) {
+
+	return redis.UseRedisByKey(options.Redis, streamKey(id))
+}
+
+//RegisterQueueHandler 注册一个队列处理方法，handler正常返回后确认消息
 func RegisterQueueHandler(id string, handler func([]byte)) {
 
-	qstart(id, handler)
+	RegisterHandler(id, func(data []byte) error {
+
+		handler(data)
+
+		return nil
+	})
+}
+
+//RegisterHandler 注册一个队列处理方法，返回错误时消息稍后重试
+func RegisterHandler(id string, handler Handler) {
+
+	qstart(id, 1, func(data [][]byte) error {
+
+		return handler(data[0])
+	})
+}
+
+//RegisterBatchHandler 注册一个批量处理方法，适合日志入库、发送邮件等批量写入
+func RegisterBatchHandler(id string, handler BatchHandler) {
+
+	qstart(id, getOptions(id).Batch, handler)
 }
 
 //QPush 添加数据到队列
 func QPush(id string, v []byte) error {
 
-	r, err := redis.UseRedisByName("queue")
+	options := getOptions(id)
+	r, err := useRedis(id, options)
 	if err != nil {
 
 		return err
 	}
 
-	key := "queue-" + id
-	err = r.Rpush(key, v)
+	_, err = r.Xadd(streamKey(id), options.MaxLen, "data", v)
 
 	return err
 }
 
-func qstart(id string, callback func([]byte)) {
+//DeadLetters 读取死信，每条消息的data为原始数据，id为原消息id，deliveries为投递次数
+func DeadLetters(id string, count int) ([]redis.StreamMessage, error) {
 
-	r, err := redis.UseRedisByName("queue")
+	r, err := useRedis(id, getOptions(id))
 	if err != nil {
 
-		log.Panicf("redis [queue] err=%s", err.Error())
+		return nil, err
 	}
 
-	key := "queue-" + id
+	return r.Xrange(deadKey(id), "-", "+", count)
+}
+
+type consumer struct {
+	id       string
+	key      string
+	options  *Options
+	batch    int
+	handler  BatchHandler
+	messages chan []redis.StreamMessage
+
+	mux      sync.Mutex
+	r        *redis.Redis
+	inflight map[string]struct{}
+}
+
+func qstart(id string, batch int, handler BatchHandler) {
+
+	options := getOptions(id)
+	r, err := useRedis(id, options)
+	if err != nil {
+
+		log.Panicf("redis [%s] err=%s", options.Redis, err.Error())
+	}
+
+	c := &consumer{
+		id:       id,
+		key:      streamKey(id),
+		options:  options,
+		batch:    batch,
+		handler:  handler,
+		messages: make(chan []redis.StreamMessage),
+		r:        r,
+		inflight: make(map[string]struct{}),
+	}
+
+	// 创建失败时在读取出错后重试
+	if err = r.XgroupCreate(c.key, group, "0"); err != nil {
+
+		log.Printf("queue[%s] create group err=%s", id, err.Error())
+	}
+
+	c.migrate()
 
 	log.Printf("queue[%s] starting", id)
 
-	g.Go(func() {
+	g.Go(c.read)
+	g.Go(c.reclaim)
+	g.Go(c.move)
+
+	for i := 0; i < options.Concurrency; i++ {
+
+		g.Go(c.work)
+	}
+}
+
+func (c *consumer) conn() *redis.Redis {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.r
+}
+
+//track 记录本进程已读取还没处理完的消息，处理时间超过ClaimIdle时不会被自己重复接管
+func (c *consumer) track(messages []redis.StreamMessage) {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for _, m := range messages {
+
+		c.inflight[m.ID] = struct{}{}
+	}
+}
+
+func (c *consumer) untrack(ids []string) {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for _, id := range ids {
+
+		delete(c.inflight, id)
+	}
+}
+
+func (c *consumer) tracked(id string) bool {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
 
-		defer log.Printf("queue[%s] exiting", id)
+	_, ok := c.inflight[id]
 
-		for {
+	return ok
+}
+
+//retry 出错后等待一秒并重新获取连接，退出时返回false
+func (c *consumer) retry(err error) bool {
+
+	log.Printf("queue[%s] err=%s", c.id, err.Error())
+
+	select {
+
+	case <-g.Quit():
+
+		return false
+
+	case <-time.After(time.Duration(1) * time.Second):
+
+	}
+
+	r, err := useRedis(c.id, c.options)
+	if err != nil {
+
+		log.Println("redis queue connection refused")
+
+		return true
+	}
 
-			select {
+	c.mux.Lock()
+	c.r = r
+	c.mux.Unlock()
 
-			case <-g.Quit():
+	// redis重启或key被删除后消费组不存在
+	_ = r.XgroupCreate(c.key, group, "0")
+
+	return true
+}
+
+//migrate 把旧版本list队列中剩余的数据转移到stream
+func (c *consumer) migrate() {
+
+	legacy := "queue-" + c.id
+	for {
+
+		var v []byte
+		if err := c.r.Lpop(legacy, &v); err != nil || len(v) == 0 {
+
+			return
+		}
+
+		if _, err := c.r.Xadd(c.key, c.options.MaxLen, "data", v); err != nil {
+
+			log.Printf("queue[%s] migrate err=%s", c.id, err.Error())
+
+			_ = c.r.Lpush(legacy, v)
+
+			return
+		}
+	}
+}
+
+func (c *consumer) read() {
+
+	defer log.Printf("queue[%s] exiting", c.id)
+
+	for {
+
+		select {
+
+		case <-g.Quit():
+
+			return
+
+		default:
+
+		}
+
+		messages, err := c.conn().XreadGroup(group, consumerName, c.key, c.options.Concurrency*c.batch, c.options.Block)
+		if err != nil {
+
+			if !c.retry(err) {
+
+				return
+			}
+
+			continue
+		}
+
+		for len(messages) > 0 {
+
+			n := c.batch
+			if n > len(messages) {
+
+				n = len(messages)
+			}
+
+			if !c.dispatch(messages[:n]) {
+
+				return
+			}
+			messages = messages[n:]
+		}
+	}
+}
+
+//dispatch 交给处理协程，退出时未处理的消息保持未确认，之后被其它消费者接管
+func (c *consumer) dispatch(m []redis.StreamMessage) bool {
+
+	c.track(m)
+
+	select {
+
+	case <-g.Quit():
+
+		return false
+
+	case c.messages <- m:
+
+		return true
+	}
+}
+
+//reclaim 接管空闲超过ClaimIdle的消息，投递次数达到MaxDeliveries的移到死信
+//本进程正在等待或处理的消息跳过，处理失败后才能重新接管
+func (c *consumer) reclaim() {
+
+	ticker := time.NewTicker(c.options.ClaimIdle / 2)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+
+		case <-g.Quit():
+
+			return
+
+		case <-ticker.C:
+
+		}
+
+		r := c.conn()
+		pending, err := r.Xpending(c.key, group, c.options.ClaimIdle, 100)
+		if err != nil {
+
+			log.Printf("queue[%s] pending err=%s", c.id, err.Error())
+
+			continue
+		}
+
+		for _, p := range pending {
+
+			if p.Consumer == consumerName && c.tracked(p.ID) {
+
+				continue
+			}
+
+			claimed, err := r.Xclaim(c.key, group, consumerName, c.options.ClaimIdle, p.ID)
+			if err != nil {
+
+				log.Printf("queue[%s] claim err=%s", c.id, err.Error())
+
+				break
+			}
+
+			if len(claimed) == 0 {
+
+				continue
+			}
+
+			if p.Deliveries >= c.options.MaxDeliveries {
+
+				c.bury(r, claimed[0], p)
+
+				continue
+			}
+
+			if !c.dispatch(claimed) {
 
 				return
+			}
+		}
+	}
+}
+
+func (c *consumer) bury(r *redis.Redis, m redis.StreamMessage, p redis.PendingEntry) {
+
+	_, err := r.Xadd(deadKey(c.id), c.options.MaxLen, "data", m.Values["data"], "id", m.ID, "deliveries", p.Deliveries, "consumer", p.Consumer)
+	if err != nil {
+
+		log.Printf("queue[%s] dead letter err=%s", c.id, err.Error())
 
-			default:
+		return
+	}
+
+	log.Printf("queue[%s] message %s moved to dead letter after %d deliveries", c.id, m.ID, p.Deliveries)
+
+	c.ack(r, m.ID)
+}
 
-				var v []byte
-				if err := r.Lpop(key, &v); err != nil {
+func (c *consumer) ack(r *redis.Redis, ids ...string) {
 
-					time.Sleep(time.Duration(1) * time.Second)
-					r, err = redis.UseRedis("queue", 0)
-					if err != nil {
+	if _, err := r.Xack(c.key, group, ids...); err != nil {
 
-						log.Println("redis queue connection refused")
-					}
+		log.Printf("queue[%s] ack err=%s", c.id, err.Error())
+
+		return
+	}
+
+	_, _ = r.Xdel(c.key, ids...)
+}
 
-					continue
-				}
+func (c *consumer) work() {
 
-				if len(v) == 0 {
+	for {
+
+		select {
+
+		case <-g.Quit():
+
+			return
+
+		case messages := <-c.messages:
+
+			ids := make([]string, len(messages))
+			data := make([][]byte, len(messages))
+			for i, m := range messages {
+
+				ids[i], data[i] = m.ID, m.Values["data"]
+			}
 
-					time.Sleep(time.Duration(1) * time.Second)
+			err := call(c.handler, data)
+			if err == nil {
 
-					continue
-				}
+				c.ack(c.conn(), ids...)
+			} else {
 
-				callback(v)
+				log.Printf("queue[%s] message %v err=%s", c.id, ids, err.Error())
 			}
+
+			c.untrack(ids)
 		}
-	})
+	}
+}
+
+func call(handler BatchHandler, data [][]byte) (err error) {
+
+	defer func() {
+
+		if e := recover(); e != nil {
+
+			err = fmt.Errorf("panic: %v", e)
+		}
+	}()
+
+	return handler(data)
+}
+
+func newConsumerName() string {
+
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+
+	return strings.Join([]string{host, fmt.Sprint(os.Getpid()), hex.EncodeToString(b)}, "-")
 }
@@ -2,8 +2,10 @@ package queue
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/laonsx/gamelib/codec"
 	"github.com/laonsx/gamelib/gofunc"
@@ -84,3 +86,225 @@ func TestQueue(t *testing.T) {
 		syncUserInfo(uint64(i), "Name", fmt.Sprintf("%d_name_%d", i, i))
 	}
 }
+
+func TestQPushDelay(t *testing.T) {
+
+	at := time.Now().Add(time.Hour)
+	if err := QPushDelayJob("SyncUserInfo", "building:10001", []byte("{}"), at); err != nil {
+
+		t.Skip("redis unavailable:", err)
+	}
+
+	v, ok, err := QDelayAt("SyncUserInfo", "building:10001")
+	if err != nil || !ok || v.Unix() != at.Unix() {
+
+		t.Fatal("QDelayAt:", v, ok, err)
+	}
+
+	if ok, err = QReschedule("SyncUserInfo", "building:10001", at.Add(time.Hour)); !ok || err != nil {
+
+		t.Error("QReschedule:", ok, err)
+	}
+
+	if ok, err = QCancel("SyncUserInfo", "building:10001"); !ok || err != nil {
+
+		t.Error("QCancel:", ok, err)
+	}
+
+	if ok, err = QReschedule("SyncUserInfo", "building:10001", at); ok || err != nil {
+
+		t.Error("QReschedule canceled:", ok, err)
+	}
+}
+
+func TestQPushPriority(t *testing.T) {
+
+	if err := QPushPriority("Mail", 5, []byte("low")); err != nil {
+
+		t.Skip("redis unavailable:", err)
+	}
+
+	if err := QPushPriority("Mail", 0, []byte("high")); err != nil {
+
+		t.Fatal("QPushPriority:", err)
+	}
+
+	r, _ := redis.UseRedisByKey("queue", streamKey("Mail"))
+	key, v, err := r.Blpop(time.Second, priorityKey("Mail", 0), priorityKey("Mail", 1), priorityKey("Mail", 2))
+	if err != nil || key != priorityKey("Mail", 0) || string(v) != "high" {
+
+		t.Fatal("Blpop high:", key, string(v), err)
+	}
+
+	key, v, err = r.Blpop(time.Second, priorityKey("Mail", 0), priorityKey("Mail", 1), priorityKey("Mail", 2))
+	if err != nil || key != priorityKey("Mail", 2) || string(v) != "low" {
+
+		t.Fatal("Blpop low:", key, string(v), err)
+	}
+}
+
+func TestQueue_SlowHandler(t *testing.T) {
+
+	Configure("Slow", &Options{ClaimIdle: time.Duration(100) * time.Millisecond})
+
+	r, _ := redis.UseRedisByKey("queue", streamKey("Slow"))
+	if err := r.Del(streamKey("Slow")); err != nil {
+
+		t.Skip("redis unavailable:", err)
+	}
+
+	// 处理时间超过ClaimIdle时不被自己重复接管
+	calls := make(chan string, 10)
+	RegisterHandler("Slow", func(data []byte) error {
+
+		calls <- string(data)
+		time.Sleep(time.Duration(400) * time.Millisecond)
+
+		return nil
+	})
+
+	if err := QPush("Slow", []byte("slow")); err != nil {
+
+		t.Fatal("QPush:", err)
+	}
+
+	time.Sleep(time.Second)
+	if len(calls) != 1 {
+
+		t.Fatal("deliveries:", len(calls))
+	}
+}
+
+func TestQPushPriority_DeadLetter(t *testing.T) {
+
+	Configure("Poison", &Options{MaxDeliveries: 2, Levels: 1})
+
+	r, _ := redis.UseRedisByKey("queue", streamKey("Poison"))
+	if err := r.Del(priorityKey("Poison", 0)); err != nil {
+
+		t.Skip("redis unavailable:", err)
+	}
+	_ = r.Del(priorityRetryKey("Poison"))
+	_ = r.Del(priorityDeadKey("Poison"))
+
+	_ = QPushPriority("Poison", 0, []byte("bad"))
+	_ = QPushPriority("Poison", 0, []byte("good"))
+
+	// 失败达到MaxDeliveries后移到死信，不阻塞之后的数据
+	done := make(chan string, 10)
+	RegisterPriorityHandler("Poison", func(data [][]byte) error {
+
+		if string(data[0]) == "bad" {
+
+			return errors.New("bad")
+		}
+
+		done <- string(data[0])
+
+		return nil
+	})
+
+	select {
+
+	case v := <-done:
+
+		if v != "good" {
+
+			t.Fatal("handled:", v)
+		}
+
+	case <-time.After(time.Duration(5) * time.Second):
+
+		t.Fatal("blocked by poison message")
+	}
+
+	dead, err := PriorityDeadLetters("Poison", 10)
+	if err != nil || len(dead) != 1 || string(dead[0]) != "bad" {
+
+		t.Fatal("PriorityDeadLetters:", dead, err)
+	}
+
+	if n, err := r.Exists(priorityRetryKey("Poison")); err != nil || n {
+
+		t.Fatal("retry count:", n, err)
+	}
+}
+
+func TestQPushPriority_BatchPoison(t *testing.T) {
+
+	Configure("PoisonBatch", &Options{MaxDeliveries: 2, Levels: 1, Batch: 3})
+
+	r, _ := redis.UseRedisByKey("queue", streamKey("PoisonBatch"))
+	if err := r.Del(priorityKey("PoisonBatch", 0)); err != nil {
+
+		t.Skip("redis unavailable:", err)
+	}
+	_ = r.Del(priorityRetryKey("PoisonBatch"))
+	_ = r.Del(priorityDeadKey("PoisonBatch"))
+
+	_ = QPushPriority("PoisonBatch", 0, []byte("good1"))
+	_ = QPushPriority("PoisonBatch", 0, []byte("bad"))
+	_ = QPushPriority("PoisonBatch", 0, []byte("good2"))
+
+	// 一条坏数据让整批失败，逐条重试后同批的数据正常处理，只有坏数据进入死信
+	done := make(chan string, 10)
+	RegisterPriorityHandler("PoisonBatch", func(data [][]byte) error {
+
+		for _, v := range data {
+
+			if string(v) == "bad" {
+
+				return errors.New("bad")
+			}
+		}
+
+		for _, v := range data {
+
+			done <- string(v)
+		}
+
+		return nil
+	})
+
+	handled := make(map[string]bool)
+	for len(handled) < 2 {
+
+		select {
+
+		case v := <-done:
+
+			handled[v] = true
+
+		case <-time.After(time.Duration(5) * time.Second):
+
+			t.Fatal("handled:", handled)
+		}
+	}
+
+	if !handled["good1"] || !handled["good2"] {
+
+		t.Fatal("handled:", handled)
+	}
+
+	deadline := time.Now().Add(time.Duration(5) * time.Second)
+	for {
+
+		dead, err := PriorityDeadLetters("PoisonBatch", 10)
+		if err != nil {
+
+			t.Fatal("PriorityDeadLetters:", err)
+		}
+
+		if len(dead) == 1 && string(dead[0]) == "bad" {
+
+			break
+		}
+
+		if len(dead) > 1 || time.Now().After(deadline) {
+
+			t.Fatal("PriorityDeadLetters:", dead)
+		}
+
+		time.Sleep(time.Duration(100) * time.Millisecond)
+	}
+}
@@ -1,6 +1,10 @@
 package redis
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
 
 //IRank 接口
 type IRank interface {
@@ -8,15 +12,43 @@ type IRank interface {
 	Name() string
 }
 
+//IRankRedis 指定排行榜使用的redis配置名，没有实现时使用rank
+type IRankRedis interface {
+	RedisName() string
+}
+
+//IRankScore 使用组合分数的排行榜，分数按RankScore编码后保存
+type IRankScore interface {
+	RankScore() *RankScore
+}
+
 //Rank 排名结构
 type Rank struct {
 	IRank
+	redis string
+	score *RankScore
 }
 
 //NewRank 初始化一个rank
 func NewRank(ir IRank) *Rank {
 
-	return &Rank{ir}
+	rank := &Rank{IRank: ir, redis: "rank"}
+	if v, ok := ir.(IRankRedis); ok {
+
+		rank.redis = v.RedisName()
+	}
+
+	if v, ok := ir.(IRankScore); ok {
+
+		rank.score = v.RankScore()
+	}
+
+	return rank
+}
+
+func (rank *Rank) use() (*Redis, error) {
+
+	return UseRedisByName(rank.redis)
 }
 
 //GetName 排名榜名
@@ -44,7 +76,7 @@ func (rank *Rank) GetKey(k ...interface{}) string {
 //score float64  -9007199254740992 - 9007199254740992
 func (rank *Rank) SetRankScore(key string, id interface{}, score interface{}) error {
 
-	r, err := UseRedisByName("rank")
+	r, err := rank.use()
 	if err != nil {
 
 		return err
@@ -54,9 +86,30 @@ func (rank *Rank) SetRankScore(key string, id interface{}, score interface{}) er
 }
 
 //IncrbyRankScore 增加排行榜score
+//组合分数时增加第一个字段，时间排序时达成时间更新为当前时间，其它字段不变
 func (rank *Rank) IncrbyRankScore(key string, id interface{}, score int) (int64, error) {
 
-	r, err := UseRedisByName("rank")
+	if rank.score != nil {
+
+		var values []int64
+		var err error
+		if rank.score.Timed() {
+
+			values, err = rank.IncrbyRankScoreAt(key, id, int64(score), time.Now())
+		} else {
+
+			values, err = rank.IncrbyRankScores(key, id, int64(score))
+		}
+
+		if err != nil {
+
+			return 0, err
+		}
+
+		return values[0], nil
+	}
+
+	r, err := rank.use()
 	if err != nil {
 
 		return 0, err
@@ -65,22 +118,34 @@ func (rank *Rank) IncrbyRankScore(key string, id interface{}, score int) (int64,
 	return r.Zincrby(key, id, score)
 }
 
-//GetRankScore 获取score
+//GetRankScore 获取score，组合分数时返回第一个字段
 func (rank *Rank) GetRankScore(key string, id interface{}) (int64, error) {
 
-	r, err := UseRedisByName("rank")
+	r, err := rank.use()
 	if err != nil {
 
 		return 0, err
 	}
 
+	if rank.score != nil {
+
+		score, err := r.ZscoreFloat(key, id)
+		if err != nil {
+
+			return 0, err
+		}
+
+		return rank.score.Decode(int64(score))[0], nil
+	}
+
 	return r.Zscore(key, id)
 }
 
 //GetRankByPage 按页获取排名 每页num条数据
+//每条数据为[成员, score]，组合分数时为[成员, 字段1, 字段2...]
 func (rank *Rank) GetRankByPage(key string, page int, num int) ([][]string, error) {
 
-	r, err := UseRedisByName("rank")
+	r, err := rank.use()
 	if err != nil {
 
 		return nil, err
@@ -89,14 +154,14 @@ func (rank *Rank) GetRankByPage(key string, page int, num int) ([][]string, erro
 	start := (page - 1) * num
 	end := start + num - 1
 
-	return r.Zrevrange(key, start, end)
+	return rank.decodeList(r.Zrevrange(key, start, end))
 }
 
 //GetRank 获取排名
 //返回0，nil：无排名信息
 func (rank *Rank) GetRank(key string, id interface{}) (int64, error) {
 
-	r, err := UseRedisByName("rank")
+	r, err := rank.use()
 	if err != nil {
 
 		return 0, err
@@ -115,34 +180,45 @@ func (rank *Rank) GetRank(key string, id interface{}) (int64, error) {
 	return n, err
 }
 
-//Del 删除排名
+//Del 删除排名和成员数据
 func (rank *Rank) Del(key string) error {
 
-	r, err := UseRedisByName("rank")
+	r, err := rank.use()
 	if err != nil {
 
 		return err
 	}
 
-	return r.Del(key)
+	// 使用DEL兼容redis 4以下的版本
+	if err = r.Del(key); err != nil {
+
+		return err
+	}
+
+	return r.Del(rank.payloadKey(key))
 }
 
 //RemRank 删除成员排名
 func (rank *Rank) RemRankScore(key string, id uint64) error {
 
-	r, err := UseRedisByName("rank")
+	r, err := rank.use()
 	if err != nil {
 
 		return err
 	}
 
-	return r.Zrem(key, id)
+	if err = r.Zrem(key, id); err != nil {
+
+		return err
+	}
+
+	return r.Hdel(rank.payloadKey(key), strconv.FormatUint(id, 10))
 }
 
 //RangeByScore 获取积分范围内的成员
 func (rank *Rank) RangeByScore(key string, s interface{}, e interface{}) ([]string, error) {
 
-	r, err := UseRedisByName("rank")
+	r, err := rank.use()
 	if err != nil {
 
 		return nil, err
@@ -151,21 +227,50 @@ func (rank *Rank) RangeByScore(key string, s interface{}, e interface{}) ([]stri
 	return r.ZrevrangeByScore(key, s, e)
 }
 
+//RangeByRank 获取排名范围内的成员，格式和GetRankByPage相同
 func (rank *Rank) RangeByRank(key string, s int, e int) ([][]string, error) {
 
-	r, err := UseRedisByName("rank")
+	r, err := rank.use()
 	if err != nil {
 
 		return nil, err
 	}
 
-	return r.Zrevrange(key, s, e)
+	return rank.decodeList(r.Zrevrange(key, s, e))
+}
+
+//decodeList 组合分数解码为各个字段
+func (rank *Rank) decodeList(list [][]string, err error) ([][]string, error) {
+
+	if err != nil || rank.score == nil {
+
+		return list, err
+	}
+
+	for i, v := range list {
+
+		values, err := rank.score.DecodeString(v[1])
+		if err != nil {
+
+			return nil, err
+		}
+
+		item := make([]string, 1, len(values)+1)
+		item[0] = v[0]
+		for _, value := range values {
+
+			item = append(item, strconv.FormatInt(value, 10))
+		}
+		list[i] = item
+	}
+
+	return list, nil
 }
 
 //SetCachePageRank 按页缓存数据
 func (rank *Rank) SetCachePageRank(key string, page int, v interface{}) error {
 
-	r, err := UseRedisByName("rank")
+	r, err := rank.use()
 	if err != nil {
 
 		return err
@@ -179,7 +284,7 @@ func (rank *Rank) SetCachePageRank(key string, page int, v interface{}) error {
 //GetCachePageRank 获取缓存数据
 func (rank *Rank) GetCachePageRank(key string, page int, v interface{}) error {
 
-	r, err := UseRedisByName("rank")
+	r, err := rank.use()
 	if err != nil {
 
 		return err
@@ -193,7 +298,7 @@ func (rank *Rank) GetCachePageRank(key string, page int, v interface{}) error {
 //GetCacheRank 获取成员缓存排名
 func (rank *Rank) GetCacheRank(key string, id uint64, v interface{}) error {
 
-	r, err := UseRedisByName("rank")
+	r, err := rank.use()
 	if err != nil {
 
 		return err
@@ -207,7 +312,7 @@ func (rank *Rank) GetCacheRank(key string, id uint64, v interface{}) error {
 //SetCacheRank 设置成员缓存排名
 func (rank *Rank) SetCacheRank(key string, id uint64, v interface{}) error {
 
-	r, err := UseRedisByName("rank")
+	r, err := rank.use()
 	if err != nil {
 
 		return err
@@ -0,0 +1,244 @@
+package redis
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//rankAroundMax above和below之和的上限，HMGET的参数用unpack展开，数量受lua栈大小限制
+const rankAroundMax = 1000
+
+var RankAroundRangeErr = errors.New("rank around range error")
+
+// KEYS[1] 排行榜 KEYS[2] 成员数据 ARGV[1] 成员 ARGV[2] 前面的数量 ARGV[3] 后面的数量
+// 返回{开始的名次, 成员和分数, 成员数据}，成员没有排名时返回空
+var rankAroundScript = RegisterScript("rank_around", 2, `
+local r = redis.call("ZREVRANK", KEYS[1], ARGV[1])
+if not r then
+	return {}
+end
+local start = r - tonumber(ARGV[2])
+if start < 0 then
+	start = 0
+end
+local list = redis.call("ZREVRANGE", KEYS[1], start, r + tonumber(ARGV[3]), "WITHSCORES")
+local members = {}
+for i = 1, #list, 2 do
+	members[#members + 1] = list[i]
+end
+if #members == 0 then
+	return {start, list, {}}
+end
+return {start, list, redis.call("HMGET", KEYS[2], unpack(members))}
+`)
+
+//RankEntry 排名和成员数据
+type RankEntry struct {
+	//Rank 名次，从1开始，好友排行中为好友间的名次
+	Rank   int64
+	Member string
+	Score  float64
+	//Values 组合分数解码后的字段
+	Values []int64
+	//Payload SetRankPayload保存的成员数据
+	Payload []byte
+}
+
+//Decode 使用redis配置的编码解码成员数据，没有数据时返回KeyNotExistsErr
+func (entry *RankEntry) Decode(v interface{}) error {
+
+	if entry.Payload == nil {
+
+		return KeyNotExistsErr
+	}
+
+	return Decode(entry.Payload, v)
+}
+
+func (rank *Rank) payloadKey(key string) string {
+
+	return tagKey(key, "payload")
+}
+
+//SetRankPayload 保存成员数据，比如昵称和头像，查询排名时一起返回
+func (rank *Rank) SetRankPayload(key string, id interface{}, v interface{}) error {
+
+	r, err := rank.use()
+	if err != nil {
+
+		return err
+	}
+
+	return r.Hset(rank.payloadKey(key), argString(id), v)
+}
+
+func (rank *Rank) newEntry(n int64, member string, score string, payload interface{}) (*RankEntry, error) {
+
+	f, err := strconv.ParseFloat(score, 64)
+	if err != nil {
+
+		return nil, err
+	}
+
+	entry := &RankEntry{Rank: n, Member: member, Score: f}
+	if rank.score != nil {
+
+		entry.Values = rank.score.Decode(int64(f))
+	}
+
+	if payload != nil {
+
+		if entry.Payload, err = redis.Bytes(payload, nil); err != nil {
+
+			return nil, err
+		}
+	}
+
+	return entry, nil
+}
+
+//GetRankAround 成员前面above名和后面below名的排名，包括成员自己，没有排名时返回nil
+//排名和范围在同一个脚本中读取，不会因为期间的修改错位
+//above和below不能为负数，之和不超过1000，否则返回RankAroundRangeErr
+func (rank *Rank) GetRankAround(key string, id interface{}, above int, below int) ([]*RankEntry, error) {
+
+	if above < 0 || below < 0 || above+below > rankAroundMax {
+
+		return nil, RankAroundRangeErr
+	}
+
+	r, err := rank.use()
+	if err != nil {
+
+		return nil, err
+	}
+
+	values, err := redis.Values(rankAroundScript.Do(r, key, rank.payloadKey(key), id, above, below))
+	if err != nil || len(values) == 0 {
+
+		return nil, err
+	}
+
+	if len(values) != 3 {
+
+		return nil, errors.New("rank around reply error")
+	}
+
+	start, err := redis.Int64(values[0], nil)
+	if err != nil {
+
+		return nil, err
+	}
+
+	list, err := redis.Strings(values[1], nil)
+	if err != nil {
+
+		return nil, err
+	}
+
+	payloads, err := redis.Values(values[2], nil)
+	if err != nil {
+
+		return nil, err
+	}
+
+	if len(payloads)*2 != len(list) {
+
+		return nil, errors.New("rank around reply error")
+	}
+
+	entries := make([]*RankEntry, 0, len(payloads))
+	for i := 0; i+1 < len(list); i += 2 {
+
+		entry, err := rank.newEntry(start+int64(i/2)+1, list[i], list[i+1], payloads[i/2])
+		if err != nil {
+
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+//GetFriendRank 好友之间的排名，按分数从高到低，分数相同时和zset的顺序一致，没有分数的成员不返回
+func (rank *Rank) GetFriendRank(key string, ids []interface{}) ([]*RankEntry, error) {
+
+	if len(ids) == 0 {
+
+		return nil, nil
+	}
+
+	r, err := rank.use()
+	if err != nil {
+
+		return nil, err
+	}
+
+	pipe := &PipeLine{}
+	for _, id := range ids {
+
+		_ = pipe.Append("ZSCORE", key, id)
+	}
+	_ = pipe.Append("HMGET", append([]interface{}{rank.payloadKey(key)}, ids...)...)
+
+	if !r.RunPipeLine(pipe) {
+
+		return nil, pipe.Err()
+	}
+
+	payloads, err := redis.Values(pipe.Commands[len(ids)].Result, nil)
+	if err != nil {
+
+		return nil, err
+	}
+
+	if len(payloads) != len(ids) {
+
+		return nil, errors.New("rank friend reply error")
+	}
+
+	entries := make([]*RankEntry, 0, len(ids))
+	for i, id := range ids {
+
+		if pipe.Commands[i].Result == nil {
+
+			continue
+		}
+
+		score, err := redis.String(pipe.Commands[i].Result, nil)
+		if err != nil {
+
+			return nil, err
+		}
+
+		entry, err := rank.newEntry(0, argString(id), score, payloads[i])
+		if err != nil {
+
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+
+		if entries[i].Score != entries[j].Score {
+
+			return entries[i].Score > entries[j].Score
+		}
+
+		return entries[i].Member > entries[j].Member
+	})
+
+	for i, entry := range entries {
+
+		entry.Rank = int64(i + 1)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,196 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func init() {
+
+	fakeScript(rankAroundScript, func(s *fakeServer, keys []string, args []string) interface{} {
+
+		r, ok := s.call("ZREVRANK", keys[0], args[0]).(int)
+		if !ok {
+
+			return []interface{}{}
+		}
+
+		above, _ := strconv.Atoi(args[1])
+		below, _ := strconv.Atoi(args[2])
+		start := r - above
+		if start < 0 {
+
+			start = 0
+		}
+
+		list := s.call("ZREVRANGE", keys[0], strconv.Itoa(start), strconv.Itoa(r+below), "WITHSCORES").([]interface{})
+		if len(list) == 0 {
+
+			return []interface{}{start, list, []interface{}{}}
+		}
+
+		fields := []string{"HMGET", keys[1]}
+		for i := 0; i < len(list); i += 2 {
+
+			fields = append(fields, list[i].(string))
+		}
+
+		return []interface{}{start, list, s.call(fields...)}
+	})
+}
+
+type rankPlayer struct {
+	Name  string
+	Level int
+}
+
+func TestRank_Around(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	useFakeRedis("ranktest", s)
+
+	testRankAround(t)
+}
+
+// TestRank_AroundLive 在真实redis上执行rank_around
+func TestRank_AroundLive(t *testing.T) {
+
+	rank := NewRank(&periodRank{})
+	key := rank.GetKey("around")
+	r := useLiveRedis(t, "ranktest", key, rank.payloadKey(key))
+	defer r.Close()
+
+	testRankAround(t)
+}
+
+func testRankAround(t *testing.T) {
+
+	rank := NewRank(&periodRank{})
+	key := rank.GetKey("around")
+
+	// 成员i的分数为i*10
+	for i := 1; i <= 20; i++ {
+
+		if err := rank.SetRankScore(key, i, i*10); err != nil {
+
+			t.Fatal("SetRankScore:", err)
+		}
+
+		if i%2 == 0 {
+
+			if err := rank.SetRankPayload(key, i, &rankPlayer{Name: "p" + strconv.Itoa(i), Level: i}); err != nil {
+
+				t.Fatal("SetRankPayload:", err)
+			}
+		}
+	}
+
+	entries, err := rank.GetRankAround(key, 10, 2, 3)
+	if err != nil || len(entries) != 6 {
+
+		t.Fatal("GetRankAround:", entries, err)
+	}
+
+	if entries[0].Rank != 9 || entries[0].Member != "12" || entries[2].Member != "10" || entries[2].Score != 100 || entries[5].Rank != 14 {
+
+		t.Fatal("GetRankAround entries:", entries[0], entries[2], entries[5])
+	}
+
+	var p rankPlayer
+	if err = entries[0].Decode(&p); err != nil || p.Name != "p12" || p.Level != 12 {
+
+		t.Fatal("Decode:", p, err)
+	}
+
+	if err = entries[1].Decode(&p); err != KeyNotExistsErr {
+
+		t.Fatal("Decode none:", err)
+	}
+
+	// 第一名前面没有成员，最后一名后面没有成员
+	if entries, err = rank.GetRankAround(key, 19, 5, 1); err != nil || len(entries) != 3 || entries[0].Rank != 1 || entries[0].Member != "20" {
+
+		t.Fatal("GetRankAround top:", entries, err)
+	}
+
+	if entries, err = rank.GetRankAround(key, 1, 1, 5); err != nil || len(entries) != 2 || entries[1].Rank != 20 {
+
+		t.Fatal("GetRankAround last:", entries, err)
+	}
+
+	if entries, err = rank.GetRankAround(key, 100, 1, 1); err != nil || entries != nil {
+
+		t.Fatal("GetRankAround none:", entries, err)
+	}
+
+	if entries, err = rank.GetRankAround(key, 10, 0, 0); err != nil || len(entries) != 1 || entries[0].Member != "10" {
+
+		t.Fatal("GetRankAround self:", entries, err)
+	}
+
+	if entries, err = rank.GetRankAround(key, 10, 500, 500); err != nil || len(entries) != 20 {
+
+		t.Fatal("GetRankAround max:", len(entries), err)
+	}
+
+	for _, r := range [][2]int{{-1, 1}, {1, -1}, {500, 501}} {
+
+		if entries, err = rank.GetRankAround(key, 10, r[0], r[1]); err != RankAroundRangeErr {
+
+			t.Fatal("GetRankAround range:", r, entries, err)
+		}
+	}
+
+	friends, err := rank.GetFriendRank(key, []interface{}{3, 18, 100, 4})
+	if err != nil || len(friends) != 3 {
+
+		t.Fatal("GetFriendRank:", friends, err)
+	}
+
+	if friends[0].Member != "18" || friends[0].Rank != 1 || friends[2].Member != "3" || friends[2].Rank != 3 || friends[2].Score != 30 {
+
+		t.Fatal("GetFriendRank order:", friends[0], friends[2])
+	}
+
+	if err = friends[1].Decode(&p); err != nil || p.Name != "p4" {
+
+		t.Fatal("GetFriendRank payload:", p, err)
+	}
+
+	if err = rank.RemRankScore(key, 18); err != nil {
+
+		t.Fatal("RemRankScore:", err)
+	}
+
+	if friends, err = rank.GetFriendRank(key, []interface{}{18}); err != nil || len(friends) != 0 {
+
+		t.Fatal("GetFriendRank removed:", friends, err)
+	}
+
+	r, _ := UseRedisByName("ranktest")
+	ctx := context.Background()
+	if _, err = redis.Bytes(r.do(ctx, "HGET", rank.payloadKey(key), "18")); err != redis.ErrNil {
+
+		t.Fatal("payload not removed:", err)
+	}
+
+	if err = rank.Del(key); err != nil {
+
+		t.Fatal("Del:", err)
+	}
+
+	if n, err := redis.Int64(r.do(ctx, "EXISTS", key)); err != nil || n != 0 {
+
+		t.Fatal("Del board:", n, err)
+	}
+
+	if n, err := redis.Int64(r.do(ctx, "EXISTS", rank.payloadKey(key))); err != nil || n != 0 {
+
+		t.Fatal("Del payload:", n, err)
+	}
+}
@@ -0,0 +1,607 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	LargeRankBucketsErr  = errors.New("large rank buckets must be ascending")
+	LargeRankConflictErr = errors.New("large rank score changed concurrently")
+
+	largeRankRetry = 10
+)
+
+// KEYS[1] 成员分数 KEYS[2] 分桶计数 ARGV[1] 成员 ARGV[2] 新的桶 ARGV[3] 新的分数
+// ARGV[4] 为1时检查原值等于ARGV[5]，ARGV[5]为空表示成员不存在
+// 成员分数保存为"桶:分数"，返回{1, 原值}，检查失败返回{0, 当前值}
+var largeRankSetScript = RegisterScript("rank_large_set", 2, `
+local old = redis.call("HGET", KEYS[1], ARGV[1]) or ""
+if ARGV[4] == "1" and old ~= ARGV[5] then
+	return {0, old}
+end
+if old ~= "" then
+	redis.call("HINCRBY", KEYS[2], string.match(old, "^(-?%d+):"), -1)
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2] .. ":" .. ARGV[3])
+redis.call("HINCRBY", KEYS[2], ARGV[2], 1)
+return {1, old}
+`)
+
+// KEYS[1] 成员分数 KEYS[2] 分桶计数 ARGV[1] 成员
+var largeRankRemScript = RegisterScript("rank_large_rem", 2, `
+local old = redis.call("HGET", KEYS[1], ARGV[1])
+if not old then
+	return 0
+end
+redis.call("HDEL", KEYS[1], ARGV[1])
+redis.call("HINCRBY", KEYS[2], string.match(old, "^(-?%d+):"), -1)
+return 1
+`)
+
+// KEYS[1] 前N名 KEYS[2] 下限 ARGV[1] 分数 ARGV[2] 成员 ARGV[3] N
+// 不在前N名的成员分数都不超过下限，满N名时下限为最后一名，不满N名时为KEYS[2]，没有KEYS[2]时所有成员都在前N名
+// 新成员分数不超过下限时不写入返回0，已有的成员分数低于下限时移出返回2，满N名时移出后记录下限
+var largeRankTopScript = RegisterScript("rank_large_top", 2, `
+local n = tonumber(ARGV[3])
+local score = tonumber(ARGV[1])
+local full = redis.call("ZCARD", KEYS[1]) >= n
+local floor
+if full then
+	floor = tonumber(redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")[2])
+else
+	floor = tonumber(redis.call("GET", KEYS[2]) or "")
+end
+if floor then
+	if redis.call("ZSCORE", KEYS[1], ARGV[2]) then
+		if score < floor then
+			redis.call("ZREM", KEYS[1], ARGV[2])
+			if full then
+				redis.call("SET", KEYS[2], string.format("%.0f", floor))
+			end
+			return 2
+		end
+	elseif score <= floor then
+		return 0
+	end
+end
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+redis.call("ZREMRANGEBYRANK", KEYS[1], 0, -(n + 1))
+return 1
+`)
+
+// KEYS[1] 前N名 KEYS[2] 下限 ARGV[1] 成员 ARGV[2] N
+// 满N名时移出成员后记录下限
+var largeRankTopRemScript = RegisterScript("rank_large_top_rem", 2, `
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	return 0
+end
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[2]) then
+	local last = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+	redis.call("SET", KEYS[2], string.format("%.0f", tonumber(last[2])))
+end
+redis.call("ZREM", KEYS[1], ARGV[1])
+return 1
+`)
+
+//LargeRankOptions 大规模排行榜配置
+type LargeRankOptions struct {
+	//Redis 使用的redis配置名，成员按一致性hash分布到各个分片，默认rank
+	Redis string
+	//Top 精确排名的名次数，默认1000
+	Top int
+	//Buckets 分桶的下限，升序，低于第一个下限的分数计入第一个桶
+	Buckets []int64
+}
+
+//LargeRank 百万级成员的排行榜，前Top名使用zset精确排名，其它成员按分数分桶计数得到近似排名
+//成员分数和分桶计数保存在成员所在的分片，前Top名保存在key所在的分片
+//前Top名中的成员分数减少到低于最后一名时移出，之后前Top名可能不足Top个，
+//直到其它成员的分数超过移出时的最后一名才补入，不足的名次按近似排名计算
+type LargeRank struct {
+	key     string
+	options LargeRankOptions
+}
+
+//LinearBuckets 从start开始等宽的count个桶
+func LinearBuckets(start int64, width int64, count int) []int64 {
+
+	buckets := make([]int64, count)
+	for i := range buckets {
+
+		buckets[i] = start + int64(i)*width
+	}
+
+	return buckets
+}
+
+//ExponentialBuckets 从start开始按factor倍增长的count个桶，分数分布集中在低分段时使用
+func ExponentialBuckets(start int64, factor float64, count int) []int64 {
+
+	buckets := make([]int64, 0, count)
+	v := float64(start)
+	for i := 0; i < count; i++ {
+
+		b := int64(v)
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+
+			b = buckets[len(buckets)-1] + 1
+		}
+		buckets = append(buckets, b)
+		v *= factor
+	}
+
+	return buckets
+}
+
+//NewLargeRank 创建大规模排行榜
+func NewLargeRank(key string, options *LargeRankOptions) (*LargeRank, error) {
+
+	lr := &LargeRank{key: key}
+	if options != nil {
+
+		lr.options = *options
+	}
+
+	if len(lr.options.Redis) == 0 {
+
+		lr.options.Redis = "rank"
+	}
+
+	if lr.options.Top <= 0 {
+
+		lr.options.Top = 1000
+	}
+
+	if len(lr.options.Buckets) == 0 {
+
+		return nil, LargeRankBucketsErr
+	}
+
+	for i := 1; i < len(lr.options.Buckets); i++ {
+
+		if lr.options.Buckets[i] <= lr.options.Buckets[i-1] {
+
+			return nil, LargeRankBucketsErr
+		}
+	}
+
+	return lr, nil
+}
+
+func (lr *LargeRank) Key() string {
+
+	return lr.key
+}
+
+func (lr *LargeRank) scoresKey() string {
+
+	return tagKey(lr.key, "scores")
+}
+
+func (lr *LargeRank) histKey() string {
+
+	return tagKey(lr.key, "hist")
+}
+
+func (lr *LargeRank) topKey() string {
+
+	return tagKey(lr.key, "top")
+}
+
+//floorKey 移出前Top名时记录的下限，前Top名以外的成员分数都不超过下限
+func (lr *LargeRank) floorKey() string {
+
+	return tagKey(lr.key, "floor")
+}
+
+//bucket 分数所在的桶
+func (lr *LargeRank) bucket(score int64) int {
+
+	i := sort.Search(len(lr.options.Buckets), func(i int) bool {
+
+		return lr.options.Buckets[i] > score
+	})
+
+	if i == 0 {
+
+		return 0
+	}
+
+	return i - 1
+}
+
+//Set 设置成员的分数
+func (lr *LargeRank) Set(ctx context.Context, member string, score int64) error {
+
+	r, err := UseRedisByKey(lr.options.Redis, member)
+	if err != nil {
+
+		return err
+	}
+
+	if _, _, err = lr.set(ctx, r, member, score, false, ""); err != nil {
+
+		return err
+	}
+
+	return lr.updateTop(ctx, member, score)
+}
+
+//Incr 增加成员的分数，返回增加后的分数
+func (lr *LargeRank) Incr(ctx context.Context, member string, n int64) (int64, error) {
+
+	r, err := UseRedisByKey(lr.options.Redis, member)
+	if err != nil {
+
+		return 0, err
+	}
+
+	old, err := redis.String(r.doRetry(ctx, "HGET", lr.scoresKey(), member))
+	if err != nil && err != redis.ErrNil {
+
+		return 0, err
+	}
+
+	// 并发修改时按当前值重试
+	for i := 0; i < largeRankRetry; i++ {
+
+		_, score, err := parseLargeScore(old)
+		if err != nil {
+
+			return 0, err
+		}
+
+		score += n
+
+		ok, current, err := lr.set(ctx, r, member, score, true, old)
+		if err != nil {
+
+			return 0, err
+		}
+
+		if ok {
+
+			return score, lr.updateTop(ctx, member, score)
+		}
+
+		old = current
+	}
+
+	return 0, LargeRankConflictErr
+}
+
+func (lr *LargeRank) set(ctx context.Context, r *Redis, member string, score int64, check bool, old string) (bool, string, error) {
+
+	flag := "0"
+	if check {
+
+		flag = "1"
+	}
+
+	values, err := redis.Values(largeRankSetScript.DoCtx(ctx, r, lr.scoresKey(), lr.histKey(), member, lr.bucket(score), score, flag, old))
+	if err != nil {
+
+		return false, "", err
+	}
+
+	if len(values) != 2 {
+
+		return false, "", errors.New("large rank set reply error")
+	}
+
+	ok, err := redis.Int(values[0], nil)
+	if err != nil {
+
+		return false, "", err
+	}
+
+	current, err := redis.String(values[1], nil)
+
+	return ok == 1, current, err
+}
+
+//updateTop 写入前N名，成员分数和前N名不在同一个分片，并发修改时写入顺序可能和修改顺序相反
+//写入后检查成员当前的分数，不一致时按当前分数重写，最后一次写入总是最新的分数
+func (lr *LargeRank) updateTop(ctx context.Context, member string, score int64) error {
+
+	r, err := UseRedisByKey(lr.options.Redis, lr.key)
+	if err != nil {
+
+		return err
+	}
+
+	for i := 0; i < largeRankRetry; i++ {
+
+		if _, err = largeRankTopScript.DoCtx(ctx, r, lr.topKey(), lr.floorKey(), score, member, lr.options.Top); err != nil {
+
+			return err
+		}
+
+		current, ok, err := lr.Score(ctx, member)
+		if err != nil {
+
+			return err
+		}
+
+		// 期间被删除
+		if !ok {
+
+			return lr.removeTop(ctx, r, member)
+		}
+
+		if current == score {
+
+			return nil
+		}
+
+		score = current
+	}
+
+	return LargeRankConflictErr
+}
+
+//parseLargeScore 解析"桶:分数"，空字符串表示成员不存在
+func parseLargeScore(v string) (int, int64, error) {
+
+	if len(v) == 0 {
+
+		return 0, 0, nil
+	}
+
+	i := strings.IndexByte(v, ':')
+	if i < 0 {
+
+		return 0, 0, errors.New("large rank score error " + v)
+	}
+
+	bucket, err := strconv.Atoi(v[:i])
+	if err != nil {
+
+		return 0, 0, err
+	}
+
+	score, err := strconv.ParseInt(v[i+1:], 10, 64)
+
+	return bucket, score, err
+}
+
+//Score 成员的分数，成员不存在时返回false
+func (lr *LargeRank) Score(ctx context.Context, member string) (int64, bool, error) {
+
+	r, err := UseRedisByKey(lr.options.Redis, member)
+	if err != nil {
+
+		return 0, false, err
+	}
+
+	v, err := redis.String(r.doRetry(ctx, "HGET", lr.scoresKey(), member))
+	if err == redis.ErrNil {
+
+		return 0, false, nil
+	}
+
+	if err != nil {
+
+		return 0, false, err
+	}
+
+	_, score, err := parseLargeScore(v)
+
+	return score, err == nil, err
+}
+
+//Remove 删除成员
+func (lr *LargeRank) Remove(ctx context.Context, member string) error {
+
+	r, err := UseRedisByKey(lr.options.Redis, member)
+	if err != nil {
+
+		return err
+	}
+
+	if _, err = largeRankRemScript.DoCtx(ctx, r, lr.scoresKey(), lr.histKey(), member); err != nil {
+
+		return err
+	}
+
+	top, err := UseRedisByKey(lr.options.Redis, lr.key)
+	if err != nil {
+
+		return err
+	}
+
+	return lr.removeTop(ctx, top, member)
+}
+
+//removeTop 从前Top名中移出成员
+func (lr *LargeRank) removeTop(ctx context.Context, r *Redis, member string) error {
+
+	_, err := largeRankTopRemScript.DoCtx(ctx, r, lr.topKey(), lr.floorKey(), member, lr.options.Top)
+
+	return err
+}
+
+//Top 前Top名中的排名范围，从0开始，格式和Rank.GetRankByPage相同
+func (lr *LargeRank) Top(ctx context.Context, start int, end int) ([][]string, error) {
+
+	if end >= lr.options.Top {
+
+		end = lr.options.Top - 1
+	}
+
+	r, err := UseRedisByKey(lr.options.Redis, lr.key)
+	if err != nil {
+
+		return nil, err
+	}
+
+	return r.ZrevrangeCtx(ctx, lr.topKey(), start, end)
+}
+
+//Rank 成员的排名，从1开始，前Top名时exact为true，成员不存在时返回0
+func (lr *LargeRank) Rank(ctx context.Context, member string) (rank int64, exact bool, err error) {
+
+	score, ok, err := lr.Score(ctx, member)
+	if err != nil || !ok {
+
+		return 0, false, err
+	}
+
+	r, err := UseRedisByKey(lr.options.Redis, lr.key)
+	if err != nil {
+
+		return 0, false, err
+	}
+
+	n, err := r.ZrevrankCtx(ctx, lr.topKey(), member)
+	if err != nil {
+
+		return 0, false, err
+	}
+
+	if n >= 0 {
+
+		return n + 1, true, nil
+	}
+
+	rank, _, err = lr.RankOfScore(ctx, score)
+
+	return rank, false, err
+}
+
+//Percentile 成员排名在所有成员中的位置，0.01表示前1%，成员不存在时返回0
+func (lr *LargeRank) Percentile(ctx context.Context, member string) (float64, error) {
+
+	rank, _, err := lr.Rank(ctx, member)
+	if err != nil || rank == 0 {
+
+		return 0, err
+	}
+
+	total, err := lr.Count(ctx)
+	if err != nil || total == 0 {
+
+		return 0, err
+	}
+
+	return float64(rank) / float64(total), nil
+}
+
+//Count 成员总数
+func (lr *LargeRank) Count(ctx context.Context) (int64, error) {
+
+	hist, err := lr.histogram(ctx)
+	if err != nil {
+
+		return 0, err
+	}
+
+	var total int64
+	for _, n := range hist {
+
+		total += n
+	}
+
+	return total, nil
+}
+
+//RankOfScore 分数的近似排名和成员总数，按分桶计数估算，桶内按分数线性插值
+func (lr *LargeRank) RankOfScore(ctx context.Context, score int64) (int64, int64, error) {
+
+	hist, err := lr.histogram(ctx)
+	if err != nil {
+
+		return 0, 0, err
+	}
+
+	b := lr.bucket(score)
+
+	var higher, total int64
+	for i, n := range hist {
+
+		total += n
+		if i > b {
+
+			higher += n
+		}
+	}
+
+	lower, upper := float64(lr.options.Buckets[b]), float64(0)
+	if b+1 < len(lr.options.Buckets) {
+
+		upper = float64(lr.options.Buckets[b+1])
+	} else {
+
+		// 最后一个桶没有上限，使用第一名的分数
+		if upper, err = lr.maxScore(ctx); err != nil {
+
+			return 0, 0, err
+		}
+		upper++
+	}
+
+	frac := 0.5
+	if upper > lower {
+
+		frac = math.Max(0, math.Min(1, (upper-float64(score))/(upper-lower)))
+	}
+
+	above := int64(math.Floor(float64(hist[b]) * frac))
+	if above >= hist[b] && hist[b] > 0 {
+
+		above = hist[b] - 1
+	}
+
+	return higher + above + 1, total, nil
+}
+
+func (lr *LargeRank) maxScore(ctx context.Context) (float64, error) {
+
+	top, err := lr.Top(ctx, 0, 0)
+	if err != nil || len(top) == 0 {
+
+		return 0, err
+	}
+
+	return strconv.ParseFloat(top[0][1], 64)
+}
+
+//histogram 汇总所有分片的分桶计数
+func (lr *LargeRank) histogram(ctx context.Context) ([]int64, error) {
+
+	shards, err := Shards(lr.options.Redis)
+	if err != nil {
+
+		return nil, err
+	}
+
+	hist := make([]int64, len(lr.options.Buckets))
+	for _, r := range shards {
+
+		values, err := redis.Int64Map(r.doRetry(ctx, "HGETALL", lr.histKey()))
+		if err != nil {
+
+			return nil, err
+		}
+
+		for k, n := range values {
+
+			b, err := strconv.Atoi(k)
+			if err != nil || b < 0 || b >= len(hist) {
+
+				continue
+			}
+
+			hist[b] += n
+		}
+	}
+
+	return hist, nil
+}
@@ -0,0 +1,353 @@
+package redis
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func init() {
+
+	largeSet := func(s *fakeServer, keys []string, args []string) interface{} {
+
+		old := ""
+		if v, ok := s.hash(keys[0], false)[args[0]]; ok {
+
+			old = string(v)
+		}
+
+		if args[3] == "1" && old != args[4] {
+
+			return []interface{}{0, old}
+		}
+
+		if len(old) > 0 {
+
+			s.call("HINCRBY", keys[1], old[:strings.IndexByte(old, ':')], "-1")
+		}
+
+		s.call("HSET", keys[0], args[0], args[1]+":"+args[2])
+		s.call("HINCRBY", keys[1], args[1], "1")
+
+		return []interface{}{1, old}
+	}
+	fakeScript(largeRankSetScript, largeSet)
+
+	fakeScript(largeRankRemScript, func(s *fakeServer, keys []string, args []string) interface{} {
+
+		v, ok := s.hash(keys[0], false)[args[0]]
+		if !ok {
+
+			return 0
+		}
+
+		old := string(v)
+		s.call("HDEL", keys[0], args[0])
+		s.call("HINCRBY", keys[1], old[:strings.IndexByte(old, ':')], "-1")
+
+		return 1
+	})
+
+	fakeScript(largeRankTopScript, func(s *fakeServer, keys []string, args []string) interface{} {
+
+		n, _ := strconv.Atoi(args[2])
+		score, _ := strconv.ParseFloat(args[0], 64)
+		z := s.zset(keys[0], true)
+		full := len(z) >= n
+
+		floor, hasFloor := 0.0, false
+		if full {
+
+			floor, hasFloor = z[s.sortedMembers(keys[0], false)[0]], true
+		} else if v, ok := s.lookup(keys[1]).([]byte); ok {
+
+			floor, _ = strconv.ParseFloat(string(v), 64)
+			hasFloor = true
+		}
+
+		if hasFloor {
+
+			if _, ok := z[args[1]]; ok {
+
+				if score < floor {
+
+					delete(z, args[1])
+					if full {
+
+						s.call("SET", keys[1], strconv.FormatFloat(floor, 'f', 0, 64))
+					}
+
+					return 2
+				}
+			} else if score <= floor {
+
+				return 0
+			}
+		}
+
+		z[args[1]] = score
+		if members := s.sortedMembers(keys[0], false); len(members) > n {
+
+			for _, m := range members[:len(members)-n] {
+
+				delete(z, m)
+			}
+		}
+
+		return 1
+	})
+
+	fakeScript(largeRankTopRemScript, func(s *fakeServer, keys []string, args []string) interface{} {
+
+		n, _ := strconv.Atoi(args[1])
+		z := s.zset(keys[0], true)
+		if _, ok := z[args[0]]; !ok {
+
+			return 0
+		}
+
+		if len(z) >= n {
+
+			last := z[s.sortedMembers(keys[0], false)[0]]
+			s.call("SET", keys[1], strconv.FormatFloat(last, 'f', 0, 64))
+		}
+
+		delete(z, args[0])
+
+		return 1
+	})
+}
+
+func TestLargeRank_Buckets(t *testing.T) {
+
+	if b := LinearBuckets(0, 10, 4); !reflect.DeepEqual(b, []int64{0, 10, 20, 30}) {
+
+		t.Fatal("LinearBuckets:", b)
+	}
+
+	if b := ExponentialBuckets(1, 1.5, 5); !reflect.DeepEqual(b, []int64{1, 2, 3, 4, 5}) {
+
+		t.Fatal("ExponentialBuckets:", b)
+	}
+
+	if _, err := NewLargeRank("large", &LargeRankOptions{Buckets: []int64{0, 10, 10}}); err != LargeRankBucketsErr {
+
+		t.Fatal("NewLargeRank:", err)
+	}
+
+	lr, _ := NewLargeRank("large", &LargeRankOptions{Buckets: []int64{0, 10, 20}})
+	for score, want := range map[int64]int{-5: 0, 0: 0, 9: 0, 10: 1, 25: 2} {
+
+		if b := lr.bucket(score); b != want {
+
+			t.Fatal("bucket:", score, b)
+		}
+	}
+}
+
+func TestLargeRank(t *testing.T) {
+
+	servers := []*fakeServer{newFakeServer(t), newFakeServer(t), newFakeServer(t)}
+	for _, s := range servers {
+
+		defer s.close()
+	}
+
+	useFakeRedis("ranklarge", servers...)
+
+	testLargeRank(t)
+
+	// 成员分布在所有分片
+	lr, _ := NewLargeRank("rank:large", &LargeRankOptions{Buckets: []int64{0}})
+	for _, s := range servers {
+
+		if h, _ := s.get(lr.scoresKey()).(map[string][]byte); len(h) == 0 {
+
+			t.Fatal("member not distributed")
+		}
+	}
+}
+
+// TestLargeRankLive 在真实redis上执行rank_large_set/rem/top
+func TestLargeRankLive(t *testing.T) {
+
+	lr, _ := NewLargeRank("rank:large", &LargeRankOptions{Buckets: []int64{0}})
+	r := useLiveRedis(t, "ranklarge", lr.scoresKey(), lr.histKey(), lr.topKey(), lr.floorKey())
+	defer r.Close()
+
+	testLargeRank(t)
+}
+
+func testLargeRank(t *testing.T) {
+
+	lr, err := NewLargeRank("rank:large", &LargeRankOptions{
+		Redis:   "ranklarge",
+		Top:     10,
+		Buckets: LinearBuckets(0, 100, 10),
+	})
+	if err != nil {
+
+		t.Fatal("NewLargeRank:", err)
+	}
+
+	// 成员i的分数为i，排名为1000-i+1
+	ctx := context.Background()
+	for i := 1; i <= 1000; i++ {
+
+		if err = lr.Set(ctx, "m"+strconv.Itoa(i), int64(i)); err != nil {
+
+			t.Fatal("Set:", err)
+		}
+	}
+
+	if n, err := lr.Count(ctx); err != nil || n != 1000 {
+
+		t.Fatal("Count:", n, err)
+	}
+
+	top, err := lr.Top(ctx, 0, 100)
+	if err != nil || len(top) != 10 || top[0][0] != "m1000" || top[9][0] != "m991" {
+
+		t.Fatal("Top:", top, err)
+	}
+
+	if rank, exact, err := lr.Rank(ctx, "m995"); err != nil || !exact || rank != 6 {
+
+		t.Fatal("Rank top:", rank, exact, err)
+	}
+
+	// 分数在桶内均匀分布时近似排名误差很小
+	for _, i := range []int{1, 150, 500, 899} {
+
+		rank, exact, err := lr.Rank(ctx, "m"+strconv.Itoa(i))
+		want := int64(1000 - i + 1)
+		if err != nil || exact || rank < want-2 || rank > want+2 {
+
+			t.Fatal("Rank approx:", i, rank, want, exact, err)
+		}
+	}
+
+	p, err := lr.Percentile(ctx, "m900")
+	if err != nil || p < 0.09 || p > 0.11 {
+
+		t.Fatal("Percentile:", p, err)
+	}
+
+	if rank, exact, err := lr.Rank(ctx, "none"); err != nil || rank != 0 || exact {
+
+		t.Fatal("Rank none:", rank, exact, err)
+	}
+
+	// 增加分数后进入前Top名并更新分桶
+	score, err := lr.Incr(ctx, "m1", 5000)
+	if err != nil || score != 5001 {
+
+		t.Fatal("Incr:", score, err)
+	}
+
+	if rank, exact, err := lr.Rank(ctx, "m1"); err != nil || !exact || rank != 1 {
+
+		t.Fatal("Rank incr:", rank, exact, err)
+	}
+
+	if n, err := lr.Count(ctx); err != nil || n != 1000 {
+
+		t.Fatal("Count incr:", n, err)
+	}
+
+	// 并发增加
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+
+		wg.Add(1)
+		go func() {
+
+			defer wg.Done()
+
+			if _, err := lr.Incr(ctx, "m2", 1); err != nil {
+
+				t.Error("Incr concurrent:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if score, ok, err := lr.Score(ctx, "m2"); err != nil || !ok || score != 7 {
+
+		t.Fatal("Score:", score, ok, err)
+	}
+
+	// 较早的修改后写入前N名时按当前分数重写
+	if err = lr.updateTop(ctx, "m1", 100); err != nil {
+
+		t.Fatal("updateTop stale:", err)
+	}
+
+	if top, err = lr.Top(ctx, 0, 0); err != nil || top[0][0] != "m1" || top[0][1] != "5001" {
+
+		t.Fatal("Top stale:", top, err)
+	}
+
+	if err = lr.Remove(ctx, "m1"); err != nil {
+
+		t.Fatal("Remove:", err)
+	}
+
+	if n, err := lr.Count(ctx); err != nil || n != 999 {
+
+		t.Fatal("Count remove:", n, err)
+	}
+
+	if _, ok, err := lr.Score(ctx, "m1"); ok || err != nil {
+
+		t.Fatal("Score removed:", ok, err)
+	}
+
+	if top, err = lr.Top(ctx, 0, 0); err != nil || top[0][0] != "m1000" {
+
+		t.Fatal("Top removed:", top, err)
+	}
+
+	// 分数减少到低于最后一名时移出前Top名，其它成员的精确排名不受影响
+	if err = lr.Set(ctx, "m995", 5); err != nil {
+
+		t.Fatal("Set decrease:", err)
+	}
+
+	if top, err = lr.Top(ctx, 0, 100); err != nil || len(top) != 8 || top[4][0] != "m996" || top[5][0] != "m994" {
+
+		t.Fatal("Top decrease:", top, err)
+	}
+
+	if rank, exact, err := lr.Rank(ctx, "m993"); err != nil || !exact || rank != 7 {
+
+		t.Fatal("Rank after decrease:", rank, exact, err)
+	}
+
+	for _, m := range []string{"m995", "m991"} {
+
+		if _, exact, err := lr.Rank(ctx, m); err != nil || exact {
+
+			t.Fatal("Rank below floor:", m, exact, err)
+		}
+	}
+
+	// 超过下限的成员补入，低于下限的不写入
+	if err = lr.Set(ctx, "m990", 2000); err != nil {
+
+		t.Fatal("Set refill:", err)
+	}
+
+	if err = lr.Set(ctx, "m3", 500); err != nil {
+
+		t.Fatal("Set below floor:", err)
+	}
+
+	if top, err = lr.Top(ctx, 0, 100); err != nil || len(top) != 9 || top[0][0] != "m990" {
+
+		t.Fatal("Top refill:", top, err)
+	}
+}
@@ -0,0 +1,428 @@
+package redis
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/laonsx/gamelib/gofunc"
+)
+
+//RankPeriod 排行榜周期
+type RankPeriod int
+
+const (
+	RankDaily RankPeriod = iota + 1
+	RankWeekly
+	RankMonthly
+)
+
+const rankSettled = "done"
+
+//RankSettle 周期结算回调，list为快照中的排名，格式和GetRankByPage相同
+//返回错误时下次检查重试，重试时使用同一份快照；ctx在失去结算锁时取消
+//回调成功后记录结算状态失败或者失去锁时会再次调用，回调必须幂等，
+//发奖记录可以用排行榜名和period作为唯一键，或者用RankSettleToken拒绝过期持有者的写入
+type RankSettle func(ctx context.Context, period string, list [][]string) error
+
+type rankSettleToken struct{}
+
+//RankSettleToken 结算回调的ctx中结算锁的fencing token，同一个周期每次加锁递增
+func RankSettleToken(ctx context.Context) int64 {
+
+	token, _ := ctx.Value(rankSettleToken{}).(int64)
+
+	return token
+}
+
+//RankSchedulerOptions 周期排行榜配置
+type RankSchedulerOptions struct {
+	//Period 周期，默认每天
+	Period RankPeriod
+	//Settle 结算回调，为空时只做快照和过期
+	Settle RankSettle
+	//Top 快照的名次数，默认1000
+	Top int
+	//Keep 结算后保留的周期数，之后排行榜、快照和成员数据过期，默认4
+	Keep int
+	//Interval 检查周期切换的间隔，默认1分钟
+	Interval time.Duration
+	//Delay 周期结束后延迟结算，等待跨周期的写入完成，默认0
+	Delay time.Duration
+}
+
+//RankScheduler 周期排行榜，按gofunc配置的时区生成每天、每周或每月的key
+//周期结束后在分布式锁内快照最终排名并调用结算回调，结算回调至少成功一次，需要幂等
+type RankScheduler struct {
+	rank    *Rank
+	options RankSchedulerOptions
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+//NewScheduler 创建周期排行榜，调用Start开始定时结算
+func (rank *Rank) NewScheduler(options *RankSchedulerOptions) *RankScheduler {
+
+	rs := &RankScheduler{
+		rank: rank,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if options != nil {
+
+		rs.options = *options
+	}
+
+	if rs.options.Period == 0 {
+
+		rs.options.Period = RankDaily
+	}
+
+	if rs.options.Top <= 0 {
+
+		rs.options.Top = 1000
+	}
+
+	if rs.options.Keep <= 0 {
+
+		rs.options.Keep = 4
+	}
+
+	if rs.options.Interval <= 0 {
+
+		rs.options.Interval = time.Duration(1) * time.Minute
+	}
+
+	return rs
+}
+
+//Period t所在的周期，每天为20060102，每周为ISO年周200601，每月为200601
+func (rs *RankScheduler) Period(t time.Time) string {
+
+	switch rs.options.Period {
+
+	case RankWeekly:
+
+		return strconv.Itoa(gofunc.YearWeek(t.Unix()))
+
+	case RankMonthly:
+
+		year, mon, _ := gofunc.GetYMD(t.Unix())
+
+		return strconv.Itoa(year*100 + mon)
+
+	default:
+
+		year, mon, day := gofunc.GetYMD(t.Unix())
+
+		return strconv.Itoa(year*10000 + mon*100 + day)
+	}
+}
+
+//Key 周期的排行榜key
+func (rs *RankScheduler) Key(period string) string {
+
+	return rs.rank.GetKey(period)
+}
+
+//CurrentKey 当前周期的排行榜key
+func (rs *RankScheduler) CurrentKey() string {
+
+	return rs.Key(rs.Period(gofunc.TimeNow()))
+}
+
+//before t之前第n个周期内的时间
+func (rs *RankScheduler) before(t time.Time, n int) time.Time {
+
+	t = t.In(gofunc.TimeNow().Location())
+	switch rs.options.Period {
+
+	case RankWeekly:
+
+		return t.AddDate(0, 0, -7*n)
+
+	case RankMonthly:
+
+		// 避免31号减一个月跳过2月
+		return time.Date(t.Year(), t.Month(), 1, 12, 0, 0, 0, t.Location()).AddDate(0, -n, 0)
+
+	default:
+
+		return t.AddDate(0, 0, -n)
+	}
+}
+
+func (rs *RankScheduler) length() time.Duration {
+
+	switch rs.options.Period {
+
+	case RankWeekly:
+
+		return time.Duration(7*24) * time.Hour
+
+	case RankMonthly:
+
+		return time.Duration(31*24) * time.Hour
+
+	default:
+
+		return time.Duration(24) * time.Hour
+	}
+}
+
+func (rs *RankScheduler) snapshotKey(period string) string {
+
+	return tagKey(rs.Key(period), "snapshot")
+}
+
+func (rs *RankScheduler) settleKey(period string) string {
+
+	return tagKey(rs.Key(period), "settle")
+}
+
+//Start 开始定时检查，结算最近Keep个周期中未结算的周期
+func (rs *RankScheduler) Start() {
+
+	go rs.run()
+}
+
+//Close 停止定时检查并等待正在进行的结算完成
+func (rs *RankScheduler) Close() {
+
+	rs.once.Do(func() {
+
+		close(rs.stop)
+	})
+
+	<-rs.done
+}
+
+func (rs *RankScheduler) run() {
+
+	defer close(rs.done)
+
+	ticker := time.NewTicker(rs.options.Interval)
+	defer ticker.Stop()
+
+	for {
+
+		rs.check()
+
+		select {
+
+		case <-rs.stop:
+
+			return
+
+		case <-ticker.C:
+
+		}
+	}
+}
+
+func (rs *RankScheduler) check() {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+
+		select {
+
+		case <-rs.stop:
+
+			cancel()
+
+		case <-ctx.Done():
+
+		}
+	}()
+
+	now := gofunc.TimeNow().Add(-rs.options.Delay)
+	for n := rs.options.Keep; n > 0 && ctx.Err() == nil; n-- {
+
+		period := rs.Period(rs.before(now, n))
+		if err := rs.Settle(ctx, period); err != nil && err != MutexHeldErr {
+
+			log.Printf("rank %s settle %s err=%s", rs.rank.Name(), period, err.Error())
+		}
+	}
+}
+
+//Settled 周期是否已经结算
+func (rs *RankScheduler) Settled(ctx context.Context, period string) (bool, error) {
+
+	r, err := rs.rank.use()
+	if err != nil {
+
+		return false, err
+	}
+
+	return rs.settled(ctx, r, period)
+}
+
+func (rs *RankScheduler) settled(ctx context.Context, r *Redis, period string) (bool, error) {
+
+	state, err := redis.String(r.doRetry(ctx, "GET", rs.settleKey(period)))
+	if err == redis.ErrNil {
+
+		return false, nil
+	}
+
+	return state == rankSettled, err
+}
+
+//Settle 结算一个已经结束的周期，已经结算过时直接返回，其它节点正在结算时返回MutexHeldErr
+func (rs *RankScheduler) Settle(ctx context.Context, period string) error {
+
+	r, err := rs.rank.use()
+	if err != nil {
+
+		return err
+	}
+
+	if ok, err := rs.settled(ctx, r, period); ok || err != nil {
+
+		return err
+	}
+
+	m := r.NewMutex(tagKey(rs.Key(period), "lock"), nil)
+	ok, err := m.TryLock(ctx)
+	if err != nil {
+
+		return err
+	}
+
+	if !ok {
+
+		return MutexHeldErr
+	}
+	defer func() {
+
+		_ = m.Unlock(context.Background())
+	}()
+
+	// 加锁期间其它节点可能已经完成
+	if ok, err = rs.settled(ctx, r, period); ok || err != nil {
+
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+
+		select {
+
+		case <-m.Lost():
+
+			cancel()
+
+		case <-ctx.Done():
+
+		}
+	}()
+
+	list, err := rs.snapshot(ctx, r, period)
+	if err != nil {
+
+		return err
+	}
+
+	if rs.options.Settle != nil && list != nil {
+
+		if err = rs.options.Settle(context.WithValue(ctx, rankSettleToken{}, m.Token()), period, list); err != nil {
+
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+
+		return ctx.Err()
+	}
+
+	ttl := int64(time.Duration(rs.options.Keep) * rs.length() / time.Millisecond)
+
+	pipe := &PipeLine{}
+	_ = pipe.Append("SET", rs.settleKey(period), rankSettled, "PX", ttl)
+	_ = pipe.Append("PEXPIRE", rs.Key(period), ttl)
+	_ = pipe.Append("PEXPIRE", rs.snapshotKey(period), ttl)
+	_ = pipe.Append("PEXPIRE", rs.rank.payloadKey(rs.Key(period)), ttl)
+	if !r.RunPipeLineCtx(ctx, pipe) {
+
+		return pipe.Err()
+	}
+
+	return nil
+}
+
+//snapshot 复制前Top名到快照，快照已经存在时直接读取，排行榜不存在时返回nil
+func (rs *RankScheduler) snapshot(ctx context.Context, r *Redis, period string) ([][]string, error) {
+
+	key, snapshotKey := rs.Key(period), rs.snapshotKey(period)
+
+	n, err := redis.Int64(r.do(ctx, "EXISTS", snapshotKey))
+	if err != nil {
+
+		return nil, err
+	}
+
+	if n == 0 {
+
+		list, err := r.ZrevrangeCtx(ctx, key, 0, rs.options.Top-1)
+		if err != nil || len(list) == 0 {
+
+			return nil, err
+		}
+
+		// 先写入临时key再改名，中途失败不会留下不完整的快照
+		tmp := tagKey(key, "snapshot:tmp")
+		pipe := &PipeLine{}
+		_ = pipe.Append("DEL", tmp)
+		for len(list) > 0 {
+
+			batch := list
+			if len(batch) > scanCount {
+
+				batch = batch[:scanCount]
+			}
+			list = list[len(batch):]
+
+			args := make([]interface{}, 1, 2*len(batch)+1)
+			args[0] = tmp
+			for _, v := range batch {
+
+				args = append(args, v[1], v[0])
+			}
+			_ = pipe.Append("ZADD", args...)
+		}
+		_ = pipe.Append("RENAME", tmp, snapshotKey)
+
+		if !r.RunPipeLineCtx(ctx, pipe) {
+
+			return nil, pipe.Err()
+		}
+	}
+
+	return rs.Snapshot(ctx, period)
+}
+
+//Snapshot 读取周期结束时的排名快照，格式和GetRankByPage相同
+func (rs *RankScheduler) Snapshot(ctx context.Context, period string) ([][]string, error) {
+
+	r, err := rs.rank.use()
+	if err != nil {
+
+		return nil, err
+	}
+
+	return rs.rank.decodeList(r.ZrevrangeCtx(ctx, rs.snapshotKey(period), 0, rs.options.Top-1))
+}
@@ -0,0 +1,269 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/laonsx/gamelib/gofunc"
+)
+
+type periodRank struct {
+}
+
+func (rank *periodRank) Name() string {
+
+	return "period"
+}
+
+func (rank *periodRank) Key() string {
+
+	return "period"
+}
+
+func (rank *periodRank) RedisName() string {
+
+	return "ranktest"
+}
+
+func TestRankScheduler_Period(t *testing.T) {
+
+	rank := NewRank(&periodRank{})
+
+	// 2026-01-01 00:30 +08:00 是2026年第1周
+	at := time.Date(2025, 12, 31, 16, 30, 0, 0, time.UTC)
+	for _, v := range []struct {
+		period RankPeriod
+		want   string
+		prev   string
+	}{{RankDaily, "20260101", "20251231"}, {RankWeekly, "202601", "202552"}, {RankMonthly, "202601", "202512"}} {
+
+		rs := rank.NewScheduler(&RankSchedulerOptions{Period: v.period})
+		if p := rs.Period(at); p != v.want {
+
+			t.Fatal("Period:", v.period, p)
+		}
+
+		if p := rs.Period(rs.before(at, 1)); p != v.prev {
+
+			t.Fatal("Period before:", v.period, p)
+		}
+	}
+
+	rs := rank.NewScheduler(&RankSchedulerOptions{Period: RankMonthly})
+	if p := rs.Period(rs.before(time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC), 1)); p != "202602" {
+
+		t.Fatal("Period month end:", p)
+	}
+}
+
+func TestRankScheduler_Settle(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	useFakeRedis("ranktest", s)
+
+	testRankSchedulerSettle(t)
+}
+
+// TestRankScheduler_SettleLive 在真实redis上执行结算锁的lua脚本
+func TestRankScheduler_SettleLive(t *testing.T) {
+
+	rs := NewRank(&periodRank{}).NewScheduler(nil)
+
+	var keys []string
+	for n := 1; n <= 2; n++ {
+
+		key := rs.Key(rs.Period(rs.before(gofunc.TimeNow(), n)))
+		keys = append(keys, key, tagKey(key, "snapshot"), tagKey(key, "settle"), tagKey(key, "payload"))
+	}
+
+	r := useLiveRedis(t, "ranktest", keys...)
+	defer r.Close()
+
+	testRankSchedulerSettle(t)
+}
+
+func testRankSchedulerSettle(t *testing.T) {
+
+	var mux sync.Mutex
+	var settled [][]string
+	var tokens []int64
+	calls := 0
+	fail := true
+
+	rank := NewRank(&periodRank{})
+	rs := rank.NewScheduler(&RankSchedulerOptions{
+		Top: 2,
+		Settle: func(ctx context.Context, period string, list [][]string) error {
+
+			mux.Lock()
+			defer mux.Unlock()
+
+			calls++
+			tokens = append(tokens, RankSettleToken(ctx))
+			if fail {
+
+				fail = false
+
+				return errors.New("settle failed")
+			}
+
+			settled = list
+
+			return nil
+		},
+	})
+
+	period := rs.Period(rs.before(gofunc.TimeNow(), 1))
+	key := rs.Key(period)
+	for i := 1; i <= 3; i++ {
+
+		if err := rank.SetRankScore(key, i, i*10); err != nil {
+
+			t.Fatal("SetRankScore:", err)
+		}
+	}
+
+	if err := rank.SetRankPayload(key, 1, &rankPlayer{Name: "p1"}); err != nil {
+
+		t.Fatal("SetRankPayload:", err)
+	}
+
+	ctx := context.Background()
+	if err := rs.Settle(ctx, period); err == nil {
+
+		t.Fatal("Settle should fail")
+	}
+
+	// 重试时使用第一次的快照
+	if err := rank.SetRankScore(key, 4, 100); err != nil {
+
+		t.Fatal("SetRankScore:", err)
+	}
+
+	if err := rs.Settle(ctx, period); err != nil {
+
+		t.Fatal("Settle:", err)
+	}
+
+	if calls != 2 || len(settled) != 2 || settled[0][0] != "3" || settled[1][0] != "2" {
+
+		t.Fatal("Settle list:", calls, settled)
+	}
+
+	// 每次结算的fencing token递增，回调可以用来拒绝过期的写入
+	if tokens[0] <= 0 || tokens[1] <= tokens[0] {
+
+		t.Fatal("RankSettleToken:", tokens)
+	}
+
+	if ok, err := rs.Settled(ctx, period); !ok || err != nil {
+
+		t.Fatal("Settled:", ok, err)
+	}
+
+	if err := rs.Settle(ctx, period); err != nil || calls != 2 {
+
+		t.Fatal("Settle again:", calls, err)
+	}
+
+	r, _ := UseRedisByName("ranktest")
+	if ttl, err := redis.Int64(r.do(ctx, "PTTL", key)); err != nil || ttl <= 0 {
+
+		t.Fatal("board ttl:", ttl, err)
+	}
+
+	if ttl, err := redis.Int64(r.do(ctx, "PTTL", rank.payloadKey(key))); err != nil || ttl <= 0 {
+
+		t.Fatal("payload ttl:", ttl, err)
+	}
+
+	list, err := rs.Snapshot(ctx, period)
+	if err != nil || len(list) != 2 || list[0][1] != "30" {
+
+		t.Fatal("Snapshot:", list, err)
+	}
+
+	// 其它节点持有结算锁
+	other := rs.Period(rs.before(gofunc.TimeNow(), 2))
+	m := r.NewMutex(tagKey(rs.Key(other), "lock"), nil)
+	if ok, err := m.TryLock(ctx); !ok || err != nil {
+
+		t.Fatal("TryLock:", ok, err)
+	}
+
+	if err = rs.Settle(ctx, other); err != MutexHeldErr {
+
+		t.Fatal("Settle locked:", err)
+	}
+	_ = m.Unlock(ctx)
+
+	// 没有数据的周期不调用结算
+	if err = rs.Settle(ctx, other); err != nil || calls != 2 {
+
+		t.Fatal("Settle empty:", calls, err)
+	}
+}
+
+func TestRankScheduler_Start(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	useFakeRedis("ranktest", s)
+
+	done := make(chan string, 1)
+	rank := NewRank(&periodRank{})
+	rs := rank.NewScheduler(&RankSchedulerOptions{
+		Period:   RankWeekly,
+		Keep:     2,
+		Interval: time.Duration(10) * time.Millisecond,
+		Settle: func(ctx context.Context, period string, list [][]string) error {
+
+			done <- period + ":" + strconv.Itoa(len(list))
+
+			return nil
+		},
+	})
+
+	period := rs.Period(rs.before(gofunc.TimeNow(), 1))
+	if err := rank.SetRankScore(rs.Key(period), 1, 1); err != nil {
+
+		t.Fatal("SetRankScore:", err)
+	}
+
+	// 当前周期不结算
+	if err := rank.SetRankScore(rs.CurrentKey(), 1, 1); err != nil {
+
+		t.Fatal("SetRankScore:", err)
+	}
+
+	rs.Start()
+	defer rs.Close()
+
+	select {
+
+	case v := <-done:
+
+		if v != period+":1" {
+
+			t.Fatal("settled:", v)
+		}
+
+	case <-time.After(time.Second):
+
+		t.Fatal("settle timeout")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if len(done) != 0 {
+
+		t.Fatal("settled twice:", <-done)
+	}
+}
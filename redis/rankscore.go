@@ -0,0 +1,398 @@
+package redis
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//rankScoreBits zset的分数是float64，53位以内的整数可以精确保存
+const rankScoreBits = 53
+
+var (
+	RankScoreBitsErr  = errors.New("rank score bits out of range")
+	RankScoreRangeErr = errors.New("rank score value out of range")
+	RankScoreArgsErr  = errors.New("rank score values count error")
+	RankScoreModeErr  = errors.New("rank score mode error")
+)
+
+// KEYS[1] 排行榜 ARGV[1] 成员 ARGV[2] 第一个字段的倍数 ARGV[3] 增量 ARGV[4] 第一个字段的上限 ARGV[5] 其它字段，为空时保持原值
+// ARGV[6] 成员不存在时的分数，第一个字段为0的编码
+// 分数都是53位以内的整数，lua的number可以精确计算，写入时用%.0f避免转换成科学计数法
+var rankIncrScript = RegisterScript("rank_incr", 1, `
+local mult = tonumber(ARGV[2])
+local old = tonumber(redis.call("ZSCORE", KEYS[1], ARGV[1]) or ARGV[6])
+local high = math.floor(old / mult) + tonumber(ARGV[3])
+if high < 0 or high >= tonumber(ARGV[4]) then
+	return redis.error_reply("rank score value out of range")
+end
+local low = old % mult
+if ARGV[5] ~= "" then
+	low = tonumber(ARGV[5])
+end
+local score = string.format("%.0f", high * mult + low)
+redis.call("ZADD", KEYS[1], score, ARGV[1])
+return score
+`)
+
+//RankField 组合分数的字段，Bits为占用的位数，Asc为true时值越小排名越靠前
+type RankField struct {
+	Name string
+	Bits uint
+	Asc  bool
+}
+
+//RankScore 把多个字段编码到一个zset分数，前面的字段优先比较，所有字段的位数之和不超过53
+//
+//	// 等级相同比较战力，都相同时先达成的在前
+//	score, _ := NewTimeRankScore(epoch, time.Second, RankField{"level", 8, false}, RankField{"power", 24, false})
+type RankScore struct {
+	fields []RankField
+	shifts []uint
+	timed  bool
+	epoch  int64
+	unit   time.Duration
+}
+
+//NewRankScore 创建组合分数
+func NewRankScore(fields ...RankField) (*RankScore, error) {
+
+	if len(fields) == 0 {
+
+		return nil, RankScoreBitsErr
+	}
+
+	var bits uint
+	for _, field := range fields {
+
+		if field.Bits == 0 {
+
+			return nil, RankScoreBitsErr
+		}
+
+		bits += field.Bits
+	}
+
+	if bits > rankScoreBits {
+
+		return nil, RankScoreBitsErr
+	}
+
+	rs := &RankScore{fields: fields, shifts: make([]uint, len(fields))}
+	for i := range fields {
+
+		bits -= fields[i].Bits
+		rs.shifts[i] = bits
+	}
+
+	return rs, nil
+}
+
+//NewTimeRankScore 创建时间排序的组合分数，fields相同时先达成的排名靠前
+//剩余的位数保存从epoch开始以unit为单位的达成时间，比如unit为秒、剩余32位时可以使用136年
+func NewTimeRankScore(epoch time.Time, unit time.Duration, fields ...RankField) (*RankScore, error) {
+
+	if unit <= 0 {
+
+		return nil, RankScoreBitsErr
+	}
+
+	var bits uint
+	for _, field := range fields {
+
+		bits += field.Bits
+	}
+
+	if bits >= rankScoreBits {
+
+		return nil, RankScoreBitsErr
+	}
+
+	all := make([]RankField, len(fields), len(fields)+1)
+	copy(all, fields)
+	all = append(all, RankField{Name: "time", Bits: rankScoreBits - bits, Asc: true})
+
+	rs, err := NewRankScore(all...)
+	if err != nil {
+
+		return nil, err
+	}
+
+	rs.timed = true
+	rs.unit = unit
+	rs.epoch = epoch.UnixNano() / int64(unit)
+
+	return rs, nil
+}
+
+//Fields 字段名，时间排序时最后一个字段为time
+func (rs *RankScore) Fields() []string {
+
+	names := make([]string, len(rs.fields))
+	for i, field := range rs.fields {
+
+		names[i] = field.Name
+	}
+
+	return names
+}
+
+//Timed 是否时间排序
+func (rs *RankScore) Timed() bool {
+
+	return rs.timed
+}
+
+//Encode 按字段顺序编码，时间排序时最后一个值为以unit为单位的unix时间
+func (rs *RankScore) Encode(values ...int64) (int64, error) {
+
+	if len(values) != len(rs.fields) {
+
+		return 0, RankScoreArgsErr
+	}
+
+	var score int64
+	for i, field := range rs.fields {
+
+		v := values[i]
+		if rs.timed && i == len(rs.fields)-1 {
+
+			v -= rs.epoch
+		}
+
+		max := int64(1)<<field.Bits - 1
+		if v < 0 || v > max {
+
+			return 0, RankScoreRangeErr
+		}
+
+		if field.Asc {
+
+			v = max - v
+		}
+
+		score |= v << rs.shifts[i]
+	}
+
+	return score, nil
+}
+
+//EncodeAt 时间排序的编码，values不包括时间
+func (rs *RankScore) EncodeAt(at time.Time, values ...int64) (int64, error) {
+
+	if !rs.timed {
+
+		return 0, RankScoreModeErr
+	}
+
+	all := make([]int64, len(values), len(values)+1)
+	copy(all, values)
+
+	return rs.Encode(append(all, rs.timeValue(at))...)
+}
+
+func (rs *RankScore) timeValue(at time.Time) int64 {
+
+	return at.UnixNano() / int64(rs.unit)
+}
+
+//Decode 解码分数，时间排序时最后一个值为以unit为单位的unix时间
+func (rs *RankScore) Decode(score int64) []int64 {
+
+	values := make([]int64, len(rs.fields))
+	for i, field := range rs.fields {
+
+		max := int64(1)<<field.Bits - 1
+		v := score >> rs.shifts[i] & max
+		if field.Asc {
+
+			v = max - v
+		}
+
+		if rs.timed && i == len(rs.fields)-1 {
+
+			v += rs.epoch
+		}
+
+		values[i] = v
+	}
+
+	return values
+}
+
+//DecodeString 解码zset返回的分数
+func (rs *RankScore) DecodeString(score string) ([]int64, error) {
+
+	f, err := strconv.ParseFloat(score, 64)
+	if err != nil {
+
+		return nil, err
+	}
+
+	return rs.Decode(int64(f)), nil
+}
+
+//incrArgs 增加第一个字段的脚本参数，values为其它字段的值，为空时保持原值
+func (rs *RankScore) incrArgs(n int64, values []int64) ([]interface{}, error) {
+
+	// 不存在的成员第一个字段为0，Asc字段0的编码为最大值
+	first := rs.fields[0]
+	var zero int64
+	if first.Asc {
+
+		n = -n
+		zero = (int64(1)<<first.Bits - 1) << rs.shifts[0]
+	}
+
+	low := ""
+	if len(values) > 0 {
+
+		all := make([]int64, 1, len(values)+1)
+		all = append(all, values...)
+
+		// 只保留第一个字段以外的编码
+		score, err := rs.Encode(all...)
+		if err != nil {
+
+			return nil, err
+		}
+
+		low = strconv.FormatInt(score&(int64(1)<<rs.shifts[0]-1), 10)
+	}
+
+	return []interface{}{int64(1) << rs.shifts[0], n, int64(1) << first.Bits, low, zero}, nil
+}
+
+//SetRankScores 组合分数排行榜设置各个字段，时间排序时最后一个值为以unit为单位的unix时间
+func (rank *Rank) SetRankScores(key string, id interface{}, values ...int64) error {
+
+	if rank.score == nil {
+
+		return RankScoreModeErr
+	}
+
+	score, err := rank.score.Encode(values...)
+	if err != nil {
+
+		return err
+	}
+
+	return rank.SetRankScore(key, id, score)
+}
+
+//SetRankScoreAt 时间排序排行榜设置分数和达成时间，values不包括时间
+func (rank *Rank) SetRankScoreAt(key string, id interface{}, at time.Time, values ...int64) error {
+
+	if rank.score == nil {
+
+		return RankScoreModeErr
+	}
+
+	score, err := rank.score.EncodeAt(at, values...)
+	if err != nil {
+
+		return err
+	}
+
+	return rank.SetRankScore(key, id, score)
+}
+
+//IncrbyRankScores 组合分数排行榜原子的增加第一个字段，values为其它字段的新值，为空时保持原值
+//返回增加后的各个字段
+func (rank *Rank) IncrbyRankScores(key string, id interface{}, n int64, values ...int64) ([]int64, error) {
+
+	if rank.score == nil {
+
+		return nil, RankScoreModeErr
+	}
+
+	args, err := rank.score.incrArgs(n, values)
+	if err != nil {
+
+		return nil, err
+	}
+
+	r, err := rank.use()
+	if err != nil {
+
+		return nil, err
+	}
+
+	score, err := redis.String(rankIncrScript.Do(r, append([]interface{}{key, id}, args...)...))
+	if err != nil {
+
+		return nil, err
+	}
+
+	return rank.score.DecodeString(score)
+}
+
+//IncrbyRankScoreAt 时间排序排行榜增加分数并更新达成时间，values为第一个字段和时间之间的字段
+func (rank *Rank) IncrbyRankScoreAt(key string, id interface{}, n int64, at time.Time, values ...int64) ([]int64, error) {
+
+	if rank.score == nil || !rank.score.Timed() {
+
+		return nil, RankScoreModeErr
+	}
+
+	all := make([]int64, len(values), len(values)+1)
+	copy(all, values)
+
+	return rank.IncrbyRankScores(key, id, n, append(all, rank.score.timeValue(at))...)
+}
+
+//GetRankScores 获取排名和解码后的分数，没有排名时返回0, nil, nil
+func (rank *Rank) GetRankScores(key string, id interface{}) (int64, []int64, error) {
+
+	r, err := rank.use()
+	if err != nil {
+
+		return 0, nil, err
+	}
+
+	pipe := &PipeLine{}
+	_ = pipe.Append("ZREVRANK", key, id)
+	_ = pipe.Append("ZSCORE", key, id)
+	if !r.RunPipeLine(pipe) {
+
+		return 0, nil, pipe.Err()
+	}
+
+	if pipe.Commands[0].Result == nil || pipe.Commands[1].Result == nil {
+
+		return 0, nil, nil
+	}
+
+	n, err := redis.Int64(pipe.Commands[0].Result, nil)
+	if err != nil {
+
+		return 0, nil, err
+	}
+
+	score, err := redis.String(pipe.Commands[1].Result, nil)
+	if err != nil {
+
+		return 0, nil, err
+	}
+
+	if rank.score == nil {
+
+		f, err := strconv.ParseFloat(score, 64)
+		if err != nil {
+
+			return 0, nil, err
+		}
+
+		return n + 1, []int64{int64(f)}, nil
+	}
+
+	values, err := rank.score.DecodeString(score)
+	if err != nil {
+
+		return 0, nil, err
+	}
+
+	return n + 1, values, nil
+}
@@ -0,0 +1,337 @@
+package redis
+
+import (
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func init() {
+
+	fakeScript(rankIncrScript, func(s *fakeServer, keys []string, args []string) interface{} {
+
+		mult, _ := strconv.ParseFloat(args[1], 64)
+		n, _ := strconv.ParseFloat(args[2], 64)
+		max, _ := strconv.ParseFloat(args[3], 64)
+		old, ok := s.zset(keys[0], false)[args[0]]
+		if !ok {
+
+			old, _ = strconv.ParseFloat(args[5], 64)
+		}
+
+		high := math.Floor(old/mult) + n
+		if high < 0 || high >= max {
+
+			return fakeError("rank score value out of range")
+		}
+
+		low := math.Mod(old, mult)
+		if len(args[4]) > 0 {
+
+			low, _ = strconv.ParseFloat(args[4], 64)
+		}
+
+		score := strconv.FormatFloat(high*mult+low, 'f', 0, 64)
+		s.call("ZADD", keys[0], score, args[0])
+
+		return score
+	})
+}
+
+// liveRedisEnv 设置后连接不上本机redis时测试失败而不是跳过，CI中设置以保证lua脚本真实执行，
+// 没有redis时只验证fakeScript中go实现的副本
+const liveRedisEnv = "GAMELIB_REDIS_LIVE"
+
+// useLiveRedis 使用本机6379的redis执行真实的lua脚本，连接不上时跳过，keys为测试前清除的key
+func useLiveRedis(t *testing.T, name string, keys ...string) *Redis {
+
+	t.Helper()
+
+	r := newRedis(NewRedisConf(name, "127.0.0.1", "6379", 0))
+	for _, key := range append(keys, "live") {
+
+		if err := r.Del(key); err != nil {
+
+			r.Close()
+
+			if len(os.Getenv(liveRedisEnv)) > 0 {
+
+				t.Fatal("redis unavailable:", err)
+			}
+
+			t.Skip("redis unavailable:", err)
+		}
+	}
+
+	helperMux.Lock()
+	defer helperMux.Unlock()
+
+	if poolRedisHelper == nil {
+
+		poolRedisHelper = make(map[string][]*Redis)
+		poolRedisRing = make(map[string]*Ring)
+	}
+
+	ring := NewRing(0)
+	ring.Add(r, 1)
+	poolRedisHelper[name] = []*Redis{r}
+	poolRedisRing[name] = ring
+
+	return r
+}
+
+// timeRank 等级相同时先达成的在前
+type timeRank struct {
+	score *RankScore
+}
+
+func (rank *timeRank) Name() string {
+
+	return "time"
+}
+
+func (rank *timeRank) Key() string {
+
+	return "time"
+}
+
+func (rank *timeRank) RedisName() string {
+
+	return "ranktest"
+}
+
+func (rank *timeRank) RankScore() *RankScore {
+
+	return rank.score
+}
+
+func TestRankScore(t *testing.T) {
+
+	rs, err := NewRankScore(RankField{"level", 8, false}, RankField{"power", 44, false}, RankField{"cost", 1, true})
+	if err != nil {
+
+		t.Fatal("NewRankScore:", err)
+	}
+
+	if _, err = NewRankScore(RankField{"a", 30, false}, RankField{"b", 24, false}); err != RankScoreBitsErr {
+
+		t.Fatal("NewRankScore bits:", err)
+	}
+
+	values := []int64{255, 1<<44 - 1, 0}
+	score, err := rs.Encode(values...)
+	if err != nil || score != 1<<53-1 || !reflect.DeepEqual(rs.Decode(score), values) {
+
+		t.Fatal("Encode max:", score, err)
+	}
+
+	// float64可以精确保存
+	if float64(score) != float64(score-1)+1 {
+
+		t.Fatal("Encode precision:", score)
+	}
+
+	if _, err = rs.Encode(256, 0, 0); err != RankScoreRangeErr {
+
+		t.Fatal("Encode range:", err)
+	}
+
+	if _, err = rs.Encode(1, 2); err != RankScoreArgsErr {
+
+		t.Fatal("Encode args:", err)
+	}
+
+	a, _ := rs.Encode(2, 100, 1)
+	b, _ := rs.Encode(2, 100, 0)
+	c, _ := rs.Encode(1, 1<<44-1, 0)
+	if !(b > a && a > c) {
+
+		t.Fatal("Encode order:", a, b, c)
+	}
+
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts, err := NewTimeRankScore(epoch, time.Second, RankField{"level", 21, false})
+	if err != nil || !reflect.DeepEqual(ts.Fields(), []string{"level", "time"}) {
+
+		t.Fatal("NewTimeRankScore:", ts, err)
+	}
+
+	at := epoch.Add(time.Hour)
+	early, _ := ts.EncodeAt(at, 10)
+	late, _ := ts.EncodeAt(at.Add(time.Second), 10)
+	if early <= late {
+
+		t.Fatal("EncodeAt order:", early, late)
+	}
+
+	if v := ts.Decode(early); !reflect.DeepEqual(v, []int64{10, at.Unix()}) {
+
+		t.Fatal("Decode time:", v)
+	}
+
+	if _, err = ts.EncodeAt(epoch.Add(-time.Second), 10); err != RankScoreRangeErr {
+
+		t.Fatal("EncodeAt before epoch:", err)
+	}
+
+	if _, err = rs.EncodeAt(at, 1, 2); err != RankScoreModeErr {
+
+		t.Fatal("EncodeAt mode:", err)
+	}
+}
+
+func TestRank_TimeScore(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	useFakeRedis("ranktest", s)
+
+	testRankTimeScore(t)
+}
+
+// TestRank_TimeScoreLive 在真实redis上执行rank_incr
+func TestRank_TimeScoreLive(t *testing.T) {
+
+	r := useLiveRedis(t, "ranktest", "rank:timeday", "rank:timemax", "rank:timeasc")
+	defer r.Close()
+
+	testRankTimeScore(t)
+}
+
+func testRankTimeScore(t *testing.T) {
+
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rs, err := NewTimeRankScore(epoch, time.Second, RankField{"level", 21, false})
+	if err != nil {
+
+		t.Fatal("NewTimeRankScore:", err)
+	}
+
+	rank := NewRank(&timeRank{score: rs})
+	key := rank.GetKey("day")
+	at := epoch.Add(24 * time.Hour)
+
+	// 等级相同时先达成的在前
+	for i, id := range []int{1, 2, 3} {
+
+		if err = rank.SetRankScoreAt(key, id, at.Add(time.Duration(3-i)*time.Second), 10); err != nil {
+
+			t.Fatal("SetRankScoreAt:", err)
+		}
+	}
+
+	if err = rank.SetRankScoreAt(key, 4, at.Add(time.Hour), 11); err != nil {
+
+		t.Fatal("SetRankScoreAt:", err)
+	}
+
+	list, err := rank.GetRankByPage(key, 1, 10)
+	if err != nil || len(list) != 4 {
+
+		t.Fatal("GetRankByPage:", list, err)
+	}
+
+	if !reflect.DeepEqual(list[0], []string{"4", "11", strconv.FormatInt(at.Add(time.Hour).Unix(), 10)}) || list[1][0] != "3" || list[3][0] != "1" {
+
+		t.Fatal("GetRankByPage order:", list)
+	}
+
+	n, values, err := rank.GetRankScores(key, 2)
+	if err != nil || n != 3 || !reflect.DeepEqual(values, []int64{10, at.Add(2 * time.Second).Unix()}) {
+
+		t.Fatal("GetRankScores:", n, values, err)
+	}
+
+	if n, values, err = rank.GetRankScores(key, 100); err != nil || n != 0 || values != nil {
+
+		t.Fatal("GetRankScores none:", n, values, err)
+	}
+
+	// 增加分数后达成时间更新
+	values, err = rank.IncrbyRankScoreAt(key, 1, 2, at.Add(2*time.Hour))
+	if err != nil || !reflect.DeepEqual(values, []int64{12, at.Add(2 * time.Hour).Unix()}) {
+
+		t.Fatal("IncrbyRankScoreAt:", values, err)
+	}
+
+	if score, err := rank.GetRankScore(key, 1); err != nil || score != 12 {
+
+		t.Fatal("GetRankScore:", score, err)
+	}
+
+	if n, err := rank.GetRank(key, 1); err != nil || n != 1 {
+
+		t.Fatal("GetRank:", n, err)
+	}
+
+	if score, err := rank.IncrbyRankScore(key, 4, 1); err != nil || score != 12 {
+
+		t.Fatal("IncrbyRankScore:", score, err)
+	}
+
+	// 1先达成12级
+	list, err = rank.RangeByRank(key, 0, 1)
+	if err != nil || len(list) != 2 || list[0][0] != "1" || list[1][0] != "4" {
+
+		t.Fatal("RangeByRank:", list, err)
+	}
+
+	if _, err = rank.IncrbyRankScoreAt(key, 1, -100, at); err == nil {
+
+		t.Fatal("IncrbyRankScoreAt out of range")
+	}
+
+	// 53位分数的格式化和取余没有精度损失
+	full, _ := NewRankScore(RankField{"level", 8, false}, RankField{"power", 44, false}, RankField{"cost", 1, true})
+	maxRank := NewRank(&timeRank{score: full})
+	maxKey := maxRank.GetKey("max")
+	if err = maxRank.SetRankScores(maxKey, 1, 254, 1<<44-1, 0); err != nil {
+
+		t.Fatal("SetRankScores:", err)
+	}
+
+	if values, err = maxRank.IncrbyRankScores(maxKey, 1, 1); err != nil || !reflect.DeepEqual(values, []int64{255, 1<<44 - 1, 0}) {
+
+		t.Fatal("IncrbyRankScores max:", values, err)
+	}
+
+	if _, err = maxRank.IncrbyRankScores(maxKey, 1, 1); err == nil {
+
+		t.Fatal("IncrbyRankScores overflow")
+	}
+
+	// 第一个字段Asc时不存在的成员从0开始增加
+	asc, _ := NewRankScore(RankField{"cost", 20, true}, RankField{"level", 8, false})
+	ascRank := NewRank(&timeRank{score: asc})
+	ascKey := ascRank.GetKey("asc")
+	if values, err = ascRank.IncrbyRankScores(ascKey, 1, 5); err != nil || !reflect.DeepEqual(values, []int64{5, 0}) {
+
+		t.Fatal("IncrbyRankScores asc:", values, err)
+	}
+
+	if values, err = ascRank.IncrbyRankScores(ascKey, 2, 3, 7); err != nil || !reflect.DeepEqual(values, []int64{3, 7}) {
+
+		t.Fatal("IncrbyRankScores asc values:", values, err)
+	}
+
+	if values, err = ascRank.IncrbyRankScores(ascKey, 1, 2); err != nil || !reflect.DeepEqual(values, []int64{7, 0}) {
+
+		t.Fatal("IncrbyRankScores asc incr:", values, err)
+	}
+
+	list, err = ascRank.GetRankByPage(ascKey, 1, 10)
+	if err != nil || len(list) != 2 || list[0][0] != "2" {
+
+		t.Fatal("GetRankByPage asc:", list, err)
+	}
+
+	plain := NewRank(&TestRank{})
+	if err = plain.SetRankScores(key, 1, 1); err != RankScoreModeErr {
+
+		t.Fatal("SetRankScores plain:", err)
+	}
+}
@@ -1,19 +1,24 @@
 package redis
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
 var (
+	helperMux       sync.RWMutex
 	poolRedisHelper map[string][]*Redis
+	poolRedisRing   map[string]*Ring
 	encode          encodeType
 	decode          decodeType
 )
@@ -22,16 +27,70 @@ type encodeType func(data interface{}) ([]byte, error)
 type decodeType func(data []byte, v interface{}) error
 
 type Redis struct {
-	rate int
-	rp   *redis.Pool
+	rate     int
+	addr     string
+	rp       *redis.Pool
+	sentinel *sentinel
+	cluster  *cluster
 }
 
+//RedisConf redis配置，未设置的连接池参数使用默认值
 type RedisConf struct {
 	Name string `json:"name"`
 	Host string `json:"host"`
 	Port string `json:"port"`
 	Rate int    `json:"rate"`
-}
+
+	//Weight 分片权重，默认1，Rate只在Sharding为rate时用于分片
+	Weight int `json:"weight"`
+	//Sharding 分片方式，默认一致性hash，同名配置中有一个为rate时按旧版Rate分段分片
+	//从旧版升级时已有数据按Rate分布，一致性hash会把大部分key映射到其它分片，需要设置为rate
+	Sharding string `json:"sharding"`
+
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+
+	//MaxIdle 最大空闲连接数，默认64
+	MaxIdle int `json:"max_idle"`
+	//MaxActive 最大连接数，0不限制
+	MaxActive int `json:"max_active"`
+	//Wait 达到MaxActive时等待空闲连接，否则返回错误
+	Wait bool `json:"wait"`
+	//IdleTimeout 空闲连接超时关闭，秒，默认300
+	IdleTimeout int `json:"idle_timeout"`
+	//TestInterval 空闲超过该时间的连接借出时PING检测，秒，默认60，小于0不检测
+	TestInterval int `json:"test_interval"`
+
+	//ConnectTimeout ReadTimeout WriteTimeout 毫秒，默认500
+	ConnectTimeout int `json:"connect_timeout"`
+	ReadTimeout    int `json:"read_timeout"`
+	WriteTimeout   int `json:"write_timeout"`
+
+	TLS           bool `json:"tls"`
+	TLSSkipVerify bool `json:"tls_skip_verify"`
+
+	//Sentinels 哨兵地址host:port，设置后Host和Port无效，连接MasterName的当前master
+	Sentinels        []string `json:"sentinels"`
+	MasterName       string   `json:"master_name"`
+	SentinelPassword string   `json:"sentinel_password"`
+
+	//Cluster 集群种子节点地址host:port，设置后Host和Port无效
+	Cluster []string `json:"cluster"`
+}
+
+//PoolStat 连接池状态
+type PoolStat struct {
+	Addr        string
+	ActiveCount int
+	IdleCount   int
+}
+
+const (
+	defaultMaxIdle      = 64
+	defaultIdleTimeout  = 300
+	defaultTestInterval = 60
+	defaultTimeout      = 500
+)
 
 func NewRedisConf(name string, host string, port string, rate int) *RedisConf {
 
@@ -45,7 +104,11 @@ func NewRedisConf(name string, host string, port string, rate int) *RedisConf {
 
 func InitRedis(encodefunc encodeType, decodefunc decodeType, conf ...*RedisConf) {
 
+	helperMux.Lock()
+	defer helperMux.Unlock()
+
 	poolRedisHelper = make(map[string][]*Redis)
+	poolRedisRing = make(map[string]*Ring)
 
 	encode = encodefunc
 	decode = decodefunc
@@ -61,7 +124,18 @@ func InitRedis(encodefunc encodeType, decodefunc decodeType, conf ...*RedisConf)
 		return p1.Rate < p2.Rate
 	}
 
-	for _, value := range rconf {
+	for name, value := range rconf {
+
+		ring := NewRing(0)
+		poolRedisRing[name] = ring
+
+		for _, v := range value {
+
+			if v.Sharding == ShardingRate {
+
+				ring.rate = true
+			}
+		}
 
 		ps := &sorter{
 			data: value,
@@ -71,20 +145,13 @@ func InitRedis(encodefunc encodeType, decodefunc decodeType, conf ...*RedisConf)
 
 		for _, v := range value {
 
-			if len(v.Name) == 0 || len(v.Host) == 0 || len(v.Port) == 0 {
+			if !v.valid() {
 
 				panic("redis conf error")
 			}
 
-			addr := v.Host + ":" + v.Port
-
-			r := new(Redis)
-
-			r.rp = &redis.Pool{
-				Dial:    Dial(addr),
-				MaxIdle: 64,
-			}
-			r.rate = v.Rate
+			r := newRedis(v)
+			ring.Add(r, v.Weight)
 
 			poolRedisHelper[v.Name] = append(poolRedisHelper[v.Name], r)
 		}
@@ -92,13 +159,228 @@ func InitRedis(encodefunc encodeType, decodefunc decodeType, conf ...*RedisConf)
 
 }
 
+func (conf *RedisConf) valid() bool {
+
+	if len(conf.Name) == 0 {
+
+		return false
+	}
+
+	switch {
+
+	case len(conf.Cluster) > 0:
+
+		return true
+
+	case len(conf.Sentinels) > 0:
+
+		return len(conf.MasterName) > 0
+	}
+
+	return len(conf.Host) > 0 && len(conf.Port) > 0
+}
+
+func newRedis(conf *RedisConf) *Redis {
+
+	r := new(Redis)
+	r.rate = conf.Rate
+
+	switch {
+
+	case len(conf.Cluster) > 0:
+
+		r.addr = "cluster:" + strings.Join(conf.Cluster, ",")
+		r.cluster = newCluster(conf)
+
+	case len(conf.Sentinels) > 0:
+
+		r.addr = "sentinel:" + conf.MasterName
+		r.sentinel = newSentinel(conf)
+
+	default:
+
+		r.addr = conf.Host + ":" + conf.Port
+		r.rp = newPool(conf, DialConf(conf))
+	}
+
+	return r
+}
+
+func newPool(conf *RedisConf, dial func() (redis.Conn, error)) *redis.Pool {
+
+	return &redis.Pool{
+		Dial:         dial,
+		TestOnBorrow: testOnBorrow(conf.TestInterval),
+		MaxIdle:      withDefault(conf.MaxIdle, defaultMaxIdle),
+		MaxActive:    conf.MaxActive,
+		Wait:         conf.Wait,
+		IdleTimeout:  time.Duration(withDefault(conf.IdleTimeout, defaultIdleTimeout)) * time.Second,
+	}
+}
+
+//get 获取连接，哨兵模式连接当前master，集群模式按命令的key路由
+func (r *Redis) get() redis.Conn {
+
+	switch {
+
+	case r.cluster != nil:
+
+		return r.cluster.get()
+
+	case r.sentinel != nil:
+
+		return r.sentinel.pool().Get()
+	}
+
+	return r.rp.Get()
+}
+
+//Close 关闭连接池，哨兵模式同时停止监听主从切换
+func (r *Redis) Close() error {
+
+	switch {
+
+	case r.cluster != nil:
+
+		return r.cluster.close()
+
+	case r.sentinel != nil:
+
+		return r.sentinel.close()
+	}
+
+	return r.rp.Close()
+}
+
+//Dial 使用默认超时连接addr
 func Dial(addr string) func() (redis.Conn, error) {
 
-	timeout := time.Duration(500) * time.Millisecond
+	return func() (redis.Conn, error) {
+
+		return redis.Dial("tcp", addr, dialOptions(&RedisConf{})...)
+	}
+}
+
+//DialConf 按配置连接，包括超时、密码、db和tls
+func DialConf(conf *RedisConf) func() (redis.Conn, error) {
+
+	addr := conf.Host + ":" + conf.Port
+	options := dialOptions(conf)
 
 	return func() (redis.Conn, error) {
 
-		return redis.Dial("tcp", addr, redis.DialConnectTimeout(timeout), redis.DialConnectTimeout(timeout), redis.DialConnectTimeout(timeout))
+		return redis.Dial("tcp", addr, options...)
+	}
+}
+
+func dialOptions(conf *RedisConf) []redis.DialOption {
+
+	millisecond := func(n int) time.Duration {
+
+		return time.Duration(withDefault(n, defaultTimeout)) * time.Millisecond
+	}
+
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(millisecond(conf.ConnectTimeout)),
+		redis.DialReadTimeout(millisecond(conf.ReadTimeout)),
+		redis.DialWriteTimeout(millisecond(conf.WriteTimeout)),
+	}
+
+	if len(conf.Password) > 0 {
+
+		options = append(options, redis.DialPassword(conf.Password))
+	}
+
+	if conf.DB > 0 {
+
+		options = append(options, redis.DialDatabase(conf.DB))
+	}
+
+	if conf.TLS {
+
+		options = append(options, redis.DialUseTLS(true), redis.DialTLSSkipVerify(conf.TLSSkipVerify))
+	}
+
+	return options
+}
+
+//testOnBorrow 空闲超过interval秒的连接借出前PING
+func testOnBorrow(interval int) func(c redis.Conn, t time.Time) error {
+
+	if interval < 0 {
+
+		return nil
+	}
+
+	d := time.Duration(withDefault(interval, defaultTestInterval)) * time.Second
+
+	return func(c redis.Conn, t time.Time) error {
+
+		if time.Since(t) < d {
+
+			return nil
+		}
+
+		_, err := c.Do("PING")
+
+		return err
+	}
+}
+
+func withDefault(v int, def int) int {
+
+	if v <= 0 {
+
+		return def
+	}
+
+	return v
+}
+
+//PoolStats 获取name下所有redis连接池状态
+func PoolStats(name string) []PoolStat {
+
+	helperMux.RLock()
+	defer helperMux.RUnlock()
+
+	var stats []PoolStat
+	for _, r := range poolRedisHelper[name] {
+
+		stats = append(stats, r.Stats())
+	}
+
+	return stats
+}
+
+//Addr redis地址
+func (r *Redis) Addr() string {
+
+	return r.addr
+}
+
+//Stats 连接池状态
+func (r *Redis) Stats() PoolStat {
+
+	var st redis.PoolStats
+	switch {
+
+	case r.cluster != nil:
+
+		st = r.cluster.stats()
+
+	case r.sentinel != nil:
+
+		st = r.sentinel.pool().Stats()
+
+	default:
+
+		st = r.rp.Stats()
+	}
+
+	return PoolStat{
+		Addr:        r.addr,
+		ActiveCount: st.ActiveCount,
+		IdleCount:   st.IdleCount,
 	}
 }
 
@@ -120,29 +402,31 @@ func (s *sorter) Less(i, j int) bool {
 	return s.by(s.data[i], s.data[j])
 }
 
+//UseRedis 按id选择分片，默认使用一致性hash，Sharding为rate时和旧版一样按id%128选择
 func UseRedis(name string, id uint64) (*Redis, error) {
 
-	r, ok := poolRedisHelper[name]
-	if !ok {
-
-		return nil, errors.New("redis mod err")
-	}
+	return UseRedisByKey(name, strconv.FormatUint(id, 10))
+}
 
-	h := hash(id)
-	var key int
-	for k, v := range r {
+//UseRedisByKey 按key在一致性hash环上选择分片
+func UseRedisByKey(name string, key string) (*Redis, error) {
 
-		if h >= v.rate {
+	ring, err := useRing(name)
+	if err != nil {
 
-			key = k
-		}
+		return nil, err
 	}
 
-	return r[key], nil
+	return ring.Get(key), nil
 }
 
+//UseRedisByName 不分片的redis，返回配置中Rate最小的一个，不经过分片路由
+//配置了多个分片的name需要使用UseRedisByKey或Shards
 func UseRedisByName(name string) (*Redis, error) {
 
+	helperMux.RLock()
+	defer helperMux.RUnlock()
+
 	r, ok := poolRedisHelper[name]
 	if !ok {
 
@@ -152,24 +436,43 @@ func UseRedisByName(name string) (*Redis, error) {
 	return r[0], nil
 }
 
-func (r *Redis) Get(key string, v interface{}) (err error) {
+//Shards 获取name下所有分片
+func Shards(name string) ([]*Redis, error) {
 
-	var data interface{}
-	var conn redis.Conn
+	ring, err := useRing(name)
+	if err != nil {
+
+		return nil, err
+	}
 
-	for i := 0; i < 2; i++ {
+	return ring.Shards(), nil
+}
 
-		conn = r.rp.Get()
-		data, err = conn.Do("GET", key)
-		conn.Close()
-		if err == nil {
+func useRing(name string) (*Ring, error) {
 
-			break
-		}
+	helperMux.RLock()
+	defer helperMux.RUnlock()
+
+	ring, ok := poolRedisRing[name]
+	if !ok {
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
+		return nil, errors.New("redis mod err " + name)
 	}
 
+	return ring, nil
+}
+
+func (r *Redis) Get(key string, v interface{}) error {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.GetCtx(ctx, key, v)
+}
+
+func (r *Redis) GetCtx(ctx context.Context, key string, v interface{}) error {
+
+	data, err := r.doRetry(ctx, "GET", key)
 	if err != nil {
 
 		return err
@@ -183,7 +486,15 @@ func (r *Redis) Get(key string, v interface{}) (err error) {
 	return Decode(data, v)
 }
 
-func (r *Redis) Set(key string, data interface{}, expire ...int) (err error) {
+func (r *Redis) Set(key string, data interface{}, expire ...int) error {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.SetCtx(ctx, key, data, expire...)
+}
+
+func (r *Redis) SetCtx(ctx context.Context, key string, data interface{}, expire ...int) (err error) {
 
 	b, e := Encode(data)
 	if e != nil {
@@ -191,93 +502,61 @@ func (r *Redis) Set(key string, data interface{}, expire ...int) (err error) {
 		return e
 	}
 
-	var conn redis.Conn
-	for i := 0; i < 2; i++ {
-
-		conn = r.rp.Get()
-		if len(expire) > 0 {
+	if len(expire) > 0 {
 
-			_, err = conn.Do("SETEX", key, expire[0], b)
-		} else {
-
-			_, err = conn.Do("SET", key, b)
-		}
-		conn.Close()
+		_, err = r.doRetry(ctx, "SETEX", key, expire[0], b)
+	} else {
 
-		if err == nil {
-
-			break
-		}
-
-		time.Sleep(time.Duration(10) * time.Millisecond)
+		_, err = r.doRetry(ctx, "SET", key, b)
 	}
 
 	return
 }
 
-func (r *Redis) Del(key string) (err error) {
-
-	var conn redis.Conn
-	for i := 0; i < 2; i++ {
+func (r *Redis) Del(key string) error {
 
-		conn = r.rp.Get()
-		_, err = conn.Do("DEL", key)
-		conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-		if err == nil {
+	return r.DelCtx(ctx, key)
+}
 
-			break
-		}
+func (r *Redis) DelCtx(ctx context.Context, key string) (err error) {
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
+	_, err = r.doRetry(ctx, "DEL", key)
 
 	return
 }
 
-func (r *Redis) Incrby(key string, n int64) (num int64, err error) {
+func (r *Redis) Incrby(key string, n int64) (int64, error) {
 
-	var conn redis.Conn
-	var ok interface{}
-	for i := 0; i < 2; i++ {
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-		conn = r.rp.Get()
-		ok, err = conn.Do("INCRBY", key, n)
-		conn.Close()
-
-		if err == nil {
+	return r.IncrbyCtx(ctx, key, n)
+}
 
-			break
-		}
+func (r *Redis) IncrbyCtx(ctx context.Context, key string, n int64) (int64, error) {
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
+	ok, err := r.doRetry(ctx, "INCRBY", key, n)
 
 	return reflect.ValueOf(ok).Int(), err
 }
 
-func (r *Redis) Hget(key string, field string, v interface{}) (err error) {
+func (r *Redis) Hget(key string, field string, v interface{}) error {
 
-	var conn redis.Conn
-	var data interface{}
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-	for i := 0; i < 2; i++ {
-
-		conn = r.rp.Get()
-		data, err = conn.Do("HGET", key, field)
-		conn.Close()
-
-		if err == nil {
-
-			break
-		}
+	return r.HgetCtx(ctx, key, field, v)
+}
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
+func (r *Redis) HgetCtx(ctx context.Context, key string, field string, v interface{}) error {
 
+	data, err := r.doRetry(ctx, "HGET", key, field)
 	if err != nil {
 
-		return
+		return err
 	}
 
 	if data != nil {
@@ -290,70 +569,43 @@ func (r *Redis) Hget(key string, field string, v interface{}) (err error) {
 
 func (r *Redis) GetRaw(key string) (interface{}, error) {
 
-	var conn redis.Conn
-	var data interface{}
-	var err error
-
-	for i := 0; i < 2; i++ {
-
-		conn = r.rp.Get()
-		data, err = conn.Do("GET", key)
-		conn.Close()
-
-		if err == nil {
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-			break
-		}
+	return r.GetRawCtx(ctx, key)
+}
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
+func (r *Redis) GetRawCtx(ctx context.Context, key string) (interface{}, error) {
 
-	return data, err
+	return r.doRetry(ctx, "GET", key)
 }
 
 func (r *Redis) Hdel(key string, args string) error {
 
-	var conn redis.Conn
-	var err error
-
-	for i := 0; i < 2; i++ {
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-		conn = r.rp.Get()
-		_, err = conn.Do("HDEL", []interface{}{key, args}...)
-		conn.Close()
-
-		if err == nil {
+	return r.HdelCtx(ctx, key, args)
+}
 
-			return nil
-		}
+func (r *Redis) HdelCtx(ctx context.Context, key string, args string) error {
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
+	_, err := r.doRetry(ctx, "HDEL", key, args)
 
 	return err
 }
 
 func (r *Redis) Hgetall(key string) (map[string]interface{}, error) {
 
-	var conn redis.Conn
-	var err error
-
-	//var data interface{}
-	var data []interface{}
-	for i := 0; i < 2; i++ {
-
-		conn = r.rp.Get()
-		data, err = redis.Values(conn.Do("HGETALL", key))
-		conn.Close()
-
-		if err == nil {
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-			break
-		}
+	return r.HgetallCtx(ctx, key)
+}
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
+func (r *Redis) HgetallCtx(ctx context.Context, key string) (map[string]interface{}, error) {
 
+	data, err := redis.Values(r.doRetry(ctx, "HGETALL", key))
 	if err != nil {
 
 		return nil, err
@@ -383,28 +635,32 @@ func (r *Redis) Hgetall(key string) (map[string]interface{}, error) {
 
 func (r *Redis) HmgetByKey(key string, args string) (interface{}, error) {
 
-	var conn redis.Conn
-	var err error
-	var data interface{}
-
-	for i := 0; i < 2; i++ {
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-		conn = r.rp.Get()
-		data, err = conn.Do("HMGET", []interface{}{key, args}...)
-		conn.Close()
+	return r.HmgetByKeyCtx(ctx, key, args)
+}
 
-		if err == nil {
+func (r *Redis) HmgetByKeyCtx(ctx context.Context, key string, args string) (interface{}, error) {
 
-			return data, nil
-		}
+	data, err := r.doRetry(ctx, "HMGET", key, args)
+	if err != nil {
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
+		return nil, err
 	}
 
-	return nil, err
+	return data, nil
 }
 
-func (r *Redis) Hmget(key string, fields []interface{}, v ...interface{}) (err error) {
+func (r *Redis) Hmget(key string, fields []interface{}, v ...interface{}) error {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.HmgetCtx(ctx, key, fields, v...)
+}
+
+func (r *Redis) HmgetCtx(ctx context.Context, key string, fields []interface{}, v ...interface{}) error {
 
 	fieldsN := len(fields)
 	if len(v) != fieldsN {
@@ -417,23 +673,7 @@ func (r *Redis) Hmget(key string, fields []interface{}, v ...interface{}) (err e
 	args[0] = key
 	copy(args[1:], fields)
 
-	var conn redis.Conn
-	var data []interface{}
-
-	for i := 0; i < 2; i++ {
-
-		conn = r.rp.Get()
-		data, err = redis.Values(conn.Do("HMGET", args...))
-		conn.Close()
-
-		if err == nil {
-
-			break
-		}
-
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
-
+	data, err := redis.Values(r.doRetry(ctx, "HMGET", args...))
 	if err != nil {
 
 		return err
@@ -463,33 +703,36 @@ func (r *Redis) Hmget(key string, fields []interface{}, v ...interface{}) (err e
 	return nil
 }
 
-func (r *Redis) Hset(key string, field string, data interface{}) (err error) {
+func (r *Redis) Hset(key string, field string, data interface{}) error {
 
-	b, e := Encode(data)
-	if e != nil {
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-		return e
-	}
+	return r.HsetCtx(ctx, key, field, data)
+}
 
-	var conn redis.Conn
-	for i := 0; i < 2; i++ {
+func (r *Redis) HsetCtx(ctx context.Context, key string, field string, data interface{}) error {
 
-		conn = r.rp.Get()
-		_, err = conn.Do("HSET", key, field, b)
-		conn.Close()
+	b, err := Encode(data)
+	if err != nil {
 
-		if err == nil {
+		return err
+	}
 
-			break
-		}
+	_, err = r.doRetry(ctx, "HSET", key, field, b)
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
+	return err
+}
 
-	return
+func (r *Redis) Hmset(key string, data map[string]interface{}) error {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.HmsetCtx(ctx, key, data)
 }
 
-func (r *Redis) Hmset(key string, data map[string]interface{}) (err error) {
+func (r *Redis) HmsetCtx(ctx context.Context, key string, data map[string]interface{}) error {
 
 	var args []interface{}
 	args = append(args, key)
@@ -504,25 +747,10 @@ func (r *Redis) Hmset(key string, data map[string]interface{}) (err error) {
 		args = append(args, k, b)
 	}
 
-	var conn redis.Conn
-	var ok interface{}
-	for i := 0; i < 2; i++ {
-
-		conn = r.rp.Get()
-		ok, err = conn.Do("HMSET", args...)
-		conn.Close()
-
-		if err == nil {
-
-			break
-		}
-
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
-
+	ok, err := r.doRetry(ctx, "HMSET", args...)
 	if err != nil {
 
-		return
+		return err
 	}
 
 	if reflect.ValueOf(ok).String() != "OK" {
@@ -533,35 +761,40 @@ func (r *Redis) Hmset(key string, data map[string]interface{}) (err error) {
 	return nil
 }
 
-func (r *Redis) Hincrby(key string, field string, n int64) (num int64, err error) {
+func (r *Redis) Hincrby(key string, field string, n int64) (int64, error) {
 
-	var conn redis.Conn
-	var ok interface{}
-	for i := 0; i < 2; i++ {
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-		conn = r.rp.Get()
-		ok, err = conn.Do("HINCRBY", key, field, n)
-		conn.Close()
+	return r.HincrbyCtx(ctx, key, field, n)
+}
 
-		if err == nil {
+func (r *Redis) HincrbyCtx(ctx context.Context, key string, field string, n int64) (int64, error) {
 
-			break
-		}
+	ok, err := r.doRetry(ctx, "HINCRBY", key, field, n)
+	if err != nil {
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
+		return 0, err
 	}
 
-	if err != nil {
+	return reflect.ValueOf(ok).Int(), nil
+}
 
-		return
-	}
+func (r *Redis) Hmincrby(key string, data map[string]int64) (map[string]int64, error) {
 
-	return reflect.ValueOf(ok).Int(), err
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.HmincrbyCtx(ctx, key, data)
 }
 
-func (r *Redis) Hmincrby(key string, data map[string]int64) (ret map[string]int64, err error) {
+func (r *Redis) HmincrbyCtx(ctx context.Context, key string, data map[string]int64) (ret map[string]int64, err error) {
+
+	conn, err := r.getContext(ctx)
+	if err != nil {
 
-	conn := r.rp.Get()
+		return
+	}
 	defer conn.Close()
 
 	var fields []string
@@ -586,7 +819,7 @@ func (r *Redis) Hmincrby(key string, data map[string]int64) (ret map[string]int6
 	for _, f := range fields {
 
 		var i interface{}
-		i, err = conn.Receive()
+		i, err = receiveContext(ctx, conn)
 		if err != nil {
 
 			return
@@ -603,52 +836,60 @@ func (r *Redis) Hmincrby(key string, data map[string]int64) (ret map[string]int6
 	return
 }
 
-func (r *Redis) Hgetraw(key string, field string) (data interface{}, err error) {
-
-	var conn redis.Conn
-	for i := 0; i < 2; i++ {
-
-		conn = r.rp.Get()
-		data, err = conn.Do("HGET", key, field)
-		conn.Close()
+func (r *Redis) Hgetraw(key string, field string) (interface{}, error) {
 
-		if err == nil {
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-			break
-		}
+	return r.HgetrawCtx(ctx, key, field)
+}
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
+func (r *Redis) HgetrawCtx(ctx context.Context, key string, field string) (interface{}, error) {
 
-	return
+	return r.doRetry(ctx, "HGET", key, field)
 }
 
 func (r *Redis) Zadd(key string, id interface{}, score interface{}) error {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.ZaddCtx(ctx, key, id, score)
+}
+
+func (r *Redis) ZaddCtx(ctx context.Context, key string, id interface{}, score interface{}) error {
 
-	_, err := conn.Do("ZADD", key, score, id)
+	_, err := r.do(ctx, "ZADD", key, score, id)
 
 	return err
 }
 
 func (r *Redis) Zrem(key string, id interface{}) error {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.ZremCtx(ctx, key, id)
+}
+
+func (r *Redis) ZremCtx(ctx context.Context, key string, id interface{}) error {
 
-	_, err := conn.Do("ZREM", key, id)
+	_, err := r.do(ctx, "ZREM", key, id)
 
 	return err
 }
 
 func (r *Redis) Zscore(key string, id interface{}) (int64, error) {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.ZscoreCtx(ctx, key, id)
+}
+
+func (r *Redis) ZscoreCtx(ctx context.Context, key string, id interface{}) (int64, error) {
 
-	data, err := conn.Do("ZSCORE", key, id)
+	data, err := r.do(ctx, "ZSCORE", key, id)
 	if err != nil {
 
 		return 0, err
@@ -657,18 +898,56 @@ func (r *Redis) Zscore(key string, id interface{}) (int64, error) {
 	if data != nil {
 
 		b := data.([]byte)
-		return strconv.ParseInt(string(b), 10, 64)
+		n, err := strconv.ParseInt(string(b), 10, 64)
+		if err != nil {
+
+			// 小数分数取整数部分
+			f, ferr := strconv.ParseFloat(string(b), 64)
+			if ferr != nil {
+
+				return 0, err
+			}
+
+			return int64(f), nil
+		}
+
+		return n, nil
 	}
 
 	return 0, nil
 }
 
+//ZscoreFloat 获取分数，成员不存在时返回0
+func (r *Redis) ZscoreFloat(key string, id interface{}) (float64, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.ZscoreFloatCtx(ctx, key, id)
+}
+
+func (r *Redis) ZscoreFloatCtx(ctx context.Context, key string, id interface{}) (float64, error) {
+
+	data, err := r.doRetry(ctx, "ZSCORE", key, id)
+	if err != nil || data == nil {
+
+		return 0, err
+	}
+
+	return redis.Float64(data, nil)
+}
+
 func (r *Redis) Zincrby(key string, id interface{}, n int) (int64, error) {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.ZincrbyCtx(ctx, key, id, n)
+}
 
-	data, err := conn.Do("ZINCRBY", key, n, id)
+func (r *Redis) ZincrbyCtx(ctx context.Context, key string, id interface{}, n int) (int64, error) {
+
+	data, err := r.do(ctx, "ZINCRBY", key, n, id)
 	if err != nil {
 
 		return 0, err
@@ -685,10 +964,15 @@ func (r *Redis) Zincrby(key string, id interface{}, n int) (int64, error) {
 
 func (r *Redis) Zrank(key string, id interface{}) (int64, error) {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.ZrankCtx(ctx, key, id)
+}
 
-	data, err := conn.Do("ZRANK", key, id)
+func (r *Redis) ZrankCtx(ctx context.Context, key string, id interface{}) (int64, error) {
+
+	data, err := r.do(ctx, "ZRANK", key, id)
 	if err != nil {
 
 		return 0, err
@@ -699,10 +983,15 @@ func (r *Redis) Zrank(key string, id interface{}) (int64, error) {
 
 func (r *Redis) Zrevrank(key string, id interface{}) (int64, error) {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.ZrevrankCtx(ctx, key, id)
+}
 
-	data, err := conn.Do("ZREVRANK", key, id)
+func (r *Redis) ZrevrankCtx(ctx context.Context, key string, id interface{}) (int64, error) {
+
+	data, err := r.do(ctx, "ZREVRANK", key, id)
 	if err != nil {
 
 		return 0, err
@@ -717,8 +1006,13 @@ func (r *Redis) Zrevrank(key string, id interface{}) (int64, error) {
 
 func (r *Redis) Zrevrange(key string, start int, end int) ([][]string, error) {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.ZrevrangeCtx(ctx, key, start, end)
+}
+
+func (r *Redis) ZrevrangeCtx(ctx context.Context, key string, start int, end int) ([][]string, error) {
 
 	var args []interface{}
 	args = append(args, key)
@@ -727,7 +1021,7 @@ func (r *Redis) Zrevrange(key string, start int, end int) ([][]string, error) {
 	//if withscores {
 	args = append(args, "WITHSCORES")
 	//}
-	data, err := conn.Do("ZREVRANGE", args...)
+	data, err := r.do(ctx, "ZREVRANGE", args...)
 	if err != nil {
 
 		return nil, err
@@ -760,13 +1054,18 @@ func (r *Redis) Zrevrange(key string, start int, end int) ([][]string, error) {
 
 func (r *Redis) ZrangeByScore(key string, params ...interface{}) ([]string, error) {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.ZrangeByScoreCtx(ctx, key, params...)
+}
+
+func (r *Redis) ZrangeByScoreCtx(ctx context.Context, key string, params ...interface{}) ([]string, error) {
 
 	var args []interface{}
 	args = append(args, key)
 	args = append(args, params...)
-	data, err := conn.Do("ZRANGEBYSCORE", args...)
+	data, err := r.do(ctx, "ZRANGEBYSCORE", args...)
 	if err != nil {
 
 		return nil, err
@@ -789,13 +1088,18 @@ func (r *Redis) ZrangeByScore(key string, params ...interface{}) ([]string, erro
 
 func (r *Redis) ZrevrangeByScore(key string, params ...interface{}) ([]string, error) {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.ZrevrangeByScoreCtx(ctx, key, params...)
+}
+
+func (r *Redis) ZrevrangeByScoreCtx(ctx context.Context, key string, params ...interface{}) ([]string, error) {
 
 	var args []interface{}
 	args = append(args, key)
 	args = append(args, params...)
-	data, err := conn.Do("ZREVRANGEBYSCORE", args...)
+	data, err := r.do(ctx, "ZREVRANGEBYSCORE", args...)
 	if err != nil {
 
 		return nil, err
@@ -816,10 +1120,16 @@ func (r *Redis) ZrevrangeByScore(key string, params ...interface{}) ([]string, e
 }
 
 func (r *Redis) Zcard(key string) (int64, error) {
-	conn := r.rp.Get()
-	defer conn.Close()
 
-	data, err := conn.Do("ZCARD", key)
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.ZcardCtx(ctx, key)
+}
+
+func (r *Redis) ZcardCtx(ctx context.Context, key string) (int64, error) {
+
+	data, err := r.do(ctx, "ZCARD", key)
 	if err != nil {
 
 		return 0, err
@@ -835,10 +1145,15 @@ func (r *Redis) Zcard(key string) (int64, error) {
 
 func (r *Redis) Zcount(key string, s, e interface{}) (int64, error) {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-	data, err := conn.Do("ZCOUNT", key, s, e)
+	return r.ZcountCtx(ctx, key, s, e)
+}
+
+func (r *Redis) ZcountCtx(ctx context.Context, key string, s, e interface{}) (int64, error) {
+
+	data, err := r.do(ctx, "ZCOUNT", key, s, e)
 	if err != nil {
 
 		return 0, err
@@ -854,7 +1169,17 @@ func (r *Redis) Zcount(key string, s, e interface{}) (int64, error) {
 
 func (r *Redis) Subscribe(channels []string, cb func([]byte)) error {
 
-	conn := r.rp.Get()
+	return r.SubscribeCtx(context.Background(), channels, cb)
+}
+
+//SubscribeCtx 订阅直到连接出错或ctx取消，ctx取消时退订并返回ctx的错误
+func (r *Redis) SubscribeCtx(ctx context.Context, channels []string, cb func([]byte)) error {
+
+	conn, err := r.getContext(ctx)
+	if err != nil {
+
+		return err
+	}
 	defer conn.Close()
 
 	psc := redis.PubSubConn{Conn: conn}
@@ -863,9 +1188,32 @@ func (r *Redis) Subscribe(channels []string, cb func([]byte)) error {
 		_ = psc.Subscribe(cl)
 	}
 
+	done, stopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+
+		close(done)
+		<-stopped
+	}()
+
+	go func() {
+
+		defer close(stopped)
+
+		select {
+
+		case <-ctx.Done():
+
+			_ = psc.Unsubscribe()
+
+		case <-done:
+
+		}
+	}()
+
 	for {
 
-		switch v := psc.Receive().(type) {
+		// 订阅连接不使用读超时
+		switch v := psc.ReceiveWithTimeout(0).(type) {
 
 		case redis.Message:
 
@@ -875,6 +1223,11 @@ func (r *Redis) Subscribe(channels []string, cb func([]byte)) error {
 
 			log.Println("[info] subscribe", v.Channel, v.Kind, v.Count)
 
+			if v.Count == 0 && ctx.Err() != nil {
+
+				return ctx.Err()
+			}
+
 		case error:
 
 			return v
@@ -885,18 +1238,28 @@ func (r *Redis) Subscribe(channels []string, cb func([]byte)) error {
 
 func (r *Redis) Publish(channel string, msg []byte) error {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.PublishCtx(ctx, channel, msg)
+}
+
+func (r *Redis) PublishCtx(ctx context.Context, channel string, msg []byte) error {
 
-	_, err := conn.Do("PUBLISH", channel, msg)
+	_, err := r.do(ctx, "PUBLISH", channel, msg)
 
 	return err
 }
 
 func (r *Redis) Lpush(key string, v interface{}) error {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.LpushCtx(ctx, key, v)
+}
+
+func (r *Redis) LpushCtx(ctx context.Context, key string, v interface{}) error {
 
 	b, err := Encode(v)
 	if err != nil {
@@ -904,15 +1267,20 @@ func (r *Redis) Lpush(key string, v interface{}) error {
 		return err
 	}
 
-	_, err = conn.Do("LPUSH", key, b)
+	_, err = r.do(ctx, "LPUSH", key, b)
 
 	return err
 }
 
 func (r *Redis) Rpush(key string, v interface{}) error {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.RpushCtx(ctx, key, v)
+}
+
+func (r *Redis) RpushCtx(ctx context.Context, key string, v interface{}) error {
 
 	b, err := Encode(v)
 	if err != nil {
@@ -920,17 +1288,22 @@ func (r *Redis) Rpush(key string, v interface{}) error {
 		return err
 	}
 
-	_, err = conn.Do("RPUSH", key, b)
+	_, err = r.do(ctx, "RPUSH", key, b)
 
 	return err
 }
 
 func (r *Redis) Lpop(key string, v interface{}) error {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.LpopCtx(ctx, key, v)
+}
 
-	data, err := conn.Do("LPOP", key)
+func (r *Redis) LpopCtx(ctx context.Context, key string, v interface{}) error {
+
+	data, err := r.do(ctx, "LPOP", key)
 	if data != nil && v != nil {
 
 		return Decode(data, v)
@@ -938,204 +1311,233 @@ func (r *Redis) Lpop(key string, v interface{}) error {
 
 	return err
 }
-func (r *Redis) Rpop(key string, v interface{}) error {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+//LpopCount 弹出最多count个元素，需要redis 6.2
+func (r *Redis) LpopCount(key string, count int) ([][]byte, error) {
 
-	data, err := conn.Do("RPOP", key)
-	if data != nil && v != nil {
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-		return Decode(data, v)
+	return r.LpopCountCtx(ctx, key, count)
+}
+
+func (r *Redis) LpopCountCtx(ctx context.Context, key string, count int) ([][]byte, error) {
+
+	values, err := redis.ByteSlices(r.do(ctx, "LPOP", key, count))
+	if err == redis.ErrNil {
+
+		return nil, nil
 	}
 
-	return err
+	return values, err
 }
 
-func (r *Redis) Lrange(key string, start interface{}, offset interface{}) ([]interface{}, error) {
+//Blpop 按keys顺序弹出第一个非空list的元素，都为空时阻塞等待timeout，超时返回空key
+func (r *Redis) Blpop(timeout time.Duration, keys ...string) (string, []byte, error) {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+DefaultTimeout)
+	defer cancel()
 
-	var args []interface{}
-	args = append(args, key)
-	args = append(args, start)
-	args = append(args, offset)
-	data, err := conn.Do("LRANGE", args...)
-	if data != nil {
+	return r.BlpopCtx(ctx, timeout, keys...)
+}
 
-		return data.([]interface{}), nil
+//BlpopCtx timeout按秒向上取整，ctx没有截止时间时以timeout加DefaultTimeout为读超时
+func (r *Redis) BlpopCtx(ctx context.Context, timeout time.Duration, keys ...string) (string, []byte, error) {
+
+	if _, ok := ctx.Deadline(); !ok {
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout+DefaultTimeout)
+		defer cancel()
 	}
 
-	return nil, err
-}
+	seconds := int64((timeout + time.Second - 1) / time.Second)
+	if seconds <= 0 {
 
-func (r *Redis) Llen(key string) (int64, error) {
+		seconds = 1
+	}
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	args := make([]interface{}, 0, len(keys)+1)
+	for _, key := range keys {
 
-	data, err := conn.Do("LLEN", key)
-	if err != nil {
+		args = append(args, key)
+	}
+	args = append(args, seconds)
 
-		return 0, err
+	values, err := redis.ByteSlices(r.do(ctx, "BLPOP", args...))
+	if err == redis.ErrNil {
+
+		return "", nil, nil
 	}
 
-	if data == nil {
+	if err != nil {
 
-		return 0, nil
+		return "", nil, err
 	}
 
-	return data.(int64), err
-}
+	if len(values) != 2 {
 
-func (r *Redis) Sadd(key string, members ...interface{}) (data bool, err error) {
+		return "", nil, errors.New("blpop reply error")
+	}
 
-	var conn redis.Conn
+	return string(values[0]), values[1], nil
+}
 
-	args := make([]interface{}, len(members)+1)
-	args[0] = key
-	copy(args[1:], members)
+func (r *Redis) Rpop(key string, v interface{}) error {
 
-	for i := 0; i < 2; i++ {
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-		conn = r.rp.Get()
-		data, err = redis.Bool(conn.Do("SADD", args...))
-		conn.Close()
+	return r.RpopCtx(ctx, key, v)
+}
 
-		if err == nil {
+func (r *Redis) RpopCtx(ctx context.Context, key string, v interface{}) error {
 
-			break
-		}
+	data, err := r.do(ctx, "RPOP", key)
+	if data != nil && v != nil {
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
+		return Decode(data, v)
 	}
 
-	return
+	return err
 }
 
-func (r *Redis) Sismember(key string, member interface{}) (data bool, err error) {
-
-	var conn redis.Conn
+func (r *Redis) Lrange(key string, start interface{}, offset interface{}) ([]interface{}, error) {
 
-	for i := 0; i < 2; i++ {
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-		conn = r.rp.Get()
-		data, err = redis.Bool(conn.Do("SISMEMBER", key, member))
-		conn.Close()
+	return r.LrangeCtx(ctx, key, start, offset)
+}
 
-		if err == nil {
+func (r *Redis) LrangeCtx(ctx context.Context, key string, start interface{}, offset interface{}) ([]interface{}, error) {
 
-			break
-		}
+	data, err := r.do(ctx, "LRANGE", key, start, offset)
+	if data != nil {
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
+		return data.([]interface{}), nil
 	}
 
-	return
+	return nil, err
 }
 
-func (r *Redis) Smembers(key string) (data interface{}, err error) {
+func (r *Redis) Llen(key string) (int64, error) {
 
-	var conn redis.Conn
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-	for i := 0; i < 2; i++ {
+	return r.LlenCtx(ctx, key)
+}
 
-		conn = r.rp.Get()
-		data, err = conn.Do("SMEMBERS", key)
-		conn.Close()
+func (r *Redis) LlenCtx(ctx context.Context, key string) (int64, error) {
 
-		if err == nil {
+	data, err := r.do(ctx, "LLEN", key)
+	if err != nil {
 
-			break
-		}
+		return 0, err
+	}
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
+	if data == nil {
+
+		return 0, nil
 	}
 
-	return
+	return data.(int64), err
 }
 
-func (r *Redis) Sdiff(key1, key2 string) (data interface{}, err error) {
+func (r *Redis) Sadd(key string, members ...interface{}) (bool, error) {
 
-	var conn redis.Conn
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-	for i := 0; i < 2; i++ {
+	return r.SaddCtx(ctx, key, members...)
+}
 
-		conn = r.rp.Get()
-		data, err = conn.Do("SDIFF", key1, key2)
-		conn.Close()
+func (r *Redis) SaddCtx(ctx context.Context, key string, members ...interface{}) (bool, error) {
 
-		if err == nil {
+	args := make([]interface{}, len(members)+1)
+	args[0] = key
+	copy(args[1:], members)
 
-			break
-		}
+	return redis.Bool(r.doRetry(ctx, "SADD", args...))
+}
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
+func (r *Redis) Sismember(key string, member interface{}) (bool, error) {
 
-	return
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.SismemberCtx(ctx, key, member)
 }
 
-func (r *Redis) Expire(key string, expire int64) (exists bool, err error) {
+func (r *Redis) SismemberCtx(ctx context.Context, key string, member interface{}) (bool, error) {
 
-	var conn redis.Conn
+	return redis.Bool(r.doRetry(ctx, "SISMEMBER", key, member))
+}
 
-	for i := 0; i < 2; i++ {
+func (r *Redis) Smembers(key string) (interface{}, error) {
 
-		conn = r.rp.Get()
-		exists, err = redis.Bool(conn.Do("EXPIRE", key, expire))
-		conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-		if err == nil {
-			break
-		}
+	return r.SmembersCtx(ctx, key)
+}
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
+func (r *Redis) SmembersCtx(ctx context.Context, key string) (interface{}, error) {
 
-	return
+	return r.doRetry(ctx, "SMEMBERS", key)
 }
 
-func (r *Redis) Exists(key string) (ok bool, err error) {
+func (r *Redis) Sdiff(key1, key2 string) (interface{}, error) {
 
-	var conn redis.Conn
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-	for i := 0; i < 2; i++ {
+	return r.SdiffCtx(ctx, key1, key2)
+}
 
-		conn = r.rp.Get()
-		ok, err = redis.Bool(conn.Do("Exists", key))
-		conn.Close()
+func (r *Redis) SdiffCtx(ctx context.Context, key1, key2 string) (interface{}, error) {
 
-		if err == nil {
+	return r.doRetry(ctx, "SDIFF", key1, key2)
+}
 
-			break
-		}
+func (r *Redis) Expire(key string, expire int64) (bool, error) {
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-	return
+	return r.ExpireCtx(ctx, key, expire)
 }
 
-func (r *Redis) Ttl(key string) (int64, error) {
+func (r *Redis) ExpireCtx(ctx context.Context, key string, expire int64) (bool, error) {
 
-	var conn redis.Conn
-	var ok interface{}
-	var err error
+	return redis.Bool(r.doRetry(ctx, "EXPIRE", key, expire))
+}
 
-	for i := 0; i < 2; i++ {
+func (r *Redis) Exists(key string) (bool, error) {
 
-		conn = r.rp.Get()
-		ok, err = conn.Do("TTL", key)
-		_ = conn.Close()
-		if err == nil {
+	ctx, cancel := withTimeout()
+	defer cancel()
 
-			break
-		}
+	return r.ExistsCtx(ctx, key)
+}
 
-		time.Sleep(time.Duration(10) * time.Millisecond)
-	}
+func (r *Redis) ExistsCtx(ctx context.Context, key string) (bool, error) {
+
+	return redis.Bool(r.doRetry(ctx, "EXISTS", key))
+}
+
+func (r *Redis) Ttl(key string) (int64, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.TtlCtx(ctx, key)
+}
+
+func (r *Redis) TtlCtx(ctx context.Context, key string) (int64, error) {
+
+	ok, err := r.doRetry(ctx, "TTL", key)
 	if ok == nil {
 
 		return 0, nil
@@ -1146,10 +1548,15 @@ func (r *Redis) Ttl(key string) (int64, error) {
 
 func (r *Redis) Lock(lockKey string, valueTag interface{}, expire int64) (bool, error) {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.LockCtx(ctx, lockKey, valueTag, expire)
+}
+
+func (r *Redis) LockCtx(ctx context.Context, lockKey string, valueTag interface{}, expire int64) (bool, error) {
 
-	ok, err := redis.String(conn.Do("SET", lockKey, valueTag, "EX", expire, "NX"))
+	ok, err := redis.String(r.do(ctx, "SET", lockKey, valueTag, "EX", expire, "NX"))
 	if err != nil || ok != "OK" {
 
 		return false, err
@@ -1158,7 +1565,7 @@ func (r *Redis) Lock(lockKey string, valueTag interface{}, expire int64) (bool,
 	return true, nil
 }
 
-var unlockLuaScript = redis.NewScript(2, `
+var unlockLuaScript = RegisterScript("unlock", 2, `
 if redis.call("get", KEYS[1]) == KEYS[2]
 then
 	redis.call("del",KEYS[1])
@@ -1169,10 +1576,15 @@ return false
 
 func (r *Redis) Unlock(lockKey string, valueTag interface{}) (bool, error) {
 
-	conn := r.rp.Get()
-	defer conn.Close()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.UnlockCtx(ctx, lockKey, valueTag)
+}
+
+func (r *Redis) UnlockCtx(ctx context.Context, lockKey string, valueTag interface{}) (bool, error) {
 
-	return redis.Bool(unlockLuaScript.Do(conn, lockKey, valueTag))
+	return redis.Bool(unlockLuaScript.DoCtx(ctx, r, lockKey, valueTag))
 }
 
 type Command struct {
@@ -1303,10 +1715,23 @@ func (pipe *PipeLine) AppendEncodeWithTag(cmd string, tag int, args ...interface
 
 func (r *Redis) RunPipeLine(pipe *PipeLine) bool {
 
-	conn := r.rp.Get()
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.RunPipeLineCtx(ctx, pipe)
+}
+
+func (r *Redis) RunPipeLineCtx(ctx context.Context, pipe *PipeLine) bool {
+
+	conn, err := r.getContext(ctx)
+	if err != nil {
+
+		pipe.RunErr = err
+
+		return false
+	}
 	defer conn.Close()
 
-	var err error
 	for _, value := range pipe.Commands {
 
 		err = conn.Send(value.Cmd, value.rArgs...)
@@ -1329,7 +1754,7 @@ func (r *Redis) RunPipeLine(pipe *PipeLine) bool {
 	ok := true
 	for _, value := range pipe.Commands {
 
-		value.Result, value.Err = conn.Receive()
+		value.Result, value.Err = receiveContext(ctx, conn)
 		if value.Err != nil {
 
 			ok = false
@@ -1339,9 +1764,23 @@ func (r *Redis) RunPipeLine(pipe *PipeLine) bool {
 	return ok
 }
 
-func hash(id uint64) int {
+//Err 管道执行的错误，没有连接错误时返回第一个失败命令的错误
+func (pipe *PipeLine) Err() error {
+
+	if pipe.RunErr != nil {
+
+		return pipe.RunErr
+	}
+
+	for _, command := range pipe.Commands {
+
+		if command.Err != nil {
 
-	return int(id % uint64(128))
+			return command.Err
+		}
+	}
+
+	return nil
 }
 
 func ToString(value interface{}, err error) (string, error) {
@@ -1354,6 +1793,11 @@ func ToStrings(value interface{}, err error) ([]string, error) {
 	return redis.Strings(value, err)
 }
 
+func ToInt64(value interface{}, err error) (int64, error) {
+
+	return redis.Int64(value, err)
+}
+
 func ToInt64s(value interface{}, err error) ([]int64, error) {
 
 	return redis.Int64s(value, err)
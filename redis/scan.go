@@ -0,0 +1,485 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var ScanReplyErr = errors.New("redis scan reply error")
+
+//ScanIterator SCAN系列命令的游标迭代器，依次遍历每个分片
+//SCAN和SSCAN的元素为key或成员，HSCAN的元素为字段和值，ZSCAN的元素为成员和分数
+//遍历期间修改的元素可能重复或遗漏，和redis的SCAN保证一致
+//
+//	it := r.Hscan("player:10001", "item:*", 100)
+//	for it.Next() {
+//		field, value := it.Val(), it.Value()
+//	}
+//	err := it.Err()
+type ScanIterator struct {
+	ctx    context.Context
+	shards []*Redis
+	cmd    string
+	key    string
+	args   []interface{}
+	pair   bool
+
+	cursor  string
+	started bool
+	items   [][]byte
+	val     string
+	value   []byte
+	err     error
+}
+
+func newScanIterator(ctx context.Context, shards []*Redis, cmd string, key string, match string, count int) *ScanIterator {
+
+	it := &ScanIterator{
+		ctx:    ctx,
+		shards: shards,
+		cmd:    cmd,
+		key:    key,
+		pair:   cmd == "HSCAN" || cmd == "ZSCAN",
+		cursor: "0",
+	}
+
+	if len(match) > 0 {
+
+		it.args = append(it.args, "MATCH", match)
+	}
+
+	if count > 0 {
+
+		it.args = append(it.args, "COUNT", count)
+	}
+
+	return it
+}
+
+//Scan 遍历key，count为每次SCAN的数量提示，集群模式下只遍历一个节点
+func (r *Redis) Scan(match string, count int) *ScanIterator {
+
+	return r.ScanCtx(context.Background(), match, count)
+}
+
+func (r *Redis) ScanCtx(ctx context.Context, match string, count int) *ScanIterator {
+
+	return newScanIterator(ctx, []*Redis{r}, "SCAN", "", match, count)
+}
+
+//Hscan 遍历hash的字段和值
+func (r *Redis) Hscan(key string, match string, count int) *ScanIterator {
+
+	return r.HscanCtx(context.Background(), key, match, count)
+}
+
+func (r *Redis) HscanCtx(ctx context.Context, key string, match string, count int) *ScanIterator {
+
+	return newScanIterator(ctx, []*Redis{r}, "HSCAN", key, match, count)
+}
+
+//Sscan 遍历set的成员
+func (r *Redis) Sscan(key string, match string, count int) *ScanIterator {
+
+	return r.SscanCtx(context.Background(), key, match, count)
+}
+
+func (r *Redis) SscanCtx(ctx context.Context, key string, match string, count int) *ScanIterator {
+
+	return newScanIterator(ctx, []*Redis{r}, "SSCAN", key, match, count)
+}
+
+//Zscan 遍历zset的成员和分数
+func (r *Redis) Zscan(key string, match string, count int) *ScanIterator {
+
+	return r.ZscanCtx(context.Background(), key, match, count)
+}
+
+func (r *Redis) ZscanCtx(ctx context.Context, key string, match string, count int) *ScanIterator {
+
+	return newScanIterator(ctx, []*Redis{r}, "ZSCAN", key, match, count)
+}
+
+//ShardScan 遍历name配置的所有分片上的key
+func ShardScan(ctx context.Context, name string, match string, count int) (*ScanIterator, error) {
+
+	shards, err := Shards(name)
+	if err != nil {
+
+		return nil, err
+	}
+
+	return newScanIterator(ctx, shards, "SCAN", "", match, count), nil
+}
+
+//Next 移动到下一个元素，遍历结束或出错时返回false
+func (it *ScanIterator) Next() bool {
+
+	for {
+
+		if len(it.items) > 0 {
+
+			it.val, it.value = string(it.items[0]), nil
+			if it.pair && len(it.items) > 1 {
+
+				it.value = it.items[1]
+				it.items = it.items[2:]
+			} else {
+
+				it.items = it.items[1:]
+			}
+
+			return true
+		}
+
+		if it.err != nil || len(it.shards) == 0 {
+
+			return false
+		}
+
+		// 当前分片遍历完成
+		if it.started && it.cursor == "0" {
+
+			it.shards = it.shards[1:]
+			it.started = false
+
+			continue
+		}
+
+		it.err = it.fetch()
+	}
+}
+
+func (it *ScanIterator) fetch() error {
+
+	conn, err := it.shards[0].getContext(it.ctx)
+	if err != nil {
+
+		return err
+	}
+	defer conn.Close()
+
+	args := make([]interface{}, 0, len(it.args)+2)
+	if len(it.key) > 0 {
+
+		args = append(args, it.key)
+	}
+	args = append(args, it.cursor)
+	args = append(args, it.args...)
+
+	values, err := redis.Values(doContext(it.ctx, conn, it.cmd, args...))
+	if err != nil {
+
+		return err
+	}
+
+	if len(values) != 2 {
+
+		return ScanReplyErr
+	}
+
+	cursor, err := redis.String(values[0], nil)
+	if err != nil {
+
+		return err
+	}
+
+	items, err := redis.ByteSlices(values[1], nil)
+	if err != nil {
+
+		return err
+	}
+
+	it.cursor, it.items, it.started = cursor, items, true
+
+	return nil
+}
+
+//Val 当前的key、成员或hash字段
+func (it *ScanIterator) Val() string {
+
+	return it.val
+}
+
+//Value HSCAN当前字段的值，ZSCAN当前成员的分数
+func (it *ScanIterator) Value() []byte {
+
+	return it.value
+}
+
+//Score ZSCAN当前成员的分数
+func (it *ScanIterator) Score() (float64, error) {
+
+	return strconv.ParseFloat(string(it.value), 64)
+}
+
+func (it *ScanIterator) Err() error {
+
+	return it.err
+}
+
+//Mget 批量读取，结果和keys顺序一致，不存在的key为nil，集群模式下按slot分组读取
+func (r *Redis) Mget(keys ...string) ([][]byte, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.MgetCtx(ctx, keys...)
+}
+
+func (r *Redis) MgetCtx(ctx context.Context, keys ...string) ([][]byte, error) {
+
+	values := make([][]byte, len(keys))
+	for _, group := range r.keyGroups(keys) {
+
+		args := make([]interface{}, len(group))
+		for i, n := range group {
+
+			args[i] = keys[n]
+		}
+
+		data, err := redis.ByteSlices(r.doRetry(ctx, "MGET", args...))
+		if err != nil {
+
+			return nil, err
+		}
+
+		if len(data) != len(group) {
+
+			return nil, errors.New("mget error data")
+		}
+
+		for i, n := range group {
+
+			values[n] = data[i]
+		}
+	}
+
+	return values, nil
+}
+
+//Mset 批量写入，值使用Encode编码，集群模式下按slot分组写入，不同slot之间不保证原子性
+func (r *Redis) Mset(data map[string]interface{}) error {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.MsetCtx(ctx, data)
+}
+
+func (r *Redis) MsetCtx(ctx context.Context, data map[string]interface{}) error {
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+
+		keys = append(keys, key)
+	}
+
+	for _, group := range r.keyGroups(keys) {
+
+		args := make([]interface{}, 0, 2*len(group))
+		for _, n := range group {
+
+			value, err := Encode(data[keys[n]])
+			if err != nil {
+
+				return err
+			}
+
+			args = append(args, keys[n], value)
+		}
+
+		if _, err := r.do(ctx, "MSET", args...); err != nil {
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Unlink 批量删除，大key在后台释放，返回删除的数量
+func (r *Redis) Unlink(keys ...string) (int64, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.UnlinkCtx(ctx, keys...)
+}
+
+func (r *Redis) UnlinkCtx(ctx context.Context, keys ...string) (int64, error) {
+
+	var total int64
+	for _, group := range r.keyGroups(keys) {
+
+		args := make([]interface{}, len(group))
+		for i, n := range group {
+
+			args[i] = keys[n]
+		}
+
+		n, err := redis.Int64(r.doRetry(ctx, "UNLINK", args...))
+		if err != nil {
+
+			return total, err
+		}
+
+		total += n
+	}
+
+	return total, nil
+}
+
+//keyGroups 多key命令的分组，返回keys的下标，集群模式下同一组的key在同一个slot
+func (r *Redis) keyGroups(keys []string) [][]int {
+
+	if len(keys) == 0 {
+
+		return nil
+	}
+
+	if r.cluster == nil {
+
+		group := make([]int, len(keys))
+		for i := range keys {
+
+			group[i] = i
+		}
+
+		return [][]int{group}
+	}
+
+	slots := make(map[int]int)
+	var groups [][]int
+	for i, key := range keys {
+
+		slot := Slot(key)
+		n, ok := slots[slot]
+		if !ok {
+
+			n = len(groups)
+			slots[slot] = n
+			groups = append(groups, nil)
+		}
+
+		groups[n] = append(groups[n], i)
+	}
+
+	return groups
+}
+
+//shardGroups 按name配置的分片对keys分组
+func shardGroups(name string, keys []string) (map[*Redis][]int, error) {
+
+	ring, err := useRing(name)
+	if err != nil {
+
+		return nil, err
+	}
+
+	groups := make(map[*Redis][]int)
+	for i, key := range keys {
+
+		r := ring.Get(key)
+		groups[r] = append(groups[r], i)
+	}
+
+	return groups, nil
+}
+
+//ShardMget 按key所在的分片批量读取，结果和keys顺序一致
+func ShardMget(ctx context.Context, name string, keys ...string) ([][]byte, error) {
+
+	groups, err := shardGroups(name, keys)
+	if err != nil {
+
+		return nil, err
+	}
+
+	values := make([][]byte, len(keys))
+	for r, group := range groups {
+
+		shardKeys := make([]string, len(group))
+		for i, n := range group {
+
+			shardKeys[i] = keys[n]
+		}
+
+		data, err := r.MgetCtx(ctx, shardKeys...)
+		if err != nil {
+
+			return nil, err
+		}
+
+		for i, n := range group {
+
+			values[n] = data[i]
+		}
+	}
+
+	return values, nil
+}
+
+//ShardMset 按key所在的分片批量写入
+func ShardMset(ctx context.Context, name string, data map[string]interface{}) error {
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+
+		keys = append(keys, key)
+	}
+
+	groups, err := shardGroups(name, keys)
+	if err != nil {
+
+		return err
+	}
+
+	for r, group := range groups {
+
+		shardData := make(map[string]interface{}, len(group))
+		for _, n := range group {
+
+			shardData[keys[n]] = data[keys[n]]
+		}
+
+		if err = r.MsetCtx(ctx, shardData); err != nil {
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+//ShardUnlink 按key所在的分片批量删除
+func ShardUnlink(ctx context.Context, name string, keys ...string) (int64, error) {
+
+	groups, err := shardGroups(name, keys)
+	if err != nil {
+
+		return 0, err
+	}
+
+	var total int64
+	for r, group := range groups {
+
+		shardKeys := make([]string, len(group))
+		for i, n := range group {
+
+			shardKeys[i] = keys[n]
+		}
+
+		n, err := r.UnlinkCtx(ctx, shardKeys...)
+		total += n
+		if err != nil {
+
+			return total, err
+		}
+	}
+
+	return total, nil
+}
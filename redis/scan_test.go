@@ -0,0 +1,253 @@
+package redis
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestRedis_Scan(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	r := newRedis(s.conf("scan"))
+	defer r.Close()
+
+	want := make([]string, 0)
+	for i := 0; i < 25; i++ {
+
+		key := "player:" + strconv.Itoa(i)
+		s.call("SET", key, "1")
+		s.call("HSET", "hash", "f"+strconv.Itoa(i), strconv.Itoa(i))
+		s.call("SADD", "set", "m"+strconv.Itoa(i))
+		s.call("ZADD", "zset", strconv.Itoa(i), "m"+strconv.Itoa(i))
+		want = append(want, key)
+	}
+	s.call("SET", "other", "1")
+	sort.Strings(want)
+
+	// count小于元素数量时分多页读取
+	var keys []string
+	it := r.Scan("player:*", 4)
+	for it.Next() {
+
+		keys = append(keys, it.Val())
+	}
+
+	if it.Err() != nil || !reflect.DeepEqual(keys, want) {
+
+		t.Fatal("Scan:", keys, it.Err())
+	}
+
+	n := 0
+	it = r.Hscan("hash", "", 7)
+	for it.Next() {
+
+		if it.Val() != "f"+string(it.Value()) {
+
+			t.Fatal("Hscan:", it.Val(), string(it.Value()))
+		}
+		n++
+	}
+
+	if it.Err() != nil || n != 25 {
+
+		t.Fatal("Hscan:", n, it.Err())
+	}
+
+	n = 0
+	it = r.Sscan("set", "m1*", 3)
+	for it.Next() {
+
+		n++
+	}
+
+	// m1 m10-m19
+	if it.Err() != nil || n != 11 {
+
+		t.Fatal("Sscan:", n, it.Err())
+	}
+
+	n = 0
+	it = r.Zscan("zset", "", 0)
+	for it.Next() {
+
+		score, err := it.Score()
+		if err != nil || "m"+strconv.Itoa(int(score)) != it.Val() {
+
+			t.Fatal("Zscan:", it.Val(), score, err)
+		}
+		n++
+	}
+
+	if it.Err() != nil || n != 25 {
+
+		t.Fatal("Zscan:", n, it.Err())
+	}
+
+	if it = r.Hscan("none", "", 10); it.Next() || it.Err() != nil {
+
+		t.Fatal("Hscan none:", it.Err())
+	}
+
+	s.close()
+	if it = r.Scan("", 10); it.Next() || it.Err() == nil {
+
+		t.Fatal("Scan closed:", it.Err())
+	}
+}
+
+func TestRedis_Mget(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	r := newRedis(s.conf("mget"))
+	defer r.Close()
+
+	err := r.Mset(map[string]interface{}{"a": "1", "b": 2, "c": []byte("3")})
+	if err != nil {
+
+		t.Fatal("Mset:", err)
+	}
+
+	values, err := r.Mget("c", "none", "a", "b")
+	if err != nil || len(values) != 4 || string(values[0]) != "3" || values[1] != nil || string(values[2]) != "1" || string(values[3]) != "2" {
+
+		t.Fatal("Mget:", values, err)
+	}
+
+	if n, err := r.Unlink("a", "b", "none"); err != nil || n != 2 {
+
+		t.Fatal("Unlink:", n, err)
+	}
+
+	if s.get("a") != nil || s.get("c") == nil {
+
+		t.Fatal("Unlink data")
+	}
+}
+
+func TestCluster_Mget(t *testing.T) {
+
+	fc := newFakeCluster(t)
+	defer fc.close()
+
+	r := newRedis(&RedisConf{Name: "cluster", Cluster: []string{fc.a.addr}})
+	defer r.Close()
+
+	// 不同slot的key分组发送到各自的节点
+	data := make(map[string]interface{})
+	keys := make([]string, 0)
+	for i := 0; i < 20; i++ {
+
+		key := "key" + strconv.Itoa(i)
+		data[key] = i
+		keys = append(keys, key)
+	}
+
+	if err := r.Mset(data); err != nil {
+
+		t.Fatal("Mset:", err)
+	}
+
+	values, err := r.Mget(keys...)
+	if err != nil {
+
+		t.Fatal("Mget:", err)
+	}
+
+	for i, v := range values {
+
+		if string(v) != strconv.Itoa(i) {
+
+			t.Fatal("Mget:", i, string(v))
+		}
+	}
+
+	if n, err := r.Unlink(keys...); err != nil || n != 20 {
+
+		t.Fatal("Unlink:", n, err)
+	}
+}
+
+func TestShardScan(t *testing.T) {
+
+	servers := []*fakeServer{newFakeServer(t), newFakeServer(t), newFakeServer(t)}
+	for _, s := range servers {
+
+		defer s.close()
+	}
+
+	useFakeRedis("scanshard", servers...)
+
+	ctx := context.Background()
+	data := make(map[string]interface{})
+	keys := make([]string, 0)
+	for i := 0; i < 30; i++ {
+
+		key := "user:" + strconv.Itoa(i)
+		data[key] = i
+		keys = append(keys, key)
+	}
+
+	if err := ShardMset(ctx, "scanshard", data); err != nil {
+
+		t.Fatal("ShardMset:", err)
+	}
+
+	shards, _ := Shards("scanshard")
+	for _, r := range shards {
+
+		if it := r.Scan("", 0); !it.Next() {
+
+			t.Fatal("ShardMset not spread:", r.Addr(), it.Err())
+		}
+	}
+
+	values, err := ShardMget(ctx, "scanshard", append(keys, "none")...)
+	if err != nil || len(values) != 31 || values[30] != nil {
+
+		t.Fatal("ShardMget:", len(values), err)
+	}
+
+	for i := 0; i < 30; i++ {
+
+		if string(values[i]) != strconv.Itoa(i) {
+
+			t.Fatal("ShardMget:", i, string(values[i]))
+		}
+	}
+
+	it, err := ShardScan(ctx, "scanshard", "user:*", 2)
+	if err != nil {
+
+		t.Fatal("ShardScan:", err)
+	}
+
+	var scanned []string
+	for it.Next() {
+
+		scanned = append(scanned, it.Val())
+	}
+	sort.Strings(scanned)
+	sort.Strings(keys)
+
+	if it.Err() != nil || !reflect.DeepEqual(scanned, keys) {
+
+		t.Fatal("ShardScan:", scanned, it.Err())
+	}
+
+	if n, err := ShardUnlink(ctx, "scanshard", keys...); err != nil || n != 30 {
+
+		t.Fatal("ShardUnlink:", n, err)
+	}
+
+	if _, err = ShardScan(ctx, "none", "", 0); err == nil {
+
+		t.Fatal("ShardScan none")
+	}
+}
@@ -0,0 +1,183 @@
+package redis
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	scriptMux sync.RWMutex
+	scripts   = make(map[string]*Script)
+
+	ScriptNotExistsErr = errors.New("redis script not exists")
+)
+
+//Script 注册的lua脚本，使用EVALSHA执行，服务端没有缓存时改用EVAL
+type Script struct {
+	Name     string
+	keyCount int
+	src      string
+	hash     string
+}
+
+//RegisterScript 注册lua脚本，keyCount小于0时由调用者在参数中传入key数量
+//同名脚本重复注册会panic
+func RegisterScript(name string, keyCount int, src string) *Script {
+
+	scriptMux.Lock()
+	defer scriptMux.Unlock()
+
+	if _, ok := scripts[name]; ok {
+
+		panic("redis script exists " + name)
+	}
+
+	h := sha1.Sum([]byte(src))
+	s := &Script{
+		Name:     name,
+		keyCount: keyCount,
+		src:      src,
+		hash:     hex.EncodeToString(h[:]),
+	}
+	scripts[name] = s
+
+	return s
+}
+
+//LookupScript 按名字查找脚本
+func LookupScript(name string) (*Script, bool) {
+
+	scriptMux.RLock()
+	defer scriptMux.RUnlock()
+
+	s, ok := scripts[name]
+
+	return s, ok
+}
+
+func (s *Script) Hash() string {
+
+	return s.hash
+}
+
+func (s *Script) args(spec string, keysAndArgs []interface{}) []interface{} {
+
+	var args []interface{}
+	if s.keyCount < 0 {
+
+		args = make([]interface{}, 1+len(keysAndArgs))
+		args[0] = spec
+		copy(args[1:], keysAndArgs)
+	} else {
+
+		args = make([]interface{}, 2+len(keysAndArgs))
+		args[0] = spec
+		args[1] = s.keyCount
+		copy(args[2:], keysAndArgs)
+	}
+
+	return args
+}
+
+//Do 在r上执行脚本
+func (s *Script) Do(r *Redis, keysAndArgs ...interface{}) (interface{}, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return s.DoCtx(ctx, r, keysAndArgs...)
+}
+
+func (s *Script) DoCtx(ctx context.Context, r *Redis, keysAndArgs ...interface{}) (interface{}, error) {
+
+	conn, err := r.getContext(ctx)
+	if err != nil {
+
+		return nil, err
+	}
+	defer conn.Close()
+
+	return s.doConn(ctx, conn, keysAndArgs...)
+}
+
+func (s *Script) doConn(ctx context.Context, conn redis.Conn, keysAndArgs ...interface{}) (interface{}, error) {
+
+	reply, err := doContext(ctx, conn, "EVALSHA", s.args(s.hash, keysAndArgs)...)
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "NOSCRIPT ") {
+
+		reply, err = doContext(ctx, conn, "EVAL", s.args(s.src, keysAndArgs)...)
+	}
+
+	return reply, err
+}
+
+//EvalScript 按名字执行注册的脚本
+func (r *Redis) EvalScript(name string, keysAndArgs ...interface{}) (interface{}, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.EvalScriptCtx(ctx, name, keysAndArgs...)
+}
+
+func (r *Redis) EvalScriptCtx(ctx context.Context, name string, keysAndArgs ...interface{}) (interface{}, error) {
+
+	s, ok := LookupScript(name)
+	if !ok {
+
+		return nil, ScriptNotExistsErr
+	}
+
+	return s.DoCtx(ctx, r, keysAndArgs...)
+}
+
+//LoadScripts 把注册的脚本全部加载到服务端，启动或主从切换后调用可以避免第一次执行时传输脚本
+//集群模式下只加载到一个节点，其它节点依赖NOSCRIPT后的EVAL
+func (r *Redis) LoadScripts(ctx context.Context) error {
+
+	scriptMux.RLock()
+	list := make([]*Script, 0, len(scripts))
+	for _, s := range scripts {
+
+		list = append(list, s)
+	}
+	scriptMux.RUnlock()
+
+	conn, err := r.getContext(ctx)
+	if err != nil {
+
+		return err
+	}
+	defer conn.Close()
+
+	for _, s := range list {
+
+		if _, err = doContext(ctx, conn, "SCRIPT", "LOAD", s.src); err != nil {
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+//AppendScript 管道或事务中执行脚本，使用EVAL保证服务端没有缓存时也能执行
+func (pipe *PipeLine) AppendScript(s *Script, keysAndArgs ...interface{}) *Command {
+
+	args := s.args(s.src, keysAndArgs)
+	command := &Command{
+		Cmd:   "EVAL",
+		Args:  keysAndArgs,
+		rArgs: args,
+	}
+
+	pipe.Commands = append(pipe.Commands, command)
+
+	return command
+}
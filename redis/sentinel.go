@@ -0,0 +1,338 @@
+package redis
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	sentinelRetry = time.Duration(1) * time.Second
+
+	NoMasterErr  = errors.New("redis sentinel no master")
+	NotMasterErr = errors.New("redis sentinel not master")
+)
+
+//sentinel 通过哨兵获取master地址，订阅+switch-master，主从切换后重建连接池
+type sentinel struct {
+	conf     *RedisConf
+	options  []redis.DialOption
+	soptions []redis.DialOption
+
+	mux      sync.RWMutex
+	addrs    []string
+	addr     string
+	rp       *redis.Pool
+	checking int32
+	quit     chan struct{}
+}
+
+func newSentinel(conf *RedisConf) *sentinel {
+
+	sconf := *conf
+	sconf.Password = conf.SentinelPassword
+	sconf.DB = 0
+
+	s := &sentinel{
+		conf:     conf,
+		options:  dialOptions(conf),
+		soptions: dialOptions(&sconf),
+		addrs:    append([]string(nil), conf.Sentinels...),
+		quit:     make(chan struct{}),
+	}
+	s.rp = newPool(conf, s.dial)
+
+	go s.watch()
+
+	return s
+}
+
+func (s *sentinel) pool() *redis.Pool {
+
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.rp
+}
+
+func (s *sentinel) master() string {
+
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.addr
+}
+
+//dial 连接当前master，连接失败或者对方已不是master时重新查询哨兵
+func (s *sentinel) dial() (redis.Conn, error) {
+
+	addr := s.master()
+	if len(addr) == 0 {
+
+		var err error
+		addr, err = s.resolve()
+		if err != nil {
+
+			return nil, err
+		}
+
+		s.switchMaster(addr)
+	}
+
+	c, err := redis.Dial("tcp", addr, s.options...)
+	if err != nil {
+
+		go s.check()
+
+		return nil, err
+	}
+
+	role, err := redis.Values(c.Do("ROLE"))
+	switch err.(type) {
+
+	case nil:
+
+		if len(role) == 0 {
+
+			err = NotMasterErr
+		} else if kind, _ := redis.String(role[0], nil); kind != "master" {
+
+			err = NotMasterErr
+		}
+
+	case redis.Error:
+
+		// 不支持ROLE的旧版本
+		err = nil
+	}
+
+	if err != nil {
+
+		c.Close()
+
+		go s.check()
+
+		return nil, err
+	}
+
+	return c, nil
+}
+
+//resolve 依次查询哨兵，返回master地址，可用的哨兵移到最前面
+func (s *sentinel) resolve() (string, error) {
+
+	s.mux.RLock()
+	addrs := append([]string(nil), s.addrs...)
+	s.mux.RUnlock()
+
+	err := NoMasterErr
+	for i, saddr := range addrs {
+
+		var c redis.Conn
+		c, err = redis.Dial("tcp", saddr, s.soptions...)
+		if err != nil {
+
+			continue
+		}
+
+		var reply []string
+		reply, err = redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.conf.MasterName))
+		c.Close()
+
+		if err != nil {
+
+			continue
+		}
+
+		if len(reply) != 2 {
+
+			err = NoMasterErr
+
+			continue
+		}
+
+		if i > 0 {
+
+			s.mux.Lock()
+			s.addrs[0], s.addrs[i] = s.addrs[i], s.addrs[0]
+			s.mux.Unlock()
+		}
+
+		return net.JoinHostPort(reply[0], reply[1]), nil
+	}
+
+	return "", err
+}
+
+//check 重新查询master，同一时间只有一个在查询
+func (s *sentinel) check() {
+
+	if !atomic.CompareAndSwapInt32(&s.checking, 0, 1) {
+
+		return
+	}
+	defer atomic.StoreInt32(&s.checking, 0)
+
+	addr, err := s.resolve()
+	if err != nil {
+
+		log.Printf("[error] redis sentinel(%s) resolve err:%v", s.conf.MasterName, err)
+
+		return
+	}
+
+	s.switchMaster(addr)
+}
+
+//switchMaster master变化时重建连接池，旧连接池中的连接全部关闭
+func (s *sentinel) switchMaster(addr string) {
+
+	s.mux.Lock()
+
+	if s.addr == addr {
+
+		s.mux.Unlock()
+
+		return
+	}
+
+	old, prev := s.rp, s.addr
+	s.addr = addr
+	if len(prev) > 0 {
+
+		s.rp = newPool(s.conf, s.dial)
+	}
+
+	s.mux.Unlock()
+
+	if len(prev) > 0 {
+
+		log.Printf("[info] redis sentinel(%s) switch master %s -> %s", s.conf.MasterName, prev, addr)
+
+		_ = old.Close()
+	}
+}
+
+//watch 订阅哨兵的+switch-master，断开后重连
+func (s *sentinel) watch() {
+
+	for {
+
+		s.subscribe()
+
+		select {
+
+		case <-s.quit:
+
+			return
+
+		case <-time.After(sentinelRetry):
+
+		}
+	}
+}
+
+func (s *sentinel) subscribe() {
+
+	s.mux.RLock()
+	addrs := append([]string(nil), s.addrs...)
+	s.mux.RUnlock()
+
+	for _, saddr := range addrs {
+
+		c, err := redis.Dial("tcp", saddr, s.soptions...)
+		if err != nil {
+
+			continue
+		}
+
+		done := make(chan struct{})
+		go func() {
+
+			select {
+
+			case <-s.quit:
+
+			case <-done:
+
+			}
+
+			c.Close()
+		}()
+
+		s.receive(redis.PubSubConn{Conn: c})
+
+		close(done)
+
+		return
+	}
+}
+
+func (s *sentinel) receive(psc redis.PubSubConn) {
+
+	if err := psc.Subscribe("+switch-master"); err != nil {
+
+		return
+	}
+
+	// 定时ping，连接半开时读超时后重新订阅
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+
+		ticker := time.NewTicker(PubSubPing)
+		defer ticker.Stop()
+
+		for {
+
+			select {
+
+			case <-stop:
+
+				return
+
+			case <-ticker.C:
+
+				_ = psc.Ping("")
+			}
+		}
+	}()
+
+	for {
+
+		switch v := psc.ReceiveWithTimeout(2 * PubSubPing).(type) {
+
+		case redis.Message:
+
+			// master-name old-ip old-port new-ip new-port
+			fields := strings.Fields(string(v.Data))
+			if len(fields) == 5 && fields[0] == s.conf.MasterName {
+
+				s.switchMaster(net.JoinHostPort(fields[3], fields[4]))
+			}
+
+		case redis.Subscription:
+
+			// 订阅期间可能错过切换消息
+			go s.check()
+
+		case error:
+
+			return
+		}
+	}
+}
+
+func (s *sentinel) close() error {
+
+	close(s.quit)
+
+	return s.pool().Close()
+}
@@ -0,0 +1,116 @@
+package redis
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSentinel_Failover(t *testing.T) {
+
+	master := newFakeServer(t)
+	defer master.close()
+
+	replica := newFakeServer(t)
+	defer replica.close()
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	s.masters["mymaster"] = master.addr
+
+	r := newRedis(&RedisConf{Name: "sentinel", Sentinels: []string{"127.0.0.1:1", s.addr}, MasterName: "mymaster"})
+	defer r.Close()
+
+	err := r.Set("k", "v1")
+	if err != nil {
+
+		t.Fatal("Set:", err)
+	}
+
+	if master.get("k") == nil {
+
+		t.Fatal("Set not on master")
+	}
+
+	// 切换master，旧master降为从库
+	s.mux.Lock()
+	s.masters["mymaster"] = replica.addr
+	s.mux.Unlock()
+
+	master.mux.Lock()
+	master.role = "slave"
+	master.mux.Unlock()
+
+	_, rport, _ := net.SplitHostPort(replica.addr)
+	_, mport, _ := net.SplitHostPort(master.addr)
+	s.publish("+switch-master", "mymaster 127.0.0.1 "+mport+" 127.0.0.1 "+rport)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for r.sentinel.master() != replica.addr {
+
+		if time.Now().After(deadline) {
+
+			t.Fatal("master not switched:", r.sentinel.master())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = r.Set("k", "v2")
+	if err != nil {
+
+		t.Fatal("Set:", err)
+	}
+
+	if replica.get("k") == nil {
+
+		t.Fatal("Set not on new master")
+	}
+
+	if st := r.Stats(); st.Addr != "sentinel:mymaster" {
+
+		t.Error("Stats:", st)
+	}
+}
+
+func TestSentinel_NotMaster(t *testing.T) {
+
+	master := newFakeServer(t)
+	defer master.close()
+
+	old := newFakeServer(t)
+	defer old.close()
+	old.role = "slave"
+
+	s := newFakeServer(t)
+	defer s.close()
+	s.masters["mymaster"] = master.addr
+
+	r := newRedis(&RedisConf{Name: "sentinel", Sentinels: []string{s.addr}, MasterName: "mymaster"})
+	defer r.Close()
+
+	// 错过切换消息，连接到从库时重新查询哨兵
+	r.sentinel.switchMaster(old.addr)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+
+		if err := r.Set("k", "v"); err == nil {
+
+			break
+		}
+
+		if time.Now().After(deadline) {
+
+			t.Fatal("master not resolved")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if master.get("k") == nil || old.get("k") != nil {
+
+		t.Error("Set on wrong node")
+	}
+}
@@ -0,0 +1,415 @@
+package redis
+
+import (
+	"errors"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	defaultVirtualNodes = 160
+	scanCount           = 500
+
+	ShardExistsErr = errors.New("redis shard exists")
+	ShardRateErr   = errors.New("redis rate sharding does not support migration")
+)
+
+//ShardingRate RedisConf.Sharding设置为rate时使用旧版按Rate分段的分片
+const ShardingRate = "rate"
+
+//Ring 一致性hash环，每个分片按权重生成虚拟节点
+//rate为true时兼容旧版分片，按Rate分段选择分片，不使用虚拟节点
+type Ring struct {
+	mux    sync.RWMutex
+	vnodes int
+	rate   bool
+	hashes []uint32
+	nodes  map[uint32]*Redis
+	shards []*Redis
+}
+
+//NewRing 创建hash环，vnodes为每单位权重的虚拟节点数
+func NewRing(vnodes int) *Ring {
+
+	if vnodes <= 0 {
+
+		vnodes = defaultVirtualNodes
+	}
+
+	return &Ring{
+		vnodes: vnodes,
+		nodes:  make(map[uint32]*Redis),
+	}
+}
+
+//Add 添加分片，虚拟节点由分片地址生成，配置顺序不影响分布
+func (ring *Ring) Add(r *Redis, weight int) {
+
+	ring.mux.Lock()
+	defer ring.mux.Unlock()
+
+	for _, v := range ring.shards {
+
+		if v == r {
+
+			return
+		}
+	}
+
+	ring.shards = append(ring.shards, r)
+
+	for i := 0; i < ring.vnodes*withDefault(weight, 1); i++ {
+
+		h := crc32.ChecksumIEEE([]byte(r.addr + "#" + strconv.Itoa(i)))
+		if _, ok := ring.nodes[h]; ok {
+
+			continue
+		}
+
+		ring.nodes[h] = r
+		ring.hashes = append(ring.hashes, h)
+	}
+
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+}
+
+//Remove 移除分片
+func (ring *Ring) Remove(r *Redis) {
+
+	ring.mux.Lock()
+	defer ring.mux.Unlock()
+
+	for i, v := range ring.shards {
+
+		if v == r {
+
+			ring.shards = append(ring.shards[:i], ring.shards[i+1:]...)
+
+			break
+		}
+	}
+
+	hashes := ring.hashes[:0]
+	for _, h := range ring.hashes {
+
+		if ring.nodes[h] == r {
+
+			delete(ring.nodes, h)
+
+			continue
+		}
+
+		hashes = append(hashes, h)
+	}
+
+	ring.hashes = hashes
+}
+
+//Get 获取key所在分片，key包含{tag}时只按tag计算
+func (ring *Ring) Get(key string) *Redis {
+
+	ring.mux.RLock()
+	defer ring.mux.RUnlock()
+
+	if ring.rate {
+
+		return ring.getRate(key)
+	}
+
+	return ring.get(KeyHash(key))
+}
+
+//getRate 旧版分片，数字key按id%128，其它key按hash%128，选择Rate不超过该值的最后一个分片
+//分片按Rate升序添加
+func (ring *Ring) getRate(key string) *Redis {
+
+	if len(ring.shards) == 0 {
+
+		return nil
+	}
+
+	var h int
+	if id, err := strconv.ParseUint(key, 10, 64); err == nil {
+
+		h = int(id % 128)
+	} else {
+
+		h = int(KeyHash(key) % 128)
+	}
+
+	r := ring.shards[0]
+	for _, v := range ring.shards {
+
+		if h >= v.rate {
+
+			r = v
+		}
+	}
+
+	return r
+}
+
+func (ring *Ring) get(h uint32) *Redis {
+
+	if len(ring.hashes) == 0 {
+
+		return nil
+	}
+
+	i := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= h })
+	if i == len(ring.hashes) {
+
+		i = 0
+	}
+
+	return ring.nodes[ring.hashes[i]]
+}
+
+//Shards 所有分片
+func (ring *Ring) Shards() []*Redis {
+
+	ring.mux.RLock()
+	defer ring.mux.RUnlock()
+
+	return append([]*Redis(nil), ring.shards...)
+}
+
+//clone 复制hash环，用于计算迁移
+func (ring *Ring) clone() *Ring {
+
+	ring.mux.RLock()
+	defer ring.mux.RUnlock()
+
+	c := NewRing(ring.vnodes)
+	c.rate = ring.rate
+	c.hashes = append(c.hashes, ring.hashes...)
+	c.shards = append(c.shards, ring.shards...)
+	for h, r := range ring.nodes {
+
+		c.nodes[h] = r
+	}
+
+	return c
+}
+
+//KeyHash key的hash值，与redis cluster一样支持{tag}，相同tag的key在同一分片
+func KeyHash(key string) uint32 {
+
+	return crc32.ChecksumIEEE([]byte(hashTag(key)))
+}
+
+func hashTag(key string) string {
+
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+
+			return key[s+1 : s+1+e]
+		}
+	}
+
+	return key
+}
+
+//tagKey 和key在集群的同一个slot的关联key
+func tagKey(key string, suffix string) string {
+
+	if strings.IndexByte(key, '{') >= 0 && hashTag(key) != key {
+
+		return key + ":" + suffix
+	}
+
+	return "{" + key + "}:" + suffix
+}
+
+//MigrationPlan 添加分片时需要迁移的key
+type MigrationPlan struct {
+	Name   string
+	Target *Redis
+	Moves  map[*Redis][]string
+
+	conf *RedisConf
+}
+
+//PlanAddShard 计算添加分片后会迁移到新分片的key，match为SCAN的匹配模式
+//迁移步骤为PlanAddShard、Copy、Commit，Copy开始到Commit完成期间需要停止对name的写入，
+//期间写入源分片的key不会被复制，Commit(true)删除源key时这些写入会丢失
+func PlanAddShard(name string, conf *RedisConf, match string) (*MigrationPlan, error) {
+
+	ring, err := useRing(name)
+	if err != nil {
+
+		return nil, err
+	}
+
+	if ring.rate {
+
+		return nil, ShardRateErr
+	}
+
+	target := newRedis(conf)
+	for _, r := range ring.Shards() {
+
+		if r.addr == target.addr {
+
+			return nil, ShardExistsErr
+		}
+	}
+
+	next := ring.clone()
+	next.Add(target, conf.Weight)
+
+	plan := &MigrationPlan{
+		Name:   name,
+		Target: target,
+		Moves:  make(map[*Redis][]string),
+		conf:   conf,
+	}
+
+	for _, r := range ring.Shards() {
+
+		it := r.Scan(match, scanCount)
+		for it.Next() {
+
+			if key := it.Val(); next.Get(key) == target {
+
+				plan.Moves[r] = append(plan.Moves[r], key)
+			}
+		}
+
+		if err = it.Err(); err != nil {
+
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+//Keys 需要迁移的key数量
+func (plan *MigrationPlan) Keys() int {
+
+	n := 0
+	for _, keys := range plan.Moves {
+
+		n += len(keys)
+	}
+
+	return n
+}
+
+//Copy 用DUMP/RESTORE把key复制到新分片，保留过期时间，已存在的key会被覆盖
+//Copy之后的写入不会复制，需要在Commit之前停止写入
+func (plan *MigrationPlan) Copy() error {
+
+	dst := plan.Target.get()
+	defer dst.Close()
+
+	for r, keys := range plan.Moves {
+
+		err := r.copyKeys(dst, keys)
+		if err != nil {
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Commit 把新分片加入hash环，del为true时删除源分片上已迁移的key
+func (plan *MigrationPlan) Commit(del bool) error {
+
+	ring, err := useRing(plan.Name)
+	if err != nil {
+
+		return err
+	}
+
+	helperMux.Lock()
+	poolRedisHelper[plan.Name] = append(poolRedisHelper[plan.Name], plan.Target)
+	helperMux.Unlock()
+
+	ring.Add(plan.Target, plan.conf.Weight)
+
+	if !del {
+
+		return nil
+	}
+
+	for r, keys := range plan.Moves {
+
+		conn := r.get()
+		for _, key := range keys {
+
+			err = conn.Send("DEL", key)
+			if err != nil {
+
+				break
+			}
+		}
+
+		if err == nil {
+
+			_, err = conn.Do("")
+		}
+		conn.Close()
+
+		if err != nil {
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Redis) copyKeys(dst redis.Conn, keys []string) error {
+
+	src := r.get()
+	defer src.Close()
+
+	for _, key := range keys {
+
+		data, err := src.Do("DUMP", key)
+		if err != nil {
+
+			return err
+		}
+
+		// 复制前key已过期或被删除
+		if data == nil {
+
+			continue
+		}
+
+		ttl, err := redis.Int64(src.Do("PTTL", key))
+		if err != nil {
+
+			return err
+		}
+
+		if ttl == -2 {
+
+			continue
+		}
+
+		if ttl < 0 {
+
+			ttl = 0
+		}
+
+		_, err = dst.Do("RESTORE", key, ttl, data, "REPLACE")
+		if err != nil {
+
+			return err
+		}
+	}
+
+	return nil
+}
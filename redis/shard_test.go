@@ -0,0 +1,211 @@
+package redis
+
+import (
+	"strconv"
+	"testing"
+)
+
+// useFakeRedis 注册测试分片，不调用InitRedis以免覆盖其它测试的配置
+func useFakeRedis(name string, servers ...*fakeServer) {
+
+	helperMux.Lock()
+	defer helperMux.Unlock()
+
+	if poolRedisHelper == nil {
+
+		poolRedisHelper = make(map[string][]*Redis)
+		poolRedisRing = make(map[string]*Ring)
+	}
+
+	ring := NewRing(0)
+	poolRedisHelper[name] = nil
+	for _, s := range servers {
+
+		r := newRedis(s.conf(name))
+		ring.Add(r, 1)
+		poolRedisHelper[name] = append(poolRedisHelper[name], r)
+	}
+
+	poolRedisRing[name] = ring
+}
+
+func TestRing_Get(t *testing.T) {
+
+	ring := NewRing(0)
+	for _, port := range []string{"6379", "6380", "6381"} {
+
+		ring.Add(newRedis(&RedisConf{Host: "127.0.0.1", Port: port}), 1)
+	}
+
+	count := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+
+		count[ring.Get("user:"+strconv.Itoa(i)).Addr()]++
+	}
+
+	for addr, n := range count {
+
+		if n < 7000 || n > 13000 {
+
+			t.Error("Ring unbalanced:", addr, n)
+		}
+	}
+
+	if ring.Get("{user:1}:bag") != ring.Get("{user:1}:info") {
+
+		t.Error("Ring hash tag")
+	}
+}
+
+func TestRing_Add(t *testing.T) {
+
+	ring := NewRing(0)
+	for _, port := range []string{"6379", "6380", "6381"} {
+
+		ring.Add(newRedis(&RedisConf{Host: "127.0.0.1", Port: port}), 1)
+	}
+
+	next := ring.clone()
+	target := newRedis(&RedisConf{Host: "127.0.0.1", Port: "6382"})
+	next.Add(target, 1)
+
+	moved := 0
+	for i := 0; i < 40000; i++ {
+
+		key := "user:" + strconv.Itoa(i)
+		before, after := ring.Get(key), next.Get(key)
+		if before != after {
+
+			if after != target {
+
+				t.Fatal("Ring moved key between old shards:", key)
+			}
+
+			moved++
+		}
+	}
+
+	if moved < 7000 || moved > 13000 {
+
+		t.Error("Ring moved:", moved)
+	}
+
+	next.Remove(target)
+	for i := 0; i < 1000; i++ {
+
+		key := "user:" + strconv.Itoa(i)
+		if ring.Get(key) != next.Get(key) {
+
+			t.Fatal("Ring remove:", key)
+		}
+	}
+}
+
+func TestRing_Rate(t *testing.T) {
+
+	ring := NewRing(0)
+	ring.rate = true
+
+	low := newRedis(&RedisConf{Host: "127.0.0.1", Port: "6379", Rate: 0})
+	high := newRedis(&RedisConf{Host: "127.0.0.1", Port: "6380", Rate: 64})
+	ring.Add(low, 1)
+	ring.Add(high, 1)
+
+	// 和旧版一样按id%128选择分片
+	for id, want := range map[uint64]*Redis{10: low, 63: low, 64: high, 127: high, 130: low, 200: high} {
+
+		if r := ring.Get(strconv.FormatUint(id, 10)); r != want {
+
+			t.Fatal("Ring rate:", id, r.Addr())
+		}
+	}
+
+	if ring.Get("{user:1}:bag") != ring.Get("{user:1}:info") {
+
+		t.Error("Ring rate hash tag")
+	}
+
+	helperMux.Lock()
+	if poolRedisRing == nil {
+
+		poolRedisHelper = make(map[string][]*Redis)
+		poolRedisRing = make(map[string]*Ring)
+	}
+	poolRedisRing["rate"] = ring
+	helperMux.Unlock()
+
+	if _, err := PlanAddShard("rate", &RedisConf{Name: "rate", Host: "127.0.0.1", Port: "6381"}, ""); err != ShardRateErr {
+
+		t.Fatal("PlanAddShard rate:", err)
+	}
+}
+
+func TestMigrationPlan(t *testing.T) {
+
+	a, b, c := newFakeServer(t), newFakeServer(t), newFakeServer(t)
+	defer a.close()
+	defer b.close()
+	defer c.close()
+
+	useFakeRedis("migrate", a, b)
+
+	for i := 0; i < 200; i++ {
+
+		r, _ := UseRedis("migrate", uint64(i))
+		if err := r.Set(strconv.Itoa(i), i); err != nil {
+
+			t.Fatal("Set:", err)
+		}
+	}
+
+	_ = a.exec(&fakeConn{}, []string{"PEXPIRE", "1", "60000"})
+	_ = b.exec(&fakeConn{}, []string{"PEXPIRE", "1", "60000"})
+
+	plan, err := PlanAddShard("migrate", c.conf("migrate"), "")
+	if err != nil {
+
+		t.Fatal("PlanAddShard:", err)
+	}
+
+	if plan.Keys() == 0 || plan.Keys() > 120 {
+
+		t.Fatal("PlanAddShard keys:", plan.Keys())
+	}
+
+	if err = plan.Copy(); err != nil {
+
+		t.Fatal("Copy:", err)
+	}
+
+	if err = plan.Commit(true); err != nil {
+
+		t.Fatal("Commit:", err)
+	}
+
+	for i := 0; i < 200; i++ {
+
+		r, _ := UseRedis("migrate", uint64(i))
+
+		var v int
+		if err = r.Get(strconv.Itoa(i), &v); err != nil || v != i {
+
+			t.Fatal("Get after migrate:", i, v, err)
+		}
+	}
+
+	for _, keys := range plan.Moves {
+
+		for _, key := range keys {
+
+			if a.get(key) != nil || b.get(key) != nil {
+
+				t.Fatal("key not deleted from source:", key)
+			}
+		}
+	}
+
+	if _, err = PlanAddShard("migrate", c.conf("migrate"), ""); err != ShardExistsErr {
+
+		t.Error("PlanAddShard exists:", err)
+	}
+}
@@ -0,0 +1,304 @@
+package redis
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//StreamMessage stream中的一条消息
+type StreamMessage struct {
+	ID     string
+	Values map[string][]byte
+}
+
+//PendingEntry 已投递未确认的消息
+type PendingEntry struct {
+	ID         string
+	Consumer   string
+	Idle       time.Duration
+	Deliveries int64
+}
+
+//Xadd 添加消息，maxLen大于0时近似裁剪到maxLen条，返回消息id
+func (r *Redis) Xadd(key string, maxLen int64, fieldValues ...interface{}) (string, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.XaddCtx(ctx, key, maxLen, fieldValues...)
+}
+
+func (r *Redis) XaddCtx(ctx context.Context, key string, maxLen int64, fieldValues ...interface{}) (string, error) {
+
+	args := make([]interface{}, 0, len(fieldValues)+5)
+	args = append(args, key)
+	if maxLen > 0 {
+
+		args = append(args, "MAXLEN", "~", maxLen)
+	}
+	args = append(args, "*")
+	args = append(args, fieldValues...)
+
+	return redis.String(r.do(ctx, "XADD", args...))
+}
+
+//XgroupCreate 创建消费组，stream不存在时创建，消费组已存在时忽略
+func (r *Redis) XgroupCreate(key string, group string, start string) error {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.XgroupCreateCtx(ctx, key, group, start)
+}
+
+func (r *Redis) XgroupCreateCtx(ctx context.Context, key string, group string, start string) error {
+
+	_, err := r.do(ctx, "XGROUP", "CREATE", key, group, start, "MKSTREAM")
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "BUSYGROUP") {
+
+		return nil
+	}
+
+	return err
+}
+
+//XreadGroup 以消费组读取新消息，block大于0时阻塞等待，没有消息返回空
+func (r *Redis) XreadGroup(group string, consumer string, key string, count int, block time.Duration) ([]StreamMessage, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), block+DefaultTimeout)
+	defer cancel()
+
+	return r.XreadGroupCtx(ctx, group, consumer, key, count, block)
+}
+
+//XreadGroupCtx ctx没有截止时间时阻塞读以block加DefaultTimeout为读超时
+func (r *Redis) XreadGroupCtx(ctx context.Context, group string, consumer string, key string, count int, block time.Duration) ([]StreamMessage, error) {
+
+	if _, ok := ctx.Deadline(); !ok && block > 0 {
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, block+DefaultTimeout)
+		defer cancel()
+	}
+
+	args := []interface{}{"GROUP", group, consumer}
+	if count > 0 {
+
+		args = append(args, "COUNT", count)
+	}
+
+	if block > 0 {
+
+		args = append(args, "BLOCK", block.Nanoseconds()/int64(time.Millisecond))
+	}
+	args = append(args, "STREAMS", key, ">")
+
+	reply, err := redis.Values(r.do(ctx, "XREADGROUP", args...))
+	if err == redis.ErrNil {
+
+		return nil, nil
+	}
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	for _, v := range reply {
+
+		stream, err := redis.Values(v, nil)
+		if err != nil {
+
+			return nil, err
+		}
+
+		if len(stream) == 2 {
+
+			return streamMessages(stream[1], nil)
+		}
+	}
+
+	return nil, nil
+}
+
+//Xack 确认消息
+func (r *Redis) Xack(key string, group string, ids ...string) (int64, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.XackCtx(ctx, key, group, ids...)
+}
+
+func (r *Redis) XackCtx(ctx context.Context, key string, group string, ids ...string) (int64, error) {
+
+	args := make([]interface{}, 0, len(ids)+2)
+	args = append(args, key, group)
+	for _, id := range ids {
+
+		args = append(args, id)
+	}
+
+	return redis.Int64(r.doRetry(ctx, "XACK", args...))
+}
+
+//Xpending 查询空闲超过idle的未确认消息，最多count条，IDLE参数需要redis 6.2
+func (r *Redis) Xpending(key string, group string, idle time.Duration, count int) ([]PendingEntry, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.XpendingCtx(ctx, key, group, idle, count)
+}
+
+func (r *Redis) XpendingCtx(ctx context.Context, key string, group string, idle time.Duration, count int) ([]PendingEntry, error) {
+
+	reply, err := redis.Values(r.doRetry(ctx, "XPENDING", key, group, "IDLE", idle.Nanoseconds()/int64(time.Millisecond), "-", "+", count))
+	if err != nil {
+
+		return nil, err
+	}
+
+	entries := make([]PendingEntry, 0, len(reply))
+	for _, v := range reply {
+
+		fields, err := redis.Values(v, nil)
+		if err != nil {
+
+			return nil, err
+		}
+
+		var entry PendingEntry
+		var ms int64
+		if _, err = redis.Scan(fields, &entry.ID, &entry.Consumer, &ms, &entry.Deliveries); err != nil {
+
+			return nil, err
+		}
+		entry.Idle = time.Duration(ms) * time.Millisecond
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+//Xclaim 把空闲超过minIdle的消息转给consumer，返回转移成功的消息，已被删除的消息不返回
+func (r *Redis) Xclaim(key string, group string, consumer string, minIdle time.Duration, ids ...string) ([]StreamMessage, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.XclaimCtx(ctx, key, group, consumer, minIdle, ids...)
+}
+
+func (r *Redis) XclaimCtx(ctx context.Context, key string, group string, consumer string, minIdle time.Duration, ids ...string) ([]StreamMessage, error) {
+
+	args := make([]interface{}, 0, len(ids)+4)
+	args = append(args, key, group, consumer, minIdle.Nanoseconds()/int64(time.Millisecond))
+	for _, id := range ids {
+
+		args = append(args, id)
+	}
+
+	return streamMessages(r.do(ctx, "XCLAIM", args...))
+}
+
+//Xdel 删除消息
+func (r *Redis) Xdel(key string, ids ...string) (int64, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.XdelCtx(ctx, key, ids...)
+}
+
+func (r *Redis) XdelCtx(ctx context.Context, key string, ids ...string) (int64, error) {
+
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, key)
+	for _, id := range ids {
+
+		args = append(args, id)
+	}
+
+	return redis.Int64(r.doRetry(ctx, "XDEL", args...))
+}
+
+func (r *Redis) Xlen(key string) (int64, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.XlenCtx(ctx, key)
+}
+
+func (r *Redis) XlenCtx(ctx context.Context, key string) (int64, error) {
+
+	return redis.Int64(r.doRetry(ctx, "XLEN", key))
+}
+
+//Xrange 按id范围读取消息，count小于等于0不限制
+func (r *Redis) Xrange(key string, start string, end string, count int) ([]StreamMessage, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.XrangeCtx(ctx, key, start, end, count)
+}
+
+func (r *Redis) XrangeCtx(ctx context.Context, key string, start string, end string, count int) ([]StreamMessage, error) {
+
+	args := []interface{}{key, start, end}
+	if count > 0 {
+
+		args = append(args, "COUNT", count)
+	}
+
+	return streamMessages(r.doRetry(ctx, "XRANGE", args...))
+}
+
+//streamMessages 解析[[id, [field, value, ...]], ...]
+func streamMessages(reply interface{}, err error) ([]StreamMessage, error) {
+
+	values, err := redis.Values(reply, err)
+	if err != nil {
+
+		return nil, err
+	}
+
+	messages := make([]StreamMessage, 0, len(values))
+	for _, v := range values {
+
+		entry, err := redis.Values(v, nil)
+		if err != nil || len(entry) != 2 {
+
+			// XCLAIM已删除的消息为nil
+			continue
+		}
+
+		id, err := redis.String(entry[0], nil)
+		if err != nil {
+
+			return nil, err
+		}
+
+		fields, err := redis.ByteSlices(entry[1], nil)
+		if err != nil && err != redis.ErrNil {
+
+			return nil, err
+		}
+
+		message := StreamMessage{ID: id, Values: make(map[string][]byte, len(fields)/2)}
+		for i := 0; i+1 < len(fields); i += 2 {
+
+			message.Values[string(fields[i])] = fields[i+1]
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
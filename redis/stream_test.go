@@ -0,0 +1,139 @@
+package redis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRedis_Stream(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	r := newRedis(s.conf("stream"))
+	defer r.Close()
+
+	if err := r.XgroupCreate("stream", "group", "0"); err != nil {
+
+		t.Fatal("XgroupCreate:", err)
+	}
+
+	if err := r.XgroupCreate("stream", "group", "0"); err != nil {
+
+		t.Fatal("XgroupCreate exists:", err)
+	}
+
+	for _, v := range []string{"a", "b", "c"} {
+
+		if _, err := r.Xadd("stream", 100, "data", v); err != nil {
+
+			t.Fatal("Xadd:", err)
+		}
+	}
+
+	messages, err := r.XreadGroup("group", "c1", "stream", 2, time.Duration(10)*time.Millisecond)
+	if err != nil || len(messages) != 2 || string(messages[0].Values["data"]) != "a" {
+
+		t.Fatal("XreadGroup:", messages, err)
+	}
+
+	if n, err := r.Xack("stream", "group", messages[0].ID); n != 1 || err != nil {
+
+		t.Error("Xack:", n, err)
+	}
+
+	time.Sleep(time.Duration(20) * time.Millisecond)
+
+	pending, err := r.Xpending("stream", "group", time.Duration(10)*time.Millisecond, 10)
+	if err != nil || len(pending) != 1 || pending[0].ID != messages[1].ID || pending[0].Consumer != "c1" || pending[0].Deliveries != 1 {
+
+		t.Fatal("Xpending:", pending, err)
+	}
+
+	claimed, err := r.Xclaim("stream", "group", "c2", time.Duration(10)*time.Millisecond, pending[0].ID)
+	if err != nil || len(claimed) != 1 || string(claimed[0].Values["data"]) != "b" {
+
+		t.Fatal("Xclaim:", claimed, err)
+	}
+
+	pending, err = r.Xpending("stream", "group", 0, 10)
+	if err != nil || len(pending) != 1 || pending[0].Consumer != "c2" || pending[0].Deliveries != 2 {
+
+		t.Error("Xpending after claim:", pending, err)
+	}
+
+	messages, err = r.XreadGroup("group", "c1", "stream", 10, 0)
+	if err != nil || len(messages) != 1 || string(messages[0].Values["data"]) != "c" {
+
+		t.Error("XreadGroup rest:", messages, err)
+	}
+
+	messages, err = r.XreadGroup("group", "c1", "stream", 10, 0)
+	if err != nil || len(messages) != 0 {
+
+		t.Error("XreadGroup empty:", messages, err)
+	}
+
+	if n, err := r.Xdel("stream", claimed[0].ID); n != 1 || err != nil {
+
+		t.Error("Xdel:", n, err)
+	}
+
+	if n, err := r.Xlen("stream"); n != 2 || err != nil {
+
+		t.Error("Xlen:", n, err)
+	}
+
+	all, err := r.Xrange("stream", "-", "+", 0)
+	if err != nil || len(all) != 2 || string(all[1].Values["data"]) != "c" {
+
+		t.Error("Xrange:", all, err)
+	}
+}
+
+func TestRedis_Blpop(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	r := newRedis(s.conf("blpop"))
+	defer r.Close()
+
+	for _, v := range []string{"a", "b", "c"} {
+
+		if err := r.Rpush("low", v); err != nil {
+
+			t.Fatal("Rpush:", err)
+		}
+	}
+
+	_ = r.Rpush("high", "x")
+
+	key, v, err := r.Blpop(time.Second, "high", "low")
+	if err != nil || key != "high" || string(v) != "x" {
+
+		t.Fatal("Blpop:", key, string(v), err)
+	}
+
+	key, v, err = r.Blpop(time.Second, "high", "low")
+	if err != nil || key != "low" || string(v) != "a" {
+
+		t.Fatal("Blpop low:", key, string(v), err)
+	}
+
+	values, err := r.LpopCount("low", 5)
+	if err != nil || len(values) != 2 || string(values[1]) != "c" {
+
+		t.Fatal("LpopCount:", values, err)
+	}
+
+	if values, err = r.LpopCount("low", 5); values != nil || err != nil {
+
+		t.Error("LpopCount empty:", values, err)
+	}
+
+	if key, v, err = r.Blpop(time.Second, "high", "low"); key != "" || v != nil || err != nil {
+
+		t.Error("Blpop empty:", key, v, err)
+	}
+}
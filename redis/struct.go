@@ -0,0 +1,318 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	structSpecs sync.Map
+
+	StructPointerErr = errors.New("redis struct must be a pointer to struct")
+)
+
+//structField 结构体字段和hash字段的对应关系
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+type structSpec struct {
+	fields []*structField
+	byName map[string]*structField
+}
+
+//getStructSpec 解析结构体的redis标签，结果按类型缓存
+//`redis:"name"`指定字段名，`redis:"-"`忽略，`redis:"name,omitempty"`零值不写入，没有标签时使用字段名
+//匿名结构体字段没有标签时展开
+func getStructSpec(t reflect.Type) *structSpec {
+
+	if v, ok := structSpecs.Load(t); ok {
+
+		return v.(*structSpec)
+	}
+
+	spec := &structSpec{byName: make(map[string]*structField)}
+	compileStructSpec(t, nil, spec)
+
+	v, _ := structSpecs.LoadOrStore(t, spec)
+
+	return v.(*structSpec)
+}
+
+func compileStructSpec(t reflect.Type, index []int, spec *structSpec) {
+
+	for i := 0; i < t.NumField(); i++ {
+
+		f := t.Field(i)
+		tag := f.Tag.Get("redis")
+		if tag == "-" {
+
+			continue
+		}
+
+		fieldIndex := make([]int, len(index)+1)
+		copy(fieldIndex, index)
+		fieldIndex[len(index)] = i
+
+		if f.Anonymous && len(tag) == 0 && f.Type.Kind() == reflect.Struct {
+
+			compileStructSpec(f.Type, fieldIndex, spec)
+
+			continue
+		}
+
+		if len(f.PkgPath) > 0 {
+
+			continue
+		}
+
+		field := &structField{name: f.Name, index: fieldIndex}
+		if len(tag) > 0 {
+
+			parts := strings.Split(tag, ",")
+			if len(parts[0]) > 0 {
+
+				field.name = parts[0]
+			}
+
+			for _, opt := range parts[1:] {
+
+				if opt == "omitempty" {
+
+					field.omitEmpty = true
+				}
+			}
+		}
+
+		if _, ok := spec.byName[field.name]; ok {
+
+			continue
+		}
+
+		spec.fields = append(spec.fields, field)
+		spec.byName[field.name] = field
+	}
+}
+
+//selectFields 按hash字段名选择，names为空时返回全部
+func (spec *structSpec) selectFields(names []string) ([]*structField, error) {
+
+	if len(names) == 0 {
+
+		return spec.fields, nil
+	}
+
+	fields := make([]*structField, 0, len(names))
+	for _, name := range names {
+
+		field, ok := spec.byName[name]
+		if !ok {
+
+			return nil, fmt.Errorf("redis struct field %s not exists", name)
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+func structValue(v interface{}, pointer bool) (reflect.Value, error) {
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+
+		rv = rv.Elem()
+	} else if pointer {
+
+		return rv, StructPointerErr
+	}
+
+	if rv.Kind() != reflect.Struct {
+
+		return rv, StructPointerErr
+	}
+
+	return rv, nil
+}
+
+//StructFields 结构体对应的hash字段名
+func StructFields(v interface{}) ([]string, error) {
+
+	rv, err := structValue(v, false)
+	if err != nil {
+
+		return nil, err
+	}
+
+	spec := getStructSpec(rv.Type())
+	names := make([]string, len(spec.fields))
+	for i, field := range spec.fields {
+
+		names[i] = field.name
+	}
+
+	return names, nil
+}
+
+//HsetStruct 按redis标签把结构体写入hash，字符串、[]byte和整数直接保存，浮点数、bool等其它类型使用配置的编码
+//fields为修改过的hash字段名，为空时写入全部字段
+func (r *Redis) HsetStruct(key string, v interface{}, fields ...string) error {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.HsetStructCtx(ctx, key, v, fields...)
+}
+
+func (r *Redis) HsetStructCtx(ctx context.Context, key string, v interface{}, fields ...string) error {
+
+	args, err := structArgs(key, v, fields)
+	if err != nil || len(args) == 1 {
+
+		return err
+	}
+
+	_, err = r.do(ctx, "HMSET", args...)
+
+	return err
+}
+
+//AppendStruct 管道中写入结构体，fields为空时写入全部字段
+func (pipe *PipeLine) AppendStruct(key string, v interface{}, fields ...string) error {
+
+	args, err := structArgs(key, v, fields)
+	if err != nil || len(args) == 1 {
+
+		return err
+	}
+
+	return pipe.Append("HMSET", args...)
+}
+
+//structArgs 生成HMSET参数，指定了fields时omitempty无效
+func structArgs(key string, v interface{}, names []string) ([]interface{}, error) {
+
+	rv, err := structValue(v, false)
+	if err != nil {
+
+		return nil, err
+	}
+
+	fields, err := getStructSpec(rv.Type()).selectFields(names)
+	if err != nil {
+
+		return nil, err
+	}
+
+	args := make([]interface{}, 1, 2*len(fields)+1)
+	args[0] = key
+	for _, field := range fields {
+
+		fv := rv.FieldByIndex(field.index)
+		if field.omitEmpty && len(names) == 0 && isZero(fv) {
+
+			continue
+		}
+
+		data, err := Encode(fv.Interface())
+		if err != nil {
+
+			return nil, fmt.Errorf("Encode f=%s err=%s", field.name, err.Error())
+		}
+
+		args = append(args, field.name, data)
+	}
+
+	return args, nil
+}
+
+func isZero(v reflect.Value) bool {
+
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+//HgetStruct 读取hash到结构体，fields为空时读取全部字段，hash中不存在的字段保持原值
+//HMGET只请求结构体的字段，耗时和hash本身的大小无关
+//所有字段都不存在时返回KeyNotExistsErr
+func (r *Redis) HgetStruct(key string, v interface{}, fields ...string) error {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.HgetStructCtx(ctx, key, v, fields...)
+}
+
+func (r *Redis) HgetStructCtx(ctx context.Context, key string, v interface{}, fields ...string) error {
+
+	rv, err := structValue(v, true)
+	if err != nil {
+
+		return err
+	}
+
+	selected, err := getStructSpec(rv.Type()).selectFields(fields)
+	if err != nil {
+
+		return err
+	}
+
+	args := make([]interface{}, len(selected)+1)
+	args[0] = key
+	for i, field := range selected {
+
+		args[i+1] = field.name
+	}
+
+	data, err := redis.Values(r.doRetry(ctx, "HMGET", args...))
+	if err != nil {
+
+		return err
+	}
+
+	if len(data) != len(selected) {
+
+		return errors.New("hmget error data")
+	}
+
+	found := false
+	for i, value := range data {
+
+		if value == nil {
+
+			continue
+		}
+
+		found = true
+		if err = decodeField(rv, selected[i], value); err != nil {
+
+			return err
+		}
+	}
+
+	if !found {
+
+		return KeyNotExistsErr
+	}
+
+	return nil
+}
+
+func decodeField(rv reflect.Value, field *structField, value interface{}) error {
+
+	fv := rv.FieldByIndex(field.index)
+	if err := Decode(value, fv.Addr().Interface()); err != nil {
+
+		return fmt.Errorf("Decode f=%s err=%s", field.name, err.Error())
+	}
+
+	return nil
+}
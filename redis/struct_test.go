@@ -0,0 +1,119 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+)
+
+type structBase struct {
+	Uid  uint64 `redis:"uid"`
+	Name string `redis:"name"`
+}
+
+type structItem struct {
+	Id    int
+	Count int
+}
+
+type structPlayer struct {
+	structBase
+	Level  int                `redis:"level"`
+	Gold   int64              `redis:"gold,omitempty"`
+	Online bool               `redis:"online"`
+	Items  []structItem       `redis:"items"`
+	Attrs  map[string]float64 `redis:"attrs"`
+	Temp   int                `redis:"-"`
+	Title  string
+	secret int
+}
+
+func TestRedis_HsetStruct(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	r := newRedis(s.conf("struct"))
+	defer r.Close()
+
+	fields, err := StructFields(&structPlayer{})
+	if err != nil || !reflect.DeepEqual(fields, []string{"uid", "name", "level", "gold", "online", "items", "attrs", "Title"}) {
+
+		t.Fatal("StructFields:", fields, err)
+	}
+
+	p := &structPlayer{
+		structBase: structBase{Uid: 10001, Name: "player"},
+		Level:      10,
+		Online:     true,
+		Items:      []structItem{{Id: 1, Count: 2}},
+		Attrs:      map[string]float64{"atk": 1.5},
+		Temp:       1,
+		Title:      "king",
+	}
+
+	if err = r.HsetStruct("player", p); err != nil {
+
+		t.Fatal("HsetStruct:", err)
+	}
+
+	if h := s.get("player").(map[string][]byte); len(h) != 7 || string(h["level"]) != "10" {
+
+		t.Fatal("hash:", h)
+	}
+
+	var got structPlayer
+	if err = r.HgetStruct("player", &got); err != nil {
+
+		t.Fatal("HgetStruct:", err)
+	}
+
+	p.Temp = 0
+	if !reflect.DeepEqual(&got, p) {
+
+		t.Fatal("HgetStruct:", got, p)
+	}
+
+	// 只写入修改过的字段
+	p.Level, p.Gold, p.Name = 11, 100, "changed"
+	if err = r.HsetStruct("player", p, "level", "gold"); err != nil {
+
+		t.Fatal("HsetStruct dirty:", err)
+	}
+
+	got = structPlayer{}
+	if err = r.HgetStruct("player", &got, "level", "gold", "name"); err != nil {
+
+		t.Fatal("HgetStruct fields:", err)
+	}
+
+	if got.Level != 11 || got.Gold != 100 || got.Name != "player" || got.Uid != 0 {
+
+		t.Error("HgetStruct fields:", got)
+	}
+
+	pipe := &PipeLine{}
+	if err = pipe.AppendStruct("player2", p, "level"); err != nil || !r.RunPipeLine(pipe) {
+
+		t.Fatal("AppendStruct:", err, pipe.RunErr)
+	}
+
+	if h := s.get("player2").(map[string][]byte); len(h) != 1 || string(h["level"]) != "11" {
+
+		t.Error("AppendStruct:", h)
+	}
+
+	if err = r.HsetStruct("player", p, "unknown"); err == nil {
+
+		t.Error("HsetStruct unknown field")
+	}
+
+	if err = r.HgetStruct("player", got); err != StructPointerErr {
+
+		t.Error("HgetStruct not pointer:", err)
+	}
+
+	if err = r.HgetStruct("none", &got); err != KeyNotExistsErr {
+
+		t.Error("HgetStruct not exists:", err)
+	}
+}
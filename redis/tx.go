@@ -0,0 +1,177 @@
+package redis
+
+import (
+	"context"
+	"errors"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	//TxMaxRetries WATCH的key被修改时的最大重试次数
+	TxMaxRetries = 10
+
+	TxConflictErr = errors.New("redis tx conflict")
+	TxReplyErr    = errors.New("redis tx reply error")
+)
+
+//Tx 乐观事务，WATCH之后在fn中读取数据，用PipeLine的Append系列方法添加写命令
+//EXEC后每个Command的Result和Err为执行结果
+type Tx struct {
+	PipeLine
+	ctx  context.Context
+	conn redis.Conn
+}
+
+//Do 事务中执行读命令，立即返回结果
+func (tx *Tx) Do(cmd string, args ...interface{}) (interface{}, error) {
+
+	return doContext(tx.ctx, tx.conn, cmd, args...)
+}
+
+//Get 事务中读取Set写入的值
+func (tx *Tx) Get(key string, v interface{}) error {
+
+	data, err := tx.Do("GET", key)
+	if err != nil {
+
+		return err
+	}
+
+	if data == nil {
+
+		return KeyNotExistsErr
+	}
+
+	return Decode(data, v)
+}
+
+//Hget 事务中读取Hset写入的值，field不存在时v不变
+func (tx *Tx) Hget(key string, field string, v interface{}) error {
+
+	data, err := tx.Do("HGET", key, field)
+	if err != nil || data == nil {
+
+		return err
+	}
+
+	return Decode(data, v)
+}
+
+//Tx WATCH keys后执行fn，fn返回错误时放弃事务
+//keys在EXEC前被其它连接修改时重新执行fn，超过TxMaxRetries返回TxConflictErr
+//返回最后一次执行的命令
+func (r *Redis) Tx(keys []string, fn func(tx *Tx) error) ([]*Command, error) {
+
+	ctx, cancel := withTimeout()
+	defer cancel()
+
+	return r.TxCtx(ctx, keys, fn)
+}
+
+func (r *Redis) TxCtx(ctx context.Context, keys []string, fn func(tx *Tx) error) ([]*Command, error) {
+
+	conn, err := r.getContext(ctx)
+	if err != nil {
+
+		return nil, err
+	}
+	defer conn.Close()
+
+	tx := &Tx{ctx: ctx, conn: conn}
+	for i := 0; i < TxMaxRetries; i++ {
+
+		var ok bool
+		ok, err = tx.run(keys, fn)
+		if err != nil || ok {
+
+			return tx.Commands, err
+		}
+	}
+
+	return tx.Commands, TxConflictErr
+}
+
+//run 执行一次，WATCH的key被修改时返回false
+func (tx *Tx) run(keys []string, fn func(tx *Tx) error) (bool, error) {
+
+	tx.Commands = nil
+	tx.RunErr = nil
+
+	if len(keys) > 0 {
+
+		args := make([]interface{}, len(keys))
+		for i, key := range keys {
+
+			args[i] = key
+		}
+
+		if _, err := tx.Do("WATCH", args...); err != nil {
+
+			return false, err
+		}
+	}
+
+	if err := fn(tx); err != nil {
+
+		_, _ = tx.Do("UNWATCH")
+
+		return false, err
+	}
+
+	if len(tx.Commands) == 0 {
+
+		_, err := tx.Do("UNWATCH")
+
+		return err == nil, err
+	}
+
+	if err := tx.conn.Send("MULTI"); err != nil {
+
+		return false, err
+	}
+
+	for _, command := range tx.Commands {
+
+		if err := tx.conn.Send(command.Cmd, command.rArgs...); err != nil {
+
+			return false, err
+		}
+	}
+
+	replies, err := redis.Values(doContext(tx.ctx, tx.conn, "EXEC"))
+	if err == redis.ErrNil {
+
+		return false, nil
+	}
+
+	if err != nil {
+
+		// 命令入队失败时EXEC返回EXECABORT，错误记录到对应的Command
+		for _, command := range tx.Commands {
+
+			command.Err = err
+		}
+		tx.RunErr = err
+
+		return false, err
+	}
+
+	if len(replies) != len(tx.Commands) {
+
+		tx.RunErr = TxReplyErr
+
+		return false, TxReplyErr
+	}
+
+	for i, command := range tx.Commands {
+
+		command.Result, command.Err = replies[i], nil
+		if e, ok := replies[i].(redis.Error); ok {
+
+			command.Result, command.Err = nil, e
+		}
+	}
+
+	return true, nil
+}
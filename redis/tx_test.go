@@ -0,0 +1,158 @@
+package redis
+
+import (
+	"testing"
+)
+
+func TestRedis_Tx(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	r := newRedis(s.conf("tx"))
+	defer r.Close()
+
+	if err := r.Set("gold", 100); err != nil {
+
+		t.Fatal("Set:", err)
+	}
+
+	runs := 0
+	commands, err := r.Tx([]string{"gold"}, func(tx *Tx) error {
+
+		runs++
+
+		var gold int
+		if err := tx.Get("gold", &gold); err != nil {
+
+			return err
+		}
+
+		// 第一次执行时其它连接修改了gold
+		if runs == 1 {
+
+			if err := r.Set("gold", gold+50); err != nil {
+
+				return err
+			}
+		}
+
+		if err := tx.AppendEncode("SET", "gold", gold-30); err != nil {
+
+			return err
+		}
+
+		return tx.Append("HINCRBY", "log", "spend", 30)
+	})
+	if err != nil {
+
+		t.Fatal("Tx:", err)
+	}
+
+	if runs != 2 {
+
+		t.Error("Tx runs:", runs)
+	}
+
+	var gold int
+	if err = r.Get("gold", &gold); err != nil || gold != 120 {
+
+		t.Error("Tx result:", gold, err)
+	}
+
+	if n, err := commands[1].ResultInt(); err != nil || n != 30 {
+
+		t.Error("Tx command result:", n, err)
+	}
+
+	_, err = r.Tx([]string{"gold"}, func(tx *Tx) error {
+
+		_ = tx.AppendEncode("SET", "gold", 0)
+
+		return KeyNotExistsErr
+	})
+	if err != KeyNotExistsErr {
+
+		t.Error("Tx abort:", err)
+	}
+
+	if err = r.Get("gold", &gold); err != nil || gold != 120 {
+
+		t.Error("Tx aborted but changed:", gold, err)
+	}
+
+	_, err = r.Tx([]string{"gold"}, func(tx *Tx) error {
+
+		_ = r.Set("gold", 1)
+
+		return tx.AppendEncode("SET", "gold", 0)
+	})
+	if err != TxConflictErr {
+
+		t.Error("Tx conflict:", err)
+	}
+}
+
+func TestScript(t *testing.T) {
+
+	s := newFakeServer(t)
+	defer s.close()
+
+	r := newRedis(s.conf("script"))
+	defer r.Close()
+
+	script := RegisterScript("test_incr", 1, `return redis.call("INCRBY", KEYS[1], ARGV[1])`)
+	fakeScript(script, func(s *fakeServer, keys []string, args []string) interface{} {
+
+		return s.call("INCRBY", keys[0], args[0])
+	})
+
+	if _, ok := LookupScript("test_incr"); !ok {
+
+		t.Fatal("LookupScript")
+	}
+
+	// 第一次NOSCRIPT后EVAL，之后EVALSHA
+	for i := 1; i <= 2; i++ {
+
+		v, err := r.EvalScript("test_incr", "n", 2)
+		if err != nil || v.(int64) != int64(2*i) {
+
+			t.Fatal("EvalScript:", v, err)
+		}
+	}
+
+	if _, err := r.EvalScript("not_exists"); err != ScriptNotExistsErr {
+
+		t.Error("EvalScript not exists:", err)
+	}
+
+	pipe := new(PipeLine)
+	command := pipe.AppendScript(script, "n", 10)
+	if !r.RunPipeLine(pipe) {
+
+		t.Fatal("RunPipeLine:", pipe.RunErr)
+	}
+
+	if n, _ := command.ResultInt(); n != 14 {
+
+		t.Error("AppendScript:", n)
+	}
+
+	ok, err := r.Lock("lock", "tag", 10)
+	if !ok || err != nil {
+
+		t.Fatal("Lock:", ok, err)
+	}
+
+	// 脚本返回false时结果为nil
+	if ok, _ = r.Unlock("lock", "other"); ok {
+
+		t.Error("Unlock other")
+	}
+
+	if ok, err = r.Unlock("lock", "tag"); !ok || err != nil {
+
+		t.Error("Unlock:", ok, err)
+	}
+}
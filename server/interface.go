@@ -2,6 +2,7 @@ package server
 
 import (
 	"net"
+	"net/http"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -18,6 +19,45 @@ type GateServer interface {
 	Close()
 	Count() int
 	SetHandler(handler Handler)
+	SetAdmission(admission Admission)
+	Stats() Stats
+
+	Get(id uint64) (Conn, bool)
+	Range(fn func(c Conn) bool)
+	Broadcast(b []byte)
+	SendTo(ids []uint64, b []byte)
+
+	Join(group string, id uint64) error
+	Leave(group string, id uint64)
+	SendGroup(group string, b []byte)
+}
+
+// QueueHandler 登录排队，Handler实现该接口并且配置了QueueSize时，
+// 超出MaxConn的连接升级后进入排队，位置变化时调用Queued，轮到时调用Open
+// Queued在其它连接关闭的流程中调用，不能阻塞，排队的客户端需在30秒内发送ping保持连接
+type QueueHandler interface {
+	Queued(c Conn, pos int)
+}
+
+// Admission 连接准入控制，在连接升级之前调用
+// 返回nil允许连接，否则按Reject拒绝
+type Admission interface {
+	Admit(r *http.Request) *Reject
+}
+
+// AdmissionFunc 函数形式的Admission
+type AdmissionFunc func(r *http.Request) *Reject
+
+func (f AdmissionFunc) Admit(r *http.Request) *Reject {
+
+	return f(r)
+}
+
+// Reject 拒绝连接，Code为http状态码，RetryAfter大于0时返回Retry-After头
+type Reject struct {
+	Code       int
+	Reason     string
+	RetryAfter time.Duration
 }
 
 var (
@@ -35,10 +75,73 @@ type Conn interface {
 	SetReadDeadline(t time.Duration)
 	RemoteAddr() net.Addr
 	Error() error
+	Stats() ConnStats
 }
 
+// ConnStats 连接发送统计，用于发现网络差的玩家
+type ConnStats struct {
+	QueuedMsgs   int
+	QueuedBytes  int
+	SentMsgs     uint64
+	SentBytes    uint64
+	DroppedMsgs  uint64
+	DroppedBytes uint64
+}
+
+// SendPolicy 发送队列满时的处理策略
+type SendPolicy int
+
+const (
+	// SendBlock 等待SendTimeout，超时丢弃当前消息，广播时不等待
+	SendBlock SendPolicy = iota
+	// SendDropNewest 丢弃当前消息
+	SendDropNewest
+	// SendDropOldest 丢弃队列中最早的消息
+	SendDropOldest
+	// SendDisconnect 断开连接
+	SendDisconnect
+)
+
 type Config struct {
 	Addr        string
 	MaxConn     int
 	OriginAllow string
+
+	// QueueSize 达到MaxConn后允许排队的连接数，需Handler实现QueueHandler
+	QueueSize int
+	// RetryAfter 达到MaxConn拒绝连接时建议客户端重试的间隔，0使用默认值5秒
+	RetryAfter time.Duration
+	// SendQueueSize 每个连接发送队列长度，0使用默认值32
+	SendQueueSize int
+	// SendPolicy 发送队列满时的处理策略
+	SendPolicy SendPolicy
+	// SendTimeout SendBlock策略的最长等待时间，0使用默认值100ms
+	SendTimeout time.Duration
+	// SendBatch 发送goroutine每次最多写出的消息数，0使用默认值16
+	SendBatch int
+	// SendCoalesce 大于0时把队列中连续的消息合并为一帧，每帧不超过该字节数，
+	// 开启后客户端协议需要自带消息长度
+	SendCoalesce int
+	// MaxConnPerIP 单个ip最大连接数，0不限制
+	MaxConnPerIP int
+	// MaxMsgSize 单条消息最大字节数，0使用默认值32768
+	MaxMsgSize int64
+	// MsgPerSec 每秒消息数限制，MsgBurst 允许突发的消息数，0不限制
+	MsgPerSec int
+	MsgBurst  int
+	// BytesPerSec 每秒流量限制，BytesBurst 允许突发的字节数，0不限制
+	// BytesBurst 小于MaxMsgSize时按MaxMsgSize处理，保证最大的消息可以通过
+	BytesPerSec int
+	BytesBurst  int
+}
+
+// Stats 服务统计，被拒绝的流量和连接
+type Stats struct {
+	Conns         int
+	QueuedConns   int
+	RejectedConns uint64
+	RejectedMsgs  uint64
+	RejectedBytes uint64
+	KickedConns   uint64
+	DroppedMsgs   uint64
 }
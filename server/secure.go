@@ -0,0 +1,419 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/laonsx/gamelib/crypt"
+)
+
+// 握手消息 magic(2) version(1) flags(1) ciphers(1) publen(2) pub [sig(64)]
+// 客户端发送自己支持的flags和ciphers，服务端回复协商结果和自己的DH公钥，
+// 配置了签名密钥时附带签名
+const (
+	secureVersion = 1
+
+	FlagEncrypt  = 1 << 0
+	FlagCompress = 1 << 1
+
+	CipherAESGCM = 1 << 0
+
+	frameCompressed = 1 << 0
+)
+
+var (
+	secureMagic = []byte{'G', 'S'}
+	dhGroup     = crypt.MODP2048
+
+	defaultCompressThreshold = 256
+	defaultHandshakeTimeout  = time.Duration(10) * time.Second
+	maxDecompressSize        = int64(4 << 20)
+
+	HandshakeErr = errors.New("secure handshake error")
+	FrameErr     = errors.New("secure frame error")
+)
+
+// SecureConfig 连接加密和压缩配置，服务端只接受客户端也请求的选项
+type SecureConfig struct {
+	Encrypt           bool
+	Compress          bool
+	CompressThreshold int
+	HandshakeTimeout  time.Duration
+
+	// SignKey 服务端签名私钥，设置后握手回复附带对双方公钥的签名
+	SignKey ed25519.PrivateKey
+	// VerifyKey 客户端内置的服务端公钥，设置后要求握手签名验证通过
+	VerifyKey ed25519.PublicKey
+}
+
+// FrameConn 按帧收发的连接，ws和tcp连接都可以使用
+type FrameConn interface {
+	Read() ([]byte, error)
+	Send(b []byte) error
+}
+
+// FrameCodec 握手后每个连接的帧编解码
+// 帧格式 flag(1) + body，加密时整帧由crypt.Session加密
+type FrameCodec struct {
+	flags     byte
+	threshold int
+	session   *crypt.Session
+}
+
+// ServerHandshake 服务端握手，读取客户端hello并回复
+func ServerHandshake(fc FrameConn, config *SecureConfig) (*FrameCodec, error) {
+
+	b, err := fc.Read()
+	if err != nil {
+
+		return nil, err
+	}
+
+	flags, ciphers, clientPub, _, err := parseHello(b)
+	if err != nil {
+
+		return nil, err
+	}
+
+	if !config.Encrypt || ciphers&CipherAESGCM == 0 {
+
+		flags &^= FlagEncrypt
+	}
+
+	if !config.Compress {
+
+		flags &^= FlagCompress
+	}
+
+	fcodec := &FrameCodec{flags: flags, threshold: config.CompressThreshold}
+
+	var reply []byte
+	if flags&FlagEncrypt != 0 {
+
+		key, err := dhGroup.RandomKey()
+		if err != nil {
+
+			return nil, err
+		}
+
+		secret, err := dhGroup.Secret(key, new(big.Int).SetBytes(clientPub))
+		if err != nil {
+
+			return nil, err
+		}
+
+		serverPub := dhGroup.Bytes(dhGroup.Exchange(key))
+
+		err = fcodec.setKeys(dhGroup.Bytes(secret), clientPub, serverPub, true)
+		if err != nil {
+
+			return nil, err
+		}
+
+		var sig []byte
+		if config.SignKey != nil {
+
+			sig = crypt.SignExchange(config.SignKey, serverPub, clientPub)
+		}
+
+		reply = makeHello(flags, CipherAESGCM, serverPub, sig)
+	} else {
+
+		reply = makeHello(flags, 0, nil, nil)
+	}
+
+	err = fc.Send(reply)
+	if err != nil {
+
+		return nil, err
+	}
+
+	return fcodec, nil
+}
+
+// ClientHandshake 客户端握手，机器人和测试客户端使用
+// 设置了VerifyKey时要求服务端开启加密并且签名正确
+func ClientHandshake(fc FrameConn, config *SecureConfig) (*FrameCodec, error) {
+
+	var flags byte
+	if config.Encrypt {
+
+		flags |= FlagEncrypt
+	}
+
+	if config.Compress {
+
+		flags |= FlagCompress
+	}
+
+	key, err := dhGroup.RandomKey()
+	if err != nil {
+
+		return nil, err
+	}
+
+	clientPub := dhGroup.Bytes(dhGroup.Exchange(key))
+
+	err = fc.Send(makeHello(flags, CipherAESGCM, clientPub, nil))
+	if err != nil {
+
+		return nil, err
+	}
+
+	b, err := fc.Read()
+	if err != nil {
+
+		return nil, err
+	}
+
+	accepted, ciphers, serverPub, sig, err := parseHello(b)
+	if err != nil {
+
+		return nil, err
+	}
+
+	if accepted&^flags != 0 {
+
+		return nil, HandshakeErr
+	}
+
+	if config.VerifyKey != nil && (accepted&FlagEncrypt == 0 || !crypt.VerifyExchange(config.VerifyKey, serverPub, clientPub, sig)) {
+
+		return nil, HandshakeErr
+	}
+
+	fcodec := &FrameCodec{flags: accepted, threshold: config.CompressThreshold}
+	if accepted&FlagEncrypt != 0 {
+
+		if ciphers != CipherAESGCM {
+
+			return nil, HandshakeErr
+		}
+
+		secret, err := dhGroup.Secret(key, new(big.Int).SetBytes(serverPub))
+		if err != nil {
+
+			return nil, err
+		}
+
+		err = fcodec.setKeys(dhGroup.Bytes(secret), clientPub, serverPub, false)
+		if err != nil {
+
+			return nil, err
+		}
+	}
+
+	return fcodec, nil
+}
+
+// makeHello magic(2) version(1) flags(1) ciphers(1) publen(2) pub [sig(64)]
+func makeHello(flags byte, ciphers byte, pub []byte, sig []byte) []byte {
+
+	b := make([]byte, 0, 7+len(pub)+len(sig))
+	b = append(b, secureMagic...)
+	b = append(b, secureVersion, flags, ciphers, 0, 0)
+	binary.BigEndian.PutUint16(b[5:7], uint16(len(pub)))
+	b = append(b, pub...)
+
+	return append(b, sig...)
+}
+
+func parseHello(b []byte) (flags byte, ciphers byte, pub []byte, sig []byte, err error) {
+
+	if len(b) < 7 || !bytes.Equal(b[:2], secureMagic) || b[2] != secureVersion {
+
+		return 0, 0, nil, nil, HandshakeErr
+	}
+
+	n := int(binary.BigEndian.Uint16(b[5:7]))
+	switch len(b) {
+
+	case 7 + n:
+
+	case 7 + n + ed25519.SignatureSize:
+
+		sig = b[7+n:]
+
+	default:
+
+		return 0, 0, nil, nil, HandshakeErr
+	}
+
+	return b[3], b[4], b[7 : 7+n], sig, nil
+}
+
+// setKeys 由DH共享密钥创建加密会话，双方公钥作为salt
+func (fcodec *FrameCodec) setKeys(secret, clientPub, serverPub []byte, isServer bool) (err error) {
+
+	salt := make([]byte, 0, len(clientPub)+len(serverPub))
+	salt = append(salt, clientPub...)
+	salt = append(salt, serverPub...)
+
+	fcodec.session, err = crypt.NewSession(secret, salt, isServer)
+
+	return
+}
+
+func (fcodec *FrameCodec) Encrypted() bool {
+
+	return fcodec.flags&FlagEncrypt != 0
+}
+
+func (fcodec *FrameCodec) Compressed() bool {
+
+	return fcodec.flags&FlagCompress != 0
+}
+
+// Encode 编码一帧，并发安全
+func (fcodec *FrameCodec) Encode(b []byte) ([]byte, error) {
+
+	var flag byte
+	threshold := fcodec.threshold
+	if threshold <= 0 {
+
+		threshold = defaultCompressThreshold
+	}
+
+	if fcodec.Compressed() && len(b) >= threshold {
+
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+
+			return nil, err
+		}
+
+		_, _ = w.Write(b)
+		if err = w.Close(); err != nil {
+
+			return nil, err
+		}
+
+		if buf.Len() < len(b) {
+
+			flag |= frameCompressed
+			b = buf.Bytes()
+		}
+	}
+
+	frame := make([]byte, 1+len(b))
+	frame[0] = flag
+	copy(frame[1:], b)
+
+	if fcodec.session == nil {
+
+		return frame, nil
+	}
+
+	return fcodec.session.Seal(frame), nil
+}
+
+// Decode 解码一帧，加密时由crypt.Session校验并拒绝重放的帧
+func (fcodec *FrameCodec) Decode(frame []byte) ([]byte, error) {
+
+	if fcodec.session != nil {
+
+		var err error
+		frame, err = fcodec.session.Open(frame)
+		if err != nil {
+
+			return nil, err
+		}
+	}
+
+	if len(frame) == 0 {
+
+		return nil, FrameErr
+	}
+
+	if frame[0]&frameCompressed == 0 {
+
+		return frame[1:], nil
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(frame[1:])), maxDecompressSize+1))
+	if err != nil {
+
+		return nil, err
+	}
+
+	if int64(len(b)) > maxDecompressSize {
+
+		return nil, FrameErr
+	}
+
+	return b, nil
+}
+
+// SecureConn 握手后透明加解密和压缩的连接
+type SecureConn struct {
+	Conn
+	codec *FrameCodec
+}
+
+// NewSecureConn 在Handler.Open中调用，完成握手后返回包装的连接
+// 握手期间设置了读超时，握手后需要重新设置
+// GateServer的Broadcast和SendGroup发送的是未编码的帧，加密连接需要逐个发送
+func NewSecureConn(c Conn, config *SecureConfig) (*SecureConn, error) {
+
+	timeout := config.HandshakeTimeout
+	if timeout <= 0 {
+
+		timeout = defaultHandshakeTimeout
+	}
+
+	c.SetReadDeadline(timeout)
+
+	fcodec, err := ServerHandshake(c, config)
+	if err != nil {
+
+		return nil, err
+	}
+
+	return &SecureConn{Conn: c, codec: fcodec}, nil
+}
+
+func (sc *SecureConn) Codec() *FrameCodec {
+
+	return sc.codec
+}
+
+func (sc *SecureConn) Read() ([]byte, error) {
+
+	b, err := sc.Conn.Read()
+	if err != nil {
+
+		return nil, err
+	}
+
+	return sc.codec.Decode(b)
+}
+
+func (sc *SecureConn) Send(b []byte) error {
+
+	frame, err := sc.codec.Encode(b)
+	if err != nil {
+
+		return err
+	}
+
+	return sc.Conn.Send(frame)
+}
+
+func (sc *SecureConn) AsyncSend(b []byte) error {
+
+	frame, err := sc.codec.Encode(b)
+	if err != nil {
+
+		return err
+	}
+
+	return sc.Conn.AsyncSend(frame)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/laonsx/gamelib/crypt"
+)
+
+// pipeConn 内存中的FrameConn，in和out交叉连接两端
+type pipeConn struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func newPipe() (*pipeConn, *pipeConn) {
+
+	a, b := make(chan []byte, 16), make(chan []byte, 16)
+
+	return &pipeConn{in: a, out: b}, &pipeConn{in: b, out: a}
+}
+
+func (p *pipeConn) Read() ([]byte, error) {
+
+	select {
+
+	case b := <-p.in:
+
+		return b, nil
+
+	case <-time.After(time.Second):
+
+		return nil, errors.New("pipe read timeout")
+	}
+}
+
+func (p *pipeConn) Send(b []byte) error {
+
+	p.out <- b
+
+	return nil
+}
+
+// handshake 两端同时握手
+func handshake(t *testing.T, serverConfig, clientConfig *SecureConfig) (*FrameCodec, *FrameCodec, error) {
+
+	t.Helper()
+
+	sc, cc := newPipe()
+
+	type result struct {
+		codec *FrameCodec
+		err   error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+
+		codec, err := ServerHandshake(sc, serverConfig)
+		done <- result{codec, err}
+	}()
+
+	client, err := ClientHandshake(cc, clientConfig)
+
+	r := <-done
+	if r.err != nil {
+
+		t.Fatal("ServerHandshake:", r.err)
+	}
+
+	return r.codec, client, err
+}
+
+func TestSecure_Handshake(t *testing.T) {
+
+	pub, priv, err := crypt.GenerateSignKey()
+	if err != nil {
+
+		t.Fatal("GenerateSignKey:", err)
+	}
+
+	server, client, err := handshake(t,
+		&SecureConfig{Encrypt: true, Compress: true, SignKey: priv},
+		&SecureConfig{Encrypt: true, Compress: true, VerifyKey: pub})
+	if err != nil {
+
+		t.Fatal("ClientHandshake:", err)
+	}
+
+	if !server.Encrypted() || !server.Compressed() || !client.Encrypted() || !client.Compressed() {
+
+		t.Fatal("flags:", server.flags, client.flags)
+	}
+
+	big := bytes.Repeat([]byte("compressible "), 100)
+	for _, msg := range [][]byte{[]byte("hello"), big} {
+
+		frame, err := client.Encode(msg)
+		if err != nil {
+
+			t.Fatal("Encode:", err)
+		}
+
+		if bytes.Contains(frame, msg[:5]) {
+
+			t.Fatal("frame not encrypted")
+		}
+
+		b, err := server.Decode(frame)
+		if err != nil || !bytes.Equal(b, msg) {
+
+			t.Fatal("Decode:", len(b), err)
+		}
+
+		frame, _ = server.Encode(msg)
+		if b, err = client.Decode(frame); err != nil || !bytes.Equal(b, msg) {
+
+			t.Fatal("Decode client:", len(b), err)
+		}
+	}
+
+	// 两个方向的密钥不同，自己编码的帧不能解码
+	frame, _ := client.Encode([]byte("hello"))
+	if _, err = client.Decode(frame); err == nil {
+
+		t.Fatal("decode own frame")
+	}
+}
+
+func TestSecure_Replay(t *testing.T) {
+
+	server, client, err := handshake(t, &SecureConfig{Encrypt: true}, &SecureConfig{Encrypt: true})
+	if err != nil {
+
+		t.Fatal("ClientHandshake:", err)
+	}
+
+	frames := make([][]byte, 70)
+	for i := range frames {
+
+		frames[i], _ = client.Encode([]byte{byte(i)})
+	}
+
+	if _, err = server.Decode(frames[1]); err != nil {
+
+		t.Fatal("Decode:", err)
+	}
+
+	if _, err = server.Decode(frames[1]); err != crypt.ReplayErr {
+
+		t.Fatal("replay:", err)
+	}
+
+	// 窗口内乱序可以接收，超出窗口的旧帧被拒绝
+	if _, err = server.Decode(frames[69]); err != nil {
+
+		t.Fatal("Decode:", err)
+	}
+
+	if b, err := server.Decode(frames[10]); err != nil || b[0] != 10 {
+
+		t.Fatal("Decode reorder:", b, err)
+	}
+
+	if _, err = server.Decode(frames[0]); err != crypt.ReplayErr {
+
+		t.Fatal("outside window:", err)
+	}
+
+	frames[20][len(frames[20])-1] ^= 1
+	if _, err = server.Decode(frames[20]); err != crypt.PacketErr {
+
+		t.Fatal("tampered:", err)
+	}
+}
+
+func TestSecure_Negotiate(t *testing.T) {
+
+	// 服务端不开启加密时只压缩
+	server, client, err := handshake(t, &SecureConfig{Compress: true}, &SecureConfig{Encrypt: true, Compress: true})
+	if err != nil || server.Encrypted() || client.Encrypted() || !client.Compressed() {
+
+		t.Fatal("negotiate:", client, err)
+	}
+
+	frame, _ := server.Encode([]byte("plain"))
+	if b, err := client.Decode(frame); err != nil || string(b) != "plain" {
+
+		t.Fatal("Decode:", b, err)
+	}
+
+	// 客户端要求签名时服务端必须加密并签名
+	pub, _, _ := crypt.GenerateSignKey()
+	if _, _, err = handshake(t, &SecureConfig{Encrypt: true}, &SecureConfig{Encrypt: true, VerifyKey: pub}); err != HandshakeErr {
+
+		t.Fatal("unsigned:", err)
+	}
+
+	_, other, _ := crypt.GenerateSignKey()
+	if _, _, err = handshake(t, &SecureConfig{Encrypt: true, SignKey: other}, &SecureConfig{Encrypt: true, VerifyKey: pub}); err != HandshakeErr {
+
+		t.Fatal("wrong key:", err)
+	}
+
+	if _, _, _, _, err = parseHello([]byte("GS")); err != HandshakeErr {
+
+		t.Fatal("parseHello:", err)
+	}
+}
@@ -0,0 +1,602 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// 会话层帧格式，第一个字节为类型
+// 客户端连接后首帧 hello: type(1) tokenlen(1) token lastseq(8)，新会话token为空
+// 服务端回复 welcome: type(1) resumed(1) tokenlen(1) token
+// 服务端下发 data: type(1) seq(8) payload，客户端上行 data: type(1) payload
+// 客户端确认 ack: type(1) seq(8)，服务端收到后释放seq之前的缓存
+const (
+	sessionHello = iota + 1
+	sessionWelcome
+	sessionData
+	sessionAck
+)
+
+var (
+	defaultSessionBuffer = 256
+	defaultGracePeriod   = time.Duration(60) * time.Second
+	defaultHelloTimeout  = time.Duration(10) * time.Second
+
+	SessionClosedErr = errors.New("session closed")
+	SessionFrameErr  = errors.New("session frame error")
+)
+
+// SessionConfig 会话恢复配置
+type SessionConfig struct {
+	// BufferSize 每个会话缓存的未确认消息数
+	BufferSize int
+	// GracePeriod 断线后等待重连的时间，超时后调用Handler.Close
+	GracePeriod time.Duration
+	// HelloTimeout 连接后等待hello的时间
+	HelloTimeout time.Duration
+}
+
+// SessionManager 可恢复会话，作为GateServer的Handler使用
+// 断线后GracePeriod内客户端携带token重连，重放未确认的消息，不需要重新登录
+type SessionManager struct {
+	mux      sync.Mutex
+	handler  Handler
+	config   SessionConfig
+	sessions map[string]*Session
+	conns    map[uint64]*Session
+}
+
+func NewSessionManager(handler Handler, config *SessionConfig) *SessionManager {
+
+	sm := &SessionManager{
+		handler:  handler,
+		sessions: make(map[string]*Session),
+		conns:    make(map[uint64]*Session),
+	}
+
+	if config != nil {
+
+		sm.config = *config
+	}
+
+	if sm.config.BufferSize <= 0 {
+
+		sm.config.BufferSize = defaultSessionBuffer
+	}
+
+	if sm.config.GracePeriod <= 0 {
+
+		sm.config.GracePeriod = defaultGracePeriod
+	}
+
+	if sm.config.HelloTimeout <= 0 {
+
+		sm.config.HelloTimeout = defaultHelloTimeout
+	}
+
+	return sm
+}
+
+// Open 读取hello，新会话调用Handler.Open，恢复的会话重放未确认消息
+func (sm *SessionManager) Open(c Conn) {
+
+	c.SetReadDeadline(sm.config.HelloTimeout)
+
+	b, err := c.Read()
+	if err != nil {
+
+		_ = c.Close()
+
+		return
+	}
+
+	token, lastSeq, err := parseSessionHello(b)
+	if err != nil {
+
+		_ = c.Close()
+
+		return
+	}
+
+	if len(token) > 0 && sm.resume(c, token, lastSeq) {
+
+		return
+	}
+
+	s := &Session{
+		id:      c.Id(),
+		manager: sm,
+		conn:    c,
+		changed: make(chan struct{}),
+	}
+
+	s.token, err = newSessionToken()
+	if err != nil {
+
+		_ = c.Close()
+
+		return
+	}
+
+	sm.mux.Lock()
+	sm.sessions[s.token] = s
+	sm.conns[c.Id()] = s
+	sm.mux.Unlock()
+
+	err = c.Send(makeSessionWelcome(false, s.token))
+	if err != nil {
+
+		_ = c.Close()
+
+		return
+	}
+
+	sm.handler.Open(s)
+}
+
+// Close 连接断开，会话进入等待重连状态
+func (sm *SessionManager) Close(c Conn) {
+
+	sm.mux.Lock()
+
+	s, ok := sm.conns[c.Id()]
+	if ok {
+
+		delete(sm.conns, c.Id())
+	}
+
+	sm.mux.Unlock()
+
+	if ok {
+
+		s.detach(c)
+	}
+}
+
+func (sm *SessionManager) resume(c Conn, token string, lastSeq uint64) bool {
+
+	sm.mux.Lock()
+	s, ok := sm.sessions[token]
+	sm.mux.Unlock()
+
+	if !ok {
+
+		return false
+	}
+
+	if !s.attach(c, lastSeq) {
+
+		return false
+	}
+
+	sm.mux.Lock()
+	sm.conns[c.Id()] = s
+	sm.mux.Unlock()
+
+	return true
+}
+
+func (sm *SessionManager) remove(s *Session) {
+
+	sm.mux.Lock()
+	delete(sm.sessions, s.token)
+	sm.mux.Unlock()
+}
+
+// Session 可恢复会话，实现Conn接口，Id在重连后保持不变
+// smux保证帧按seq顺序发送，网络发送时不持有mux，
+// 发送失败触发的连接关闭回调会调用detach获取mux
+// Id是第一个连接的id，重连后GateServer的Get、SendTo、Join按这个id找不到当前连接，
+// Broadcast和SendGroup发送的是未编码的帧且不进入重放缓存，可恢复会话需要逐个调用Send
+type Session struct {
+	smux    sync.Mutex
+	mux     sync.Mutex
+	id      uint64
+	token   string
+	manager *SessionManager
+	conn    Conn
+	changed chan struct{}
+	timer   *time.Timer
+	closed  bool
+	msgType int
+	err     error
+
+	seq    uint64
+	buffer [][]byte
+}
+
+func (s *Session) Id() uint64 {
+
+	return s.id
+}
+
+func (s *Session) Token() string {
+
+	return s.token
+}
+
+func (s *Session) AsyncSend(b []byte) error {
+
+	return s.send(b, true)
+}
+
+func (s *Session) Send(b []byte) error {
+
+	return s.send(b, false)
+}
+
+// send 消息先进入缓存，断线时只缓存，重连后重放
+func (s *Session) send(b []byte, async bool) error {
+
+	s.smux.Lock()
+	defer s.smux.Unlock()
+
+	s.mux.Lock()
+
+	if s.closed {
+
+		s.mux.Unlock()
+
+		return SessionClosedErr
+	}
+
+	s.seq++
+
+	frame := make([]byte, 9+len(b))
+	frame[0] = sessionData
+	binary.BigEndian.PutUint64(frame[1:9], s.seq)
+	copy(frame[9:], b)
+
+	if len(s.buffer) >= s.manager.config.BufferSize {
+
+		s.buffer[0] = nil
+		s.buffer = s.buffer[1:]
+	}
+
+	s.buffer = append(s.buffer, frame)
+	conn := s.conn
+
+	s.mux.Unlock()
+
+	if conn == nil {
+
+		return nil
+	}
+
+	if async {
+
+		_ = conn.AsyncSend(frame)
+	} else {
+
+		_ = conn.Send(frame)
+	}
+
+	return nil
+}
+
+// Read 读取客户端数据，断线期间阻塞等待重连，会话结束时返回错误
+func (s *Session) Read() ([]byte, error) {
+
+	for {
+
+		s.mux.Lock()
+		conn, changed, closed := s.conn, s.changed, s.closed
+		s.mux.Unlock()
+
+		if closed {
+
+			return nil, SessionClosedErr
+		}
+
+		if conn == nil {
+
+			<-changed
+
+			continue
+		}
+
+		b, err := conn.Read()
+		if err != nil {
+
+			s.mux.Lock()
+			if s.conn == conn {
+
+				s.err = err
+			}
+			s.mux.Unlock()
+
+			// 关闭底层连接触发SessionManager.Close，会话进入等待重连
+			_ = conn.Close()
+
+			<-changed
+
+			continue
+		}
+
+		if len(b) == 0 {
+
+			continue
+		}
+
+		switch b[0] {
+
+		case sessionData:
+
+			return b[1:], nil
+
+		case sessionAck:
+
+			if len(b) == 9 {
+
+				s.ack(binary.BigEndian.Uint64(b[1:9]))
+			}
+		}
+	}
+}
+
+// Close 主动关闭会话，不再等待重连
+func (s *Session) Close() error {
+
+	conn := s.end()
+	if conn != nil {
+
+		return conn.Close()
+	}
+
+	return nil
+}
+
+func (s *Session) SetMsgType(t int) {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.msgType = t
+	if s.conn != nil {
+
+		s.conn.SetMsgType(t)
+	}
+}
+
+func (s *Session) SetReadDeadline(t time.Duration) {
+
+	s.mux.Lock()
+	conn := s.conn
+	s.mux.Unlock()
+
+	if conn != nil {
+
+		conn.SetReadDeadline(t)
+	}
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.conn == nil {
+
+		return nil
+	}
+
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) Error() error {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.err
+}
+
+func (s *Session) Stats() ConnStats {
+
+	s.mux.Lock()
+	conn := s.conn
+	s.mux.Unlock()
+
+	if conn == nil {
+
+		return ConnStats{}
+	}
+
+	return conn.Stats()
+}
+
+// ack 释放已确认的消息
+func (s *Session) ack(seq uint64) {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	n := 0
+	for n < len(s.buffer) && binary.BigEndian.Uint64(s.buffer[n][1:9]) <= seq {
+
+		s.buffer[n] = nil
+		n++
+	}
+
+	s.buffer = s.buffer[n:]
+}
+
+// attach 重连，lastSeq之后的消息必须都在缓存中
+func (s *Session) attach(c Conn, lastSeq uint64) bool {
+
+	s.smux.Lock()
+	s.mux.Lock()
+
+	ok := !s.closed && lastSeq <= s.seq
+	if ok && len(s.buffer) > 0 {
+
+		ok = binary.BigEndian.Uint64(s.buffer[0][1:9]) <= lastSeq+1
+	} else if ok {
+
+		ok = lastSeq == s.seq
+	}
+
+	if !ok {
+
+		s.mux.Unlock()
+		s.smux.Unlock()
+
+		return false
+	}
+
+	if s.timer != nil {
+
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	old := s.conn
+	s.conn = c
+	s.err = nil
+	if s.msgType != 0 {
+
+		c.SetMsgType(s.msgType)
+	}
+
+	var replay [][]byte
+	for _, frame := range s.buffer {
+
+		if binary.BigEndian.Uint64(frame[1:9]) > lastSeq {
+
+			replay = append(replay, frame)
+		}
+	}
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	s.mux.Unlock()
+
+	// 重放期间持有smux，新的消息在重放之后发送
+	err := c.Send(makeSessionWelcome(true, s.token))
+	for _, frame := range replay {
+
+		if err != nil {
+
+			break
+		}
+
+		err = c.Send(frame)
+	}
+
+	s.smux.Unlock()
+
+	if old != nil {
+
+		_ = old.Close()
+	}
+
+	return true
+}
+
+// detach 连接断开，GracePeriod后没有重连则结束会话
+func (s *Session) detach(c Conn) {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.closed || s.conn != c {
+
+		return
+	}
+
+	s.conn = nil
+	s.timer = time.AfterFunc(s.manager.config.GracePeriod, s.expire)
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Session) expire() {
+
+	s.mux.Lock()
+	expired := s.conn == nil && !s.closed
+	s.mux.Unlock()
+
+	if expired {
+
+		s.end()
+	}
+}
+
+// end 结束会话，调用Handler.Close，返回当前连接
+func (s *Session) end() Conn {
+
+	s.mux.Lock()
+
+	if s.closed {
+
+		s.mux.Unlock()
+
+		return nil
+	}
+
+	s.closed = true
+	conn := s.conn
+	s.conn = nil
+	s.buffer = nil
+
+	if s.timer != nil {
+
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	close(s.changed)
+
+	s.mux.Unlock()
+
+	s.manager.remove(s)
+	s.manager.handler.Close(s)
+
+	return conn
+}
+
+func newSessionToken() (string, error) {
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func parseSessionHello(b []byte) (token string, lastSeq uint64, err error) {
+
+	if len(b) < 2 || b[0] != sessionHello {
+
+		return "", 0, SessionFrameErr
+	}
+
+	n := int(b[1])
+	if len(b) != 2+n+8 {
+
+		return "", 0, SessionFrameErr
+	}
+
+	return string(b[2 : 2+n]), binary.BigEndian.Uint64(b[2+n:]), nil
+}
+
+func makeSessionWelcome(resumed bool, token string) []byte {
+
+	b := make([]byte, 0, 3+len(token))
+	b = append(b, sessionWelcome, 0, byte(len(token)))
+	if resumed {
+
+		b[1] = 1
+	}
+
+	return append(b, token...)
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessionConn 模拟GateServer的连接，AsyncSend超过queue条时和SendDisconnect一样
+// 在调用者的goroutine中关闭连接并触发SessionManager.Close
+type sessionConn struct {
+	id      uint64
+	manager *SessionManager
+	queue   int
+
+	mux    sync.Mutex
+	in     chan []byte
+	sent   [][]byte
+	async  int
+	closed bool
+}
+
+func newSessionConn(id uint64, manager *SessionManager, queue int) *sessionConn {
+
+	return &sessionConn{id: id, manager: manager, queue: queue, in: make(chan []byte, 16)}
+}
+
+func (c *sessionConn) Id() uint64 {
+
+	return c.id
+}
+
+func (c *sessionConn) AsyncSend(b []byte) error {
+
+	c.mux.Lock()
+	if c.async >= c.queue {
+
+		c.mux.Unlock()
+		_ = c.Close()
+
+		return errors.New("slow consumer")
+	}
+
+	c.async++
+	c.mux.Unlock()
+
+	return c.Send(b)
+}
+
+func (c *sessionConn) Send(b []byte) error {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.closed {
+
+		return errors.New("conn closed")
+	}
+
+	c.sent = append(c.sent, b)
+
+	return nil
+}
+
+func (c *sessionConn) Read() ([]byte, error) {
+
+	b, ok := <-c.in
+	if !ok {
+
+		return nil, errors.New("conn closed")
+	}
+
+	return b, nil
+}
+
+func (c *sessionConn) Close() error {
+
+	c.mux.Lock()
+	if c.closed {
+
+		c.mux.Unlock()
+
+		return nil
+	}
+
+	c.closed = true
+	close(c.in)
+	c.mux.Unlock()
+
+	c.manager.Close(c)
+
+	return nil
+}
+
+func (c *sessionConn) frames() [][]byte {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return append([][]byte(nil), c.sent...)
+}
+
+func (c *sessionConn) SetMsgType(t int)                {}
+func (c *sessionConn) SetReadDeadline(t time.Duration) {}
+func (c *sessionConn) RemoteAddr() net.Addr            { return nil }
+func (c *sessionConn) Error() error                    { return nil }
+func (c *sessionConn) Stats() ConnStats                { return ConnStats{} }
+
+type sessionHandler struct {
+	opened chan Conn
+	closed chan Conn
+}
+
+func (h *sessionHandler) Open(c Conn) {
+
+	h.opened <- c
+}
+
+func (h *sessionHandler) Close(c Conn) {
+
+	h.closed <- c
+}
+
+func makeSessionHello(token string, lastSeq uint64) []byte {
+
+	b := make([]byte, 2+len(token)+8)
+	b[0] = sessionHello
+	b[1] = byte(len(token))
+	copy(b[2:], token)
+	binary.BigEndian.PutUint64(b[2+len(token):], lastSeq)
+
+	return b
+}
+
+// openSession 连接发送hello后调用SessionManager.Open，返回welcome
+func openSession(t *testing.T, sm *SessionManager, c *sessionConn, token string, lastSeq uint64) []byte {
+
+	t.Helper()
+
+	c.in <- makeSessionHello(token, lastSeq)
+	sm.Open(c)
+
+	frames := c.frames()
+	if len(frames) == 0 || frames[0][0] != sessionWelcome {
+
+		t.Fatal("welcome:", frames)
+	}
+
+	return frames[0]
+}
+
+func frameSeq(frame []byte) uint64 {
+
+	return binary.BigEndian.Uint64(frame[1:9])
+}
+
+func TestSession_SlowConsumer(t *testing.T) {
+
+	handler := &sessionHandler{opened: make(chan Conn, 1), closed: make(chan Conn, 1)}
+	sm := NewSessionManager(handler, nil)
+
+	c := newSessionConn(1, sm, 2)
+	openSession(t, sm, c, "", 0)
+	s := (<-handler.opened).(*Session)
+
+	// 队列满时关闭连接的回调在发送的goroutine中调用detach
+	done := make(chan struct{})
+	go func() {
+
+		defer close(done)
+
+		for i := 0; i < 5; i++ {
+
+			if err := s.AsyncSend([]byte{byte(i)}); err != nil {
+
+				t.Error("AsyncSend:", err)
+			}
+		}
+	}()
+
+	select {
+
+	case <-done:
+
+	case <-time.After(time.Second):
+
+		t.Fatal("AsyncSend deadlock")
+	}
+
+	s.mux.Lock()
+	conn, buffered := s.conn, len(s.buffer)
+	s.mux.Unlock()
+
+	if conn != nil || buffered != 5 {
+
+		t.Fatal("detach:", conn, buffered)
+	}
+
+	// 重连后重放客户端没有收到的消息
+	c2 := newSessionConn(2, sm, 10)
+	welcome := openSession(t, sm, c2, s.Token(), 2)
+	if welcome[1] != 1 || s.Id() != 1 {
+
+		t.Fatal("resume:", welcome, s.Id())
+	}
+
+	frames := c2.frames()[1:]
+	if len(frames) != 3 || frameSeq(frames[0]) != 3 || frames[2][9] != 4 {
+
+		t.Fatal("replay:", frames)
+	}
+}
+
+func TestSession_Resume(t *testing.T) {
+
+	handler := &sessionHandler{opened: make(chan Conn, 2), closed: make(chan Conn, 2)}
+	sm := NewSessionManager(handler, &SessionConfig{BufferSize: 2, GracePeriod: time.Duration(200) * time.Millisecond})
+
+	c := newSessionConn(1, sm, 10)
+	openSession(t, sm, c, "", 0)
+	s := (<-handler.opened).(*Session)
+
+	for i := 0; i < 3; i++ {
+
+		_ = s.Send([]byte{byte(i)})
+	}
+
+	// 客户端确认后释放缓存
+	ack := make([]byte, 9)
+	ack[0] = sessionAck
+	binary.BigEndian.PutUint64(ack[1:], 2)
+	c.in <- ack
+	c.in <- []byte{sessionData, 'h', 'i'}
+
+	b, err := s.Read()
+	if err != nil || string(b) != "hi" {
+
+		t.Fatal("Read:", b, err)
+	}
+
+	s.mux.Lock()
+	buffered := len(s.buffer)
+	s.mux.Unlock()
+
+	if buffered != 1 {
+
+		t.Fatal("ack:", buffered)
+	}
+
+	_ = c.Close()
+
+	// 断线期间的消息缓存，重连后Read继续读取新连接
+	_ = s.Send([]byte{3})
+
+	read := make(chan string, 1)
+	go func() {
+
+		b, err := s.Read()
+		if err != nil {
+
+			read <- err.Error()
+
+			return
+		}
+
+		read <- string(b)
+	}()
+
+	// seq 2已经释放，不能从seq 1恢复
+	c2 := newSessionConn(2, sm, 10)
+	if welcome := openSession(t, sm, c2, s.Token(), 1); welcome[1] != 0 {
+
+		t.Fatal("resume with lost frames")
+	}
+	_ = (<-handler.opened).(*Session).Close()
+	<-handler.closed
+
+	c3 := newSessionConn(3, sm, 10)
+	openSession(t, sm, c3, s.Token(), 2)
+	if frames := c3.frames(); len(frames) != 3 || frameSeq(frames[1]) != 3 || frameSeq(frames[2]) != 4 {
+
+		t.Fatal("replay:", frames)
+	}
+
+	c3.in <- []byte{sessionData, 'o', 'k'}
+	select {
+
+	case msg := <-read:
+
+		if msg != "ok" {
+
+			t.Fatal("Read after resume:", msg)
+		}
+
+	case <-time.After(time.Second):
+
+		t.Fatal("Read timeout")
+	}
+
+	// 超过GracePeriod没有重连，会话结束
+	_ = c3.Close()
+	select {
+
+	case closed := <-handler.closed:
+
+		if closed != s {
+
+			t.Fatal("closed:", closed)
+		}
+
+	case <-time.After(time.Second):
+
+		t.Fatal("expire timeout")
+	}
+
+	if err = s.Send([]byte{5}); err != SessionClosedErr {
+
+		t.Fatal("Send closed:", err)
+	}
+
+	c4 := newSessionConn(4, sm, 10)
+	if welcome := openSession(t, sm, c4, s.Token(), 4); welcome[1] != 0 {
+
+		t.Fatal("resume expired")
+	}
+}
@@ -0,0 +1,203 @@
+package ws
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/laonsx/gamelib/server"
+)
+
+var (
+	defaultRetryAfter = time.Duration(5) * time.Second
+	queueTimeout      = time.Duration(30) * time.Second
+)
+
+const (
+	admitOK = iota
+	admitQueued
+	admitFull
+)
+
+// reserve 在升级前预占连接名额，防止并发升级超过MaxConn
+func (server *Server) reserve() int {
+
+	server.mux.Lock()
+	defer server.mux.Unlock()
+
+	if len(server.waiting) == 0 && server.hasSlot() {
+
+		server.pending++
+
+		return admitOK
+	}
+
+	if _, ok := queueHandler(server.handler); ok && len(server.waiting)+server.queuing < server.config.QueueSize {
+
+		server.queuing++
+
+		return admitQueued
+	}
+
+	return admitFull
+}
+
+// unreserve 调用者需持有锁
+func (server *Server) unreserve(state int) {
+
+	switch state {
+
+	case admitOK:
+
+		server.pending--
+
+	case admitQueued:
+
+		server.queuing--
+	}
+}
+
+// hasSlot 调用者需持有锁
+func (server *Server) hasSlot() bool {
+
+	return server.maxConn <= 0 || len(server.conns)+server.pending < server.maxConn
+}
+
+// promote 有空闲名额时将排队连接转为正式连接，调用者需持有锁
+// 有连接出队时返回出队的连接和剩余排队连接
+func (server *Server) promote() (promoted []*Conn, waiting []*Conn) {
+
+	for len(server.waiting) > 0 && server.hasSlot() {
+
+		conn := server.waiting[0]
+		server.waiting[0] = nil
+		server.waiting = server.waiting[1:]
+
+		server.conns[conn.id] = conn
+		promoted = append(promoted, conn)
+	}
+
+	if len(promoted) > 0 {
+
+		waiting = server.snapshotWaiting()
+	}
+
+	return
+}
+
+// removeWaiting 调用者需持有锁
+func (server *Server) removeWaiting(id uint64) bool {
+
+	for i, conn := range server.waiting {
+
+		if conn.id == id {
+
+			server.waiting = append(server.waiting[:i], server.waiting[i+1:]...)
+			server.releaseIP(conn.ip)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// snapshotWaiting 调用者需持有锁
+func (server *Server) snapshotWaiting() []*Conn {
+
+	waiting := make([]*Conn, len(server.waiting))
+	copy(waiting, server.waiting)
+
+	return waiting
+}
+
+// notifyQueue 通知出队连接Open，剩余连接更新排队位置
+// 调用者可能是其它连接的关闭流程，Open在单独的goroutine中调用，不阻塞调用者
+func (server *Server) notifyQueue(promoted []*Conn, waiting []*Conn) {
+
+	for _, conn := range promoted {
+
+		go server.open(conn)
+	}
+
+	if server.handler == nil {
+
+		return
+	}
+
+	qh, ok := queueHandler(server.handler)
+	if !ok {
+
+		return
+	}
+
+	for i, conn := range waiting {
+
+		if !conn.IsClosed() {
+
+			qh.Queued(conn, i+1)
+		}
+	}
+}
+
+func (server *Server) open(conn *Conn) {
+
+	conn.dequeue()
+
+	if server.handler != nil {
+
+		server.handler.Open(conn)
+	}
+}
+
+func (server *Server) retryAfter() time.Duration {
+
+	if server.config.RetryAfter > 0 {
+
+		return server.config.RetryAfter
+	}
+
+	return defaultRetryAfter
+}
+
+func (server *Server) reject(w http.ResponseWriter, reject *server.Reject) {
+
+	atomic.AddUint64(&server.stats.rejectedConns, 1)
+
+	code := reject.Code
+	if code == 0 {
+
+		code = http.StatusForbidden
+	}
+
+	reason := reject.Reason
+	if len(reason) == 0 {
+
+		reason = http.StatusText(code)
+	}
+
+	if reject.RetryAfter > 0 {
+
+		sec := int64((reject.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(sec, 10))
+	}
+
+	http.Error(w, reason, code)
+}
+
+func newReject(code int, reason string, retryAfter time.Duration) *server.Reject {
+
+	return &server.Reject{
+		Code:       code,
+		Reason:     reason,
+		RetryAfter: retryAfter,
+	}
+}
+
+func queueHandler(handler server.Handler) (server.QueueHandler, bool) {
+
+	qh, ok := handler.(server.QueueHandler)
+
+	return qh, ok
+}
@@ -0,0 +1,241 @@
+package ws
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/laonsx/gamelib/server"
+)
+
+type queueTestHandler struct {
+	*testHandler
+	queued chan string
+}
+
+func (h *queueTestHandler) Queued(c server.Conn, pos int) {
+
+	h.queued <- fmt.Sprintf("%d:%d", c.Id(), pos)
+}
+
+func expectQueued(t *testing.T, h *queueTestHandler, want ...string) {
+
+	t.Helper()
+
+	for _, w := range want {
+
+		select {
+
+		case got := <-h.queued:
+
+			if got != w {
+
+				t.Fatal("queued:", got, "want", w)
+			}
+
+		case <-time.After(time.Second):
+
+			t.Fatal("queued timeout", w)
+		}
+	}
+}
+
+func dialReject(t *testing.T, url string) *http.Response {
+
+	t.Helper()
+
+	ws, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+
+		_ = ws.Close()
+		t.Fatal("dial should be rejected")
+	}
+
+	if resp == nil {
+
+		t.Fatal("dial:", err)
+	}
+
+	return resp
+}
+
+func TestServer_Reject(t *testing.T) {
+
+	handler := newTestHandler(false)
+	srv, url := newTestServer(t, &server.Config{MaxConn: 1, MaxConnPerIP: 2}, handler)
+
+	dial(t, url)
+	waitConn(t, handler.opened)
+
+	resp := dialReject(t, url)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "5" {
+
+		t.Fatal("full:", resp.Status, resp.Header)
+	}
+
+	srv.SetAdmission(server.AdmissionFunc(func(r *http.Request) *server.Reject {
+
+		return &server.Reject{Code: http.StatusForbidden, Reason: "banned"}
+	}))
+
+	if resp = dialReject(t, url); resp.StatusCode != http.StatusForbidden {
+
+		t.Fatal("admission:", resp.Status)
+	}
+
+	if st := srv.Stats(); st.Conns != 1 || st.RejectedConns != 2 {
+
+		t.Fatal("stats:", st)
+	}
+}
+
+func TestServer_Queue(t *testing.T) {
+
+	handler := &queueTestHandler{testHandler: newTestHandler(true), queued: make(chan string, 100)}
+	srv, url := newTestServer(t, &server.Config{MaxConn: 1, QueueSize: 2}, handler)
+
+	a := dial(t, url)
+	waitConn(t, handler.opened)
+
+	b := dial(t, url)
+	expectQueued(t, handler, "1:1")
+
+	c := dial(t, url)
+	expectQueued(t, handler, "1:1", "2:2")
+
+	if resp := dialReject(t, url); resp.StatusCode != http.StatusServiceUnavailable {
+
+		t.Fatal("queue full:", resp.Status)
+	}
+
+	// 排队中断开的客户端释放排队位置
+	_ = b.Close()
+	expectQueued(t, handler, "2:1")
+
+	if st := srv.Stats(); st.Conns != 1 || st.QueuedConns != 1 {
+
+		t.Fatal("stats:", st)
+	}
+
+	// 排队期间的消息被丢弃，收到pong说明之前的消息已经读取
+	pong := make(chan struct{}, 1)
+	c.SetPongHandler(func(string) error {
+
+		pong <- struct{}{}
+
+		return nil
+	})
+
+	go func() {
+
+		for {
+
+			if _, _, err := c.ReadMessage(); err != nil {
+
+				return
+			}
+		}
+	}()
+
+	if err := c.WriteMessage(websocket.BinaryMessage, []byte("queued")); err != nil {
+
+		t.Fatal("write:", err)
+	}
+
+	if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+
+		t.Fatal("ping:", err)
+	}
+
+	select {
+
+	case <-pong:
+
+	case <-time.After(time.Second):
+
+		t.Fatal("pong timeout")
+	}
+
+	// a断开后c出队，Open在单独的goroutine中阻塞读取
+	_ = a.Close()
+	if conn := waitConn(t, handler.opened); conn.Id() != 2 {
+
+		t.Fatal("promoted:", conn.Id())
+	}
+
+	if err := c.WriteMessage(websocket.BinaryMessage, []byte("hello")); err != nil {
+
+		t.Fatal("write:", err)
+	}
+
+	select {
+
+	case msg := <-handler.msgs:
+
+		if msg != "hello" {
+
+			t.Fatal("read:", msg)
+		}
+
+	case <-time.After(time.Second):
+
+		t.Fatal("read timeout")
+	}
+
+	if st := srv.Stats(); st.Conns != 1 || st.QueuedConns != 0 {
+
+		t.Fatal("stats:", st)
+	}
+}
+
+func TestServer_QueueTimeout(t *testing.T) {
+
+	timeout := queueTimeout
+	queueTimeout = time.Duration(200) * time.Millisecond
+	defer func() { queueTimeout = timeout }()
+
+	handler := &queueTestHandler{testHandler: newTestHandler(true), queued: make(chan string, 100)}
+	srv, url := newTestServer(t, &server.Config{MaxConn: 1, QueueSize: 2}, handler)
+
+	dial(t, url)
+	waitConn(t, handler.opened)
+
+	idle := dial(t, url)
+	alive := dial(t, url)
+	expectQueued(t, handler, "1:1", "1:1", "2:2")
+
+	// alive的ping由读goroutine回复pong
+	go func() {
+
+		for {
+
+			if _, _, err := alive.ReadMessage(); err != nil {
+
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+
+		if err := alive.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+
+			t.Fatal("ping:", err)
+		}
+
+		time.Sleep(queueTimeout / 2)
+	}
+
+	// 没有ping的连接超时关闭
+	if err := waitClose(t, idle); err == nil {
+
+		t.Fatal("idle not closed")
+	}
+
+	if st := srv.Stats(); st.QueuedConns != 1 {
+
+		t.Fatal("stats:", st)
+	}
+}
@@ -0,0 +1,230 @@
+package ws
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/laonsx/gamelib/server"
+)
+
+// message 发送队列中的消息，shared不为空时为广播消息
+type message struct {
+	data   []byte
+	shared *sharedMsg
+}
+
+// sharedMsg 广播消息只编码一次帧，所有连接共用
+type sharedMsg struct {
+	mux      sync.Mutex
+	data     []byte
+	prepared map[int]*websocket.PreparedMessage
+}
+
+func newSharedMsg(b []byte) *message {
+
+	return &message{
+		data:   b,
+		shared: &sharedMsg{data: b, prepared: make(map[int]*websocket.PreparedMessage, 1)},
+	}
+}
+
+func (sm *sharedMsg) prepare(msgType int) (*websocket.PreparedMessage, error) {
+
+	sm.mux.Lock()
+	defer sm.mux.Unlock()
+
+	if pm, ok := sm.prepared[msgType]; ok {
+
+		return pm, nil
+	}
+
+	pm, err := websocket.NewPreparedMessage(msgType, sm.data)
+	if err != nil {
+
+		return nil, err
+	}
+
+	sm.prepared[msgType] = pm
+
+	return pm, nil
+}
+
+func (server *Server) Get(id uint64) (server.Conn, bool) {
+
+	server.mux.Lock()
+	conn, ok := server.conns[id]
+	server.mux.Unlock()
+
+	if !ok {
+
+		return nil, false
+	}
+
+	return conn, true
+}
+
+// Range 遍历连接，fn返回false时停止
+func (server *Server) Range(fn func(c server.Conn) bool) {
+
+	for _, conn := range server.snapshotConns() {
+
+		if !fn(conn) {
+
+			return
+		}
+	}
+}
+
+// Broadcast 广播给所有连接，不等待发送队列已满的连接
+func (server *Server) Broadcast(b []byte) {
+
+	server.fanout(server.snapshotConns(), b)
+}
+
+func (server *Server) SendTo(ids []uint64, b []byte) {
+
+	conns := make([]*Conn, 0, len(ids))
+
+	server.mux.Lock()
+
+	for _, id := range ids {
+
+		if conn, ok := server.conns[id]; ok {
+
+			conns = append(conns, conn)
+		}
+	}
+
+	server.mux.Unlock()
+
+	server.fanout(conns, b)
+}
+
+// Join 加入分组，例如公会、房间
+func (server *Server) Join(group string, id uint64) error {
+
+	server.mux.Lock()
+	conn, ok := server.conns[id]
+	server.mux.Unlock()
+
+	if !ok {
+
+		return errors.New("conn not found")
+	}
+
+	server.gmux.Lock()
+	defer server.gmux.Unlock()
+
+	// 关闭标记先于leaveAll设置，持锁检查可避免关闭后残留在分组中
+	if conn.IsClosed() {
+
+		return errors.New("conn closed")
+	}
+
+	members, ok := server.groups[group]
+	if !ok {
+
+		members = make(map[uint64]*Conn)
+		server.groups[group] = members
+	}
+
+	members[id] = conn
+
+	if conn.groups == nil {
+
+		conn.groups = make(map[string]struct{})
+	}
+
+	conn.groups[group] = struct{}{}
+
+	return nil
+}
+
+func (server *Server) Leave(group string, id uint64) {
+
+	server.gmux.Lock()
+	defer server.gmux.Unlock()
+
+	members, ok := server.groups[group]
+	if !ok {
+
+		return
+	}
+
+	if conn, ok := members[id]; ok {
+
+		delete(conn.groups, group)
+		delete(members, id)
+	}
+
+	if len(members) == 0 {
+
+		delete(server.groups, group)
+	}
+}
+
+func (server *Server) SendGroup(group string, b []byte) {
+
+	server.gmux.RLock()
+
+	members := server.groups[group]
+	conns := make([]*Conn, 0, len(members))
+	for _, conn := range members {
+
+		conns = append(conns, conn)
+	}
+
+	server.gmux.RUnlock()
+
+	server.fanout(conns, b)
+}
+
+// leaveAll 连接关闭时退出所有分组
+func (server *Server) leaveAll(conn *Conn) {
+
+	server.gmux.Lock()
+	defer server.gmux.Unlock()
+
+	for group := range conn.groups {
+
+		if members, ok := server.groups[group]; ok {
+
+			delete(members, conn.id)
+			if len(members) == 0 {
+
+				delete(server.groups, group)
+			}
+		}
+	}
+
+	conn.groups = nil
+}
+
+func (server *Server) snapshotConns() []*Conn {
+
+	server.mux.Lock()
+	defer server.mux.Unlock()
+
+	conns := make([]*Conn, 0, len(server.conns))
+	for _, conn := range server.conns {
+
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
+
+func (server *Server) fanout(conns []*Conn, b []byte) {
+
+	if len(conns) == 0 {
+
+		return
+	}
+
+	msg := newSharedMsg(b)
+	for _, conn := range conns {
+
+		conn.post(msg)
+	}
+}
@@ -0,0 +1,264 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/laonsx/gamelib/server"
+)
+
+// none 不存在的连接id
+const none = ^uint64(0)
+
+// dialN 建立n个连接，返回客户端和对应的服务端连接
+func dialN(t *testing.T, url string, handler *testHandler, n int) ([]*websocket.Conn, []*Conn) {
+
+	t.Helper()
+
+	clients := make([]*websocket.Conn, n)
+	conns := make([]*Conn, n)
+	for i := 0; i < n; i++ {
+
+		clients[i] = dial(t, url)
+		conns[i] = waitConn(t, handler.opened).(*Conn)
+	}
+
+	return clients, conns
+}
+
+func readMsg(t *testing.T, ws *websocket.Conn) string {
+
+	t.Helper()
+
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, b, err := ws.ReadMessage()
+	if err != nil {
+
+		t.Fatal("read:", err)
+	}
+
+	return string(b)
+}
+
+func TestServer_Broadcast(t *testing.T) {
+
+	handler := newTestHandler(false)
+	srv, url := newTestServer(t, &server.Config{}, handler)
+
+	clients, conns := dialN(t, url, handler, 3)
+
+	srv.Broadcast([]byte("all"))
+	for _, ws := range clients {
+
+		if msg := readMsg(t, ws); msg != "all" {
+
+			t.Fatal("Broadcast:", msg)
+		}
+	}
+
+	// 只发给指定的连接，不存在的id忽略
+	srv.SendTo([]uint64{conns[0].Id(), conns[2].Id(), none}, []byte("to"))
+	srv.Broadcast([]byte("next"))
+	for i, ws := range clients {
+
+		want := "to"
+		if i == 1 {
+
+			want = "next"
+		}
+
+		if msg := readMsg(t, ws); msg != want {
+
+			t.Fatal("SendTo:", i, msg)
+		}
+	}
+
+	if c, ok := srv.Get(conns[1].Id()); !ok || c != conns[1] {
+
+		t.Fatal("Get:", c, ok)
+	}
+
+	if _, ok := srv.Get(none); ok {
+
+		t.Fatal("Get none")
+	}
+
+	n := 0
+	srv.Range(func(c server.Conn) bool {
+
+		n++
+
+		return true
+	})
+
+	if n != 3 {
+
+		t.Fatal("Range:", n)
+	}
+
+	n = 0
+	srv.Range(func(c server.Conn) bool {
+
+		n++
+
+		return false
+	})
+
+	if n != 1 {
+
+		t.Fatal("Range stop:", n)
+	}
+}
+
+func TestServer_Group(t *testing.T) {
+
+	handler := newTestHandler(false)
+	srv, url := newTestServer(t, &server.Config{}, handler)
+
+	clients, conns := dialN(t, url, handler, 3)
+
+	for _, c := range conns[:2] {
+
+		if err := srv.Join("guild", c.Id()); err != nil {
+
+			t.Fatal("Join:", err)
+		}
+	}
+
+	if err := srv.Join("guild", none); err == nil {
+
+		t.Fatal("Join unknown conn")
+	}
+
+	srv.Leave("guild", conns[1].Id())
+	srv.SendGroup("guild", []byte("guild"))
+	srv.Broadcast([]byte("next"))
+	for i, ws := range clients {
+
+		want := "next"
+		if i == 0 {
+
+			want = "guild"
+		}
+
+		if msg := readMsg(t, ws); msg != want {
+
+			t.Fatal("SendGroup:", i, msg)
+		}
+	}
+
+	// 连接关闭后退出所有分组
+	_ = conns[0].Close()
+	waitConn(t, handler.closed)
+
+	srv.gmux.RLock()
+	groups := len(srv.groups)
+	srv.gmux.RUnlock()
+
+	if groups != 0 {
+
+		t.Fatal("groups after close:", groups)
+	}
+
+	if err := srv.Join("guild", conns[0].Id()); err == nil {
+
+		t.Fatal("Join closed conn")
+	}
+}
+
+func TestServer_BroadcastSlowConn(t *testing.T) {
+
+	handler := newTestHandler(false)
+	srv, url := newTestServer(t, &server.Config{SendQueueSize: 2, SendPolicy: server.SendBlock, SendTimeout: time.Second}, handler)
+
+	clients, conns := dialN(t, url, handler, 2)
+
+	// 持有写锁让慢连接的发送goroutine阻塞
+	slow := conns[1]
+	slow.wmux.Lock()
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+
+		srv.Broadcast([]byte("msg"))
+	}
+	elapsed := time.Since(start)
+
+	slow.wmux.Unlock()
+
+	if elapsed > time.Duration(100)*time.Millisecond {
+
+		t.Fatal("Broadcast blocked:", elapsed)
+	}
+
+	// 快的连接不受影响，等队列发完再投递
+	for i := 0; conns[0].Stats().QueuedMsgs > 0; i++ {
+
+		if i > 100 {
+
+			t.Fatal("fast conn stats:", conns[0].Stats())
+		}
+
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+
+	srv.SendTo([]uint64{conns[0].Id()}, []byte("last"))
+	for {
+
+		msg := readMsg(t, clients[0])
+		if msg == "last" {
+
+			break
+		}
+
+		if msg != "msg" {
+
+			t.Fatal("fast conn:", msg)
+		}
+	}
+
+	if st := slow.Stats(); st.DroppedMsgs == 0 {
+
+		t.Fatal("slow conn stats:", st)
+	}
+}
+
+// closeHandler Close中广播离开的消息
+type closeHandler struct {
+	*testHandler
+	srv *Server
+}
+
+func (h *closeHandler) Close(c server.Conn) {
+
+	if _, ok := h.srv.Get(c.Id()); ok {
+
+		h.errs <- nil
+	}
+
+	h.srv.Broadcast([]byte("left"))
+	h.testHandler.Close(c)
+}
+
+func TestServer_CloseHandlerBroadcast(t *testing.T) {
+
+	handler := &closeHandler{testHandler: newTestHandler(false)}
+	srv, url := newTestServer(t, &server.Config{}, handler)
+	handler.srv = srv
+
+	clients, conns := dialN(t, url, handler.testHandler, 2)
+
+	_ = conns[0].Close()
+	waitConn(t, handler.closed)
+
+	if msg := readMsg(t, clients[1]); msg != "left" {
+
+		t.Fatal("Close broadcast:", msg)
+	}
+
+	if len(handler.errs) != 0 {
+
+		t.Fatal("closed conn still registered")
+	}
+}
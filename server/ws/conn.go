@@ -4,25 +4,49 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/laonsx/gamelib/server"
 )
 
 var (
 	defaultSendTimeout = time.Duration(100) * time.Millisecond
+	defaultReadLimit   = int64(32768)
+
+	MsgRateLimitErr   = errors.New("message rate limit exceeded")
+	BytesRateLimitErr = errors.New("bytes rate limit exceeded")
 )
 
 type Conn struct {
 	id            uint64
 	ws            *websocket.Conn
-	sendChan      chan []byte
+	wmux          sync.Mutex
+	sendQueue     *sendQueue
 	closeChan     chan int
+	kicks         chan error
 	closeFlag     int32
 	closeCallback func(id uint64)
 	msgType       int
 	err           error
+	ip            string
+	limiter       *limiter
+	stats         *stats
+	groups        map[string]struct{}
+	batch         int
+	coalesce      int
+
+	// 排队的连接由drain读取，出队后通过reads交给Read
+	qmux   sync.Mutex
+	queued bool
+	reads  chan readResult
+
+	sentMsgs     uint64
+	sentBytes    uint64
+	droppedMsgs  uint64
+	droppedBytes uint64
 }
 
 func (c *Conn) Ping() func(string) error {
@@ -42,21 +66,21 @@ func (c *Conn) Id() uint64 {
 
 func (c *Conn) AsyncSend(b []byte) error {
 
-	if c.IsClosed() {
-
-		return errors.New("conn closed")
-	}
-
-	select {
+	return c.enqueue(&message{data: b}, true)
+}
 
-	case c.sendChan <- b:
+func (c *Conn) Stats() server.ConnStats {
 
-	case <-time.After(defaultSendTimeout):
+	queuedMsgs, queuedBytes := c.sendQueue.len()
 
-		return errors.New("send timeout")
+	return server.ConnStats{
+		QueuedMsgs:   queuedMsgs,
+		QueuedBytes:  queuedBytes,
+		SentMsgs:     atomic.LoadUint64(&c.sentMsgs),
+		SentBytes:    atomic.LoadUint64(&c.sentBytes),
+		DroppedMsgs:  atomic.LoadUint64(&c.droppedMsgs),
+		DroppedBytes: atomic.LoadUint64(&c.droppedBytes),
 	}
-
-	return nil
 }
 
 func (c *Conn) SetMsgType(t int) {
@@ -71,14 +95,149 @@ func (c *Conn) Send(b []byte) error {
 		return errors.New("conn closed")
 	}
 
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
 	return c.ws.WriteMessage(c.msgType, b)
 }
 
+type readResult struct {
+	b   []byte
+	err error
+}
+
 func (c *Conn) Read() ([]byte, error) {
 
-	_, b, err := c.ws.ReadMessage()
+	b, err := c.readMessage()
+	if err != nil {
+
+		return b, err
+	}
+
+	if err = c.limiter.check(len(b)); err != nil {
+
+		atomic.AddUint64(&c.stats.rejectedMsgs, 1)
+		atomic.AddUint64(&c.stats.rejectedBytes, uint64(len(b)))
+
+		c.kick(err)
+
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (c *Conn) readMessage() ([]byte, error) {
+
+	if c.reads == nil {
+
+		_, b, err := c.ws.ReadMessage()
+
+		return b, err
+	}
+
+	select {
+
+	case r := <-c.reads:
+
+		return r.b, r.err
+
+	case <-c.closeChan:
+
+		return nil, errors.New("conn closed")
+	}
+}
+
+// enqueueWait 进入排队，由drain读取连接，客户端需在queueTimeout内发送ping
+func (c *Conn) enqueueWait() {
+
+	c.queued = true
+	c.reads = make(chan readResult)
+
+	_ = c.ws.SetReadDeadline(time.Now().Add(queueTimeout))
+	c.ws.SetPingHandler(func(s string) error {
+
+		c.qmux.Lock()
+		if c.queued {
+
+			_ = c.ws.SetReadDeadline(time.Now().Add(queueTimeout))
+		}
+		c.qmux.Unlock()
+
+		_ = c.sendMsg(websocket.PongMessage, []byte(s))
+
+		return nil
+	})
+
+	go c.drain()
+}
+
+// dequeue 出队，取消排队期间的读超时
+func (c *Conn) dequeue() {
+
+	c.qmux.Lock()
+	defer c.qmux.Unlock()
+
+	c.queued = false
+	_ = c.ws.SetReadDeadline(time.Time{})
+}
+
+// drain 排队期间丢弃客户端消息，断开或超时后关闭连接释放排队位置
+// 出队后继续读取，消息交给Read
+func (c *Conn) drain() {
+
+	for {
+
+		_, b, err := c.ws.ReadMessage()
+
+		c.qmux.Lock()
+		queued := c.queued
+		c.qmux.Unlock()
+
+		if queued {
+
+			if err != nil {
+
+				c.err = fmt.Errorf("queued wsconn id=%d err=%v", c.id, err)
+				_ = c.Close()
+
+				return
+			}
+
+			continue
+		}
+
+		select {
+
+		case c.reads <- readResult{b: b, err: err}:
+
+		case <-c.closeChan:
+
+			return
+		}
+
+		if err != nil {
+
+			return
+		}
+	}
+}
+
+// kick 发送关闭原因后断开连接
+func (c *Conn) kick(reason error) {
 
-	return b, err
+	if c.IsClosed() {
+
+		return
+	}
+
+	c.err = fmt.Errorf("kick wsconn id=%d ip=%s reason=%v", c.id, c.ip, reason)
+	atomic.AddUint64(&c.stats.kickedConns, 1)
+
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason.Error())
+	_ = c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(defaultSendTimeout))
+
+	_ = c.Close()
 }
 
 func (c *Conn) Close() error {
@@ -114,18 +273,43 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.ws.RemoteAddr()
 }
 
-func newConn(id uint64, ws *websocket.Conn, closeCallback func(id uint64)) *Conn {
+func newConn(id uint64, ws *websocket.Conn, ip string, config *server.Config, st *stats, closeCallback func(id uint64)) *Conn {
 
 	c := &Conn{
 		id:            id,
 		ws:            ws,
-		sendChan:      make(chan []byte, 32),
+		sendQueue:     newSendQueue(config),
 		closeChan:     make(chan int),
+		kicks:         make(chan error, 1),
 		closeCallback: closeCallback,
 		msgType:       websocket.BinaryMessage,
+		ip:            ip,
+		stats:         st,
+		batch:         config.SendBatch,
+		coalesce:      config.SendCoalesce,
 	}
 
-	ws.SetReadLimit(32768)
+	if c.batch <= 0 {
+
+		c.batch = defaultSendBatch
+	}
+
+	readLimit := defaultReadLimit
+	if config.MaxMsgSize > 0 {
+
+		readLimit = config.MaxMsgSize
+	}
+
+	ws.SetReadLimit(readLimit)
+
+	// 突发字节数小于单条消息上限时，最大的消息会直接触发限流
+	bytesBurst := config.BytesBurst
+	if int64(bytesBurst) < readLimit {
+
+		bytesBurst = int(readLimit)
+	}
+
+	c.limiter = newLimiter(config.MsgPerSec, config.MsgBurst, config.BytesPerSec, bytesBurst)
 
 	go c.sendLoop()
 
@@ -138,9 +322,15 @@ func (c *Conn) sendLoop() {
 
 		select {
 
-		case msg := <-c.sendChan:
+		case <-c.sendQueue.ready:
+
+			msgs := c.sendQueue.pop(c.batch)
+			if len(msgs) == 0 {
+
+				continue
+			}
 
-			err := c.Send(msg)
+			err := c.writeBatch(msgs)
 			if err != nil {
 
 				c.err = fmt.Errorf("send wsconn id=%d err=%v", c.id, err)
@@ -149,6 +339,12 @@ func (c *Conn) sendLoop() {
 				return
 			}
 
+		case reason := <-c.kicks:
+
+			c.kick(reason)
+
+			return
+
 		case <-c.closeChan:
 
 			return
@@ -156,6 +352,136 @@ func (c *Conn) sendLoop() {
 	}
 }
 
+func notifyKick(ch chan error, reason error) {
+
+	select {
+
+	case ch <- reason:
+
+	default:
+
+	}
+}
+
+// enqueue 按发送策略入队，block为false时不等待
+func (c *Conn) enqueue(msg *message, block bool) error {
+
+	if c.IsClosed() {
+
+		return errors.New("conn closed")
+	}
+
+	dropped, err := c.sendQueue.push(msg, block, c.closeChan)
+	for _, m := range dropped {
+
+		atomic.AddUint64(&c.droppedMsgs, 1)
+		atomic.AddUint64(&c.droppedBytes, uint64(len(m.data)))
+		atomic.AddUint64(&c.stats.droppedMsgs, 1)
+	}
+
+	// kick会阻塞写关闭帧并触发关闭回调，交给发送goroutine处理
+	if err == SlowConsumerErr {
+
+		notifyKick(c.kicks, err)
+	}
+
+	return err
+}
+
+// post 非阻塞投递
+func (c *Conn) post(msg *message) bool {
+
+	return c.enqueue(msg, false) == nil
+}
+
+// writeBatch 一次写出多条消息，开启SendCoalesce时合并连续的消息
+func (c *Conn) writeBatch(msgs []*message) error {
+
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	_ = c.ws.SetWriteDeadline(time.Now().Add(deadline))
+	defer c.ws.SetWriteDeadline(time.Time{})
+
+	var buf []byte
+	var n int
+
+	flush := func() error {
+
+		if n == 0 {
+
+			return nil
+		}
+
+		if err := c.ws.WriteMessage(c.msgType, buf); err != nil {
+
+			return err
+		}
+
+		c.sent(n, len(buf))
+		buf = buf[:0]
+		n = 0
+
+		return nil
+	}
+
+	for _, msg := range msgs {
+
+		if c.coalesce > 0 && msg.shared == nil && len(msg.data) < c.coalesce {
+
+			if len(buf)+len(msg.data) > c.coalesce {
+
+				if err := flush(); err != nil {
+
+					return err
+				}
+			}
+
+			buf = append(buf, msg.data...)
+			n++
+
+			continue
+		}
+
+		if err := flush(); err != nil {
+
+			return err
+		}
+
+		if err := c.write(msg); err != nil {
+
+			return err
+		}
+
+		c.sent(1, len(msg.data))
+	}
+
+	return flush()
+}
+
+// write 调用者需持有wmux
+func (c *Conn) write(msg *message) error {
+
+	if msg.shared == nil {
+
+		return c.ws.WriteMessage(c.msgType, msg.data)
+	}
+
+	pm, err := msg.shared.prepare(c.msgType)
+	if err != nil {
+
+		return err
+	}
+
+	return c.ws.WritePreparedMessage(pm)
+}
+
+func (c *Conn) sent(msgs int, bytes int) {
+
+	atomic.AddUint64(&c.sentMsgs, uint64(msgs))
+	atomic.AddUint64(&c.sentBytes, uint64(bytes))
+}
+
 func (c *Conn) pong(deadline time.Duration) {
 
 	_ = c.ws.SetReadDeadline(time.Now().Add(deadline))
@@ -169,5 +495,8 @@ func (c *Conn) sendMsg(t int, b []byte) error {
 		return errors.New("conn closed")
 	}
 
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
 	return c.ws.WriteMessage(t, b)
 }
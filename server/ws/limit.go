@@ -0,0 +1,89 @@
+package ws
+
+import (
+	"time"
+)
+
+// tokenBucket 令牌桶，rate为每秒生成的令牌数，burst为桶容量
+// 只在连接的读goroutine中使用，不加锁
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, burst int) *tokenBucket {
+
+	if rate <= 0 {
+
+		return nil
+	}
+
+	if burst < rate {
+
+		burst = rate
+	}
+
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (tb *tokenBucket) allow(n int) bool {
+
+	if tb == nil {
+
+		return true
+	}
+
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	tb.last = now
+
+	if tb.tokens > tb.burst {
+
+		tb.tokens = tb.burst
+	}
+
+	if tb.tokens < float64(n) {
+
+		return false
+	}
+
+	tb.tokens -= float64(n)
+
+	return true
+}
+
+// limiter 连接读限流
+type limiter struct {
+	msgs  *tokenBucket
+	bytes *tokenBucket
+}
+
+func newLimiter(msgPerSec, msgBurst, bytesPerSec, bytesBurst int) *limiter {
+
+	return &limiter{
+		msgs:  newTokenBucket(msgPerSec, msgBurst),
+		bytes: newTokenBucket(bytesPerSec, bytesBurst),
+	}
+}
+
+func (l *limiter) check(n int) error {
+
+	if !l.msgs.allow(1) {
+
+		return MsgRateLimitErr
+	}
+
+	if !l.bytes.allow(n) {
+
+		return BytesRateLimitErr
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/laonsx/gamelib/server"
+)
+
+func TestTokenBucket(t *testing.T) {
+
+	if tb := newTokenBucket(0, 10); tb != nil || !tb.allow(100) {
+
+		t.Fatal("unlimited bucket")
+	}
+
+	tb := newTokenBucket(10, 20)
+	if !tb.allow(20) || tb.allow(1) {
+
+		t.Fatal("burst")
+	}
+
+	// 100ms生成1个令牌
+	tb.last = tb.last.Add(-time.Duration(100) * time.Millisecond)
+	if !tb.allow(1) || tb.allow(1) {
+
+		t.Fatal("refill")
+	}
+
+	// 令牌不超过桶容量
+	tb.last = tb.last.Add(-time.Duration(10) * time.Second)
+	if !tb.allow(20) || tb.allow(1) {
+
+		t.Fatal("refill burst")
+	}
+
+	// burst小于rate时按rate处理
+	if tb = newTokenBucket(10, 1); !tb.allow(10) {
+
+		t.Fatal("burst less than rate")
+	}
+}
+
+func TestConn_RateLimitKick(t *testing.T) {
+
+	handler := newTestHandler(true)
+	srv, url := newTestServer(t, &server.Config{MsgPerSec: 1, MsgBurst: 2}, handler)
+
+	ws := dial(t, url)
+	waitConn(t, handler.opened)
+
+	for i := 0; i < 3; i++ {
+
+		if err := ws.WriteMessage(websocket.BinaryMessage, []byte("msg")); err != nil {
+
+			t.Fatal("write:", err)
+		}
+	}
+
+	err := waitClose(t, ws)
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.ClosePolicyViolation || ce.Text != MsgRateLimitErr.Error() {
+
+		t.Fatal("close:", err)
+	}
+
+	select {
+
+	case err = <-handler.errs:
+
+		if err != MsgRateLimitErr {
+
+			t.Fatal("read:", err)
+		}
+
+	case <-time.After(time.Second):
+
+		t.Fatal("read timeout")
+	}
+
+	waitConn(t, handler.closed)
+
+	if st := srv.Stats(); st.KickedConns != 1 || st.RejectedMsgs != 1 || st.RejectedBytes != 3 || st.Conns != 0 {
+
+		t.Fatal("stats:", st)
+	}
+}
+
+func TestConn_BytesBurst(t *testing.T) {
+
+	handler := newTestHandler(true)
+	_, url := newTestServer(t, &server.Config{MaxMsgSize: 1024, BytesPerSec: 10, BytesBurst: 10}, handler)
+
+	ws := dial(t, url)
+	c := waitConn(t, handler.opened)
+
+	// 突发字节数按单条消息上限处理，最大的消息可以通过
+	if err := ws.WriteMessage(websocket.BinaryMessage, make([]byte, 1024)); err != nil {
+
+		t.Fatal("write:", err)
+	}
+
+	if err := ws.WriteMessage(websocket.BinaryMessage, make([]byte, 100)); err != nil {
+
+		t.Fatal("write:", err)
+	}
+
+	err := waitClose(t, ws)
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Text != BytesRateLimitErr.Error() {
+
+		t.Fatal("close:", err)
+	}
+
+	<-handler.errs
+	if c.Error() == nil {
+
+		t.Fatal("kick error")
+	}
+}
@@ -0,0 +1,191 @@
+package ws
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/laonsx/gamelib/server"
+)
+
+var (
+	defaultSendQueueSize = 32
+	defaultSendBatch     = 16
+
+	SendQueueFullErr = errors.New("send queue full")
+	SendTimeoutErr   = errors.New("send timeout")
+	SlowConsumerErr  = errors.New("slow consumer")
+)
+
+// sendQueue 连接发送队列，队列满时按SendPolicy处理
+type sendQueue struct {
+	mux     sync.Mutex
+	msgs    []*message
+	bytes   int
+	size    int
+	policy  server.SendPolicy
+	timeout time.Duration
+	ready   chan struct{}
+	space   chan struct{}
+}
+
+func newSendQueue(config *server.Config) *sendQueue {
+
+	size := config.SendQueueSize
+	if size <= 0 {
+
+		size = defaultSendQueueSize
+	}
+
+	timeout := config.SendTimeout
+	if timeout <= 0 {
+
+		timeout = defaultSendTimeout
+	}
+
+	return &sendQueue{
+		msgs:    make([]*message, 0, size),
+		size:    size,
+		policy:  config.SendPolicy,
+		timeout: timeout,
+		ready:   make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+	}
+}
+
+// push 入队，block为false时SendBlock策略按SendDropNewest处理
+// dropped返回因入队被丢弃的消息
+func (q *sendQueue) push(msg *message, block bool, closeChan chan int) (dropped []*message, err error) {
+
+	var timer *time.Timer
+
+	for {
+
+		q.mux.Lock()
+
+		if len(q.msgs) < q.size {
+
+			q.msgs = append(q.msgs, msg)
+			q.bytes += len(msg.data)
+			q.mux.Unlock()
+
+			notify(q.ready)
+
+			return
+		}
+
+		switch q.policy {
+
+		case server.SendDropOldest:
+
+			dropped = append(dropped, q.msgs[0])
+			q.bytes -= len(q.msgs[0].data)
+			q.msgs[0] = nil
+			q.msgs = append(q.msgs[1:], msg)
+			q.bytes += len(msg.data)
+			q.mux.Unlock()
+
+			notify(q.ready)
+
+			return
+
+		case server.SendDisconnect:
+
+			q.mux.Unlock()
+
+			return []*message{msg}, SlowConsumerErr
+
+		case server.SendBlock:
+
+			q.mux.Unlock()
+
+			if !block {
+
+				return []*message{msg}, SendQueueFullErr
+			}
+
+			if timer == nil {
+
+				timer = time.NewTimer(q.timeout)
+				defer timer.Stop()
+			}
+
+			select {
+
+			case <-q.space:
+
+				continue
+
+			case <-timer.C:
+
+				return []*message{msg}, SendTimeoutErr
+
+			case <-closeChan:
+
+				return nil, errors.New("conn closed")
+			}
+
+		default:
+
+			q.mux.Unlock()
+
+			return []*message{msg}, SendQueueFullErr
+		}
+	}
+}
+
+// pop 取出最多n条消息
+func (q *sendQueue) pop(n int) []*message {
+
+	q.mux.Lock()
+
+	if n > len(q.msgs) {
+
+		n = len(q.msgs)
+	}
+
+	msgs := make([]*message, n)
+	copy(msgs, q.msgs[:n])
+
+	for i := 0; i < n; i++ {
+
+		q.bytes -= len(q.msgs[i].data)
+		q.msgs[i] = nil
+	}
+
+	q.msgs = q.msgs[n:]
+	more := len(q.msgs) > 0
+
+	q.mux.Unlock()
+
+	if n > 0 {
+
+		notify(q.space)
+	}
+
+	if more {
+
+		notify(q.ready)
+	}
+
+	return msgs
+}
+
+func (q *sendQueue) len() (int, int) {
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return len(q.msgs), q.bytes
+}
+
+func notify(ch chan struct{}) {
+
+	select {
+
+	case ch <- struct{}{}:
+
+	default:
+
+	}
+}
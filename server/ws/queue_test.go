@@ -0,0 +1,154 @@
+package ws
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/laonsx/gamelib/server"
+)
+
+func pushN(t *testing.T, q *sendQueue, n int) {
+
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+
+		if _, err := q.push(&message{data: []byte(strconv.Itoa(i))}, true, nil); err != nil {
+
+			t.Fatal("push:", err)
+		}
+	}
+}
+
+func TestSendQueue_Policy(t *testing.T) {
+
+	newQueue := func(policy server.SendPolicy) *sendQueue {
+
+		return newSendQueue(&server.Config{SendQueueSize: 2, SendPolicy: policy, SendTimeout: time.Duration(50) * time.Millisecond})
+	}
+
+	q := newQueue(server.SendDropNewest)
+	pushN(t, q, 2)
+	if dropped, err := q.push(&message{data: []byte("new")}, true, nil); err != SendQueueFullErr || len(dropped) != 1 || string(dropped[0].data) != "new" {
+
+		t.Fatal("drop newest:", dropped, err)
+	}
+
+	q = newQueue(server.SendDropOldest)
+	pushN(t, q, 2)
+	if dropped, err := q.push(&message{data: []byte("new")}, true, nil); err != nil || len(dropped) != 1 || string(dropped[0].data) != "0" {
+
+		t.Fatal("drop oldest:", dropped, err)
+	}
+
+	if msgs := q.pop(10); len(msgs) != 2 || string(msgs[0].data) != "1" || string(msgs[1].data) != "new" {
+
+		t.Fatal("drop oldest pop:", msgs)
+	}
+
+	q = newQueue(server.SendDisconnect)
+	pushN(t, q, 2)
+	if dropped, err := q.push(&message{data: []byte("new")}, true, nil); err != SlowConsumerErr || len(dropped) != 1 {
+
+		t.Fatal("disconnect:", dropped, err)
+	}
+
+	// 不等待时按丢弃当前消息处理
+	q = newQueue(server.SendBlock)
+	pushN(t, q, 2)
+	if _, err := q.push(&message{data: []byte("new")}, false, nil); err != SendQueueFullErr {
+
+		t.Fatal("block no wait:", err)
+	}
+
+	start := time.Now()
+	if _, err := q.push(&message{data: []byte("new")}, true, nil); err != SendTimeoutErr || time.Since(start) < q.timeout {
+
+		t.Fatal("block timeout:", err)
+	}
+
+	// 等待期间有空位时入队
+	go func() {
+
+		time.Sleep(time.Duration(10) * time.Millisecond)
+		q.pop(1)
+	}()
+
+	if _, err := q.push(&message{data: []byte("new")}, true, nil); err != nil {
+
+		t.Fatal("block:", err)
+	}
+
+	if n, bytes := q.len(); n != 2 || bytes != 4 {
+
+		t.Fatal("len:", n, bytes)
+	}
+
+	closeChan := make(chan int)
+	close(closeChan)
+	if _, err := q.push(&message{data: []byte("new")}, true, closeChan); err == nil {
+
+		t.Fatal("block closed")
+	}
+}
+
+func TestConn_SlowConsumer(t *testing.T) {
+
+	handler := newTestHandler(false)
+	srv, url := newTestServer(t, &server.Config{SendQueueSize: 2, SendPolicy: server.SendDisconnect}, handler)
+
+	ws := dial(t, url)
+	c := waitConn(t, handler.opened).(*Conn)
+
+	// 持有写锁让发送goroutine阻塞，队列写满后断开
+	c.wmux.Lock()
+
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+
+		err = c.AsyncSend([]byte("msg"))
+	}
+
+	if err != SlowConsumerErr {
+
+		c.wmux.Unlock()
+		t.Fatal("AsyncSend:", err)
+	}
+
+	// 断开在发送goroutine中进行，不阻塞调用者
+	if c.IsClosed() {
+
+		c.wmux.Unlock()
+		t.Fatal("closed in caller")
+	}
+
+	c.wmux.Unlock()
+
+	waitConn(t, handler.closed)
+
+	for {
+
+		_, _, err = ws.ReadMessage()
+		if err != nil {
+
+			break
+		}
+	}
+
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.ClosePolicyViolation {
+
+		t.Fatal("close:", err)
+	}
+
+	if st := c.Stats(); st.DroppedMsgs != 1 || st.SentBytes != st.SentMsgs*3 {
+
+		t.Fatal("conn stats:", st)
+	}
+
+	if st := srv.Stats(); st.KickedConns != 1 || st.DroppedMsgs != 1 {
+
+		t.Fatal("stats:", st)
+	}
+}
@@ -2,9 +2,11 @@ package ws
 
 import (
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,15 +22,31 @@ var (
 )
 
 type Server struct {
-	name    string
-	id      uint64
-	mux     sync.Mutex
-	handler server.Handler
-	addr    string
-	maxConn int
-	quit    chan bool
-	config  *server.Config
-	conns   map[uint64]*Conn
+	name      string
+	id        uint64
+	mux       sync.Mutex
+	gmux      sync.RWMutex
+	handler   server.Handler
+	admission server.Admission
+	addr      string
+	maxConn   int
+	pending   int
+	queuing   int
+	quit      chan bool
+	config    *server.Config
+	conns     map[uint64]*Conn
+	waiting   []*Conn
+	ipConns   map[string]int
+	groups    map[string]map[uint64]*Conn
+	stats     stats
+}
+
+type stats struct {
+	rejectedConns uint64
+	rejectedMsgs  uint64
+	rejectedBytes uint64
+	kickedConns   uint64
+	droppedMsgs   uint64
 }
 
 func NewServer(name string, config *server.Config) server.GateServer {
@@ -40,6 +58,8 @@ func NewServer(name string, config *server.Config) server.GateServer {
 		maxConn: config.MaxConn,
 		quit:    make(chan bool),
 		conns:   make(map[uint64]*Conn),
+		ipConns: make(map[string]int),
+		groups:  make(map[string]map[uint64]*Conn),
 	}
 }
 
@@ -48,9 +68,19 @@ func (server *Server) SetHandler(handler server.Handler) {
 	server.handler = handler
 }
 
+func (server *Server) SetAdmission(admission server.Admission) {
+
+	server.admission = admission
+}
+
 func (server *Server) SetMaxConn(n int) {
 
+	server.mux.Lock()
 	server.maxConn = n
+	promoted, waiting := server.promote()
+	server.mux.Unlock()
+
+	server.notifyQueue(promoted, waiting)
 }
 
 func (server *Server) Start() {
@@ -85,6 +115,11 @@ func (server *Server) Close() {
 		conns[i] = c
 	}
 
+	for _, c := range server.waiting {
+
+		conns[c.id] = c
+	}
+
 	server.mux.Unlock()
 
 	for _, c := range conns {
@@ -101,19 +136,90 @@ func (server *Server) Count() int {
 	return len(server.conns)
 }
 
+func (server *Server) Stats() (st server.Stats) {
+
+	server.mux.Lock()
+	st.Conns = len(server.conns)
+	st.QueuedConns = len(server.waiting)
+	server.mux.Unlock()
+
+	st.RejectedConns = atomic.LoadUint64(&server.stats.rejectedConns)
+	st.RejectedMsgs = atomic.LoadUint64(&server.stats.rejectedMsgs)
+	st.RejectedBytes = atomic.LoadUint64(&server.stats.rejectedBytes)
+	st.KickedConns = atomic.LoadUint64(&server.stats.kickedConns)
+	st.DroppedMsgs = atomic.LoadUint64(&server.stats.droppedMsgs)
+
+	return
+}
+
 func (server *Server) removeConn(id uint64) {
 
 	server.mux.Lock()
-	defer server.mux.Unlock()
 
 	if conn, ok := server.conns[id]; ok {
 
+		delete(server.conns, id)
+		server.releaseIP(conn.ip)
+		server.leaveAll(conn)
+
+		promoted, waiting := server.promote()
+
+		server.mux.Unlock()
+
+		// 解锁后回调，Close中可以调用Broadcast、Get等方法
 		if server.handler != nil {
 
 			server.handler.Close(conn)
 		}
 
-		delete(server.conns, id)
+		server.notifyQueue(promoted, waiting)
+
+		return
+	}
+
+	if !server.removeWaiting(id) {
+
+		server.mux.Unlock()
+
+		return
+	}
+
+	promoted, waiting := server.promote()
+	if waiting == nil {
+
+		waiting = server.snapshotWaiting()
+	}
+
+	server.mux.Unlock()
+
+	server.notifyQueue(promoted, waiting)
+}
+
+// acquireIP 占用ip连接数，超出MaxConnPerIP返回false
+func (server *Server) acquireIP(ip string) bool {
+
+	server.mux.Lock()
+	defer server.mux.Unlock()
+
+	if server.config.MaxConnPerIP > 0 && server.ipConns[ip] >= server.config.MaxConnPerIP {
+
+		return false
+	}
+
+	server.ipConns[ip]++
+
+	return true
+}
+
+// releaseIP 调用者需持有锁
+func (server *Server) releaseIP(ip string) {
+
+	if n := server.ipConns[ip]; n > 1 {
+
+		server.ipConns[ip] = n - 1
+	} else {
+
+		delete(server.ipConns, ip)
 	}
 }
 
@@ -148,11 +254,46 @@ func (server *Server) serveWs(w http.ResponseWriter, r *http.Request) {
 		return u.Host == server.config.OriginAllow
 	}
 
+	if server.admission != nil {
+
+		if reject := server.admission.Admit(r); reject != nil {
+
+			server.reject(w, reject)
+
+			return
+		}
+	}
+
+	ip := remoteIP(r)
+	if !server.acquireIP(ip) {
+
+		server.reject(w, newReject(http.StatusTooManyRequests, "Too many connections", 0))
+
+		return
+	}
+
+	state := server.reserve()
+	if state == admitFull {
+
+		server.mux.Lock()
+		server.releaseIP(ip)
+		server.mux.Unlock()
+
+		server.reject(w, newReject(http.StatusServiceUnavailable, "Server is full", server.retryAfter()))
+
+		return
+	}
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 
 		log.Printf("ws upgrade err:%v", err)
 
+		server.mux.Lock()
+		server.releaseIP(ip)
+		server.unreserve(state)
+		server.mux.Unlock()
+
 		return
 	}
 
@@ -160,13 +301,43 @@ func (server *Server) serveWs(w http.ResponseWriter, r *http.Request) {
 
 	id := server.id
 	server.id++
-	conn := newConn(id, ws, server.removeConn)
-	server.conns[id] = conn
+	conn := newConn(id, ws, ip, server.config, &server.stats, server.removeConn)
+	server.unreserve(state)
+
+	if state == admitOK {
+
+		server.conns[id] = conn
+
+		server.mux.Unlock()
+
+		if server.handler != nil {
+
+			server.handler.Open(conn)
+		}
+
+		return
+	}
+
+	conn.enqueueWait()
+	server.waiting = append(server.waiting, conn)
+	promoted, waiting := server.promote()
+	if waiting == nil {
+
+		waiting = server.snapshotWaiting()
+	}
 
 	server.mux.Unlock()
 
-	if server.handler != nil {
+	server.notifyQueue(promoted, waiting)
+}
+
+func remoteIP(r *http.Request) string {
 
-		server.handler.Open(conn)
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+
+		return r.RemoteAddr
 	}
+
+	return host
 }
@@ -0,0 +1,125 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/laonsx/gamelib/server"
+)
+
+// testHandler 记录Open和Close，read为true时Open中循环读取，出错后关闭连接
+type testHandler struct {
+	read   bool
+	opened chan server.Conn
+	closed chan server.Conn
+	msgs   chan string
+	errs   chan error
+}
+
+func newTestHandler(read bool) *testHandler {
+
+	return &testHandler{
+		read:   read,
+		opened: make(chan server.Conn, 100),
+		closed: make(chan server.Conn, 100),
+		msgs:   make(chan string, 100),
+		errs:   make(chan error, 100),
+	}
+}
+
+func (h *testHandler) Open(c server.Conn) {
+
+	h.opened <- c
+
+	if !h.read {
+
+		return
+	}
+
+	for {
+
+		b, err := c.Read()
+		if err != nil {
+
+			h.errs <- err
+			_ = c.Close()
+
+			return
+		}
+
+		h.msgs <- string(b)
+	}
+}
+
+func (h *testHandler) Close(c server.Conn) {
+
+	h.closed <- c
+}
+
+func newTestServer(t *testing.T, config *server.Config, handler server.Handler) (*Server, string) {
+
+	t.Helper()
+
+	srv := NewServer("test", config).(*Server)
+	srv.SetHandler(handler)
+
+	hs := httptest.NewServer(http.HandlerFunc(srv.serveWs))
+	t.Cleanup(func() {
+
+		srv.Close()
+		hs.Close()
+	})
+
+	return srv, "ws" + strings.TrimPrefix(hs.URL, "http")
+}
+
+func dial(t *testing.T, url string) *websocket.Conn {
+
+	t.Helper()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+
+		t.Fatal("dial:", err)
+	}
+	t.Cleanup(func() { _ = ws.Close() })
+
+	return ws
+}
+
+func waitConn(t *testing.T, ch chan server.Conn) server.Conn {
+
+	t.Helper()
+
+	select {
+
+	case c := <-ch:
+
+		return c
+
+	case <-time.After(time.Second):
+
+		t.Fatal("wait conn timeout")
+	}
+
+	return nil
+}
+
+// waitClose 读取直到连接关闭，返回关闭错误
+func waitClose(t *testing.T, ws *websocket.Conn) error {
+
+	t.Helper()
+
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+
+		if _, _, err := ws.ReadMessage(); err != nil {
+
+			return err
+		}
+	}
+}